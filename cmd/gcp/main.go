@@ -41,8 +41,15 @@ func main() {
 		SilenceErrors: true,
 	}
 
+	server.AddRootDirectoryFlag(cmd)
+
 	command := server.NewCommand()
 	cmd.AddCommand(command)
+	cmd.AddCommand(server.NewKubeConfigCommand())
+	cmd.AddCommand(server.NewSnapshotCommand())
+	cmd.AddCommand(server.NewMemberCommand())
+	cmd.AddCommand(server.NewExportCommand())
+	cmd.AddCommand(server.NewImportCommand())
 
 	code := cli.Run(cmd)
 	os.Exit(code)
@@ -17,8 +17,14 @@ limitations under the License.
 package batteries
 
 import (
+	"fmt"
+	"sync"
+
 	"golang.org/x/exp/slices"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/admission"
 	"k8s.io/apiserver/pkg/admission/plugin/namespace/lifecycle"
@@ -26,6 +32,8 @@ import (
 	"k8s.io/apiserver/pkg/admission/plugin/resourcequota"
 	mutatingwebhook "k8s.io/apiserver/pkg/admission/plugin/webhook/mutating"
 	validatingwebhook "k8s.io/apiserver/pkg/admission/plugin/webhook/validating"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/discovery"
 	controlplaneapiserver "k8s.io/kubernetes/pkg/controlplane/apiserver"
 	"k8s.io/kubernetes/plugin/pkg/admission/admit"
 	certapproval "k8s.io/kubernetes/plugin/pkg/admission/certificates/approval"
@@ -56,6 +64,58 @@ type BatterySpec struct {
 	// Groups is the list of group names that the battery is responsible for.
 	// If disabled, the battery will not be registered for these groups.
 	Groups []string
+
+	// Resources is the list of individual resources that the battery is
+	// responsible for, for groups shared with other batteries like the legacy
+	// core group. If disabled, these resources will not be served.
+	Resources []schema.GroupVersionResource
+
+	// DisabledResources is the list of resources of the battery's groups that
+	// are not served even if the battery is enabled. An empty version matches
+	// all versions of the resource.
+	DisabledResources []schema.GroupVersionResource
+
+	// Requires is the list of batteries this battery depends on. They are
+	// enabled automatically unless explicitly disabled.
+	Requires []Battery
+
+	// Conflicts is the list of batteries that cannot be enabled together with
+	// this battery.
+	Conflicts []Battery
+
+	// StorageProviders returns additional REST storage providers served when
+	// the battery is enabled. The group names of the returned providers should
+	// be listed in Groups so that they are filtered out when disabled, and
+	// they should only create the storage of resources enabled in the
+	// APIResourceConfigSource, which excludes DisabledResources.
+	StorageProviders StorageProvidersFunc
+
+	// AdmissionPlugins is the list of admission plugins the battery contributes.
+	// They are always registered, but only turned on by default when the battery
+	// is enabled.
+	AdmissionPlugins []AdmissionPlugin
+
+	// PostStartHooks are added to the server when the battery is enabled.
+	PostStartHooks map[string]genericapiserver.PostStartHookFunc
+
+	// BootstrapObjects are created after the server started when the battery
+	// is enabled. Existing objects are left untouched, and failures are
+	// reported by the readyz check named BootstrapObjectsCheckName.
+	BootstrapObjects []*unstructured.Unstructured
+}
+
+// StorageProvidersFunc returns REST storage providers for the given completed
+// controlplane config, in the same way as GenericStorageProviders does.
+type StorageProvidersFunc func(config controlplaneapiserver.CompletedConfig, discovery discovery.DiscoveryInterface) ([]controlplaneapiserver.RESTStorageProvider, error)
+
+// AdmissionPlugin is an admission plugin contributed by a battery.
+type AdmissionPlugin struct {
+	// Name is the name of the plugin, as used in --enable-admission-plugins.
+	Name string
+	// Register registers the plugin with the given plugins.
+	Register func(plugins *admission.Plugins)
+	// DefaultOn indicates whether the plugin is enabled by default when the battery is enabled.
+	DefaultOn bool
 }
 
 const (
@@ -71,10 +131,40 @@ const (
 	BatteryFlowControl Battery = "flowcontrol"
 	// BatteryCRDs is the name of the CRD battery.
 	BatteryCRDs Battery = "crds"
+	// BatteryCertificates is the name of the certificates battery.
+	BatteryCertificates Battery = "certificates"
+	// BatteryGarbageCollector is the name of the garbage collector battery.
+	BatteryGarbageCollector Battery = "garbagecollector"
+	// BatteryNamespaceController is the name of the namespace controller battery.
+	BatteryNamespaceController Battery = "namespacecontroller"
+	// BatteryServiceAccountControllers is the name of the service account controllers battery.
+	BatteryServiceAccountControllers Battery = "serviceaccountcontrollers"
+	// BatteryResourceQuotaController is the name of the resource quota controller battery.
+	BatteryResourceQuotaController Battery = "resourcequotacontroller"
+
+	// BatteryCoreNamespaces is the name of the core namespaces battery.
+	BatteryCoreNamespaces Battery = CoreBatteryPrefix + "namespaces"
+	// BatteryCoreConfigMaps is the name of the core configmaps battery.
+	BatteryCoreConfigMaps Battery = CoreBatteryPrefix + "configmaps"
+	// BatteryCoreSecrets is the name of the core secrets battery.
+	BatteryCoreSecrets Battery = CoreBatteryPrefix + "secrets"
+	// BatteryCoreEvents is the name of the core events battery.
+	BatteryCoreEvents Battery = CoreBatteryPrefix + "events"
+	// BatteryCoreServiceAccounts is the name of the core serviceaccounts battery.
+	BatteryCoreServiceAccounts Battery = CoreBatteryPrefix + "serviceaccounts"
+	// BatteryCoreResourceQuotas is the name of the core resourcequotas battery.
+	BatteryCoreResourceQuotas Battery = CoreBatteryPrefix + "resourcequotas"
 )
 
+// CoreBatteryPrefix is the name prefix of the batteries of the legacy core
+// group family, one per core/v1 resource.
+const CoreBatteryPrefix = "core."
+
 var (
-	// The generic features.
+	// registryLock guards defaultBatteries.
+	registryLock sync.RWMutex
+
+	// The generic features, extended by Register.
 	defaultBatteries = map[Battery]BatterySpec{
 		BatteryLeases: {
 			Enabled:     false,
@@ -93,6 +183,7 @@ var (
 		BatteryAdmission: {
 			Enabled:     false,
 			Groups:      []string{"admissionregistration.k8s.io"},
+			Requires:    []Battery{BatteryAuthorization},
 			Description: "Admission controllers validate and mutate requests",
 		},
 		BatteryFlowControl: {
@@ -105,6 +196,60 @@ var (
 			Groups:      []string{"apiextensions.k8s.io"},
 			Description: "CustomResourceDefinitions (CRDs) allow definition of custom resources",
 		},
+		BatteryCertificates: {
+			Enabled:     false,
+			Groups:      []string{"certificates.k8s.io"},
+			Description: "CertificateSigningRequests are signed and approved by an embedded signer and approver",
+		},
+		BatteryGarbageCollector: {
+			Enabled:     false,
+			Description: "The embedded garbage collector deletes dependents of deleted owners, including custom resources",
+		},
+		BatteryNamespaceController: {
+			Enabled:     true,
+			Requires:    []Battery{BatteryCoreNamespaces},
+			Description: "The embedded namespace controller deletes the content of terminating namespaces and finalizes them",
+		},
+		BatteryServiceAccountControllers: {
+			Enabled:     false,
+			Requires:    []Battery{BatteryCoreNamespaces, BatteryCoreServiceAccounts},
+			Description: "The embedded service account controllers create default ServiceAccounts, publish kube-root-ca.crt ConfigMaps and populate legacy token Secrets",
+		},
+		BatteryResourceQuotaController: {
+			Enabled:     true,
+			Requires:    []Battery{BatteryCoreResourceQuotas},
+			Description: "The embedded resource quota controller calculates quota usage, including object counts of custom resources",
+		},
+		BatteryCoreNamespaces: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("namespaces")},
+			Description: "Namespaces scope namespaced resources, including the NamespaceLifecycle admission",
+		},
+		BatteryCoreConfigMaps: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("configmaps")},
+			Description: "ConfigMaps hold non-confidential configuration data",
+		},
+		BatteryCoreSecrets: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("secrets")},
+			Description: "Secrets hold confidential data, including legacy service account tokens",
+		},
+		BatteryCoreEvents: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("events")},
+			Description: "Events report what happens to objects",
+		},
+		BatteryCoreServiceAccounts: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("serviceaccounts")},
+			Description: "ServiceAccounts provide identities for workloads, including the ServiceAccount admission",
+		},
+		BatteryCoreResourceQuotas: {
+			Enabled:     true,
+			Resources:   []schema.GroupVersionResource{corev1.SchemeGroupVersion.WithResource("resourcequotas")},
+			Description: "ResourceQuotas limit resource consumption per namespace, including the ResourceQuota admission",
+		},
 	}
 )
 
@@ -112,24 +257,76 @@ func (b Battery) String() string {
 	return string(b)
 }
 
-func New() Options {
-	b := Options{
-		batteries: make(List, len(defaultBatteries)),
+// Register registers a battery with the given name and spec. It must be called
+// before the options are created with New, usually from an init function.
+// Registered batteries can be toggled via the --batteries flag like the
+// built-in ones.
+func Register(name Battery, spec BatterySpec) error {
+	if len(name) == 0 {
+		return fmt.Errorf("battery name must not be empty")
+	}
+	if name[0] == '-' || name[0] == '+' {
+		return fmt.Errorf("battery name %q must not start with '-' or '+'", name)
+	}
+	for _, plugin := range spec.AdmissionPlugins {
+		if plugin.Name == "" || plugin.Register == nil {
+			return fmt.Errorf("battery %q has an admission plugin without name or register function", name)
+		}
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := defaultBatteries[name]; ok {
+		return fmt.Errorf("battery %q is already registered", name)
+	}
+	defaultBatteries[name] = spec
+	return nil
+}
+
+// MustRegister is like Register, but panics on error.
+func MustRegister(name Battery, spec BatterySpec) {
+	if err := Register(name, spec); err != nil {
+		panic(err)
 	}
+}
+
+// Registered returns a copy of all registered batteries.
+func Registered() List {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	l := make(List, len(defaultBatteries))
 	for name, spec := range defaultBatteries {
-		b.batteries[name] = spec
+		l[name] = spec
+	}
+	return l
+}
+
+func New() Options {
+	return Options{
+		batteries: Registered(),
 	}
-	return b
 }
 
+// Enable enables the battery with the given name. Unknown batteries are
+// ignored, Validate reports them.
 func (b Options) Enable(name Battery) {
-	_b := b.batteries[name]
+	_b, ok := b.batteries[name]
+	if !ok {
+		return
+	}
 	_b.Enabled = true
 	b.batteries[name] = _b
 }
 
+// Disable disables the battery with the given name. Unknown batteries are
+// ignored, Validate reports them.
 func (b Options) Disable(name Battery) {
-	_b := b.batteries[name]
+	_b, ok := b.batteries[name]
+	if !ok {
+		return
+	}
 	_b.Enabled = false
 	b.batteries[name] = _b
 }
@@ -140,6 +337,7 @@ func (b CompletedOptions) IsEnabled(name Battery) bool {
 }
 
 // RegisterAllAdmissionPlugins registers all admission plugins based on the batteries configuration.
+// Plugins of disabled batteries are registered as well, but are turned off by DefaultOffAdmissionPlugins.
 func (b CompletedOptions) RegisterAllAdmissionPlugins(plugins *admission.Plugins) {
 	admit.Register(plugins) // DEPRECATED as no real meaning
 	autoprovision.Register(plugins)
@@ -157,14 +355,35 @@ func (b CompletedOptions) RegisterAllAdmissionPlugins(plugins *admission.Plugins
 	validatingwebhook.Register(plugins)
 	resourcequota.Register(plugins)
 	deny.Register(plugins)
+
+	for _, name := range b.sortedNames() {
+		for _, plugin := range b.batteries[name].AdmissionPlugins {
+			plugin.Register(plugins)
+		}
+	}
+}
+
+// OrderedAdmissionPlugins returns AllOrderedPlugins with the admission plugins
+// of all batteries inserted before the webhook, resourcequota and deny plugins.
+func (b CompletedOptions) OrderedAdmissionPlugins() []string {
+	var batteryPlugins []string
+	for _, name := range b.sortedNames() {
+		for _, plugin := range b.batteries[name].AdmissionPlugins {
+			batteryPlugins = append(batteryPlugins, plugin.Name)
+		}
+	}
+
+	i := slices.Index(AllOrderedPlugins, mutatingwebhook.PluginName)
+	ret := make([]string, 0, len(AllOrderedPlugins)+len(batteryPlugins))
+	ret = append(ret, AllOrderedPlugins[:i]...)
+	ret = append(ret, batteryPlugins...)
+	ret = append(ret, AllOrderedPlugins[i:]...)
+	return ret
 }
 
 func (b CompletedOptions) DefaultOffAdmissionPlugins() sets.Set[string] {
 	defaultOnPlugins := sets.New[string](
-		lifecycle.PluginName, // NamespaceLifecycle
 		// limitranger.PluginName,           // LimitRanger
-		serviceaccount.PluginName,           // ServiceAccount
-		resourcequota.PluginName,            // ResourceQuota
 		certapproval.PluginName,             // CertificateApproval
 		certsigning.PluginName,              // CertificateSigning
 		ctbattest.PluginName,                // ClusterTrustBundleAttest
@@ -172,6 +391,17 @@ func (b CompletedOptions) DefaultOffAdmissionPlugins() sets.Set[string] {
 		defaulttolerationseconds.PluginName, // DefaultTolerationSeconds
 	)
 
+	// These plugins depend on informers of their core resources.
+	if b.IsEnabled(BatteryCoreNamespaces) {
+		defaultOnPlugins.Insert(lifecycle.PluginName) // NamespaceLifecycle
+	}
+	if b.IsEnabled(BatteryCoreServiceAccounts) {
+		defaultOnPlugins.Insert(serviceaccount.PluginName) // ServiceAccount
+	}
+	if b.IsEnabled(BatteryCoreResourceQuotas) {
+		defaultOnPlugins.Insert(resourcequota.PluginName) // ResourceQuota
+	}
+
 	if b.IsEnabled(BatteryAdmission) {
 		defaultOnPlugins.Insert(
 			mutatingwebhook.PluginName,           // MutatingAdmissionWebhook
@@ -180,9 +410,22 @@ func (b CompletedOptions) DefaultOffAdmissionPlugins() sets.Set[string] {
 		)
 	}
 
-	return sets.New[string](AllOrderedPlugins...).Difference(defaultOnPlugins)
+	for _, spec := range b.batteries {
+		if !spec.Enabled {
+			continue
+		}
+		for _, plugin := range spec.AdmissionPlugins {
+			if plugin.DefaultOn {
+				defaultOnPlugins.Insert(plugin.Name)
+			}
+		}
+	}
+
+	return sets.New[string](b.OrderedAdmissionPlugins()...).Difference(defaultOnPlugins)
 }
 
+// containsAndDisabled returns whether the group with the given name belongs
+// to a disabled battery.
 func (b CompletedOptions) containsAndDisabled(name string) bool {
 	for _, spec := range b.batteries {
 		if slices.Contains(spec.Groups, name) && !spec.Enabled {
@@ -192,6 +435,10 @@ func (b CompletedOptions) containsAndDisabled(name string) bool {
 	return false
 }
 
+// FilterStorageProviders drops the storage providers of the groups of disabled
+// batteries. It only handles whole groups: the resources of batteries sharing
+// a group with others, like the core batteries, and the disabled resources of
+// enabled batteries are disabled by ApplyToResourceConfig instead.
 func (b CompletedOptions) FilterStorageProviders(input []controlplaneapiserver.RESTStorageProvider) []controlplaneapiserver.RESTStorageProvider {
 	var result []controlplaneapiserver.RESTStorageProvider
 	for _, rest := range input {
@@ -202,3 +449,30 @@ func (b CompletedOptions) FilterStorageProviders(input []controlplaneapiserver.R
 	}
 	return result
 }
+
+// StorageProviders returns the additional REST storage providers of all enabled batteries.
+func (b CompletedOptions) StorageProviders(config controlplaneapiserver.CompletedConfig, discovery discovery.DiscoveryInterface) ([]controlplaneapiserver.RESTStorageProvider, error) {
+	var result []controlplaneapiserver.RESTStorageProvider
+	for _, name := range b.sortedNames() {
+		spec := b.batteries[name]
+		if !spec.Enabled || spec.StorageProviders == nil {
+			continue
+		}
+		providers, err := spec.StorageProviders(config, discovery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage providers of battery %q: %w", name, err)
+		}
+		result = append(result, providers...)
+	}
+	return result, nil
+}
+
+// sortedNames returns the names of all batteries in a stable order.
+func (b CompletedOptions) sortedNames() []Battery {
+	names := make([]Battery, 0, len(b.batteries))
+	for name := range b.batteries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batteries
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/admission"
+	mutatingwebhook "k8s.io/apiserver/pkg/admission/plugin/webhook/mutating"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// register registers a battery for the duration of the test.
+func register(t *testing.T, name Battery, spec BatterySpec) {
+	t.Helper()
+	if err := Register(name, spec); err != nil {
+		t.Fatalf("Register(%q) failed: %v", name, err)
+	}
+	t.Cleanup(func() {
+		registryLock.Lock()
+		defer registryLock.Unlock()
+		delete(defaultBatteries, name)
+	})
+}
+
+func TestRegister(t *testing.T) {
+	register(t, "test-registered", BatterySpec{Description: "test"})
+
+	tests := []struct {
+		name    Battery
+		spec    BatterySpec
+		wantErr string
+	}{
+		{name: "", wantErr: "battery name must not be empty"},
+		{name: "-test", wantErr: `battery name "-test" must not start with '-' or '+'`},
+		{name: "+test", wantErr: `battery name "+test" must not start with '-' or '+'`},
+		{name: "test-registered", wantErr: `battery "test-registered" is already registered`},
+		{name: BatteryCRDs, wantErr: `battery "crds" is already registered`},
+		{
+			name:    "test-plugin",
+			spec:    BatterySpec{AdmissionPlugins: []AdmissionPlugin{{Name: "TestPlugin"}}},
+			wantErr: `battery "test-plugin" has an admission plugin without name or register function`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			err := Register(tt.name, tt.spec)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Register(%q) = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	registered := Registered()
+	if _, ok := registered["test-registered"]; !ok {
+		t.Errorf("registered battery is missing from Registered()")
+	}
+	delete(registered, BatteryCRDs)
+	if _, ok := Registered()[BatteryCRDs]; !ok {
+		t.Errorf("Registered() does not return a copy")
+	}
+}
+
+func TestAdmissionPlugins(t *testing.T) {
+	registerPlugin := func(name string) func(plugins *admission.Plugins) {
+		return func(plugins *admission.Plugins) {
+			plugins.Register(name, func(config io.Reader) (admission.Interface, error) { return nil, nil })
+		}
+	}
+	register(t, "test-on", BatterySpec{
+		Enabled:          true,
+		AdmissionPlugins: []AdmissionPlugin{{Name: "TestOn", Register: registerPlugin("TestOn"), DefaultOn: true}},
+	})
+	register(t, "test-off", BatterySpec{
+		Enabled:          true,
+		AdmissionPlugins: []AdmissionPlugin{{Name: "TestOff", Register: registerPlugin("TestOff")}},
+	})
+	register(t, "test-disabled", BatterySpec{
+		AdmissionPlugins: []AdmissionPlugin{{Name: "TestDisabled", Register: registerPlugin("TestDisabled"), DefaultOn: true}},
+	})
+
+	completed := New().Complete()
+
+	plugins := admission.NewPlugins()
+	completed.RegisterAllAdmissionPlugins(plugins)
+	for _, name := range []string{"TestOn", "TestOff", "TestDisabled"} {
+		if !slices.Contains(plugins.Registered(), name) {
+			t.Errorf("plugin %s is not registered", name)
+		}
+	}
+
+	ordered := completed.OrderedAdmissionPlugins()
+	webhook := slices.Index(ordered, mutatingwebhook.PluginName)
+	for _, name := range []string{"TestOn", "TestOff", "TestDisabled"} {
+		if i := slices.Index(ordered, name); i < 0 || i > webhook {
+			t.Errorf("plugin %s is at %d, expected before %s at %d", name, i, mutatingwebhook.PluginName, webhook)
+		}
+	}
+
+	off := completed.DefaultOffAdmissionPlugins()
+	if off.Has("TestOn") {
+		t.Errorf("default-on plugin of an enabled battery is off")
+	}
+	if !off.Has("TestOff") {
+		t.Errorf("plugin of an enabled battery which is not default-on is on")
+	}
+	if !off.Has("TestDisabled") {
+		t.Errorf("default-on plugin of a disabled battery is on")
+	}
+}
+
+func TestCreateObject(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+	existing := &unstructured.Unstructured{}
+	existing.SetAPIVersion("v1")
+	existing.SetKind("ConfigMap")
+	existing.SetNamespace("default")
+	existing.SetName("existing")
+	existing.Object["data"] = map[string]interface{}{"key": "existing"}
+
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), existing)
+
+	obj := existing.DeepCopy()
+	obj.Object["data"] = map[string]interface{}{"key": "bootstrap"}
+	if err := createObject(context.Background(), client, mapper, obj); err != nil {
+		t.Fatalf("createObject of an existing object failed: %v", err)
+	}
+	got, err := client.Resource(corev1.SchemeGroupVersion.WithResource("configmaps")).Namespace("default").Get(context.Background(), "existing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := unstructured.NestedString(got.Object, "data", "key"); data != "existing" {
+		t.Errorf("existing object was changed to %q", data)
+	}
+
+	obj = existing.DeepCopy()
+	obj.SetName("new")
+	if err := createObject(context.Background(), client, mapper, obj); err != nil {
+		t.Fatalf("createObject failed: %v", err)
+	}
+	if _, err := client.Resource(corev1.SchemeGroupVersion.WithResource("configmaps")).Namespace("default").Get(context.Background(), "new", metav1.GetOptions{}); err != nil {
+		t.Errorf("object was not created: %v", err)
+	}
+
+	obj.SetKind("Unknown")
+	if err := createObject(context.Background(), client, mapper, obj); !meta.IsNoMatchError(err) {
+		t.Errorf("expected a no match error for an unknown kind, got %v", err)
+	}
+}
+
+// resetMapper is a RESTMapper ignoring resets.
+type resetMapper struct {
+	meta.RESTMapper
+}
+
+func (resetMapper) Reset() {}
+
+func TestCreateBootstrapObjects(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	configMap := &unstructured.Unstructured{}
+	configMap.SetAPIVersion("v1")
+	configMap.SetKind("ConfigMap")
+	configMap.SetNamespace("default")
+	configMap.SetName("bootstrap")
+	unknown := configMap.DeepCopy()
+	unknown.SetKind("Unknown")
+
+	// an object which cannot be created is reported until the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	check := newBootstrapObjectsCheck()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		createBootstrapObjects(ctx, client, resetMapper{mapper}, []*unstructured.Unstructured{unknown, configMap}, check)
+	}()
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+		err := check.Check(nil)
+		return err != nil && strings.Contains(err.Error(), "failed to create Unknown default/bootstrap"), nil
+	})
+	if err != nil {
+		t.Fatalf("check does not report the failed object: %v", check.Check(nil))
+	}
+	if _, err := client.Resource(corev1.SchemeGroupVersion.WithResource("configmaps")).Namespace("default").Get(ctx, "bootstrap", metav1.GetOptions{}); err != nil {
+		t.Errorf("object after the failed one was not created: %v", err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("createBootstrapObjects did not return when the context was done")
+	}
+
+	// objects which can be created pass the check
+	check = newBootstrapObjectsCheck()
+	createBootstrapObjects(context.Background(), client, resetMapper{mapper}, []*unstructured.Unstructured{configMap}, check)
+	if err := check.Check(nil); err != nil {
+		t.Errorf("check failed after all objects were created: %v", err)
+	}
+}
+
+func TestApplyToBootstrapObjectsCheck(t *testing.T) {
+	config := &genericapiserver.Config{}
+	New().Complete().ApplyTo(config)
+	if len(config.ReadyzChecks) > 0 {
+		t.Errorf("readyz checks added without bootstrap objects: %v", config.ReadyzChecks)
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetName("bootstrap")
+	register(t, "test-bootstrap", BatterySpec{Enabled: true, BootstrapObjects: []*unstructured.Unstructured{obj}})
+	New().Complete().ApplyTo(config)
+	if len(config.ReadyzChecks) != 1 || config.ReadyzChecks[0].Name() != BootstrapObjectsCheckName {
+		t.Fatalf("expected the %s readyz check, got %v", BootstrapObjectsCheckName, config.ReadyzChecks)
+	}
+	if err := config.ReadyzChecks[0].Check(nil); err == nil {
+		t.Errorf("check passes before the bootstrap objects are created")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batteries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog/v2"
+)
+
+const (
+	bootstrapObjectsHookName = "gcp-battery-bootstrap-objects"
+	// BootstrapObjectsCheckName is the name of the readyz check of the
+	// bootstrap objects of the enabled batteries.
+	BootstrapObjectsCheckName = "gcp-battery-bootstrap-objects"
+	// bootstrapObjectsRetryInterval is the interval to retry creating the
+	// bootstrap objects after a failure.
+	bootstrapObjectsRetryInterval = time.Second
+)
+
+// bootstrapObjectsCheck fails until the bootstrap objects are created, with
+// the error of the last attempt.
+type bootstrapObjectsCheck struct {
+	lock sync.RWMutex
+	err  error
+}
+
+var _ healthz.HealthChecker = &bootstrapObjectsCheck{}
+
+func newBootstrapObjectsCheck() *bootstrapObjectsCheck {
+	return &bootstrapObjectsCheck{err: errors.New("bootstrap objects not created yet")}
+}
+
+func (c *bootstrapObjectsCheck) setErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+}
+
+// Name implements healthz.HealthChecker.
+func (c *bootstrapObjectsCheck) Name() string {
+	return BootstrapObjectsCheckName
+}
+
+// Check implements healthz.HealthChecker.
+func (c *bootstrapObjectsCheck) Check(_ *http.Request) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.err
+}
+
+// bootstrapObjects returns the bootstrap objects of the enabled batteries.
+func (b CompletedOptions) bootstrapObjects() []*unstructured.Unstructured {
+	var objs []*unstructured.Unstructured
+	for _, name := range b.sortedNames() {
+		if spec := b.batteries[name]; spec.Enabled {
+			objs = append(objs, spec.BootstrapObjects...)
+		}
+	}
+	return objs
+}
+
+// ApplyTo adds the readyz check of the bootstrap objects of the enabled
+// batteries to the given config, if there are any. It fails until
+// AddPostStartHooks created all of them.
+func (b CompletedOptions) ApplyTo(config *genericapiserver.Config) {
+	if len(b.bootstrapObjects()) == 0 {
+		return
+	}
+	b.bootstrapObjectsCheck = newBootstrapObjectsCheck()
+	config.ReadyzChecks = append(config.ReadyzChecks, b.bootstrapObjectsCheck)
+}
+
+// AddPostStartHooks adds the post-start hooks of all enabled batteries to the
+// given server, including a hook creating their bootstrap objects in the
+// background. Failures are retried and reported by the readyz check added by
+// ApplyTo.
+func (b CompletedOptions) AddPostStartHooks(server *genericapiserver.GenericAPIServer) error {
+	for _, name := range b.sortedNames() {
+		spec := b.batteries[name]
+		if !spec.Enabled {
+			continue
+		}
+		for hookName, hook := range spec.PostStartHooks {
+			if err := server.AddPostStartHook(hookName, hook); err != nil {
+				return fmt.Errorf("failed to add post-start hook of battery %q: %w", name, err)
+			}
+		}
+	}
+
+	objs := b.bootstrapObjects()
+	if len(objs) == 0 {
+		return nil
+	}
+	check := b.bootstrapObjectsCheck
+	if check == nil {
+		check = newBootstrapObjectsCheck()
+	}
+	return server.AddPostStartHook(bootstrapObjectsHookName, func(hookContext genericapiserver.PostStartHookContext) error {
+		logger := klog.FromContext(hookContext).WithValues("postStartHook", bootstrapObjectsHookName)
+
+		client, err := dynamic.NewForConfig(hookContext.LoopbackClientConfig)
+		if err != nil {
+			return err
+		}
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(hookContext.LoopbackClientConfig)
+		if err != nil {
+			return err
+		}
+		mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+		go createBootstrapObjects(klog.NewContext(hookContext, logger), client, mapper, objs, check)
+		return nil
+	})
+}
+
+// resettableRESTMapper is a RESTMapper whose cached discovery can be reset.
+type resettableRESTMapper interface {
+	meta.RESTMapper
+	Reset()
+}
+
+// createBootstrapObjects creates the given objects, retrying until all of them
+// exist or the context is done. Objects of custom resources are retried until
+// their CRD is served. The errors of the last attempt are reported by check.
+func createBootstrapObjects(ctx context.Context, client dynamic.Interface, mapper resettableRESTMapper, objs []*unstructured.Unstructured, check *bootstrapObjectsCheck) {
+	logger := klog.FromContext(ctx)
+	_ = wait.PollUntilContextCancel(ctx, bootstrapObjectsRetryInterval, true, func(ctx context.Context) (bool, error) {
+		var errs []error
+		for _, obj := range objs {
+			if err := createObject(ctx, client, mapper, obj); err != nil {
+				errs = append(errs, fmt.Errorf("failed to create %s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err))
+			}
+		}
+		err := utilerrors.NewAggregate(errs)
+		check.setErr(err)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error(err, "Failed to create bootstrap objects, retrying", "interval", bootstrapObjectsRetryInterval)
+			}
+			mapper.Reset()
+			return false, nil
+		}
+		logger.Info("Created bootstrap objects", "objects", len(objs))
+		return true, nil
+	})
+}
+
+func createObject(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+
+	var ri dynamic.ResourceInterface = client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		ri = client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	}
+	if _, err := ri.Create(ctx, obj, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
@@ -22,22 +22,33 @@ import (
 	"strings"
 
 	"github.com/spf13/pflag"
+	"golang.org/x/exp/slices"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	genericfeatures "k8s.io/apiserver/pkg/features"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	"k8s.io/klog/v2"
 )
 
 // Options holds the configuration for the batteries.
 type Options struct {
-	batteries List
-	Enabled   []string
+	batteries     List
+	Enabled       []string
+	Resources     []string
+	CoreResources []string
 }
 
 type completedOptions struct {
-	batteries List
-	Enabled   []string
+	batteries     List
+	Enabled       []string
+	Resources     []string
+	CoreResources []string
+
+	// errs holds the errors found while resolving requirements and conflicts.
+	errs []error
+	// bootstrapObjectsCheck is set by ApplyTo if there are bootstrap objects.
+	bootstrapObjectsCheck *bootstrapObjectsCheck
 }
 
 // CompletedOptions holds the completed configuration for the batteries.
@@ -54,16 +65,29 @@ func (s *Options) AddFlags(fs *pflag.FlagSet) {
 	all := sets.NewString()
 	enabled := sets.NewString()
 	var maxLen int
-	for name := range defaultBatteries {
+	for name := range s.batteries {
 		if len(name) > maxLen {
 			maxLen = len(name)
 		}
 	}
-	for name, bat := range defaultBatteries {
-		if bat.Groups == nil {
-			all = all.Insert(fmt.Sprintf("%-*s: %s", maxLen, name, bat.Description))
+	for name, bat := range s.batteries {
+		description := bat.Description
+		if len(bat.Requires) > 0 {
+			requires := make([]string, 0, len(bat.Requires))
+			for _, req := range bat.Requires {
+				requires = append(requires, string(req))
+			}
+			description += fmt.Sprintf(" (requires %s)", strings.Join(requires, ", "))
+		}
+		served := slices.Clone(bat.Groups)
+		for _, gvr := range bat.Resources {
+			served = append(served, strings.TrimPrefix(gvr.GroupVersion().String()+"/"+gvr.Resource, "/"))
+		}
+		if served == nil {
+			all = all.Insert(fmt.Sprintf("%-*s %s", maxLen+1, name+":", description))
+		} else {
+			all = all.Insert(fmt.Sprintf("%-*s %s [%s]", maxLen+1, name+":", description, strings.Join(served, ", ")))
 		}
-		all = all.Insert(fmt.Sprintf("%-*s %s [%s]", maxLen+1, name+":", bat.Description, strings.Join(bat.Groups, ", ")))
 		if bat.Enabled {
 			enabled.Insert(string(name))
 		}
@@ -73,11 +97,39 @@ func (s *Options) AddFlags(fs *pflag.FlagSet) {
 		strings.Join(all.List(), "\n- "),
 		strings.Join(enabled.List(), ", "),
 	))
+	fs.StringSliceVar(&s.Resources, "battery-resources", []string{}, ""+
+		"Resources of enabled batteries to disable ('-group/version/resource') or re-enable ('+group/version/resource'). "+
+		"The version can be omitted to match all versions, e.g. '-rbac.authorization.k8s.io/clusterrolebindings'.")
+	fs.StringSliceVar(&s.CoreResources, "core-resources", s.CoreResources, ""+
+		"Allowlist of core/v1 resources to serve, e.g. 'namespaces,configmaps'. "+
+		"The "+CoreBatteryPrefix+"<resource> batteries of all other core resources are disabled. By default all core resources are served.")
 }
 
 // Complete defaults fields that have not set by the consumer of this package.
+// Requirements of enabled batteries are enabled as well, unless they were
+// explicitly disabled. Unresolvable requirements and conflicts are reported
+// by Validate.
 func (s Options) Complete() CompletedOptions {
+	logger := klog.Background()
+
 	// Ensure all related configurations are configured
+	disabled := sets.New[Battery]()
+	enabled := sets.New[Battery]()
+	if len(s.CoreResources) > 0 {
+		allowed := sets.New[string](s.CoreResources...)
+		for name := range s.batteries {
+			if !strings.HasPrefix(string(name), CoreBatteryPrefix) {
+				continue
+			}
+			if allowed.Has(strings.TrimPrefix(string(name), CoreBatteryPrefix)) {
+				s.Enable(name)
+				enabled.Insert(name)
+			} else {
+				s.Disable(name)
+				disabled.Insert(name)
+			}
+		}
+	}
 	for _, name := range s.Enabled {
 		if len(name) == 0 {
 			continue
@@ -88,42 +140,136 @@ func (s Options) Complete() CompletedOptions {
 				fmt.Fprintf(os.Stderr, "Warning: unknown battery %q\n", name[1:])
 			}
 			s.Disable(Battery(name[1:]))
+			disabled.Insert(Battery(name[1:]))
+			enabled.Delete(Battery(name[1:]))
 		case '+':
 			if _, ok := s.batteries[Battery(name[1:])]; !ok {
 				fmt.Fprintf(os.Stderr, "Warning: unknown battery %q\n", name[1:])
 			}
 			s.Enable(Battery(name[1:]))
+			disabled.Delete(Battery(name[1:]))
+			enabled.Insert(Battery(name[1:]))
 		default:
-			if _, ok := s.batteries[Battery(name[1:])]; !ok {
+			if _, ok := s.batteries[Battery(name)]; !ok {
 				fmt.Fprintf(os.Stderr, "Warning: unknown battery %q\n", name)
 			}
 			s.Enable(Battery(name))
+			disabled.Delete(Battery(name))
+			enabled.Insert(Battery(name))
 		}
 	}
 
+	errs := s.applyResources()
+
 	ret := CompletedOptions{
 		&completedOptions{
-			batteries: s.batteries,
-			Enabled:   s.Enabled,
+			batteries:     s.batteries,
+			Enabled:       s.Enabled,
+			Resources:     s.Resources,
+			CoreResources: s.CoreResources,
 		},
 	}
+	ret.errs = append(errs, ret.resolveDependencies(logger, enabled, disabled)...)
 
 	// If lease is disabled, we disable APIServerIdentity
 	if !ret.IsEnabled(BatteryLeases) {
+		logger.Info("Disabling feature gate because battery is disabled", "featureGate", genericfeatures.APIServerIdentity, "battery", BatteryLeases)
 		utilruntime.Must(utilfeature.DefaultMutableFeatureGate.Set(fmt.Sprintf("%s=false", genericfeatures.APIServerIdentity)))
 	}
 
 	return ret
 }
 
+// resolveDependencies enables the requirements of all enabled batteries
+// transitively and checks for conflicts between enabled batteries. Batteries
+// that are enabled by default, but not explicitly, are disabled instead if
+// one of their requirements is explicitly disabled.
+func (b CompletedOptions) resolveDependencies(logger klog.Logger, enabled, disabled sets.Set[Battery]) []error {
+	var errs []error
+
+	for changed := true; changed; {
+		changed = false
+		for _, name := range b.sortedNames() {
+			if !b.IsEnabled(name) || enabled.Has(name) {
+				continue
+			}
+			for _, req := range b.batteries[name].Requires {
+				if disabled.Has(req) {
+					logger.Info("Disabling battery because a required battery is disabled", "battery", name, "requires", req)
+					_b := b.batteries[name]
+					_b.Enabled = false
+					b.batteries[name] = _b
+					disabled.Insert(name)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var queue []Battery
+	for _, name := range b.sortedNames() {
+		if b.IsEnabled(name) {
+			queue = append(queue, name)
+		}
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		for _, req := range b.batteries[name].Requires {
+			switch {
+			case b.IsEnabled(req):
+			case !b.isKnown(req):
+				errs = append(errs, fmt.Errorf("battery %q requires unknown battery %q", name, req))
+			case disabled.Has(req):
+				errs = append(errs, fmt.Errorf("battery %q requires battery %q, which is disabled", name, req))
+			default:
+				logger.Info("Enabling battery required by another battery", "battery", req, "requiredBy", name)
+				_b := b.batteries[req]
+				_b.Enabled = true
+				b.batteries[req] = _b
+				queue = append(queue, req)
+			}
+		}
+	}
+
+	for _, name := range b.sortedNames() {
+		if !b.IsEnabled(name) {
+			continue
+		}
+		for _, other := range b.batteries[name].Conflicts {
+			if b.IsEnabled(other) {
+				errs = append(errs, fmt.Errorf("battery %q conflicts with battery %q", name, other))
+			}
+		}
+	}
+
+	return errs
+}
+
+func (b CompletedOptions) isKnown(name Battery) bool {
+	_, ok := b.batteries[name]
+	return ok
+}
+
 // Validate validates the batteries options.
 func (b CompletedOptions) Validate() []error {
 	var errs []error
 	for _, name := range b.Enabled {
-		fmt.Println(name)
+		name = strings.TrimLeft(name, "+-")
+		if len(name) == 0 {
+			continue
+		}
 		if _, ok := b.batteries[Battery(name)]; !ok {
 			errs = append(errs, fmt.Errorf("invalid battery %q", name))
 		}
 	}
+	for _, resource := range b.CoreResources {
+		if _, ok := b.batteries[Battery(CoreBatteryPrefix+resource)]; !ok {
+			errs = append(errs, fmt.Errorf("invalid core resource %q", resource))
+		}
+	}
+	errs = append(errs, b.errs...)
 	return errs
 }
@@ -0,0 +1,355 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batteries
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	tests := []struct {
+		name      string
+		batteries List
+		flags     []string
+		enabled   []Battery
+		wantErrs  []string
+	}{
+		{
+			name: "requirements are enabled transitively",
+			batteries: List{
+				"a": {Requires: []Battery{"b"}},
+				"b": {Requires: []Battery{"c"}},
+				"c": {},
+				"d": {},
+			},
+			flags:   []string{"a"},
+			enabled: []Battery{"a", "b", "c"},
+		},
+		{
+			name: "requirements of default batteries are enabled",
+			batteries: List{
+				"a": {Enabled: true, Requires: []Battery{"b"}},
+				"b": {},
+			},
+			enabled: []Battery{"a", "b"},
+		},
+		{
+			name: "explicitly enabled battery requires an explicitly disabled one",
+			batteries: List{
+				"a": {Requires: []Battery{"b"}},
+				"b": {Enabled: true},
+			},
+			flags:    []string{"a", "-b"},
+			enabled:  []Battery{"a"},
+			wantErrs: []string{`battery "a" requires battery "b", which is disabled`},
+		},
+		{
+			name: "default battery is disabled with an explicitly disabled requirement",
+			batteries: List{
+				"a": {Enabled: true, Requires: []Battery{"b"}},
+				"b": {Enabled: true},
+				"c": {Enabled: true, Requires: []Battery{"a"}},
+			},
+			flags:   []string{"-b"},
+			enabled: nil,
+		},
+		{
+			name: "unknown requirement",
+			batteries: List{
+				"a": {Requires: []Battery{"unknown"}},
+			},
+			flags:    []string{"a"},
+			enabled:  []Battery{"a"},
+			wantErrs: []string{`battery "a" requires unknown battery "unknown"`},
+		},
+		{
+			name: "cyclic requirements",
+			batteries: List{
+				"a": {Requires: []Battery{"b"}},
+				"b": {Requires: []Battery{"c"}},
+				"c": {Requires: []Battery{"a"}},
+			},
+			flags:   []string{"b"},
+			enabled: []Battery{"a", "b", "c"},
+		},
+		{
+			name: "cyclic requirements with one disabled",
+			batteries: List{
+				"a": {Enabled: true, Requires: []Battery{"b"}},
+				"b": {Enabled: true, Requires: []Battery{"a"}},
+			},
+			flags:   []string{"-a"},
+			enabled: nil,
+		},
+		{
+			name: "conflicting batteries",
+			batteries: List{
+				"a": {Conflicts: []Battery{"b"}},
+				"b": {},
+			},
+			flags:    []string{"a", "b"},
+			enabled:  []Battery{"a", "b"},
+			wantErrs: []string{`battery "a" conflicts with battery "b"`},
+		},
+		{
+			name: "conflict through a requirement",
+			batteries: List{
+				"a": {Requires: []Battery{"b"}},
+				"b": {Conflicts: []Battery{"c"}},
+				"c": {Enabled: true},
+			},
+			flags:    []string{"a"},
+			enabled:  []Battery{"a", "b", "c"},
+			wantErrs: []string{`battery "b" conflicts with battery "c"`},
+		},
+		{
+			name: "conflict with a disabled battery",
+			batteries: List{
+				"a": {Conflicts: []Battery{"b"}},
+				"b": {Enabled: true},
+			},
+			flags:   []string{"a", "-b"},
+			enabled: []Battery{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the leases battery is kept to leave the APIServerIdentity feature gate alone
+			tt.batteries[BatteryLeases] = BatterySpec{Enabled: true}
+			o := Options{batteries: tt.batteries, Enabled: tt.flags}
+			completed := o.Complete()
+
+			var errs []string
+			for _, err := range completed.Validate() {
+				errs = append(errs, err.Error())
+			}
+			if diff := cmp.Diff(tt.wantErrs, errs); diff != "" {
+				t.Errorf("unexpected errors (-want +got):\n%s", diff)
+			}
+
+			enabled := sets.New[Battery]()
+			for name := range tt.batteries {
+				if name != BatteryLeases && completed.IsEnabled(name) {
+					enabled.Insert(name)
+				}
+			}
+			if diff := cmp.Diff(sets.New(tt.enabled...), enabled); diff != "" {
+				t.Errorf("unexpected enabled batteries (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownBattery(t *testing.T) {
+	o := New()
+	o.Enabled = []string{"+unknown"}
+	errs := o.Complete().Validate()
+	if len(errs) != 1 || errs[0].Error() != `invalid battery "unknown"` {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestCoreResources(t *testing.T) {
+	tests := []struct {
+		name          string
+		coreResources []string
+		flags         []string
+		enabled       []Battery
+		disabled      []Battery
+		wantErrs      []string
+	}{
+		{
+			name:    "all core resources by default",
+			enabled: []Battery{BatteryCoreNamespaces, BatteryCoreConfigMaps, BatteryCoreSecrets, BatteryCoreEvents, BatteryCoreServiceAccounts, BatteryCoreResourceQuotas},
+		},
+		{
+			name:          "allowlist",
+			coreResources: []string{"namespaces", "configmaps"},
+			enabled:       []Battery{BatteryCoreNamespaces, BatteryCoreConfigMaps, BatteryNamespaceController},
+			disabled:      []Battery{BatteryCoreSecrets, BatteryCoreEvents, BatteryCoreServiceAccounts, BatteryCoreResourceQuotas, BatteryResourceQuotaController},
+		},
+		{
+			name:          "controllers are disabled with their core resources",
+			coreResources: []string{"configmaps"},
+			enabled:       []Battery{BatteryCoreConfigMaps},
+			disabled:      []Battery{BatteryCoreNamespaces, BatteryNamespaceController, BatteryResourceQuotaController},
+		},
+		{
+			name:          "explicitly enabled controller requires a core resource outside of the allowlist",
+			coreResources: []string{"configmaps"},
+			flags:         []string{BatteryServiceAccountControllers.String()},
+			wantErrs: []string{
+				`battery "serviceaccountcontrollers" requires battery "core.namespaces", which is disabled`,
+				`battery "serviceaccountcontrollers" requires battery "core.serviceaccounts", which is disabled`,
+			},
+		},
+		{
+			name:          "batteries flag wins over the allowlist",
+			coreResources: []string{"configmaps"},
+			flags:         []string{"+" + BatteryCoreSecrets.String()},
+			enabled:       []Battery{BatteryCoreConfigMaps, BatteryCoreSecrets},
+			disabled:      []Battery{BatteryCoreEvents},
+		},
+		{
+			name:          "unknown core resource",
+			coreResources: []string{"pods"},
+			wantErrs:      []string{`invalid core resource "pods"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New()
+			o.CoreResources = tt.coreResources
+			o.Enabled = tt.flags
+			completed := o.Complete()
+
+			var errs []string
+			for _, err := range completed.Validate() {
+				errs = append(errs, err.Error())
+			}
+			if diff := cmp.Diff(tt.wantErrs, errs); diff != "" {
+				t.Errorf("unexpected errors (-want +got):\n%s", diff)
+			}
+			for _, name := range tt.enabled {
+				if !completed.IsEnabled(name) {
+					t.Errorf("expected battery %q to be enabled", name)
+				}
+			}
+			for _, name := range tt.disabled {
+				if completed.IsEnabled(name) {
+					t.Errorf("expected battery %q to be disabled", name)
+				}
+			}
+		})
+	}
+}
+
+func TestControllerBatteries(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		enabled  []Battery
+		disabled []Battery
+		wantErrs []string
+	}{
+		{
+			name:     "garbage collector is disabled by default",
+			disabled: []Battery{BatteryGarbageCollector},
+		},
+		{
+			name:    "garbage collector does not require core resources",
+			flags:   []string{BatteryGarbageCollector.String(), "-" + BatteryCoreNamespaces.String()},
+			enabled: []Battery{BatteryGarbageCollector},
+		},
+		{
+			name:    "namespace controller is enabled by default",
+			enabled: []Battery{BatteryNamespaceController, BatteryCoreNamespaces},
+		},
+		{
+			name:     "namespace controller is disabled without namespaces",
+			flags:    []string{"-" + BatteryCoreNamespaces.String()},
+			disabled: []Battery{BatteryNamespaceController, BatteryCoreNamespaces},
+		},
+		{
+			name:     "explicitly enabled namespace controller requires namespaces",
+			flags:    []string{BatteryNamespaceController.String(), "-" + BatteryCoreNamespaces.String()},
+			wantErrs: []string{`battery "namespacecontroller" requires battery "core.namespaces", which is disabled`},
+		},
+		{
+			name:    "service account controllers enable their core resources",
+			flags:   []string{BatteryServiceAccountControllers.String()},
+			enabled: []Battery{BatteryServiceAccountControllers, BatteryCoreNamespaces, BatteryCoreServiceAccounts},
+		},
+		{
+			name:     "service account controllers are disabled by default",
+			disabled: []Battery{BatteryServiceAccountControllers},
+		},
+		{
+			name:     "explicitly enabled service account controllers require service accounts",
+			flags:    []string{BatteryServiceAccountControllers.String(), "-" + BatteryCoreServiceAccounts.String()},
+			wantErrs: []string{`battery "serviceaccountcontrollers" requires battery "core.serviceaccounts", which is disabled`},
+		},
+		{
+			name:    "resource quota controller is enabled by default",
+			enabled: []Battery{BatteryResourceQuotaController, BatteryCoreResourceQuotas},
+		},
+		{
+			name:     "resource quota controller is disabled without resource quotas",
+			flags:    []string{"-" + BatteryCoreResourceQuotas.String()},
+			enabled:  []Battery{BatteryNamespaceController},
+			disabled: []Battery{BatteryResourceQuotaController},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New()
+			o.Enabled = tt.flags
+			completed := o.Complete()
+
+			var errs []string
+			for _, err := range completed.Validate() {
+				errs = append(errs, err.Error())
+			}
+			if diff := cmp.Diff(tt.wantErrs, errs); diff != "" {
+				t.Errorf("unexpected errors (-want +got):\n%s", diff)
+			}
+			for _, name := range tt.enabled {
+				if !completed.IsEnabled(name) {
+					t.Errorf("expected battery %q to be enabled", name)
+				}
+			}
+			for _, name := range tt.disabled {
+				if completed.IsEnabled(name) {
+					t.Errorf("expected battery %q to be disabled", name)
+				}
+			}
+		})
+	}
+}
+
+// TestValidateDisabledRequirements checks that no battery is left enabled
+// with a disabled requirement, e.g. a controller without the resources it
+// works on: validation either disables it or fails.
+func TestValidateDisabledRequirements(t *testing.T) {
+	for name, spec := range Registered() {
+		for _, req := range spec.Requires {
+			for _, flags := range [][]string{{"-" + req.String()}, {name.String(), "-" + req.String()}} {
+				o := New()
+				o.Enabled = flags
+				completed := o.Complete()
+				if errs := completed.Validate(); len(errs) > 0 {
+					continue
+				}
+				for enabled, enabledSpec := range Registered() {
+					if !completed.IsEnabled(enabled) {
+						continue
+					}
+					for _, enabledReq := range enabledSpec.Requires {
+						if !completed.IsEnabled(enabledReq) {
+							t.Errorf("with --batteries=%s, battery %q is enabled without its requirement %q", strings.Join(flags, ","), enabled, enabledReq)
+						}
+					}
+				}
+			}
+		}
+	}
+}
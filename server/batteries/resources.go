@@ -0,0 +1,106 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batteries
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+)
+
+// ParseResource parses a resource in the form group/version/resource or
+// group/resource. An empty version matches all versions of the resource.
+func ParseResource(s string) (schema.GroupVersionResource, error) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionResource{Group: parts[0], Resource: parts[1]}, nil
+	case 3:
+		return schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+	default:
+		return schema.GroupVersionResource{}, fmt.Errorf("invalid resource %q, expected group/version/resource or group/resource", s)
+	}
+}
+
+// applyResources applies the --battery-resources entries to the batteries
+// owning the respective groups.
+func (s Options) applyResources() []error {
+	var errs []error
+	for _, entry := range s.Resources {
+		if len(entry) == 0 {
+			continue
+		}
+		disable := entry[0] == '-'
+		gvr, err := ParseResource(strings.TrimLeft(entry, "+-"))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var owner Battery
+		for name, spec := range s.batteries {
+			if slices.Contains(spec.Groups, gvr.Group) || slices.ContainsFunc(spec.Resources, func(other schema.GroupVersionResource) bool {
+				return other.Group == gvr.Group && other.Resource == gvr.Resource
+			}) {
+				owner = name
+				break
+			}
+		}
+		if owner == "" {
+			errs = append(errs, fmt.Errorf("resource %q does not belong to any battery", entry))
+			continue
+		}
+
+		spec := s.batteries[owner]
+		spec.DisabledResources = slices.DeleteFunc(slices.Clone(spec.DisabledResources), func(other schema.GroupVersionResource) bool {
+			return other == gvr
+		})
+		if disable {
+			spec.DisabledResources = append(spec.DisabledResources, gvr)
+		}
+		s.batteries[owner] = spec
+	}
+	return errs
+}
+
+// ApplyToResourceConfig disables the resources of disabled batteries and the
+// disabled resources of enabled batteries in the given resource config, like
+// --runtime-config does, so that their storage is never created. An empty
+// version disables the resource in all versions of its group.
+func (b CompletedOptions) ApplyToResourceConfig(config *serverstorage.ResourceConfig) {
+	for _, spec := range b.batteries {
+		resources := spec.DisabledResources
+		if !spec.Enabled {
+			resources = spec.Resources
+		}
+		for _, gvr := range resources {
+			if gvr.Version != "" {
+				config.DisableResources(gvr)
+				continue
+			}
+			for gv := range config.GroupVersionConfigs {
+				if gv.Group == gvr.Group {
+					config.DisableResources(gv.WithResource(gvr.Resource))
+				}
+			}
+		}
+	}
+}
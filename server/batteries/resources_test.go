@@ -0,0 +1,237 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batteries
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
+	"k8s.io/apiserver/pkg/registry/generic"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	serverstorage "k8s.io/apiserver/pkg/server/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/client-go/rest"
+	"k8s.io/component-base/compatibility"
+	"k8s.io/kubernetes/pkg/api/legacyscheme"
+	generatedopenapi "k8s.io/kubernetes/pkg/generated/openapi"
+	admissionregistrationrest "k8s.io/kubernetes/pkg/registry/admissionregistration/rest"
+
+	_ "k8s.io/kubernetes/pkg/apis/admissionregistration/install"
+
+	"github.com/kcp-dev/generic-controlplane/server/sqlstorage"
+)
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    schema.GroupVersionResource
+		wantErr bool
+	}{
+		{in: "rbac.authorization.k8s.io/v1/roles", want: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"}},
+		{in: "rbac.authorization.k8s.io/roles", want: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Resource: "roles"}},
+		{in: "/v1/configmaps", want: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+		{in: "roles", wantErr: true},
+		{in: "a/b/c/d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseResource(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResource(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseResource(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyToResourceConfig(t *testing.T) {
+	rbacV1 := rbacv1.SchemeGroupVersion
+	rbacV1beta1 := schema.GroupVersion{Group: rbacV1.Group, Version: "v1beta1"}
+
+	tests := []struct {
+		name      string
+		resources []string
+		enabled   []string
+		disabled  []schema.GroupVersionResource
+		served    []schema.GroupVersionResource
+	}{
+		{
+			name:     "nothing disabled",
+			enabled:  []string{string(BatteryAuthorization)},
+			served:   []schema.GroupVersionResource{rbacV1.WithResource("roles"), rbacV1.WithResource("clusterrolebindings")},
+			disabled: nil,
+		},
+		{
+			name:      "resource in one version",
+			resources: []string{"-rbac.authorization.k8s.io/v1/roles"},
+			enabled:   []string{string(BatteryAuthorization)},
+			disabled:  []schema.GroupVersionResource{rbacV1.WithResource("roles")},
+			served:    []schema.GroupVersionResource{rbacV1beta1.WithResource("roles"), rbacV1.WithResource("rolebindings")},
+		},
+		{
+			name:      "resource in all versions",
+			resources: []string{"-rbac.authorization.k8s.io/roles"},
+			enabled:   []string{string(BatteryAuthorization)},
+			disabled:  []schema.GroupVersionResource{rbacV1.WithResource("roles"), rbacV1beta1.WithResource("roles")},
+			served:    []schema.GroupVersionResource{rbacV1.WithResource("rolebindings")},
+		},
+		{
+			name:      "re-enabled resource",
+			resources: []string{"-rbac.authorization.k8s.io/roles", "+rbac.authorization.k8s.io/roles"},
+			enabled:   []string{string(BatteryAuthorization)},
+			served:    []schema.GroupVersionResource{rbacV1.WithResource("roles")},
+		},
+		{
+			name:     "resource of a disabled core battery",
+			enabled:  []string{"-" + string(BatteryCoreSecrets)},
+			disabled: []schema.GroupVersionResource{{Version: "v1", Resource: "secrets"}},
+			served:   []schema.GroupVersionResource{{Version: "v1", Resource: "configmaps"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New()
+			o.Resources = tt.resources
+			o.Enabled = tt.enabled
+			completed := o.Complete()
+			if errs := completed.Validate(); len(errs) > 0 {
+				t.Fatalf("unexpected validation errors: %v", errs)
+			}
+
+			config := serverstorage.NewResourceConfig()
+			config.EnableVersions(rbacV1, rbacV1beta1, schema.GroupVersion{Version: "v1"})
+			completed.ApplyToResourceConfig(config)
+
+			for _, gvr := range tt.disabled {
+				if config.ResourceEnabled(gvr) {
+					t.Errorf("expected %v to be disabled", gvr)
+				}
+			}
+			for _, gvr := range tt.served {
+				if !config.ResourceEnabled(gvr) {
+					t.Errorf("expected %v to be enabled", gvr)
+				}
+			}
+		})
+	}
+}
+
+// recordingRESTOptionsGetter records the resources whose storage is created.
+type recordingRESTOptionsGetter struct {
+	socket string
+
+	lock      sync.Mutex
+	resources sets.Set[string]
+}
+
+func (g *recordingRESTOptionsGetter) GetRESTOptions(resource schema.GroupResource, example runtime.Object) (generic.RESTOptions, error) {
+	g.lock.Lock()
+	g.resources.Insert(resource.Resource)
+	g.lock.Unlock()
+
+	storageConfig := storagebackend.NewDefaultConfig("/registry", legacyscheme.Codecs.LegacyCodec(admissionregistrationv1.SchemeGroupVersion))
+	storageConfig.Transport.ServerList = []string{"unix://" + g.socket}
+	return generic.RESTOptions{
+		StorageConfig:  storageConfig.ForResource(resource),
+		Decorator:      generic.UndecoratedStorage,
+		ResourcePrefix: resource.Group + "/" + resource.Resource,
+	}, nil
+}
+
+func TestDisabledResourceIsNotServed(t *testing.T) {
+	o := New()
+	o.Enabled = []string{string(BatteryAdmission)}
+	o.Resources = []string{"-admissionregistration.k8s.io/mutatingwebhookconfigurations"}
+	completed := o.Complete()
+	if errs := completed.Validate(); len(errs) > 0 {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+
+	resourceConfig := serverstorage.NewResourceConfig()
+	resourceConfig.EnableVersions(admissionregistrationv1.SchemeGroupVersion)
+	completed.ApplyToResourceConfig(resourceConfig)
+
+	config := genericapiserver.NewConfig(legacyscheme.Codecs)
+	config.MergedResourceConfig = resourceConfig
+	config.EffectiveVersion = compatibility.NewEffectiveVersionFromString("1.35", "", "")
+	config.LoopbackClientConfig = &rest.Config{}
+	config.ExternalAddress = "127.0.0.1:6443"
+	config.OpenAPIV3Config = genericapiserver.DefaultOpenAPIV3Config(generatedopenapi.GetOpenAPIDefinitions, openapinamer.NewDefinitionNamer(legacyscheme.Scheme))
+	server, err := config.Complete(nil).New("test", genericapiserver.NewEmptyDelegate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Destroy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	socket := filepath.Join(t.TempDir(), "etcd.sock")
+	if err := sqlstorage.NewServer(sqlstorage.Config{DataSource: sqlstorage.MemoryDataSource, Socket: socket}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	getter := &recordingRESTOptionsGetter{socket: socket, resources: sets.New[string]()}
+	apiGroupInfo, err := admissionregistrationrest.RESTStorageProvider{}.NewRESTStorage(resourceConfig, getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.InstallAPIGroup(&apiGroupInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	if getter.resources.Has("mutatingwebhookconfigurations") {
+		t.Errorf("storage of the disabled mutatingwebhookconfigurations was created")
+	}
+	if !getter.resources.Has("validatingwebhookconfigurations") {
+		t.Errorf("storage of validatingwebhookconfigurations was not created")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/apis/admissionregistration.k8s.io/v1", nil)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("discovery returned %d: %s", rec.Code, rec.Body.String())
+	}
+	var resources metav1.APIResourceList
+	if err := json.Unmarshal(rec.Body.Bytes(), &resources); err != nil {
+		t.Fatal(err)
+	}
+	served := sets.New[string]()
+	for _, r := range resources.APIResources {
+		served.Insert(r.Name)
+	}
+	if served.Has("mutatingwebhookconfigurations") {
+		t.Errorf("disabled mutatingwebhookconfigurations are served: %v", sets.List(served))
+	}
+	if !served.HasAll("validatingwebhookconfigurations", "validatingadmissionpolicies") {
+		t.Errorf("expected the other resources to be served, got %v", sets.List(served))
+	}
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bootstrapmanifests applies the manifests of a directory to the
+// control plane on startup, such that e.g. namespaces, CRDs, RBAC and default
+// configuration objects exist without an external bootstrap job.
+package bootstrapmanifests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// FieldManager is the field manager of the applied manifests.
+	FieldManager = "gcp-bootstrap"
+	// CheckName is the name of the readyz check of the applier. Waiting for
+	// readiness before applying the manifests must exclude it.
+	CheckName = "bootstrap-manifests"
+
+	// retryInterval is the interval to retry applying the manifests after a failure.
+	retryInterval = 10 * time.Second
+	// establishTimeout is the time to wait for applied CRDs to be established.
+	establishTimeout = time.Minute
+)
+
+var (
+	crdGroupKind       = schema.GroupKind{Group: apiextensionsv1.GroupName, Kind: "CustomResourceDefinition"}
+	namespaceGroupKind = schema.GroupKind{Kind: "Namespace"}
+)
+
+// Applier applies the manifests of a directory with server-side apply.
+type Applier struct {
+	directory string
+
+	lock sync.RWMutex
+	err  error
+}
+
+var _ healthz.HealthChecker = &Applier{}
+
+// NewApplier returns an applier of the YAML and JSON manifests in directory
+// and its subdirectories.
+func NewApplier(directory string) *Applier {
+	return &Applier{directory: directory, err: errors.New("bootstrap manifests not applied yet")}
+}
+
+// Run applies the manifests with the given client config, and retries until
+// all are applied or the context is done.
+func (a *Applier) Run(ctx context.Context, config *rest.Config) {
+	logger := klog.FromContext(ctx).WithValues("directory", a.directory)
+	logger.Info("Applying bootstrap manifests")
+
+	_ = wait.PollUntilContextCancel(ctx, retryInterval, true, func(ctx context.Context) (bool, error) {
+		n, err := a.apply(ctx, config)
+		a.setErr(err)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error(err, "Failed to apply bootstrap manifests, retrying", "interval", retryInterval)
+			}
+			return false, nil
+		}
+		logger.Info("Applied bootstrap manifests", "objects", n)
+		return true, nil
+	})
+}
+
+// apply applies the manifests, the CRDs first until they are established,
+// then the namespaces and then all other objects. It returns the number of
+// applied objects.
+func (a *Applier) apply(ctx context.Context, config *rest.Config) (int, error) {
+	objs, err := read(a.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	var crds, namespaces, others []*unstructured.Unstructured
+	for _, obj := range objs {
+		switch obj.GroupVersionKind().GroupKind() {
+		case crdGroupKind:
+			crds = append(crds, obj)
+		case namespaceGroupKind:
+			namespaces = append(namespaces, obj)
+		default:
+			others = append(others, obj)
+		}
+	}
+
+	if err := applyAll(ctx, client, mapper, crds); err != nil {
+		return 0, err
+	}
+	for _, crd := range crds {
+		if err := WaitForEstablished(ctx, client, crd.GetName()); err != nil {
+			return 0, err
+		}
+	}
+	if len(crds) > 0 {
+		// discover the resources of the new CRDs
+		mapper.Reset()
+	}
+
+	if err := applyAll(ctx, client, mapper, namespaces); err != nil {
+		return 0, err
+	}
+	if err := applyAll(ctx, client, mapper, others); err != nil {
+		return 0, err
+	}
+	return len(objs), nil
+}
+
+// applyAll applies the given objects and returns the errors of all failed ones.
+func applyAll(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, objs []*unstructured.Unstructured) error {
+	var errs []error
+	for _, obj := range objs {
+		if err := applyOne(ctx, client, mapper, obj); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func applyOne(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("failed to apply %s %q: %w", gvk.Kind, obj.GetName(), err)
+	}
+
+	var resource dynamic.ResourceInterface = client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(metav1.NamespaceDefault)
+		}
+		resource = client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	} else {
+		obj.SetNamespace("")
+	}
+
+	// the manifests are the desired state, they win over changes by others
+	if _, err := resource.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: FieldManager, Force: true}); err != nil {
+		if obj.GetNamespace() != "" {
+			return fmt.Errorf("failed to apply %s %s/%s: %w", gvk.Kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+		return fmt.Errorf("failed to apply %s %s: %w", gvk.Kind, obj.GetName(), err)
+	}
+	return nil
+}
+
+// WaitForEstablished waits for the CRD with the given name to be established.
+func WaitForEstablished(ctx context.Context, client dynamic.Interface, name string) error {
+	crds := client.Resource(apiextensionsv1.SchemeGroupVersion.WithResource("customresourcedefinitions"))
+	err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, establishTimeout, true, func(ctx context.Context) (bool, error) {
+		obj, err := crds.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, crd); err != nil {
+			return false, err
+		}
+		for _, cond := range crd.Status.Conditions {
+			if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("CustomResourceDefinition %s is not established: %w", name, err)
+	}
+	return nil
+}
+
+// read returns the objects of the .yaml, .yml and .json files in directory
+// and its subdirectories in lexical order. Lists are expanded into their items.
+func read(directory string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fileObjs, err := decode(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		objs = append(objs, fileObjs...)
+		return nil
+	})
+	return objs, err
+}
+
+// decode returns the objects of a YAML or JSON stream of documents.
+func decode(r io.Reader) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var content map[string]interface{}
+		if err := decoder.Decode(&content); errors.Is(err, io.EOF) {
+			return objs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(content) == 0 {
+			// empty document
+			continue
+		}
+
+		obj := &unstructured.Unstructured{Object: content}
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				objs = append(objs, item.(*unstructured.Unstructured))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		objs = append(objs, obj)
+	}
+}
+
+func (a *Applier) setErr(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.err = err
+}
+
+// Name implements healthz.HealthChecker.
+func (a *Applier) Name() string {
+	return CheckName
+}
+
+// Check implements healthz.HealthChecker. It fails until the manifests are
+// applied, and while the last attempt to apply them failed.
+func (a *Applier) Check(_ *http.Request) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.err
+}
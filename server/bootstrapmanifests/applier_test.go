@@ -0,0 +1,218 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrapmanifests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+)
+
+// names returns the kind, namespace and name of the given objects.
+func names(objs []*unstructured.Unstructured) []string {
+	var names []string
+	for _, obj := range objs {
+		names = append(names, strings.Join([]string{obj.GetKind(), obj.GetNamespace(), obj.GetName()}, "/"))
+	}
+	return names
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "single document",
+			data: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n",
+			want: []string{"Namespace//a"},
+		},
+		{
+			name: "multiple documents",
+			data: "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n---\n" +
+				"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n  namespace: a\n",
+			want: []string{"Namespace//a", "ConfigMap/a/b"},
+		},
+		{
+			name: "empty documents",
+			data: "---\n# only a comment\n---\n\n---\napiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n---\n",
+			want: []string{"Namespace//a"},
+		},
+		{
+			name: "list",
+			data: "apiVersion: v1\nkind: List\nitems:\n" +
+				"- apiVersion: v1\n  kind: Namespace\n  metadata:\n    name: a\n" +
+				"- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: b\n    namespace: a\n" +
+				"---\napiVersion: v1\nkind: Namespace\nmetadata:\n  name: c\n",
+			want: []string{"Namespace//a", "ConfigMap/a/b", "Namespace//c"},
+		},
+		{
+			name: "typed list",
+			data: `{"apiVersion": "v1", "kind": "ConfigMapList", "items": [{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}}]}`,
+			want: []string{"ConfigMap//a"},
+		},
+		{
+			name: "json",
+			data: `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "a"}}`,
+			want: []string{"Namespace//a"},
+		},
+		{
+			name: "empty",
+			data: "",
+		},
+		{
+			name:    "invalid",
+			data:    "apiVersion: v1\nkind: [Namespace\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs, err := decode(strings.NewReader(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, names(objs)); diff != "" {
+				t.Errorf("unexpected objects (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "lexical order of files and subdirectories",
+			files: map[string]string{
+				"b.yaml":          "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: b\n",
+				"a.yml":           "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n",
+				"c/d.json":        `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "d"}}`,
+				"c/e/f.yaml":      "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: f\n",
+				"README.md":       "# manifests\n",
+				"c/notes.txt":     "not a manifest",
+				"c/e/g.yaml.orig": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: g\n",
+			},
+			want: []string{"Namespace//a", "Namespace//b", "Namespace//d", "Namespace//f"},
+		},
+		{
+			name:  "empty directory",
+			files: map[string]string{},
+		},
+		{
+			name: "invalid file",
+			files: map[string]string{
+				"a.yaml":      "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n",
+				"b/bad.yaml":  "apiVersion: v1\nkind: [Namespace\n",
+				"b/good.yaml": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: good\n",
+			},
+			wantErr: filepath.Join("b", "bad.yaml"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			objs, err := read(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, names(objs)); diff != "" {
+				t.Errorf("unexpected objects (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadMissingDirectory(t *testing.T) {
+	if _, err := read(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a := NewApplier(filepath.Join(t.TempDir(), "missing"))
+	if a.Name() != CheckName {
+		t.Errorf("Name() = %q, want %q", a.Name(), CheckName)
+	}
+
+	// not applied yet
+	if err := a.Check(nil); err == nil {
+		t.Errorf("check succeeded before the first attempt")
+	}
+
+	// a failed attempt is reported
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx, &rest.Config{Host: "https://127.0.0.1:1"})
+	}()
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+		return errors.Is(a.Check(nil), os.ErrNotExist), nil
+	})
+	if err != nil {
+		t.Errorf("failed attempt was not reported: %v", a.Check(nil))
+	}
+	cancel()
+	<-done
+
+	// a successful attempt clears the error, an empty directory needs no requests
+	a.directory = t.TempDir()
+	a.Run(context.Background(), &rest.Config{Host: "https://127.0.0.1:1"})
+	if err := a.Check(nil); err != nil {
+		t.Errorf("check failed after the manifests were applied: %v", err)
+	}
+}
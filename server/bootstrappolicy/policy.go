@@ -0,0 +1,173 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bootstrappolicy holds the bootstrap RBAC policy of the generic
+// control plane. In contrast to kube-apiserver, it has no roles of the
+// container domain, i.e. no node, pod, kubelet or controller roles.
+package bootstrappolicy
+
+import (
+	"slices"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	rbacv1helpers "k8s.io/kubernetes/pkg/apis/rbac/v1"
+	controlplaneapiserver "k8s.io/kubernetes/pkg/controlplane/apiserver"
+	rbacrest "k8s.io/kubernetes/pkg/registry/rbac/rest"
+	upstream "k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac/bootstrappolicy"
+)
+
+const (
+	// UserClusterRoleBindingName is the name of the ClusterRoleBinding of the "user" identity.
+	UserClusterRoleBindingName = "gcp:user"
+	// UserName is the name of the non-admin "user" identity.
+	UserName = "user"
+
+	aggregateToAdmin = "rbac.authorization.k8s.io/aggregate-to-admin"
+	aggregateToEdit  = "rbac.authorization.k8s.io/aggregate-to-edit"
+	aggregateToView  = "rbac.authorization.k8s.io/aggregate-to-view"
+)
+
+var (
+	read      = []string{"get", "list", "watch"}
+	write     = []string{"create", "update", "patch", "delete", "deletecollection"}
+	readWrite = []string{"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection"}
+
+	// upstreamClusterRoles are the upstream cluster roles and bindings which are
+	// not specific to the container domain.
+	upstreamClusterRoles = []string{"cluster-admin", "system:discovery", "system:basic-user", "system:public-info-viewer"}
+)
+
+// ClusterRoles returns the bootstrap cluster roles. admin, edit and view
+// aggregate the roles labeled with rbac.authorization.k8s.io/aggregate-to-<role>,
+// e.g. for custom resources.
+func ClusterRoles() []rbacv1.ClusterRole {
+	roles := slices.DeleteFunc(upstream.ClusterRoles(), func(role rbacv1.ClusterRole) bool {
+		return !slices.Contains(upstreamClusterRoles, role.Name)
+	})
+	roles = append(roles, []rbacv1.ClusterRole{
+		{
+			// a role for a namespace level admin.  It is `edit` plus the power to grant permissions to other users.
+			ObjectMeta: metav1.ObjectMeta{Name: "admin"},
+			AggregationRule: &rbacv1.AggregationRule{
+				ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{aggregateToAdmin: "true"}}},
+			},
+		},
+		{
+			// a role for a namespace level editor.  It grants access to all user level actions in a namespace.
+			ObjectMeta: metav1.ObjectMeta{Name: "edit", Labels: map[string]string{aggregateToAdmin: "true"}},
+			AggregationRule: &rbacv1.AggregationRule{
+				ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{aggregateToEdit: "true"}}},
+			},
+		},
+		{
+			// a role for namespace level viewing.  It grants read-only access to non-escalating resources in a namespace.
+			ObjectMeta: metav1.ObjectMeta{Name: "view", Labels: map[string]string{aggregateToEdit: "true"}},
+			AggregationRule: &rbacv1.AggregationRule{
+				ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: map[string]string{aggregateToView: "true"}}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:aggregate-to-admin", Labels: map[string]string{aggregateToAdmin: "true"}},
+			Rules: []rbacv1.PolicyRule{
+				rbacv1helpers.NewRule("create").Groups("authorization.k8s.io").Resources("localsubjectaccessreviews").RuleOrDie(),
+				rbacv1helpers.NewRule(readWrite...).Groups("rbac.authorization.k8s.io").Resources("roles", "rolebindings").RuleOrDie(),
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:aggregate-to-edit", Labels: map[string]string{aggregateToEdit: "true"}},
+			Rules: []rbacv1.PolicyRule{
+				rbacv1helpers.NewRule(read...).Groups("").Resources("secrets").RuleOrDie(),
+				rbacv1helpers.NewRule("impersonate").Groups("").Resources("serviceaccounts").RuleOrDie(),
+				rbacv1helpers.NewRule(write...).Groups("").Resources("configmaps", "secrets", "serviceaccounts").RuleOrDie(),
+				rbacv1helpers.NewRule("create").Groups("").Resources("serviceaccounts/token").RuleOrDie(),
+				rbacv1helpers.NewRule(write...).Groups("", "events.k8s.io").Resources("events").RuleOrDie(),
+				rbacv1helpers.NewRule(readWrite...).Groups("coordination.k8s.io").Resources("leases").RuleOrDie(),
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "system:aggregate-to-view", Labels: map[string]string{aggregateToView: "true"}},
+			Rules: []rbacv1.PolicyRule{
+				rbacv1helpers.NewRule(read...).Groups("").Resources("configmaps", "serviceaccounts", "resourcequotas", "resourcequotas/status", "namespaces", "namespaces/status").RuleOrDie(),
+				rbacv1helpers.NewRule(read...).Groups("", "events.k8s.io").Resources("events").RuleOrDie(),
+			},
+		},
+	}...)
+	for i := range roles {
+		addDefaultMetadata(&roles[i].ObjectMeta)
+	}
+	return roles
+}
+
+// ClusterRoleBindings returns the bootstrap cluster role bindings, including
+// the binding of the "user" identity to the view role.
+func ClusterRoleBindings() []rbacv1.ClusterRoleBinding {
+	bindings := slices.DeleteFunc(upstream.ClusterRoleBindings(), func(binding rbacv1.ClusterRoleBinding) bool {
+		return !slices.Contains(upstreamClusterRoles, binding.Name)
+	})
+	bindings = append(bindings, rbacv1helpers.NewClusterBinding("view").Users(UserName).BindingOrDie())
+	bindings[len(bindings)-1].Name = UserClusterRoleBindingName
+	for i := range bindings {
+		addDefaultMetadata(&bindings[i].ObjectMeta)
+	}
+	return bindings
+}
+
+// Policy returns the bootstrap policy of the generic control plane.
+func Policy() *rbacrest.PolicyData {
+	return &rbacrest.PolicyData{
+		ClusterRoles:        ClusterRoles(),
+		ClusterRoleBindings: ClusterRoleBindings(),
+	}
+}
+
+// ReplaceRBACPolicy replaces the upstream bootstrap policy reconciled by the
+// post-start hook of the RBAC storage provider with the generic control plane
+// bootstrap policy.
+func ReplaceRBACPolicy(providers []controlplaneapiserver.RESTStorageProvider) []controlplaneapiserver.RESTStorageProvider {
+	for i, provider := range providers {
+		if rbacProvider, ok := provider.(rbacrest.RESTStorageProvider); ok {
+			providers[i] = rbacStorageProvider{RESTStorageProvider: rbacProvider}
+		}
+	}
+	return providers
+}
+
+type rbacStorageProvider struct {
+	rbacrest.RESTStorageProvider
+}
+
+var _ genericapiserver.PostStartHookProvider = rbacStorageProvider{}
+
+func (p rbacStorageProvider) PostStartHook() (string, genericapiserver.PostStartHookFunc, error) {
+	return rbacrest.PostStartHookName, Policy().EnsureRBACPolicy(), nil
+}
+
+func addDefaultMetadata(meta *metav1.ObjectMeta) {
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	for k, v := range upstream.Label {
+		meta.Labels[k] = v
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	for k, v := range upstream.Annotation {
+		meta.Annotations[k] = v
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrappolicy
+
+import (
+	"slices"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestUserClusterRoleBinding(t *testing.T) {
+	bindings := ClusterRoleBindings()
+	i := slices.IndexFunc(bindings, func(binding rbacv1.ClusterRoleBinding) bool {
+		return binding.Name == UserClusterRoleBindingName
+	})
+	if i < 0 {
+		t.Fatalf("no ClusterRoleBinding %q", UserClusterRoleBindingName)
+	}
+	binding := bindings[i]
+
+	if binding.RoleRef.Kind != "ClusterRole" || binding.RoleRef.Name != "view" {
+		t.Errorf("user is bound to %s %q, want ClusterRole \"view\"", binding.RoleRef.Kind, binding.RoleRef.Name)
+	}
+	if len(binding.Subjects) != 1 || binding.Subjects[0].Kind != rbacv1.UserKind || binding.Subjects[0].Name != UserName {
+		t.Errorf("unexpected subjects %v", binding.Subjects)
+	}
+}
+
+func TestClusterRoles(t *testing.T) {
+	roles := map[string]rbacv1.ClusterRole{}
+	for _, role := range ClusterRoles() {
+		roles[role.Name] = role
+	}
+
+	for _, name := range append([]string{"admin", "edit", "view"}, upstreamClusterRoles...) {
+		if _, ok := roles[name]; !ok {
+			t.Errorf("missing ClusterRole %q", name)
+		}
+	}
+	for _, name := range []string{"system:node", "system:kube-scheduler", "system:controller:replicaset-controller"} {
+		if _, ok := roles[name]; ok {
+			t.Errorf("unexpected container domain ClusterRole %q", name)
+		}
+	}
+
+	// view must not grant writes or access to secrets
+	for _, rule := range roles["system:aggregate-to-view"].Rules {
+		if slices.Contains(rule.Resources, "secrets") {
+			t.Errorf("view grants access to secrets: %v", rule)
+		}
+		for _, verb := range rule.Verbs {
+			if !slices.Contains(read, verb) {
+				t.Errorf("view grants verb %q: %v", verb, rule)
+			}
+		}
+	}
+}
@@ -0,0 +1,465 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	quota "k8s.io/apiserver/pkg/quota/v1"
+	quotageneric "k8s.io/apiserver/pkg/quota/v1/generic"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	cacheddiscovery "k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/controller-manager/pkg/informerfactory"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/controller"
+	"k8s.io/kubernetes/pkg/controller/certificates/rootcacertpublisher"
+	"k8s.io/kubernetes/pkg/controller/certificates/signer"
+	"k8s.io/kubernetes/pkg/controller/clusterroleaggregation"
+	"k8s.io/kubernetes/pkg/controller/garbagecollector"
+	namespacecontroller "k8s.io/kubernetes/pkg/controller/namespace"
+	resourcequotacontroller "k8s.io/kubernetes/pkg/controller/resourcequota"
+	serviceaccountcontroller "k8s.io/kubernetes/pkg/controller/serviceaccount"
+	quotainstall "k8s.io/kubernetes/pkg/quota/v1/install"
+	"k8s.io/kubernetes/pkg/serviceaccount"
+
+	"github.com/kcp-dev/generic-controlplane/server/batteries"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+	"github.com/kcp-dev/generic-controlplane/server/controllers/certificates"
+)
+
+const (
+	// garbageCollectorWorkers is the number of garbage collector workers, as in kube-controller-manager.
+	garbageCollectorWorkers = 20
+	// garbageCollectorSyncPeriod is the period to resync the monitored resources from discovery.
+	garbageCollectorSyncPeriod = 30 * time.Second
+
+	// namespaceWorkers is the number of namespace controller workers, as in kube-controller-manager.
+	namespaceWorkers = 10
+	// namespaceSyncPeriod is the period to resync namespaces, as in kube-controller-manager.
+	namespaceSyncPeriod = 5 * time.Minute
+
+	// serviceAccountWorkers is the number of workers of each service account controller, as in kube-controller-manager.
+	serviceAccountWorkers = 5
+
+	// clusterRoleAggregationWorkers is the number of cluster role aggregation workers, as in kube-controller-manager.
+	clusterRoleAggregationWorkers = 5
+
+	// resourceQuotaWorkers is the number of resource quota controller workers, as in kube-controller-manager.
+	resourceQuotaWorkers = 5
+	// resourceQuotaSyncPeriod is the period to recalculate quota usage, as in kube-controller-manager.
+	resourceQuotaSyncPeriod = 5 * time.Minute
+	// resourceQuotaReplenishmentSyncPeriod is the period to resync the objects monitored for replenishment.
+	resourceQuotaReplenishmentSyncPeriod = 12 * time.Hour
+)
+
+// resourceQuotaDiscoverySyncPeriod is the period to resync the monitored
+// resources from discovery. It is a variable for tests.
+var resourceQuotaDiscoverySyncPeriod = 30 * time.Second
+
+// legacyObjectCountResources are the core resources which can be limited by
+// their plain resource name in a quota, in addition to count/<resource>, and
+// the batteries serving them.
+var legacyObjectCountResources = map[string]batteries.Battery{
+	"configmaps":     batteries.BatteryCoreConfigMaps,
+	"secrets":        batteries.BatteryCoreSecrets,
+	"resourcequotas": batteries.BatteryCoreResourceQuotas,
+}
+
+// controllersConfig is the configuration of the embedded controllers.
+type controllersConfig struct {
+	Batteries    batteries.CompletedOptions
+	Certificates options.Certificates
+	// ServiceAccountSigningKeyFile is the key the legacy token Secrets are signed with.
+	ServiceAccountSigningKeyFile string
+	// RootCA is published as kube-root-ca.crt and added to legacy token Secrets.
+	RootCA []byte
+}
+
+// newControllersConfig returns the configuration of the embedded controllers
+// of the given server config.
+func newControllersConfig(config options.CompletedConfig) (controllersConfig, error) {
+	c := controllersConfig{
+		Batteries:                    config.Batteries,
+		Certificates:                 config.Options.Certificates,
+		ServiceAccountSigningKeyFile: config.Options.GenericControlPlane.ServiceAccountSigningKeyFile,
+	}
+	if !config.Batteries.IsEnabled(batteries.BatteryServiceAccountControllers) {
+		return c, nil
+	}
+
+	var err error
+	if rootCAFile := config.Options.Extra.RootCAFile; rootCAFile != "" {
+		cas, err := certutil.CertsFromFile(rootCAFile)
+		if err != nil {
+			return controllersConfig{}, fmt.Errorf("failed to read --root-ca-file: %w", err)
+		}
+		c.RootCA, err = certutil.EncodeCertificates(cas...)
+		if err != nil {
+			return controllersConfig{}, err
+		}
+		return c, nil
+	}
+	servingCert, _ := config.ControlPlane.Generic.SecureServing.Cert.CurrentCertKeyContent()
+	if c.RootCA, err = servingCAs(servingCert); err != nil {
+		return controllersConfig{}, err
+	}
+	return c, nil
+}
+
+// servingCAs returns the CA certificates of the given serving certificate
+// chain, such as the CA a self-signed serving certificate is followed by.
+func servingCAs(servingCert []byte) ([]byte, error) {
+	certs, err := certutil.ParseCertsPEM(servingCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the serving certificate: %w", err)
+	}
+	var cas []*x509.Certificate
+	for _, cert := range certs {
+		if cert.IsCA {
+			cas = append(cas, cert)
+		}
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("the serving certificate chain does not include its CA, set --root-ca-file")
+	}
+	return certutil.EncodeCertificates(cas...)
+}
+
+// postStartHookAdder is the part of the generic API server the embedded
+// controllers are added to.
+type postStartHookAdder interface {
+	AddPostStartHook(name string, hook genericapiserver.PostStartHookFunc) error
+}
+
+// addControllers adds post-start hooks running the embedded controllers,
+// replacing the parts of kube-controller-manager the enabled batteries need.
+// The batteries options are validated already, so the batteries the enabled
+// ones require are enabled as well.
+func addControllers(config controllersConfig, server postStartHookAdder) error {
+	if config.Batteries.IsEnabled(batteries.BatteryCertificates) {
+		if err := server.AddPostStartHook("start-gcp-certificates-controllers", func(hookContext genericapiserver.PostStartHookContext) error {
+			return startCertificatesControllers(hookContext, config.Certificates)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if config.Batteries.IsEnabled(batteries.BatteryGarbageCollector) {
+		if err := server.AddPostStartHook("start-gcp-garbage-collector", startGarbageCollector); err != nil {
+			return err
+		}
+	}
+
+	if config.Batteries.IsEnabled(batteries.BatteryNamespaceController) {
+		if err := server.AddPostStartHook("start-gcp-namespace-controller", startNamespaceController); err != nil {
+			return err
+		}
+	}
+
+	if config.Batteries.IsEnabled(batteries.BatteryServiceAccountControllers) {
+		if err := server.AddPostStartHook("start-gcp-service-account-controllers", func(hookContext genericapiserver.PostStartHookContext) error {
+			return startServiceAccountControllers(hookContext, config.Batteries, config.ServiceAccountSigningKeyFile, config.RootCA)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if config.Batteries.IsEnabled(batteries.BatteryAuthorization) {
+		if err := server.AddPostStartHook("start-gcp-cluster-role-aggregation-controller", startClusterRoleAggregationController); err != nil {
+			return err
+		}
+	}
+
+	if config.Batteries.IsEnabled(batteries.BatteryResourceQuotaController) {
+		if err := server.AddPostStartHook("start-gcp-resource-quota-controller", func(hookContext genericapiserver.PostStartHookContext) error {
+			return startResourceQuotaController(hookContext, config.Batteries)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func startCertificatesControllers(hookContext genericapiserver.PostStartHookContext, opts options.Certificates) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-certificates-controllers")
+	ctx := klog.NewContext(hookContext, logger)
+
+	client, err := kubernetes.NewForConfig(rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "certificates-controllers"))
+	if err != nil {
+		return err
+	}
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	csrInformer := informerFactory.Certificates().V1().CertificateSigningRequests()
+
+	signingController, err := signer.NewKubeAPIServerClientCSRSigningController(ctx, client, csrInformer, opts.CAFile, opts.CAKeyFile, opts.SigningDuration)
+	if err != nil {
+		return err
+	}
+	approvingController := certificates.NewCSRApprovingController(ctx, client, csrInformer, certificates.ApprovePolicy(opts.AutoApprovePolicy))
+
+	informerFactory.Start(hookContext.Done())
+	go signingController.Run(ctx, 1)
+	go approvingController.Run(ctx, 1)
+
+	logger.Info("Started certificates controllers", "autoApprovePolicy", opts.AutoApprovePolicy)
+	return nil
+}
+
+func startGarbageCollector(hookContext genericapiserver.PostStartHookContext) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-garbage-collector")
+	ctx := klog.NewContext(hookContext, logger)
+
+	config := rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "generic-garbage-collector")
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	// each object deletion takes two API calls, see kube-controller-manager
+	config.QPS *= 2
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cacheddiscovery.NewMemCacheClient(client.Discovery()))
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	metadataInformerFactory := metadatainformer.NewSharedInformerFactory(metadataClient, 0)
+	informersStarted := make(chan struct{})
+
+	gc, err := garbagecollector.NewGarbageCollector(
+		ctx,
+		client,
+		metadataClient,
+		mapper,
+		garbagecollector.DefaultIgnoredResources(),
+		informerfactory.NewInformerFactory(informerFactory, metadataInformerFactory),
+		informersStarted,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create the garbage collector: %w", err)
+	}
+
+	informerFactory.Start(hookContext.Done())
+	metadataInformerFactory.Start(hookContext.Done())
+	close(informersStarted)
+
+	go gc.Run(ctx, garbageCollectorWorkers, garbageCollectorSyncPeriod)
+	// periodically refresh the RESTMapper with new discovery information, e.g. for CRDs
+	go gc.Sync(ctx, client.Discovery(), garbageCollectorSyncPeriod)
+
+	logger.Info("Started garbage collector")
+	return nil
+}
+
+func startNamespaceController(hookContext genericapiserver.PostStartHookContext) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-namespace-controller")
+	ctx := klog.NewContext(hookContext, logger)
+
+	config := rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "namespace-controller")
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+
+	// discovery includes the resources of CRDs, which are deleted as well
+	namespaceController := namespacecontroller.NewNamespaceController(
+		ctx,
+		client,
+		metadataClient,
+		client.Discovery().ServerPreferredNamespacedResources,
+		informerFactory.Core().V1().Namespaces(),
+		namespaceSyncPeriod,
+		corev1.FinalizerKubernetes,
+	)
+
+	informerFactory.Start(hookContext.Done())
+	go namespaceController.Run(ctx, namespaceWorkers)
+
+	logger.Info("Started namespace controller")
+	return nil
+}
+
+// startClusterRoleAggregationController starts the controller aggregating the
+// rules of labeled ClusterRoles, e.g. of custom resources, into admin, edit and view.
+func startClusterRoleAggregationController(hookContext genericapiserver.PostStartHookContext) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-cluster-role-aggregation-controller")
+	ctx := klog.NewContext(hookContext, logger)
+
+	client, err := kubernetes.NewForConfig(rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "clusterrole-aggregation-controller"))
+	if err != nil {
+		return err
+	}
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+
+	aggregationController := clusterroleaggregation.NewClusterRoleAggregation(informerFactory.Rbac().V1().ClusterRoles(), client.RbacV1())
+
+	informerFactory.Start(hookContext.Done())
+	go aggregationController.Run(ctx, clusterRoleAggregationWorkers)
+
+	logger.Info("Started cluster role aggregation controller")
+	return nil
+}
+
+// startServiceAccountControllers starts the default service account controller,
+// and, if their core resources are served, the root CA publisher and the legacy
+// token controller signing with the service account key.
+func startServiceAccountControllers(hookContext genericapiserver.PostStartHookContext, batteryOptions batteries.CompletedOptions, signingKeyFile string, rootCA []byte) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-service-account-controllers")
+	ctx := klog.NewContext(hookContext, logger)
+
+	client, err := kubernetes.NewForConfig(rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "service-account-controllers"))
+	if err != nil {
+		return err
+	}
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+
+	serviceAccountsController, err := serviceaccountcontroller.NewServiceAccountsController(
+		logger,
+		informerFactory.Core().V1().ServiceAccounts(),
+		informerFactory.Core().V1().Namespaces(),
+		client,
+		serviceaccountcontroller.DefaultServiceAccountsControllerOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create the service account controller: %w", err)
+	}
+	runners := []func(ctx context.Context, workers int){serviceAccountsController.Run}
+
+	if batteryOptions.IsEnabled(batteries.BatteryCoreConfigMaps) {
+		publisher, err := rootcacertpublisher.NewPublisher(informerFactory.Core().V1().ConfigMaps(), informerFactory.Core().V1().Namespaces(), client, rootCA)
+		if err != nil {
+			return fmt.Errorf("failed to create the root CA certificate publisher: %w", err)
+		}
+		runners = append(runners, publisher.Run)
+	}
+
+	if batteryOptions.IsEnabled(batteries.BatteryCoreSecrets) && signingKeyFile == "" {
+		logger.Info("Not starting the tokens controller without --service-account-signing-key-file")
+	} else if batteryOptions.IsEnabled(batteries.BatteryCoreSecrets) {
+		key, err := keyutil.PrivateKeyFromFile(signingKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read service account signing key %q: %w", signingKeyFile, err)
+		}
+		tokenGenerator, err := serviceaccount.JWTTokenGenerator(serviceaccount.LegacyIssuer, key)
+		if err != nil {
+			return fmt.Errorf("failed to build token generator: %w", err)
+		}
+		tokensController, err := serviceaccountcontroller.NewTokensController(
+			logger,
+			informerFactory.Core().V1().ServiceAccounts(),
+			informerFactory.Core().V1().Secrets(),
+			client,
+			serviceaccountcontroller.TokensControllerOptions{
+				TokenGenerator: tokenGenerator,
+				RootCA:         rootCA,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create the tokens controller: %w", err)
+		}
+		runners = append(runners, tokensController.Run)
+	}
+
+	informerFactory.Start(hookContext.Done())
+	for _, run := range runners {
+		go run(ctx, serviceAccountWorkers)
+	}
+
+	logger.Info("Started service account controllers")
+	return nil
+}
+
+// startResourceQuotaController starts the resource quota controller. Object
+// count evaluators for every served namespaced resource, including custom
+// resources, are added dynamically from discovery. The legacy object count
+// evaluators are only added for the core resources of enabled batteries, as
+// the informers of resources which are not served never sync.
+func startResourceQuotaController(hookContext genericapiserver.PostStartHookContext, batteryOptions batteries.CompletedOptions) error {
+	logger := klog.FromContext(hookContext).WithValues("postStartHook", "start-gcp-resource-quota-controller")
+	ctx := klog.NewContext(hookContext, logger)
+
+	config := rest.AddUserAgent(rest.CopyConfig(hookContext.LoopbackClientConfig), "resourcequota-controller")
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	metadataInformerFactory := metadatainformer.NewSharedInformerFactory(metadataClient, 0)
+	objectOrMetadataInformerFactory := informerfactory.NewInformerFactory(informerFactory, metadataInformerFactory)
+	informersStarted := make(chan struct{})
+
+	listerFuncForResource := quotageneric.ListerFuncForResourceFunc(objectOrMetadataInformerFactory.ForResource)
+	var evaluators []quota.Evaluator
+	for resource, battery := range legacyObjectCountResources {
+		if !batteryOptions.IsEnabled(battery) {
+			continue
+		}
+		gvr := corev1.SchemeGroupVersion.WithResource(resource)
+		evaluators = append(evaluators, quotageneric.NewObjectCountEvaluator(gvr.GroupResource(), quotageneric.ListResourceUsingListerFunc(listerFuncForResource, gvr), corev1.ResourceName(resource)))
+	}
+
+	discoveryFunc := client.Discovery().ServerPreferredNamespacedResources
+	resourceQuotaController, err := resourcequotacontroller.NewController(ctx, &resourcequotacontroller.ControllerOptions{
+		QuotaClient:               client.CoreV1(),
+		ResourceQuotaInformer:     informerFactory.Core().V1().ResourceQuotas(),
+		ResyncPeriod:              controller.StaticResyncPeriodFunc(resourceQuotaSyncPeriod),
+		InformerFactory:           objectOrMetadataInformerFactory,
+		ReplenishmentResyncPeriod: controller.StaticResyncPeriodFunc(resourceQuotaReplenishmentSyncPeriod),
+		DiscoveryFunc:             discoveryFunc,
+		IgnoredResourcesFunc:      quotainstall.DefaultIgnoredResources,
+		InformersStarted:          informersStarted,
+		Registry:                  quotageneric.NewRegistry(evaluators),
+		UpdateFilter:              quotainstall.DefaultUpdateFilter(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create the resource quota controller: %w", err)
+	}
+
+	informerFactory.Start(hookContext.Done())
+	metadataInformerFactory.Start(hookContext.Done())
+	close(informersStarted)
+
+	go resourceQuotaController.Run(ctx, resourceQuotaWorkers)
+	// periodically resync the monitored resources from discovery, e.g. for CRDs
+	go resourceQuotaController.Sync(ctx, discoveryFunc, resourceQuotaDiscoverySyncPeriod)
+
+	logger.Info("Started resource quota controller")
+	return nil
+}
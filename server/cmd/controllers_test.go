@@ -0,0 +1,407 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+
+	"github.com/kcp-dev/generic-controlplane/server/batteries"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+// hookRecorder records the added post-start hooks.
+type hookRecorder map[string]genericapiserver.PostStartHookFunc
+
+func (r hookRecorder) AddPostStartHook(name string, hook genericapiserver.PostStartHookFunc) error {
+	r[name] = hook
+	return nil
+}
+
+// fakeAPIServer serves the discovery and empty lists of the core resources of
+// the enabled batteries, but one ResourceQuota limiting them. It records the
+// paths of all other requests, which fail with NotFound unless they list a
+// served resource.
+type fakeAPIServer struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	coreResources *metav1.APIResourceList
+	paths         []string
+	// quotaStatus is the last status update of the ResourceQuota.
+	quotaStatus *corev1.ResourceQuota
+}
+
+func newFakeAPIServer(t *testing.T, batteryOptions batteries.CompletedOptions) *fakeAPIServer {
+	s := &fakeAPIServer{coreResources: &metav1.APIResourceList{GroupVersion: "v1"}}
+	for _, r := range []struct {
+		name, kind string
+		namespaced bool
+	}{
+		{"namespaces", "Namespace", false},
+		{"configmaps", "ConfigMap", true},
+		{"secrets", "Secret", true},
+		{"serviceaccounts", "ServiceAccount", true},
+		{"resourcequotas", "ResourceQuota", true},
+	} {
+		if batteryOptions.IsEnabled(batteries.Battery(batteries.CoreBatteryPrefix + r.name)) {
+			s.serve(r.name, r.kind, r.namespaced)
+		}
+	}
+
+	quotas := &corev1.ResourceQuotaList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuotaList"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		Items: []corev1.ResourceQuota{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "quota", ResourceVersion: "1"},
+			Spec: corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{
+				corev1.ResourceConfigMaps: resource.MustParse("1"),
+				corev1.ResourceSecrets:    resource.MustParse("1"),
+			}},
+		}},
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			_ = json.NewEncoder(w).Encode(&metav1.APIVersions{Versions: []string{"v1"}})
+		case "/api/v1":
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			_ = json.NewEncoder(w).Encode(s.coreResources)
+		case "/apis":
+			_ = json.NewEncoder(w).Encode(&metav1.APIGroupList{})
+		default:
+			s.lock.Lock()
+			s.paths = append(s.paths, r.URL.Path)
+			s.lock.Unlock()
+			if r.Method == http.MethodPut && r.URL.Path == "/api/v1/namespaces/default/resourcequotas/quota/status" {
+				quota := &corev1.ResourceQuota{}
+				body, err := io.ReadAll(r.Body)
+				if err == nil {
+					_, _, err = scheme.Codecs.UniversalDeserializer().Decode(body, nil, quota)
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				s.lock.Lock()
+				s.quotaStatus = quota
+				s.lock.Unlock()
+				_ = json.NewEncoder(w).Encode(quota)
+				return
+			}
+			if r.URL.Query().Get("watch") == "" {
+				if r.URL.Path == "/api/v1/resourcequotas" {
+					_ = json.NewEncoder(w).Encode(quotas)
+					return
+				}
+				if kind, ok := s.servedKind(r.URL.Path); ok {
+					_ = json.NewEncoder(w).Encode(&metav1.List{
+						TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: kind + "List"},
+						ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+					})
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// serve adds the given core resource to the discovery.
+func (s *fakeAPIServer) serve(name, kind string, namespaced bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.coreResources.APIResources = append(s.coreResources.APIResources, metav1.APIResource{
+		Name:       name,
+		Kind:       kind,
+		Namespaced: namespaced,
+		Verbs:      metav1.Verbs{"create", "delete", "deletecollection", "get", "list", "patch", "update", "watch"},
+	})
+}
+
+// servedKind returns the kind of the served core resource listed at the given
+// path.
+func (s *fakeAPIServer) servedKind(path string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, resource := range s.coreResources.APIResources {
+		if path == "/api/v1/"+resource.Name {
+			return resource.Kind, true
+		}
+	}
+	return "", false
+}
+
+// usedQuota returns the used resources of the last ResourceQuota status update.
+func (s *fakeAPIServer) usedQuota() corev1.ResourceList {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.quotaStatus == nil {
+		return nil
+	}
+	return s.quotaStatus.Status.Used
+}
+
+// requested returns whether the given path was requested.
+func (s *fakeAPIServer) requested(path string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Contains(s.paths, path)
+}
+
+func writeControllerKeys(t *testing.T) (options.Certificates, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: "test-ca"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := certutil.EncodeCertificates(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := options.Certificates{
+		CAFile:            filepath.Join(dir, "ca.crt"),
+		CAKeyFile:         filepath.Join(dir, "ca.key"),
+		SigningDuration:   time.Hour,
+		AutoApprovePolicy: "none",
+	}
+	if err := os.WriteFile(certs.CAFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certs.CAKeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certs, certs.CAKeyFile
+}
+
+func TestAddControllers(t *testing.T) {
+	resourceQuotaDiscoverySyncPeriod = 10 * time.Millisecond
+	t.Cleanup(func() { resourceQuotaDiscoverySyncPeriod = 30 * time.Second })
+
+	tests := []struct {
+		name      string
+		batteries []string
+		// wantPaths are requested by the started controllers
+		wantPaths map[string][]string
+		// counted are counted in the ResourceQuota status
+		counted []corev1.ResourceName
+		// servedLater maps core resources to their kinds which are served
+		// once the quota is counted, such that the resource quota controller
+		// starts the informers created in the meantime
+		servedLater map[string]string
+		// unwantedPaths are never requested
+		unwantedPaths []string
+	}{
+		{
+			name: "defaults",
+			wantPaths: map[string][]string{
+				"start-gcp-namespace-controller":      {"/api/v1/namespaces"},
+				"start-gcp-resource-quota-controller": {"/api/v1/resourcequotas"},
+			},
+		},
+		{
+			name:      "all controllers",
+			batteries: []string{"certificates", "garbagecollector", "serviceaccountcontrollers", "authorization"},
+			wantPaths: map[string][]string{
+				"start-gcp-certificates-controllers":            {"/apis/certificates.k8s.io/v1/certificatesigningrequests"},
+				"start-gcp-garbage-collector":                   {"/api/v1/configmaps"},
+				"start-gcp-namespace-controller":                {"/api/v1/namespaces"},
+				"start-gcp-service-account-controllers":         {"/api/v1/serviceaccounts", "/api/v1/configmaps", "/api/v1/secrets"},
+				"start-gcp-cluster-role-aggregation-controller": {"/apis/rbac.authorization.k8s.io/v1/clusterroles"},
+				"start-gcp-resource-quota-controller":           {"/api/v1/resourcequotas"},
+			},
+		},
+		{
+			name:      "secrets disabled",
+			batteries: []string{"-core.secrets"},
+			wantPaths: map[string][]string{
+				"start-gcp-namespace-controller":      {"/api/v1/namespaces"},
+				"start-gcp-resource-quota-controller": {"/api/v1/resourcequotas", "/api/v1/configmaps", "/api/v1/namespaces/default/resourcequotas/quota/status"},
+			},
+			counted:       []corev1.ResourceName{corev1.ResourceConfigMaps},
+			servedLater:   map[string]string{"podtemplates": "PodTemplate"},
+			unwantedPaths: []string{"/api/v1/secrets"},
+		},
+		{
+			name:      "no controllers",
+			batteries: []string{"-namespacecontroller", "-resourcequotacontroller"},
+			wantPaths: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := batteries.New()
+			o.Enabled = tt.batteries
+			completed := o.Complete()
+			if errs := completed.Validate(); len(errs) > 0 {
+				t.Fatalf("unexpected battery errors: %v", errs)
+			}
+			certs, signingKeyFile := writeControllerKeys(t)
+
+			hooks := hookRecorder{}
+			err := addControllers(controllersConfig{
+				Batteries:                    completed,
+				Certificates:                 certs,
+				ServiceAccountSigningKeyFile: signingKeyFile,
+				RootCA:                       []byte("root CA"),
+			}, hooks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want []string
+			for name := range hooks {
+				got = append(got, name)
+			}
+			for name := range tt.wantPaths {
+				want = append(want, name)
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("unexpected post-start hooks (-want +got):\n%s", diff)
+			}
+
+			server := newFakeAPIServer(t, completed)
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			for name, hook := range hooks {
+				if err := hook(genericapiserver.PostStartHookContext{LoopbackClientConfig: &rest.Config{Host: server.URL}, Context: ctx}); err != nil {
+					t.Errorf("post-start hook %q failed: %v", name, err)
+				}
+			}
+
+			for name, paths := range tt.wantPaths {
+				for _, path := range paths {
+					err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+						return server.requested(path), nil
+					})
+					if err != nil {
+						t.Errorf("controllers of %q did not request %s", name, path)
+					}
+				}
+			}
+			for _, name := range tt.counted {
+				err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+					_, ok := server.usedQuota()[name]
+					return ok, nil
+				})
+				if err != nil {
+					t.Errorf("quota does not count %s", name)
+				}
+			}
+			for name, kind := range tt.servedLater {
+				server.serve(name, kind, true)
+				err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+					return server.requested("/api/v1/" + name), nil
+				})
+				if err != nil {
+					t.Errorf("controllers did not request /api/v1/%s", name)
+				}
+			}
+			for _, path := range tt.unwantedPaths {
+				// give the informers started with the last one time to list
+				err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 100*time.Millisecond, true, func(context.Context) (bool, error) {
+					return server.requested(path), nil
+				})
+				if err == nil {
+					t.Errorf("controllers requested %s", path)
+				}
+			}
+		})
+	}
+}
+
+func TestServingCAs(t *testing.T) {
+	selfSigned, _, err := certutil.GenerateSelfSignedCertKey("localhost", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := certutil.ParseCertsPEM(selfSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].IsCA || !chain[1].IsCA {
+		t.Fatalf("unexpected self-signed serving certificate chain of %d certificates", len(chain))
+	}
+	leaf, err := certutil.EncodeCertificates(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := servingCAs(selfSigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := certutil.ParseCertsPEM(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cas) != 1 || !cas[0].Equal(chain[1]) {
+		t.Errorf("expected the CA of the self-signed serving certificate, got %d certificates", len(cas))
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cas[0])
+	if _, err := chain[0].Verify(x509.VerifyOptions{Roots: pool, DNSName: "localhost"}); err != nil {
+		t.Errorf("the serving certificate is not verified by the returned CA: %v", err)
+	}
+
+	if _, err := servingCAs(leaf); err == nil || !strings.Contains(err.Error(), "set --root-ca-file") {
+		t.Errorf("unexpected error for a chain without CA: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/spf13/cobra"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/kcp-dev/generic-controlplane/server/cmd/help"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+// NewKubeConfigCommand creates the kubeconfig command, writing kubeconfigs for
+// the admin, the "user" identity or a ServiceAccount.
+func NewKubeConfigCommand() *cobra.Command {
+	o := options.NewKubeConfigOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Write a kubeconfig for the admin, the user or a ServiceAccount",
+		Long: help.Doc(`
+			Write a kubeconfig for the admin, the user or a ServiceAccount
+
+			The admin and the user get a client certificate signed by the client CA in the
+			root directory, which works without a running server. The server only trusts it with
+			--authentication-admin-credentials=client-cert or --authentication-static-users-file,
+			otherwise they get their persisted token of the root directory.
+			ServiceAccounts get a token requested from the running server through the TokenRequest API.
+		`),
+		Example: help.Doc(`
+			gcp kubeconfig --identity=user -o user.kubeconfig
+			gcp kubeconfig --serviceaccount=default/deployer --expiration=1h --audience=gcp
+		`),
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			return o.Run(cmd.Context())
+		},
+	}
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/kcp-dev/generic-controlplane/server/cmd/help"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+// NewMemberCommand creates the member command, managing the members of the
+// embedded etcd cluster.
+func NewMemberCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "member",
+		Short: "Manage the members of the embedded etcd cluster",
+		Long: help.Doc(`
+			Manage the members of the embedded etcd cluster
+
+			The commands talk to the embedded etcd of the running server in the root directory,
+			which must have quorum to change the members.
+		`),
+	}
+	cmd.AddCommand(newMemberListCommand())
+	cmd.AddCommand(newMemberAddCommand())
+	cmd.AddCommand(newMemberRemoveCommand())
+	return cmd
+}
+
+func newMemberListCommand() *cobra.Command {
+	o := options.NewMemberOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the members of the embedded etcd cluster",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			members, err := o.List(cmd.Context())
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tPEER URLS\tSTARTED")
+			for _, m := range members {
+				fmt.Fprintf(w, "%x\t%s\t%s\t%t\n", m.ID, m.Name, strings.Join(m.PeerURLs, ","), m.Name != "")
+			}
+			return w.Flush()
+		},
+	}
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newMemberAddCommand() *cobra.Command {
+	o := options.NewMemberOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "add <name> <peer-url>",
+		Short: "Add a member to the embedded etcd cluster",
+		Long: help.Doc(`
+			Add a member to the embedded etcd cluster
+
+			The member is added to the cluster before it is started. Start it right after with the printed
+			flags and a copy of the peer CA of the cluster, as the cluster may lose quorum until it runs.
+		`),
+		Example: help.Doc(`
+			gcp member add gcp-3 https://10.0.0.4:2380
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			id, initialCluster, err := o.Add(cmd.Context(), args[0], args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Added member %s with ID %x, start it with:\n\n", args[0], id)
+			fmt.Fprintf(cmd.OutOrStdout(), "  --embedded-etcd-name=%s --embedded-etcd-initial-cluster=%s --embedded-etcd-initial-cluster-state=existing\n",
+				args[0], initialCluster)
+			return nil
+		},
+	}
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newMemberRemoveCommand() *cobra.Command {
+	o := options.NewMemberOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "remove <name|id>",
+		Short: "Remove a member from the embedded etcd cluster",
+		Long: help.Doc(`
+			Remove a member from the embedded etcd cluster
+
+			The member is identified by its name or its hexadecimal ID as printed by "gcp member list".
+			Members which have not started yet have no name and are identified by their ID. The removed
+			member stops serving, its embedded etcd directory must be deleted before it can be added again.
+		`),
+		Example: help.Doc(`
+			gcp member remove gcp-3
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			id, err := o.Remove(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed member %s with ID %x\n", args[0], id)
+			return nil
+		},
+	}
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
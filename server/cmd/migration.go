@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/kcp-dev/generic-controlplane/server/cmd/help"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+// NewExportCommand creates the export command, writing all objects of the
+// running server to a directory tree or an archive.
+func NewExportCommand() *cobra.Command {
+	o := options.NewMigrationOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "export <directory|archive.tar.gz>",
+		Short: "Export all objects of the running server",
+		Long: help.Doc(`
+			Export all objects of the running server
+
+			The objects of all resources served by the server, including those of CRDs, are written
+			to one file <resource>.<group>/[<namespace>/]<name>.yaml each, in a new directory or in
+			a gzipped tar archive if the path ends with .tar.gz or .tgz. Fields populated by the
+			server like the UID, the resourceVersion and the managed fields are not exported, nor are
+			the objects every server creates for itself.
+
+			The export is no consistent snapshot, stop the clients for a consistent one.
+		`),
+		Example: help.Doc(`
+			gcp export backup
+			gcp export --kubeconfig=old/admin.kubeconfig backup.tar.gz
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			stats, err := o.Export(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Exported %d objects of %d resources to %s\n", stats.Objects, stats.Resources, args[0])
+			return nil
+		},
+	}
+	o.AddFlags(cmd.Flags())
+
+	return cmd
+}
+
+// NewImportCommand creates the import command, creating the objects of an
+// export on the running server.
+func NewImportCommand() *cobra.Command {
+	o := options.NewMigrationOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "import <directory|archive.tar.gz>",
+		Short: "Import the objects of an export into the running server",
+		Long: help.Doc(`
+			Import the objects of an export into the running server
+
+			The CRDs are created first and, once they are established, the namespaces and then the
+			other objects, with their status. Objects which exist already are kept as they are and
+			reported, or replaced with --overwrite. Owner references are updated to the UIDs of the owners on the server, and dropped if
+			the owner is not imported. The import continues on errors and reports them at the end.
+		`),
+		Example: help.Doc(`
+			gcp import backup
+			gcp import --kubeconfig=new/admin.kubeconfig backup.tar.gz
+			gcp import --overwrite backup
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			stats, err := o.Import(cmd.Context(), args[0])
+			if o.Overwrite {
+				fmt.Fprintf(cmd.OutOrStdout(), "Imported %s: %d created, %d overwritten, %d failed\n", args[0], stats.Created, stats.Overwritten, stats.Failed)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "Imported %s: %d created, %d existing kept, %d failed\n", args[0], stats.Created, stats.Existing, stats.Failed)
+			}
+			if stats.Existing > 0 {
+				fmt.Fprintf(cmd.ErrOrStderr(), "%d objects exist already and were kept as they are, use --overwrite to replace them with the export\n", stats.Existing)
+			}
+			return err
+		},
+	}
+	o.AddImportFlags(cmd.Flags())
+
+	return cmd
+}
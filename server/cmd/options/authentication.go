@@ -18,12 +18,16 @@ package options
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"os"
 	"path/filepath"
+	"slices"
 
-	"github.com/google/uuid"
 	"github.com/spf13/pflag"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/group"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
@@ -32,6 +36,8 @@ import (
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -41,12 +47,65 @@ const (
 	gcpUserUserName = "user"
 )
 
+const (
+	// AdminCredentialsToken authenticates the admin in the kubeconfig with a bearer token.
+	AdminCredentialsToken = "token"
+	// AdminCredentialsClientCert authenticates the admin in the kubeconfig with an
+	// x509 client certificate signed by the admin client CA.
+	AdminCredentialsClientCert = "client-cert"
+)
+
 // AdminAuthentication holds the configuration for the admin authentication in standalone mode.
 type AdminAuthentication struct {
 	KubeConfigPath string
 
 	// TODO: move into Secret in-cluster, maybe by using an "in-cluster" string as value
 	ShardAdminTokenHashFilePath string
+
+	// Credentials is the kind of admin credentials written to the kubeconfig,
+	// either AdminCredentialsToken or AdminCredentialsClientCert.
+	Credentials string
+	// ClientCAFile and ClientCAKeyFile are the CA signing the admin client
+	// certificate. They are generated if they do not exist.
+	ClientCAFile    string
+	ClientCAKeyFile string
+	// ClientCertFile and ClientKeyFile are the admin client certificate and key.
+	// They are generated if they do not exist, do not match or are about to expire.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// StaticUsersFile is the optional static users file, see StaticUsers.
+	StaticUsersFile string
+	// StaticUsersCertDirectory is the directory of the generated client
+	// certificates of the static users.
+	StaticUsersCertDirectory string
+
+	// KubeConfigSecretNamespace, if set, is the namespace of the Secret the
+	// kubeconfig is published to after readiness.
+	KubeConfigSecretNamespace string
+	// KubeConfigSecretName is the name of the kubeconfig Secret.
+	KubeConfigSecretName string
+	// KubeConfigSecretKubeConfig is the kubeconfig of a host cluster to publish
+	// the kubeconfig Secret to. By default it is published to gcp itself.
+	KubeConfigSecretKubeConfig string
+
+	// KubeConfigEndpoints are the endpoints of the kubeconfig clusters, see
+	// kubeConfigEndpoint. The first endpoint is used by the default contexts.
+	KubeConfigEndpoints []string
+	// KubeConfigTLSServerName is the TLS server name of custom endpoints whose
+	// host is not covered by the serving certificate.
+	KubeConfigTLSServerName string
+
+	// staticUsers is set by ApplyTo if StaticUsersFile is set.
+	staticUsers *staticUsers
+	// newKubeConfig is set by WriteKubeConfig and returns the current kubeconfig.
+	newKubeConfig func() (*clientcmdapi.Config, error)
+	// kubeConfigSecretCheck is set by ApplyTo if KubeConfigSecretNamespace is set.
+	kubeConfigSecretCheck *kubeConfigSecretCheck
+
+	// RotateTokens forces new admin and user tokens to be generated, invalidating
+	// all previously written kubeconfigs.
+	RotateTokens bool
 }
 
 // NewAdminAuthentication returns a new AdminAuthentication for the given root directory
@@ -55,6 +114,14 @@ func NewAdminAuthentication(rootDir string) *AdminAuthentication {
 	return &AdminAuthentication{
 		KubeConfigPath:              filepath.Join(rootDir, "admin.kubeconfig"),
 		ShardAdminTokenHashFilePath: filepath.Join(rootDir, ".admin-token-store"),
+		Credentials:                 AdminCredentialsToken,
+		ClientCAFile:                filepath.Join(rootDir, "client-ca.crt"),
+		ClientCAKeyFile:             filepath.Join(rootDir, "client-ca.key"),
+		ClientCertFile:              filepath.Join(rootDir, "admin-client.crt"),
+		ClientKeyFile:               filepath.Join(rootDir, "admin-client.key"),
+		StaticUsersCertDirectory:    filepath.Join(rootDir, "users"),
+		KubeConfigSecretName:        "admin-kubeconfig",
+		KubeConfigEndpoints:         []string{kubeConfigEndpointExternal},
 	}
 }
 
@@ -67,7 +134,39 @@ func (s *AdminAuthentication) Validate() []error {
 	errs := []error{}
 
 	if s.ShardAdminTokenHashFilePath == "" && s.KubeConfigPath != "" {
-		errs = append(errs, fmt.Errorf("--admin-kubeconfig requires --admin-token-hash-file-path"))
+		errs = append(errs, fmt.Errorf("--kubeconfig-path requires --authentication-admin-token-path"))
+	}
+	if len(s.KubeConfigEndpoints) == 0 {
+		errs = append(errs, fmt.Errorf("--kubeconfig-endpoints must not be empty"))
+	}
+	names := sets.New[string]()
+	for _, entry := range s.KubeConfigEndpoints {
+		name, _, err := parseKubeConfigEndpoint(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if names.Has(name) {
+			errs = append(errs, fmt.Errorf("duplicate kubeconfig endpoint %q", name))
+		}
+		names.Insert(name)
+	}
+	if s.KubeConfigSecretNamespace != "" && s.KubeConfigSecretName == "" {
+		errs = append(errs, fmt.Errorf("--kubeconfig-secret-namespace requires --kubeconfig-secret-name"))
+	}
+	// the tokens are read back from the kubeconfig file or the Secret on restart,
+	// which is impossible before start if the Secret is stored in gcp itself
+	if s.KubeConfigPath == "" && s.KubeConfigSecretNamespace != "" && s.KubeConfigSecretKubeConfig == "" {
+		errs = append(errs, fmt.Errorf("--kubeconfig-path=\"\" with --kubeconfig-secret-namespace requires --kubeconfig-secret-kubeconfig"))
+	}
+	switch s.Credentials {
+	case AdminCredentialsToken:
+	case AdminCredentialsClientCert:
+		if s.ClientCAFile == "" || s.ClientCAKeyFile == "" || s.ClientCertFile == "" || s.ClientKeyFile == "" {
+			errs = append(errs, fmt.Errorf("--authentication-admin-credentials=%s requires the admin client CA and certificate files", AdminCredentialsClientCert))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid --authentication-admin-credentials %q, must be one of %s, %s", s.Credentials, AdminCredentialsToken, AdminCredentialsClientCert))
 	}
 
 	return errs
@@ -80,21 +179,68 @@ func (s *AdminAuthentication) AddFlags(fs *pflag.FlagSet) {
 	}
 
 	fs.StringVar(&s.KubeConfigPath, "kubeconfig-path", s.KubeConfigPath,
-		"Path to which the administrative kubeconfig should be written at startup. If this is relative, it is relative to --root-directory.")
+		"Path to which the administrative kubeconfig should be written at startup. If this is relative, it is relative to --root-directory. "+
+			"If empty, no kubeconfig file is written, and the tokens are only kept across restarts in a kubeconfig Secret of --kubeconfig-secret-kubeconfig.")
+	fs.StringSliceVar(&s.KubeConfigEndpoints, "kubeconfig-endpoints", s.KubeConfigEndpoints, fmt.Sprintf(""+
+		"The endpoints of the clusters in the administrative kubeconfig: '%s' for the external address, '%s' for 127.0.0.1, "+
+		"or '<name>=<host>[:<port>]' for a custom hostname. The contexts of the first endpoint are named after the users ('root' for the admin), "+
+		"the contexts of the other endpoints are suffixed with '@<name>'.", kubeConfigEndpointExternal, kubeConfigEndpointLoopback))
+	fs.StringVar(&s.KubeConfigTLSServerName, "kubeconfig-tls-server-name", s.KubeConfigTLSServerName,
+		"The TLS server name of kubeconfig endpoints not covered by the serving certificate. Defaults to the host of the external address.")
+	fs.StringVar(&s.KubeConfigSecretNamespace, "kubeconfig-secret-namespace", s.KubeConfigSecretNamespace,
+		"Namespace of a Secret the administrative kubeconfig is published to after readiness, under the key '"+kubeConfigSecretKey+"'. "+
+			"The namespace is created if it does not exist. If empty, no Secret is published.")
+	fs.StringVar(&s.KubeConfigSecretName, "kubeconfig-secret-name", s.KubeConfigSecretName,
+		"Name of the Secret the administrative kubeconfig is published to.")
+	fs.StringVar(&s.KubeConfigSecretKubeConfig, "kubeconfig-secret-kubeconfig", s.KubeConfigSecretKubeConfig,
+		"Path to the kubeconfig of a host cluster to publish the administrative kubeconfig Secret to. By default it is published to gcp itself.")
 	fs.StringVar(&s.ShardAdminTokenHashFilePath, "authentication-admin-token-path", s.ShardAdminTokenHashFilePath,
-		"Path to which the administrative token hash should be written at startup. If this is relative, it is relative to --root-directory.")
+		"Path to which the administrative token hash should be written at startup. If this is relative, it is relative to --root-directory. "+
+			"Only the hashes are persisted; the tokens of --kubeconfig-path are reused across restarts if they match them.")
+	fs.StringVar(&s.Credentials, "authentication-admin-credentials", s.Credentials, fmt.Sprintf(
+		"The credentials of the admin in the kubeconfig. One of %s, %s.", AdminCredentialsToken, AdminCredentialsClientCert))
+	fs.StringVar(&s.ClientCAFile, "authentication-admin-client-ca-file", s.ClientCAFile,
+		"Path to the CA certificate signing the admin client certificate. It is generated with --authentication-admin-client-ca-key-file if it does not exist, "+
+			"and used as --client-ca-file if that is not set.")
+	fs.StringVar(&s.ClientCAKeyFile, "authentication-admin-client-ca-key-file", s.ClientCAKeyFile,
+		"Path to the CA key signing the admin client certificate.")
+	fs.StringVar(&s.ClientCertFile, "authentication-admin-client-cert-file", s.ClientCertFile,
+		"Path to the admin client certificate. It is generated if it does not exist or is about to expire.")
+	fs.StringVar(&s.ClientKeyFile, "authentication-admin-client-key-file", s.ClientKeyFile,
+		"Path to the admin client key.")
+	fs.StringVar(&s.StaticUsersFile, "authentication-static-users-file", s.StaticUsersFile, fmt.Sprintf(
+		"Path to a YAML file of kind %s (apiVersion %s) with users, groups and token or client certificate credentials. "+
+			"It is reloaded on change, and every user with a token or client certificate gets a context in the kubeconfig.", StaticUsersKind, StaticUsersAPIVersion))
+	fs.StringVar(&s.StaticUsersCertDirectory, "authentication-static-users-cert-dir", s.StaticUsersCertDirectory,
+		"Directory of the client certificates generated for the static users, signed by the admin client CA.")
+	fs.BoolVar(&s.RotateTokens, "authentication-admin-token-rotate", s.RotateTokens,
+		"Generate new admin and user tokens at startup, invalidating all previously written kubeconfigs.")
 }
 
-// ApplyTo returns a new volatile gcp admin token.
-// It also returns a new shard admin token and its hash if the configured shard admin hash file is not present.
-// If the shard admin hash file is present only the shard admin hash is returned and the returned shard admin token is empty.
-func (s *AdminAuthentication) ApplyTo(config *genericapiserver.Config) (volatileGcpAdminToken, volatileUserToken string, err error) {
-	volatileUserToken = uuid.New().String()
-	volatileGcpAdminToken = uuid.New().String()
+// ApplyTo adds an authenticator for the gcp admin and user tokens and returns them.
+// Only the token hashes are persisted, in the shard admin token hash file. The
+// tokens of the kubeconfig written by a previous start, or without kubeconfig
+// file of the Secret published to a host cluster, are reused if they match
+// them, such that handed out kubeconfigs stay valid across restarts.
+// Otherwise, or if rotation is requested, new tokens are generated.
+func (s *AdminAuthentication) ApplyTo(config *genericapiserver.Config) (gcpAdminToken, userToken string, err error) {
+	// the admin only gets a token if it does not authenticate with a client certificate
+	names := []string{gcpUserUserName}
+	if s.Credentials == AdminCredentialsToken {
+		names = append(names, gcpAdminUserName)
+	}
+	existing, err := s.existingTokens()
+	if err != nil {
+		return "", "", err
+	}
+	store, tokens, err := ensureTokens(s.ShardAdminTokenHashFilePath, existing, names, s.RotateTokens)
+	if err != nil {
+		return "", "", err
+	}
 
 	gcpAdminUser := &user.DefaultInfo{
 		Name: gcpAdminUserName,
-		UID:  uuid.New().String(),
+		UID:  store.Users[gcpAdminUserName].UID,
 		Groups: []string{
 			"system:masters",
 		},
@@ -102,58 +248,217 @@ func (s *AdminAuthentication) ApplyTo(config *genericapiserver.Config) (volatile
 
 	nonAdminUser := &user.DefaultInfo{
 		Name:   gcpUserUserName,
-		UID:    uuid.New().String(),
+		UID:    store.Users[gcpUserUserName].UID,
 		Groups: []string{},
 	}
 
-	newAuthenticator := group.NewAuthenticatedGroupAdder(bearertoken.New(authenticator.WrapAudienceAgnosticToken(config.Authentication.APIAudiences, authenticator.TokenFunc(func(_ context.Context, requestToken string) (*authenticator.Response, bool, error) {
-		if requestToken == volatileGcpAdminToken {
+	if s.StaticUsersFile != "" {
+		s.staticUsers, err = newStaticUsers(s.StaticUsersFile, s.StaticUsersCertDirectory, s.ClientCAFile, s.ClientCAKeyFile)
+		if err != nil {
+			return "", "", err
+		}
+		if err := config.AddPostStartHook("gcp-static-users-reloader", func(hookContext genericapiserver.PostStartHookContext) error {
+			go s.staticUsers.run(hookContext)
+			return nil
+		}); err != nil {
+			return "", "", err
+		}
+	}
+
+	if s.KubeConfigSecretNamespace != "" {
+		s.kubeConfigSecretCheck = newKubeConfigSecretCheck()
+		config.ReadyzChecks = append(config.ReadyzChecks, s.kubeConfigSecretCheck)
+	}
+
+	adminHash, userHash := store.Users[gcpAdminUserName], store.Users[gcpUserUserName]
+	newAuthenticator := group.NewAuthenticatedGroupAdder(bearertoken.New(authenticator.WrapAudienceAgnosticToken(config.Authentication.APIAudiences, authenticator.TokenFunc(func(ctx context.Context, requestToken string) (*authenticator.Response, bool, error) {
+		if adminHash.matches(requestToken) {
 			return &authenticator.Response{User: gcpAdminUser}, true, nil
 		}
 
-		if requestToken == volatileUserToken {
+		if userHash.matches(requestToken) {
 			return &authenticator.Response{User: nonAdminUser}, true, nil
 		}
 
+		if s.staticUsers != nil {
+			return s.staticUsers.AuthenticateToken(ctx, requestToken)
+		}
+
 		return nil, false, nil
 	}))))
 
 	config.Authentication.Authenticator = authenticatorunion.New(newAuthenticator, config.Authentication.Authenticator)
 
-	return volatileGcpAdminToken, volatileUserToken, nil
+	// the generated client certificates are long-lived, so those of removed
+	// or regrouped identities are ignored explicitly
+	if s.Credentials == AdminCredentialsClientCert || s.staticUsers != nil {
+		cas, err := certutil.CertsFromFile(s.ClientCAFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading client CA certificate file %q: %w", s.ClientCAFile, err)
+		}
+		config.Authentication.Authenticator = &clientCertFilter{
+			ca:       cas[0],
+			allowed:  s.allowsClientCert,
+			delegate: config.Authentication.Authenticator,
+		}
+	}
+
+	return tokens[gcpAdminUserName], tokens[gcpUserUserName], nil
+}
+
+// existingTokens returns the tokens handed out by a previous start: those of
+// the kubeconfig file or, if none is written, of the kubeconfig Secret in the
+// host cluster.
+func (s *AdminAuthentication) existingTokens() (map[string]string, error) {
+	if s.ShardAdminTokenHashFilePath == "" {
+		return nil, nil
+	}
+	if s.KubeConfigPath == "" && s.KubeConfigSecretNamespace != "" && s.KubeConfigSecretKubeConfig != "" {
+		return s.loadKubeConfigSecretTokens(context.Background())
+	}
+	return loadKubeConfigTokens(s.KubeConfigPath)
+}
+
+// allowsClientCert returns true if the given user and groups are a current
+// identity with a client certificate signed by the admin client CA. These are
+// the admin and the user, whose certificates gcp kubeconfig signs regardless
+// of the admin credentials, and the static users with a client certificate.
+func (s *AdminAuthentication) allowsClientCert(userName string, groups []string) bool {
+	switch {
+	case userName == gcpAdminUserName && slices.Equal(groups, []string{user.SystemPrivilegedGroup}):
+		return true
+	case userName == gcpUserUserName && len(groups) == 0:
+		return true
+	}
+	return s.staticUsers != nil && s.staticUsers.hasClientCert(userName, groups)
+}
+
+// clientCertFilter hides client certificates signed by the given CA whose user
+// and groups are not allowed from the delegate authenticator verifying them.
+// Other credentials of such requests, e.g. bearer tokens, are still
+// authenticated by the delegate.
+type clientCertFilter struct {
+	ca       *x509.Certificate
+	allowed  func(userName string, groups []string) bool
+	delegate authenticator.Request
+}
+
+var _ authenticator.Request = &clientCertFilter{}
+
+// AuthenticateRequest implements authenticator.Request.
+func (f *clientCertFilter) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert := req.TLS.PeerCertificates[0]
+		if cert.CheckSignatureFrom(f.ca) == nil && !f.allowed(cert.Subject.CommonName, cert.Subject.Organization) {
+			klog.V(4).InfoS("Ignoring client certificate which is no longer valid", "user", cert.Subject.CommonName, "groups", cert.Subject.Organization)
+			tlsState := *req.TLS
+			tlsState.PeerCertificates, tlsState.VerifiedChains = nil, nil
+			req = req.WithContext(req.Context())
+			req.TLS = &tlsState
+		}
+	}
+	return f.delegate.AuthenticateRequest(req)
 }
 
-// WriteKubeConfig writes the kubeconfig to the configured path.
+// WriteKubeConfig writes the kubeconfig to the configured path, if any.
 func (s *AdminAuthentication) WriteKubeConfig(config genericapiserver.CompletedConfig, gcpAdminToken, userToken string) error {
 	externalCACert, _ := config.SecureServing.Cert.CurrentCertKeyContent()
-	externalKubeConfigHost := fmt.Sprintf("https://%s", config.ExternalAddress)
 
-	externalKubeConfig := createKubeConfig(gcpAdminToken, userToken, externalKubeConfigHost, "", externalCACert)
-	return clientcmd.WriteToFile(*externalKubeConfig, s.KubeConfigPath)
+	adminAuthInfo, err := s.adminAuthInfo(gcpAdminToken)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := s.kubeConfigEndpoints(config.ExternalAddress, externalCACert)
+	if err != nil {
+		return err
+	}
+
+	s.newKubeConfig = func() (*clientcmdapi.Config, error) {
+		kubeConfig := createKubeConfig(adminAuthInfo, userToken, endpoints, externalCACert)
+		if s.staticUsers != nil {
+			if err := s.staticUsers.addAuthInfos(kubeConfig); err != nil {
+				return nil, err
+			}
+		}
+		addContexts(kubeConfig, endpoints)
+		return kubeConfig, nil
+	}
+	if s.staticUsers != nil {
+		// rewrite the kubeconfig when the static users change
+		s.staticUsers.setOnChange(s.writeKubeConfigFile)
+	}
+	return s.writeKubeConfigFile()
+}
+
+func (s *AdminAuthentication) writeKubeConfigFile() error {
+	if s.KubeConfigPath == "" {
+		return nil
+	}
+	kubeConfig, err := s.newKubeConfig()
+	if err != nil {
+		return err
+	}
+	return clientcmd.WriteToFile(*kubeConfig, s.KubeConfigPath)
+}
+
+// adminAuthInfo returns the admin credentials of the kubeconfig.
+func (s *AdminAuthentication) adminAuthInfo(gcpAdminToken string) (*clientcmdapi.AuthInfo, error) {
+	if s.Credentials != AdminCredentialsClientCert {
+		return &clientcmdapi.AuthInfo{Token: gcpAdminToken}, nil
+	}
+
+	cert, err := os.ReadFile(s.ClientCertFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(s.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &clientcmdapi.AuthInfo{ClientCertificateData: cert, ClientKeyData: key}, nil
 }
 
-func createKubeConfig(gcpAdminToken, userToken, baseHost, tlsServerName string, caData []byte) *clientcmdapi.Config {
+func createKubeConfig(adminAuthInfo *clientcmdapi.AuthInfo, userToken string, endpoints []kubeConfigEndpoint, caData []byte) *clientcmdapi.Config {
 	var kubeConfig clientcmdapi.Config
 	// Create Client and Shared
 	kubeConfig.AuthInfos = map[string]*clientcmdapi.AuthInfo{
-		gcpAdminUserName: {Token: gcpAdminToken},
+		gcpAdminUserName: adminAuthInfo,
 	}
-	kubeConfig.Clusters = map[string]*clientcmdapi.Cluster{
-		"root": {
-			Server:                   baseHost,
+	kubeConfig.Clusters = map[string]*clientcmdapi.Cluster{}
+	for i, endpoint := range endpoints {
+		kubeConfig.Clusters[endpoint.clusterName(i == 0)] = &clientcmdapi.Cluster{
+			Server:                   endpoint.Server,
 			CertificateAuthorityData: caData,
-			TLSServerName:            tlsServerName,
-		},
-	}
-	kubeConfig.Contexts = map[string]*clientcmdapi.Context{
-		"root": {Cluster: "root", AuthInfo: gcpAdminUserName},
+			TLSServerName:            endpoint.TLSServerName,
+		}
 	}
+	kubeConfig.Contexts = map[string]*clientcmdapi.Context{}
 	kubeConfig.CurrentContext = "root"
 
 	if len(userToken) > 0 {
 		kubeConfig.AuthInfos[gcpUserUserName] = &clientcmdapi.AuthInfo{Token: userToken}
-		kubeConfig.Contexts[gcpUserUserName] = &clientcmdapi.Context{Cluster: "root", AuthInfo: gcpUserUserName}
 	}
 
 	return &kubeConfig
 }
+
+// addContexts adds a context for every user of the kubeconfig and every
+// endpoint. The contexts of the first endpoint are named after the users,
+// "root" for the admin, the contexts of other endpoints are suffixed with
+// "@<endpoint>".
+func addContexts(kubeConfig *clientcmdapi.Config, endpoints []kubeConfigEndpoint) {
+	for name := range kubeConfig.AuthInfos {
+		base := name
+		if name == gcpAdminUserName {
+			base = "root"
+		}
+		for i, endpoint := range endpoints {
+			contextName := base
+			if i > 0 {
+				contextName = base + "@" + endpoint.Name
+			}
+			kubeConfig.Contexts[contextName] = &clientcmdapi.Context{Cluster: endpoint.clusterName(i == 0), AuthInfo: name}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func authenticate(t *testing.T, config *genericapiserver.Config, token string) (string, bool) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, ok, err := config.Authentication.Authenticator.AuthenticateRequest(req)
+	if err != nil || !ok {
+		return "", false
+	}
+	return resp.User.GetName(), true
+}
+
+func newAuthenticationConfig() *genericapiserver.Config {
+	config := &genericapiserver.Config{}
+	config.Authentication.Authenticator = authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+		return nil, false, nil
+	})
+	return config
+}
+
+func TestAdminAuthenticationCredentials(t *testing.T) {
+	rootDir := t.TempDir()
+
+	s := NewAdminAuthentication(rootDir)
+	if s.Credentials != AdminCredentialsToken {
+		t.Fatalf("default admin credentials are %q, want %q", s.Credentials, AdminCredentialsToken)
+	}
+	config := newAuthenticationConfig()
+	adminToken, userToken, err := s.ApplyTo(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adminToken == "" || userToken == "" {
+		t.Fatalf("expected admin and user tokens")
+	}
+	if name, ok := authenticate(t, config, adminToken); !ok || name != gcpAdminUserName {
+		t.Errorf("admin token authenticated as %q, %v", name, ok)
+	}
+	writeKubeConfigTokens(t, s.KubeConfigPath, map[string]string{gcpAdminUserName: adminToken, gcpUserUserName: userToken})
+
+	// with client certificates the admin token is dropped, the user token kept
+	s = NewAdminAuthentication(rootDir)
+	s.Credentials = AdminCredentialsClientCert
+	if err := ensureCA(s.ClientCAFile, s.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+		t.Fatal(err)
+	}
+	config = newAuthenticationConfig()
+	newAdminToken, newUserToken, err := s.ApplyTo(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newAdminToken != "" {
+		t.Errorf("admin token generated for client certificate credentials")
+	}
+	if newUserToken != userToken {
+		t.Errorf("user token was not reused")
+	}
+	if _, ok := authenticate(t, config, adminToken); ok {
+		t.Errorf("old admin token is still valid")
+	}
+	if name, ok := authenticate(t, config, userToken); !ok || name != gcpUserUserName {
+		t.Errorf("user token authenticated as %q, %v", name, ok)
+	}
+}
+
+func TestAdminAuthInfo(t *testing.T) {
+	rootDir := t.TempDir()
+	s := NewAdminAuthentication(rootDir)
+
+	authInfo, err := s.adminAuthInfo("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authInfo.Token != "token" || len(authInfo.ClientCertificateData) > 0 {
+		t.Errorf("unexpected token credentials %+v", authInfo)
+	}
+
+	s.Credentials = AdminCredentialsClientCert
+	if err := ensureCA(s.ClientCAFile, s.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureClientCert(s.ClientCAFile, s.ClientCAKeyFile, s.ClientCertFile, s.ClientKeyFile, gcpAdminUserName, []string{"system:masters"}); err != nil {
+		t.Fatal(err)
+	}
+	authInfo, err = s.adminAuthInfo("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authInfo.Token != "" || len(authInfo.ClientCertificateData) == 0 || len(authInfo.ClientKeyData) == 0 {
+		t.Errorf("unexpected client certificate credentials %+v", authInfo)
+	}
+
+	endpoints := []kubeConfigEndpoint{{Name: kubeConfigEndpointExternal, Server: "https://127.0.0.1:6443"}}
+	kubeConfig := createKubeConfig(authInfo, "user-token", endpoints, nil)
+	addContexts(kubeConfig, endpoints)
+	if err := clientcmd.Validate(*kubeConfig); err != nil {
+		t.Errorf("invalid kubeconfig: %v", err)
+	}
+	if kubeConfig.Contexts["root"].AuthInfo != gcpAdminUserName || kubeConfig.Contexts[gcpUserUserName].AuthInfo != gcpUserUserName {
+		t.Errorf("unexpected contexts %v", kubeConfig.Contexts)
+	}
+}
+
+func TestAdminAuthenticationIgnoresStaleClientCerts(t *testing.T) {
+	rootDir := t.TempDir()
+	s := NewAdminAuthentication(rootDir)
+	s.StaticUsersFile = filepath.Join(rootDir, "users.yaml")
+	writeUsers := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(s.StaticUsersFile, []byte(staticUsersHeader+data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeUsers("users:\n- name: carol\n  groups: [ops]\n  clientCertificate: true\n- name: dave\n  clientCertificate: true\n")
+	if err := ensureCA(s.ClientCAFile, s.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delegate stands in for the union of the x509 authenticator accepting
+	// every certificate and a token authenticator accepting "valid"
+	config := &genericapiserver.Config{PostStartHooks: map[string]genericapiserver.PostStartHookConfigEntry{}}
+	config.Authentication.Authenticator = authenticator.RequestFunc(func(req *http.Request) (*authenticator.Response, bool, error) {
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			return &authenticator.Response{User: &user.DefaultInfo{Name: req.TLS.PeerCertificates[0].Subject.CommonName}}, true, nil
+		}
+		if req.Header.Get("Authorization") == "Bearer valid" {
+			return &authenticator.Response{User: &user.DefaultInfo{Name: "token-user"}}, true, nil
+		}
+		return nil, false, nil
+	})
+	if _, _, err := s.ApplyTo(config); err != nil {
+		t.Fatal(err)
+	}
+
+	readCert := func(name string) *x509.Certificate {
+		t.Helper()
+		certFile, _ := s.staticUsers.clientCertFiles(name)
+		certs, err := certutil.CertsFromFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certs[0]
+	}
+	authenticateCert := func(cert *x509.Certificate, token string) (string, error) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		resp, ok, err := config.Authentication.Authenticator.AuthenticateRequest(req)
+		if err != nil || !ok {
+			return "", err
+		}
+		return resp.User.GetName(), nil
+	}
+	carol, dave := readCert("carol"), readCert("dave")
+
+	// a certificate of another CA is left to the delegate
+	otherCAFile, otherCAKeyFile := filepath.Join(rootDir, "other-ca.crt"), filepath.Join(rootDir, "other-ca.key")
+	if err := ensureCA(otherCAFile, otherCAKeyFile, "other-ca"); err != nil {
+		t.Fatal(err)
+	}
+	otherCertFile := filepath.Join(rootDir, "other.crt")
+	if err := ensureClientCert(otherCAFile, otherCAKeyFile, otherCertFile, filepath.Join(rootDir, "other.key"), "erin", nil); err != nil {
+		t.Fatal(err)
+	}
+	otherCerts, err := certutil.CertsFromFile(otherCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cert, want := range map[*x509.Certificate]string{carol: "carol", dave: "dave", otherCerts[0]: "erin"} {
+		if name, err := authenticateCert(cert, ""); err != nil || name != want {
+			t.Errorf("certificate of %q authenticated as %q: %v", want, name, err)
+		}
+	}
+
+	// carol is regrouped and dave removed, their old certificates are ignored
+	// while other credentials of the request are still authenticated
+	writeUsers("users:\n- name: carol\n  groups: [dev]\n  clientCertificate: true\n")
+	if changed, err := s.staticUsers.reload(); err != nil || !changed {
+		t.Fatalf("reload returned %v, %v", changed, err)
+	}
+	for _, cert := range []*x509.Certificate{carol, dave} {
+		if name, err := authenticateCert(cert, ""); err != nil || name != "" {
+			t.Errorf("stale certificate of %q authenticated as %q: %v", cert.Subject.CommonName, name, err)
+		}
+		if name, err := authenticateCert(cert, "valid"); err != nil || name != "token-user" {
+			t.Errorf("token with stale certificate of %q authenticated as %q: %v", cert.Subject.CommonName, name, err)
+		}
+	}
+	if name, err := authenticateCert(readCert("carol"), ""); err != nil || name != "carol" {
+		t.Errorf("new certificate of carol authenticated as %q: %v", name, err)
+	}
+
+	// the admin certificate is valid with token credentials, as gcp kubeconfig
+	// signs it, but not with other groups
+	if err := ensureClientCert(s.ClientCAFile, s.ClientCAKeyFile, s.ClientCertFile, s.ClientKeyFile, gcpAdminUserName, []string{user.SystemPrivilegedGroup}); err != nil {
+		t.Fatal(err)
+	}
+	adminCerts, err := certutil.CertsFromFile(s.ClientCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := authenticateCert(adminCerts[0], ""); err != nil || name != gcpAdminUserName {
+		t.Errorf("admin certificate authenticated as %q: %v", name, err)
+	}
+	regroupedFile := filepath.Join(rootDir, "regrouped.crt")
+	if err := ensureClientCert(s.ClientCAFile, s.ClientCAKeyFile, regroupedFile, filepath.Join(rootDir, "regrouped.key"), gcpUserUserName, []string{user.SystemPrivilegedGroup}); err != nil {
+		t.Fatal(err)
+	}
+	regroupedCerts, err := certutil.CertsFromFile(regroupedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := authenticateCert(regroupedCerts[0], ""); err != nil || name != "" {
+		t.Errorf("certificate of the user in group %s authenticated as %q: %v", user.SystemPrivilegedGroup, name, err)
+	}
+}
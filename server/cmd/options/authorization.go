@@ -0,0 +1,91 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+
+	authorizerunion "k8s.io/apiserver/pkg/authorization/union"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog/v2"
+
+	"github.com/kcp-dev/generic-controlplane/server/batteries"
+	"github.com/kcp-dev/generic-controlplane/server/policy"
+)
+
+// AuthorizationPolicy holds the configuration for the file-based policy
+// authorizer, used when the authorization battery is disabled.
+type AuthorizationPolicy struct {
+	// File is the policy file. The policy authorizer is only enabled if it
+	// exists at startup.
+	File string
+}
+
+// NewAuthorizationPolicy returns a new AuthorizationPolicy for the given root
+// directory where the policy file is read from.
+func NewAuthorizationPolicy(rootDir string) *AuthorizationPolicy {
+	return &AuthorizationPolicy{
+		File: filepath.Join(rootDir, "authorization-policy.yaml"),
+	}
+}
+
+// AddFlags adds the flags for the authorization policy to the given FlagSet.
+func (s *AuthorizationPolicy) AddFlags(fs *pflag.FlagSet) {
+	if s == nil {
+		return
+	}
+
+	fs.StringVar(&s.File, "authorization-policy-file", s.File, ""+
+		"Path to a YAML file of kind "+policy.Kind+" (apiVersion "+policy.APIVersion+") with rules allowing users and groups verbs on resources, "+
+		"optionally restricted by CEL expressions. If the file exists at startup and the authorization battery is disabled, requests not allowed "+
+		"by a rule are denied, except for system:masters. The file is reloaded on change.")
+}
+
+// ApplyTo inserts the policy authorizer in front of the authorizers of the
+// given config, if the policy file exists and the authorization battery is
+// disabled.
+func (s *AuthorizationPolicy) ApplyTo(config *genericapiserver.Config, completedBatteries batteries.CompletedOptions) error {
+	logger := klog.Background().WithValues("path", s.File)
+	if s.File == "" {
+		return nil
+	}
+	if _, err := os.Stat(s.File); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if completedBatteries.IsEnabled(batteries.BatteryAuthorization) {
+		logger.Info("Ignoring authorization policy file because the authorization battery is enabled")
+		return nil
+	}
+
+	authorizer, err := policy.NewAuthorizer(s.File)
+	if err != nil {
+		return err
+	}
+	config.Authorization.Authorizer = authorizerunion.New(authorizer, config.Authorization.Authorizer)
+	logger.Info("Enabled authorization policy")
+
+	return config.AddPostStartHook("gcp-authorization-policy-reloader", func(hookContext genericapiserver.PostStartHookContext) error {
+		go authorizer.Run(hookContext)
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+
+	"github.com/kcp-dev/generic-controlplane/server/bootstrapmanifests"
+)
+
+// BootstrapManifests holds the configuration of the manifests applied on startup.
+type BootstrapManifests struct {
+	// Directory holds the YAML and JSON manifests. Empty applies none.
+	Directory string
+}
+
+// NewBootstrapManifests returns a new BootstrapManifests with default parameters.
+func NewBootstrapManifests() *BootstrapManifests {
+	return &BootstrapManifests{}
+}
+
+// AddFlags adds the flags for the bootstrap manifests to the given FlagSet.
+func (s *BootstrapManifests) AddFlags(fs *pflag.FlagSet) {
+	if s == nil {
+		return
+	}
+
+	fs.StringVar(&s.Directory, "bootstrap-manifests", s.Directory, ""+
+		"Directory of YAML and JSON manifests, including its subdirectories, applied with server-side apply on every start. "+
+		"CustomResourceDefinitions are applied first and waited on until established, then namespaces, then all other objects. "+
+		"Failures are retried and reported by the bootstrap-manifests check of /readyz.")
+}
+
+// Validate validates the bootstrap manifests options.
+func (s *BootstrapManifests) Validate() []error {
+	var errs []error
+
+	if s.Directory != "" {
+		if info, err := os.Stat(s.Directory); err != nil {
+			errs = append(errs, fmt.Errorf("--bootstrap-manifests: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("--bootstrap-manifests %q must be a directory", s.Directory))
+		}
+	}
+
+	return errs
+}
+
+// ApplyTo returns the applier of the bootstrap manifests and adds its check
+// to the readyz checks of the given config. It returns nil if there is no
+// manifest directory.
+func (s *BootstrapManifests) ApplyTo(config *genericapiserver.Config) *bootstrapmanifests.Applier {
+	if s.Directory == "" {
+		return nil
+	}
+
+	applier := bootstrapmanifests.NewApplier(s.Directory)
+	config.ReadyzChecks = append(config.ReadyzChecks, applier)
+	return applier
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/kcp-dev/generic-controlplane/server/controllers/certificates"
+)
+
+// Certificates holds the configuration for the embedded CSR signer and approver
+// of the certificates battery.
+type Certificates struct {
+	// CAFile and CAKeyFile are the CA used to sign kube-apiserver-client
+	// certificates. They are generated if they do not exist.
+	CAFile    string
+	CAKeyFile string
+
+	// SigningDuration is the maximum duration of signed certificates.
+	SigningDuration time.Duration
+
+	// AutoApprovePolicy decides which CertificateSigningRequests are approved automatically.
+	AutoApprovePolicy string
+}
+
+// NewCertificates returns a new Certificates for the given root directory
+// where the signing CA is stored.
+func NewCertificates(rootDir string) *Certificates {
+	return &Certificates{
+		CAFile:            filepath.Join(rootDir, "csr-signer-ca.crt"),
+		CAKeyFile:         filepath.Join(rootDir, "csr-signer-ca.key"),
+		SigningDuration:   365 * 24 * time.Hour,
+		AutoApprovePolicy: string(certificates.ApprovePolicySelf),
+	}
+}
+
+// Validate validates the certificates configuration.
+func (s *Certificates) Validate() []error {
+	if s == nil {
+		return nil
+	}
+
+	errs := []error{}
+
+	if !certificates.ApprovePolicies.Has(s.AutoApprovePolicy) {
+		errs = append(errs, fmt.Errorf("invalid --certificates-auto-approve-policy %q, must be one of %s", s.AutoApprovePolicy, strings.Join(sets.List(certificates.ApprovePolicies), ", ")))
+	}
+	if s.SigningDuration <= 0 {
+		errs = append(errs, fmt.Errorf("--certificates-signing-duration must be positive"))
+	}
+
+	return errs
+}
+
+// AddFlags adds the flags for the certificates to the given FlagSet.
+func (s *Certificates) AddFlags(fs *pflag.FlagSet) {
+	if s == nil {
+		return
+	}
+
+	fs.StringVar(&s.CAFile, "certificates-ca-file", s.CAFile,
+		"Path to the CA certificate used to sign kube-apiserver-client CertificateSigningRequests. It is generated with --certificates-ca-key-file if it does not exist.")
+	fs.StringVar(&s.CAKeyFile, "certificates-ca-key-file", s.CAKeyFile,
+		"Path to the CA key used to sign kube-apiserver-client CertificateSigningRequests.")
+	fs.DurationVar(&s.SigningDuration, "certificates-signing-duration", s.SigningDuration,
+		"The maximum duration of certificates signed by the embedded signer.")
+	fs.StringVar(&s.AutoApprovePolicy, "certificates-auto-approve-policy", s.AutoApprovePolicy, fmt.Sprintf(
+		"The policy to approve kube-apiserver-client CertificateSigningRequests automatically. One of %s. "+
+			"'self' approves requests for the requesting user's own name and groups with an expirationSeconds of at most %s, "+
+			"except for ServiceAccounts and system: users.", strings.Join(sets.List(certificates.ApprovePolicies), ", "), certificates.MaxSelfExpiration))
+}
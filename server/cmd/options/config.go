@@ -30,6 +30,11 @@ import (
 	generatedopenapi "k8s.io/kubernetes/pkg/generated/openapi"
 
 	"github.com/kcp-dev/generic-controlplane/server/batteries"
+	"github.com/kcp-dev/generic-controlplane/server/bootstrapmanifests"
+	"github.com/kcp-dev/generic-controlplane/server/etcdcluster"
+	"github.com/kcp-dev/generic-controlplane/server/etcdmaintenance"
+	"github.com/kcp-dev/generic-controlplane/server/snapshot"
+	"github.com/kcp-dev/generic-controlplane/server/sqlstorage"
 )
 
 // Config holds the configuration for the generic controlplane server.
@@ -50,6 +55,16 @@ type ExtraConfig struct {
 	GcpAdminToken, UserToken string
 	// Batteries holds the batteries configuration for the generic controlplane server.
 	Batteries batteries.CompletedOptions
+	// SQLStorage serves the etcd API from a SQL database, if enabled.
+	SQLStorage *sqlstorage.Server
+	// EtcdSnapshotScheduler saves scheduled snapshots of the embedded etcd, if enabled.
+	EtcdSnapshotScheduler *snapshot.Scheduler
+	// EtcdMaintainer compacts and defragments the embedded etcd, if enabled.
+	EtcdMaintainer *etcdmaintenance.Maintainer
+	// EtcdQuorumChecker checks the quorum of the embedded etcd cluster, if it has multiple members.
+	EtcdQuorumChecker *etcdcluster.QuorumChecker
+	// BootstrapManifests applies the bootstrap manifests once the server is ready, if configured.
+	BootstrapManifests *bootstrapmanifests.Applier
 }
 
 type completedConfig struct {
@@ -100,6 +115,16 @@ func NewConfig(opts CompletedOptions) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := opts.EtcdCluster.ApplyToEmbeddedEtcd(c.EmbeddedEtcd.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SQLStorage.Enabled {
+		c.SQLStorage = sqlstorage.NewServer(sqlstorage.Config{
+			DataSource: opts.SQLStorage.DataSource,
+			Socket:     opts.SQLStorage.Socket,
+		})
 	}
 
 	genericConfig, versionedInformers, storageFactory, err := controlplaneapiserver.BuildGenericConfig(
@@ -111,6 +136,8 @@ func NewConfig(opts CompletedOptions) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	opts.Batteries.ApplyToResourceConfig(genericConfig.MergedResourceConfig)
+	opts.Batteries.ApplyTo(genericConfig)
 
 	// set standalone config
 	c.GcpAdminToken, c.UserToken, err = opts.AdminAuthentication.ApplyTo(genericConfig)
@@ -118,6 +145,26 @@ func NewConfig(opts CompletedOptions) (*Config, error) {
 		return nil, err
 	}
 
+	if err := opts.AuthorizationPolicy.ApplyTo(genericConfig, opts.Batteries); err != nil {
+		return nil, err
+	}
+	c.BootstrapManifests = opts.BootstrapManifests.ApplyTo(genericConfig)
+
+	if opts.EmbeddedEtcd.Enabled {
+		c.EtcdSnapshotScheduler, err = opts.EtcdSnapshots.ApplyTo(genericConfig, opts.GenericControlPlane.Etcd)
+		if err != nil {
+			return nil, err
+		}
+		c.EtcdMaintainer, err = opts.EtcdMaintenance.ApplyTo(genericConfig, opts.GenericControlPlane.Etcd, c.EmbeddedEtcd.QuotaBackendBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.EtcdQuorumChecker, err = opts.EtcdCluster.ApplyTo(genericConfig, opts.GenericControlPlane.Etcd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	serviceResolver := webhook.NewDefaultServiceResolver()
 	kubeAPIs, pluginInitializer, err := controlplaneapiserver.CreateConfig(opts.GenericControlPlane, genericConfig, versionedInformers, storageFactory, serviceResolver, nil)
 	if err != nil {
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+	etcdtypes "go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/klog/v2"
+
+	"github.com/kcp-dev/generic-controlplane/server/etcdcluster"
+)
+
+const (
+	// peerCertValidity is the validity of the peer certificates of the embedded etcd.
+	peerCertValidity = 365 * 24 * time.Hour
+	// peerCertRenewBefore is the remaining validity below which the peer
+	// certificate is renewed on start.
+	peerCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// EtcdCluster holds the configuration of an embedded etcd with multiple
+// members, each run by a gcp process.
+type EtcdCluster struct {
+	Enabled bool
+
+	// Name is the name of this member.
+	Name string
+	// InitialCluster is the comma separated list of name=peer-url of all
+	// members. Empty runs a single member.
+	InitialCluster string
+	// InitialClusterState is "new" for the members of a new cluster and
+	// "existing" for members added to a running cluster.
+	InitialClusterState string
+	// InitialClusterToken distinguishes clusters with the same peer URLs.
+	InitialClusterToken string
+
+	// PeerCAFile and PeerCAKeyFile are the CA shared by all members, which
+	// signs the peer certificates.
+	PeerCAFile    string
+	PeerCAKeyFile string
+}
+
+// NewEtcdCluster returns a new EtcdCluster with default parameters for the
+// given root directory.
+func NewEtcdCluster(rootDir string) *EtcdCluster {
+	return &EtcdCluster{
+		Name:                embed.DefaultName,
+		InitialClusterState: embed.ClusterStateFlagNew,
+		InitialClusterToken: "gcp",
+		PeerCAFile:          filepath.Join(rootDir, "etcd-peer-ca.crt"),
+		PeerCAKeyFile:       filepath.Join(rootDir, "etcd-peer-ca.key"),
+	}
+}
+
+// AddFlags adds the flags for the embedded etcd cluster to the given FlagSet.
+func (c *EtcdCluster) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Name, "embedded-etcd-name", c.Name, "Name of this member of the embedded etcd cluster.")
+	fs.StringVar(&c.InitialCluster, "embedded-etcd-initial-cluster", c.InitialCluster, ""+
+		"Comma separated name=https://host:port peer URLs of the members of the embedded etcd cluster, including this one. "+
+		"Empty runs a single member. The members connect with certificates signed by --embedded-etcd-peer-ca-file.")
+	fs.StringVar(&c.InitialClusterState, "embedded-etcd-initial-cluster-state", c.InitialClusterState,
+		"State of the embedded etcd cluster this member starts in, new or existing for members added with 'gcp member add'.")
+	fs.StringVar(&c.InitialClusterToken, "embedded-etcd-initial-cluster-token", c.InitialClusterToken,
+		"Token of the embedded etcd cluster, unique among clusters with the same peers.")
+	fs.StringVar(&c.PeerCAFile, "embedded-etcd-peer-ca-file", c.PeerCAFile,
+		"CA certificate shared by the members of the embedded etcd cluster. It is generated if it does not exist.")
+	fs.StringVar(&c.PeerCAKeyFile, "embedded-etcd-peer-ca-key-file", c.PeerCAKeyFile,
+		"CA key shared by the members of the embedded etcd cluster. It is generated if it does not exist.")
+}
+
+// Complete enables the cluster if the embedded etcd is enabled and has an
+// initial cluster, and generates the peer CA if it does not exist.
+func (c *EtcdCluster) Complete(embeddedEtcd bool) error {
+	c.Enabled = embeddedEtcd && c.InitialCluster != ""
+	if !c.Enabled {
+		return nil
+	}
+
+	var err error
+	for _, path := range []*string{&c.PeerCAFile, &c.PeerCAKeyFile} {
+		if *path, err = filepath.Abs(*path); err != nil {
+			return err
+		}
+	}
+	return ensureCA(c.PeerCAFile, c.PeerCAKeyFile, "gcp-etcd-peer-ca")
+}
+
+// Validate validates the embedded etcd cluster options.
+func (c *EtcdCluster) Validate() []error {
+	var errs []error
+
+	if c.Name == "" {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-name must be specified"))
+	}
+	if c.InitialClusterState != embed.ClusterStateFlagNew && c.InitialClusterState != embed.ClusterStateFlagExisting {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-initial-cluster-state must be %s or %s", embed.ClusterStateFlagNew, embed.ClusterStateFlagExisting))
+	}
+	if c.InitialCluster != "" {
+		members, err := etcdtypes.NewURLsMap(c.InitialCluster)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("--embedded-etcd-initial-cluster parse failure: %w", err))
+			return errs
+		}
+		if _, ok := members[c.Name]; !ok {
+			errs = append(errs, fmt.Errorf("--embedded-etcd-initial-cluster must contain this member %q", c.Name))
+		}
+		for name, urls := range members {
+			for _, u := range urls {
+				if u.Scheme != "https" {
+					errs = append(errs, fmt.Errorf("--embedded-etcd-initial-cluster peer URL %q of member %q must be https", u.String(), name))
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// ApplyToEmbeddedEtcd makes the given embedded etcd config a member of the
+// cluster, serving its peers at its URLs of the initial cluster with a
+// certificate signed by the peer CA.
+func (c *EtcdCluster) ApplyToEmbeddedEtcd(config *embed.Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	if err := c.applyMembership(config); err != nil {
+		return err
+	}
+	peerURLs := etcdtypes.URLs(config.AdvertisePeerUrls)
+
+	hosts := make([]string, 0, len(peerURLs))
+	for _, u := range peerURLs {
+		hosts = append(hosts, u.Hostname())
+	}
+	certFile := filepath.Join(config.Dir, "secrets", "cluster-peer", "cert.pem")
+	keyFile := filepath.Join(config.Dir, "secrets", "cluster-peer", "key.pem")
+	if err := ensurePeerCert(c.PeerCAFile, c.PeerCAKeyFile, certFile, keyFile, c.Name, hosts); err != nil {
+		return fmt.Errorf("error ensuring embedded etcd peer certificate: %w", err)
+	}
+	klog.Background().Info("joining embedded etcd cluster", "name", c.Name, "peerURLs", peerURLs.String(), "state", c.InitialClusterState)
+
+	// peers verify each other by the hosts of their URLs
+	config.PeerTLSInfo.ServerName = ""
+	config.PeerTLSInfo.CertFile = certFile
+	config.PeerTLSInfo.KeyFile = keyFile
+	config.PeerTLSInfo.TrustedCAFile = c.PeerCAFile
+	config.PeerTLSInfo.ClientCertAuth = true
+	return nil
+}
+
+// applyMembership sets the name, the initial cluster and the peer URLs of the
+// member to the given embedded etcd config.
+func (c *EtcdCluster) applyMembership(config *embed.Config) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	members, err := etcdtypes.NewURLsMap(c.InitialCluster)
+	if err != nil {
+		return err
+	}
+	peerURLs := members[c.Name]
+
+	config.Name = c.Name
+	config.InitialCluster = c.InitialCluster
+	config.ClusterState = c.InitialClusterState
+	config.InitialClusterToken = c.InitialClusterToken
+	config.ListenPeerUrls = []url.URL(peerURLs)
+	config.AdvertisePeerUrls = []url.URL(peerURLs)
+	return nil
+}
+
+// ApplyTo returns the quorum checker of the embedded etcd cluster with the
+// given etcd options, and adds it to the readyz checks of the given config.
+// It returns nil if the cluster is disabled.
+func (c *EtcdCluster) ApplyTo(config *genericapiserver.Config, etcdOptions *genericoptions.EtcdOptions) (*etcdcluster.QuorumChecker, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	clientConfig, err := embeddedEtcdClientConfig(etcdOptions.StorageConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	checker := etcdcluster.NewQuorumChecker(clientConfig)
+	config.ReadyzChecks = append(config.ReadyzChecks, checker)
+	return checker, nil
+}
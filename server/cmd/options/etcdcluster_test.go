@@ -0,0 +1,190 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// freePeerURL returns a https URL of a free local port.
+func freePeerURL(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "https://" + l.Addr().String()
+}
+
+func TestEtcdClusterThreeMembers(t *testing.T) {
+	names := []string{"gcp-0", "gcp-1", "gcp-2"}
+	members := make([]string, 0, len(names))
+	for _, name := range names {
+		members = append(members, name+"="+freePeerURL(t))
+	}
+	initialCluster := strings.Join(members, ",")
+
+	// the first member generates the peer CA, which is copied to the others
+	rootDirs := make([]string, 0, len(names))
+	for range names {
+		rootDirs = append(rootDirs, t.TempDir())
+	}
+	configs := make([]*embed.Config, 0, len(names))
+	for i, name := range names {
+		if i > 0 {
+			for _, file := range []string{"etcd-peer-ca.crt", "etcd-peer-ca.key"} {
+				data, err := os.ReadFile(filepath.Join(rootDirs[0], file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(rootDirs[i], file), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		c := NewEtcdCluster(rootDirs[i])
+		c.Name = name
+		c.InitialCluster = initialCluster
+		if errs := c.Validate(); len(errs) > 0 {
+			t.Fatalf("unexpected validation errors: %v", errs)
+		}
+		if err := c.Complete(true); err != nil {
+			t.Fatal(err)
+		}
+
+		config := embed.NewConfig()
+		config.Dir = filepath.Join(rootDirs[i], "etcd-server")
+		config.LogLevel = "error"
+		clientURL, err := url.Parse("http://127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ListenClientUrls = []url.URL{*clientURL}
+		config.AdvertiseClientUrls = []url.URL{*clientURL}
+		if err := c.ApplyToEmbeddedEtcd(config); err != nil {
+			t.Fatal(err)
+		}
+
+		// a restart keeps the valid peer certificate
+		cert, err := os.ReadFile(config.PeerTLSInfo.CertFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.ApplyToEmbeddedEtcd(config); err != nil {
+			t.Fatal(err)
+		}
+		if kept, _ := os.ReadFile(config.PeerTLSInfo.CertFile); string(kept) != string(cert) {
+			t.Errorf("valid peer certificate of %q was regenerated", name)
+		}
+		configs = append(configs, config)
+	}
+
+	// the members wait for each other, so they are started concurrently
+	errCh := make(chan error, len(configs))
+	etcds := make([]*embed.Etcd, len(configs))
+	for i, config := range configs {
+		go func() {
+			e, err := embed.StartEtcd(config)
+			if err != nil {
+				errCh <- fmt.Errorf("starting %q: %w", config.Name, err)
+				return
+			}
+			etcds[i] = e
+			select {
+			case <-e.Server.ReadyNotify():
+				errCh <- nil
+			case <-time.After(wait.ForeverTestTimeout):
+				errCh <- fmt.Errorf("%q did not become ready", config.Name)
+			}
+		}()
+	}
+	for range configs {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, e := range etcds {
+			if e != nil {
+				e.Close()
+			}
+		}
+	})
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	clients := make([]*clientv3.Client, 0, len(etcds))
+	for _, e := range etcds {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   []string{"http://" + e.Clients[0].Addr().String()},
+			DialTimeout: 5 * time.Second,
+			Logger:      zap.NewNop(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		clients = append(clients, client)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	resp, err := clients[0].MemberList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range resp.Members {
+		got = append(got, m.Name)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, names) {
+		t.Errorf("unexpected members %v, want %v", got, names)
+	}
+
+	// a write through one member is read through the others
+	if _, err := clients[0].Put(ctx, "/registry/key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i, client := range clients[1:] {
+		get, err := client.Get(ctx, "/registry/key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(get.Kvs) != 1 || string(get.Kvs[0].Value) != "value" {
+			t.Errorf("member %q did not return the written key", names[i+1])
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/server/v3/storage"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+
+	"github.com/kcp-dev/generic-controlplane/server/etcdmaintenance"
+)
+
+// EtcdMaintenance holds the configuration of the compaction, defragmentation
+// and NOSPACE alarm handling of the embedded etcd.
+type EtcdMaintenance struct {
+	// Interval is the interval between maintenance runs. Zero disables them.
+	Interval time.Duration
+	// RetainedRevisions is the number of revisions kept by compactions. Zero,
+	// the default, leaves compactions to the API server.
+	RetainedRevisions int64
+	// DefragThreshold is the fraction of unused space of the database above
+	// which it is defragmented.
+	DefragThreshold float64
+	// DefragMinSizeBytes is the database size below which it is not defragmented.
+	DefragMinSizeBytes int64
+}
+
+// NewEtcdMaintenance returns a new EtcdMaintenance with default parameters.
+func NewEtcdMaintenance() *EtcdMaintenance {
+	return &EtcdMaintenance{
+		Interval:           10 * time.Minute,
+		DefragThreshold:    0.5,
+		DefragMinSizeBytes: 64 * 1024 * 1024,
+	}
+}
+
+// AddFlags adds the flags for the embedded etcd maintenance to the given FlagSet.
+func (s *EtcdMaintenance) AddFlags(fs *pflag.FlagSet) {
+	if s == nil {
+		return
+	}
+
+	fs.DurationVar(&s.Interval, "embedded-etcd-maintenance-interval", s.Interval, ""+
+		"Interval of the compaction and defragmentation of the embedded etcd. NOSPACE alarms trigger them right away and are "+
+		"cleared once there is space again. Zero disables the maintenance.")
+	fs.Int64Var(&s.RetainedRevisions, "embedded-etcd-compaction-retained-revisions", s.RetainedRevisions,
+		"Number of revisions of the embedded etcd kept by additional compactions. Zero leaves compactions to the API server, see --etcd-compaction-interval.")
+	fs.Float64Var(&s.DefragThreshold, "embedded-etcd-defrag-threshold", s.DefragThreshold,
+		"Fraction of unused space of the embedded etcd database above which it is defragmented. Defragmentation blocks the embedded etcd shortly.")
+	fs.Int64Var(&s.DefragMinSizeBytes, "embedded-etcd-defrag-min-size-bytes", s.DefragMinSizeBytes,
+		"Size of the embedded etcd database below which it is not defragmented.")
+}
+
+// Validate validates the embedded etcd maintenance options.
+func (s *EtcdMaintenance) Validate() []error {
+	var errs []error
+
+	if s.Interval < 0 {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-maintenance-interval must not be negative"))
+	}
+	if s.RetainedRevisions < 0 {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-compaction-retained-revisions must not be negative"))
+	}
+	if s.DefragThreshold <= 0 || s.DefragThreshold > 1 {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-defrag-threshold must be in (0, 1]"))
+	}
+	if s.DefragMinSizeBytes < 0 {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-defrag-min-size-bytes must not be negative"))
+	}
+
+	return errs
+}
+
+// ApplyTo returns the maintainer of the embedded etcd with the given etcd
+// options and backend quota, and adds its NOSPACE check to the readyz checks
+// of the given config. It returns nil if the maintenance is disabled.
+func (s *EtcdMaintenance) ApplyTo(config *genericapiserver.Config, etcdOptions *genericoptions.EtcdOptions, quotaBackendBytes int64) (*etcdmaintenance.Maintainer, error) {
+	if s.Interval == 0 {
+		return nil, nil
+	}
+	if quotaBackendBytes <= 0 {
+		quotaBackendBytes = storage.DefaultQuotaBytes
+	}
+
+	clientConfig, err := embeddedEtcdClientConfig(etcdOptions.StorageConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	maintainer := etcdmaintenance.NewMaintainer(clientConfig, etcdmaintenance.Policy{
+		Interval:           s.Interval,
+		RetainedRevisions:  s.RetainedRevisions,
+		DefragThreshold:    s.DefragThreshold,
+		DefragMinSizeBytes: s.DefragMinSizeBytes,
+		QuotaBackendBytes:  quotaBackendBytes,
+	})
+	config.ReadyzChecks = append(config.ReadyzChecks, maintainer)
+	return maintainer, nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestEtcdMaintenanceCompactionOptIn(t *testing.T) {
+	s := NewEtcdMaintenance()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	s.AddFlags(fs)
+	if s.RetainedRevisions != 0 {
+		t.Errorf("compactions are enabled by default with %d retained revisions", s.RetainedRevisions)
+	}
+	if errs := s.Validate(); len(errs) != 0 {
+		t.Errorf("defaults are invalid: %v", errs)
+	}
+
+	if err := fs.Parse([]string{"--embedded-etcd-compaction-retained-revisions=1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.RetainedRevisions != 1000 {
+		t.Errorf("RetainedRevisions = %d, want 1000", s.RetainedRevisions)
+	}
+
+	s.RetainedRevisions = -1
+	if errs := s.Validate(); len(errs) != 1 {
+		t.Errorf("expected one error for negative retained revisions, got %v", errs)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+
+	"github.com/kcp-dev/generic-controlplane/server/snapshot"
+)
+
+// EtcdSnapshots holds the configuration of the scheduled snapshots of the
+// embedded etcd.
+type EtcdSnapshots struct {
+	// Directory is the directory of the compressed, timestamped snapshots.
+	Directory string
+	// Interval is the interval between snapshots. Zero disables them.
+	Interval time.Duration
+	// Retention is the number of snapshots to keep.
+	Retention int
+}
+
+// NewEtcdSnapshots returns a new EtcdSnapshots for the given root directory.
+func NewEtcdSnapshots(rootDir string) *EtcdSnapshots {
+	return &EtcdSnapshots{
+		Directory: filepath.Join(rootDir, "snapshots"),
+		Retention: 7,
+	}
+}
+
+// AddFlags adds the flags for the scheduled snapshots to the given FlagSet.
+func (s *EtcdSnapshots) AddFlags(fs *pflag.FlagSet) {
+	if s == nil {
+		return
+	}
+
+	fs.DurationVar(&s.Interval, "embedded-etcd-snapshot-interval", s.Interval, ""+
+		"Interval of the scheduled snapshots of the embedded etcd. Zero disables them. If snapshots stop succeeding "+
+		"for two intervals, the etcd-snapshots check of /healthz fails.")
+	fs.IntVar(&s.Retention, "embedded-etcd-snapshot-retention", s.Retention, "Number of scheduled snapshots of the embedded etcd to keep.")
+	fs.StringVar(&s.Directory, "embedded-etcd-snapshot-directory", s.Directory, "Directory of the scheduled snapshots of the embedded etcd.")
+}
+
+// Validate validates the scheduled snapshot options.
+func (s *EtcdSnapshots) Validate() []error {
+	var errs []error
+
+	if s.Interval < 0 {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-snapshot-interval must not be negative"))
+	}
+	if s.Interval > 0 {
+		if s.Retention < 1 {
+			errs = append(errs, fmt.Errorf("--embedded-etcd-snapshot-retention must be at least 1"))
+		}
+		if s.Directory == "" {
+			errs = append(errs, fmt.Errorf("--embedded-etcd-snapshot-directory must be specified"))
+		}
+	}
+
+	return errs
+}
+
+// ApplyTo returns the scheduler of the snapshots of the embedded etcd with the
+// given etcd options, and adds its health check to the given config. It
+// returns nil if the scheduled snapshots are disabled.
+func (s *EtcdSnapshots) ApplyTo(config *genericapiserver.Config, etcdOptions *genericoptions.EtcdOptions) (*snapshot.Scheduler, error) {
+	if s.Interval == 0 {
+		return nil, nil
+	}
+
+	clientConfig, err := embeddedEtcdClientConfig(etcdOptions.StorageConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	scheduler := snapshot.NewScheduler(clientConfig, s.Directory, s.Interval, s.Retention)
+	// only /healthz, a failing backup must not restart or unready the server
+	config.HealthzChecks = append(config.HealthzChecks, scheduler)
+	return scheduler, nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// KubeConfigIdentityAdmin is the gcp admin in the system:masters group.
+	KubeConfigIdentityAdmin = "admin"
+	// KubeConfigIdentityUser is the non-admin "user" identity.
+	KubeConfigIdentityUser = "user"
+
+	// minServiceAccountTokenExpiration is the minimum expiration accepted by the TokenRequest API.
+	minServiceAccountTokenExpiration = 10 * time.Minute
+)
+
+// KubeConfigOptions holds the configuration of the kubeconfig command, which
+// mints credentials for the admin, the "user" identity or a ServiceAccount.
+type KubeConfigOptions struct {
+	// KubeConfig is the kubeconfig of the running server, used for its
+	// endpoint and for ServiceAccount tokens.
+	KubeConfig string
+	Context    string
+
+	// Server and ServingCAFile override the endpoint and the CA of the written kubeconfig.
+	Server        string
+	ServingCAFile string
+
+	// ClientCAFile and ClientCAKeyFile are the CA signing the client
+	// certificates of the admin and the user, without a running server.
+	ClientCAFile    string
+	ClientCAKeyFile string
+
+	Identity       string
+	ServiceAccount string
+	Expiration     time.Duration
+	Audiences      []string
+
+	// Output is the file the kubeconfig is written to. Empty means stdout.
+	Output string
+}
+
+// NewKubeConfigOptions returns a new KubeConfigOptions for the given root directory.
+func NewKubeConfigOptions(rootDir string) *KubeConfigOptions {
+	return &KubeConfigOptions{
+		KubeConfig:      filepath.Join(rootDir, "admin.kubeconfig"),
+		Context:         "root",
+		ServingCAFile:   filepath.Join(rootDir, "apiserver.crt"),
+		ClientCAFile:    filepath.Join(rootDir, "client-ca.crt"),
+		ClientCAKeyFile: filepath.Join(rootDir, "client-ca.key"),
+		Identity:        KubeConfigIdentityAdmin,
+		Expiration:      24 * time.Hour,
+	}
+}
+
+// AddFlags adds the flags for the kubeconfig command to the given FlagSet.
+func (o *KubeConfigOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.KubeConfig, "kubeconfig", o.KubeConfig,
+		"The kubeconfig of the running server. It is used for the server endpoint, to request ServiceAccount tokens, "+
+			"and for the token of --identity if the server does not trust --client-ca-file.")
+	fs.StringVar(&o.Context, "context", o.Context, "The context of --kubeconfig to use.")
+	fs.StringVar(&o.Server, "server", o.Server, "The server URL of the written kubeconfig. Defaults to the server of --kubeconfig.")
+	fs.StringVar(&o.ServingCAFile, "serving-ca-file", o.ServingCAFile,
+		"The CA of the serving certificate. If it does not exist, the CA of --kubeconfig is used.")
+	fs.StringVar(&o.ClientCAFile, "client-ca-file", o.ClientCAFile,
+		"The client CA signing the client certificates of the admin and the user. It must be trusted by the server.")
+	fs.StringVar(&o.ClientCAKeyFile, "client-ca-key-file", o.ClientCAKeyFile, "The key of --client-ca-file.")
+	fs.StringVar(&o.Identity, "identity", o.Identity, fmt.Sprintf(
+		"The identity to write a kubeconfig for, '%s' or '%s'. They get a client certificate signed by --client-ca-file, without a running server, "+
+			"or their token of --kubeconfig if the server does not trust the client CA, e.g. with the default token credentials. "+
+			"--expiration does not apply to tokens.",
+		KubeConfigIdentityAdmin, KubeConfigIdentityUser))
+	fs.StringVar(&o.ServiceAccount, "serviceaccount", o.ServiceAccount,
+		"A ServiceAccount '<namespace>/<name>' to write a kubeconfig for instead of --identity. Its token is requested from the running server.")
+	fs.DurationVar(&o.Expiration, "expiration", o.Expiration, "The validity of the client certificate or ServiceAccount token.")
+	fs.StringSliceVar(&o.Audiences, "audience", o.Audiences, "The audiences of the ServiceAccount token. Defaults to the API server audiences.")
+	fs.StringVarP(&o.Output, "output", "o", o.Output, "The file to write the kubeconfig to. Defaults to stdout.")
+}
+
+// Validate validates the kubeconfig command options.
+func (o *KubeConfigOptions) Validate() []error {
+	var errs []error
+
+	if o.ServiceAccount != "" {
+		if namespace, name, ok := strings.Cut(o.ServiceAccount, "/"); !ok || namespace == "" || name == "" {
+			errs = append(errs, fmt.Errorf("invalid --serviceaccount %q, expected <namespace>/<name>", o.ServiceAccount))
+		}
+		if o.Expiration < minServiceAccountTokenExpiration {
+			errs = append(errs, fmt.Errorf("--expiration must be at least %s for ServiceAccount tokens", minServiceAccountTokenExpiration))
+		}
+	} else {
+		if o.Identity != KubeConfigIdentityAdmin && o.Identity != KubeConfigIdentityUser {
+			errs = append(errs, fmt.Errorf("invalid --identity %q, must be one of %s, %s", o.Identity, KubeConfigIdentityAdmin, KubeConfigIdentityUser))
+		}
+		if o.Expiration <= 0 {
+			errs = append(errs, fmt.Errorf("--expiration must be positive"))
+		}
+		if len(o.Audiences) > 0 {
+			errs = append(errs, fmt.Errorf("--audience requires --serviceaccount"))
+		}
+	}
+
+	return errs
+}
+
+// Run writes the kubeconfig.
+func (o *KubeConfigOptions) Run(ctx context.Context) error {
+	source, err := clientcmd.LoadFromFile(o.KubeConfig)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	cluster := &clientcmdapi.Cluster{Server: o.Server}
+	if source != nil {
+		if sourceContext, ok := source.Contexts[o.Context]; ok {
+			if sourceCluster, ok := source.Clusters[sourceContext.Cluster]; ok {
+				cluster = sourceCluster.DeepCopy()
+				if o.Server != "" {
+					cluster.Server = o.Server
+				}
+			}
+		}
+	}
+	if caData, err := os.ReadFile(o.ServingCAFile); err == nil {
+		cluster.CertificateAuthorityData = caData
+		cluster.CertificateAuthority = ""
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if cluster.Server == "" {
+		return fmt.Errorf("no server found in context %q of %q, use --server", o.Context, o.KubeConfig)
+	}
+
+	var userName string
+	var authInfo *clientcmdapi.AuthInfo
+	if o.ServiceAccount != "" {
+		userName, authInfo, err = o.serviceAccountAuthInfo(ctx)
+	} else {
+		userName, authInfo, err = o.identityAuthInfo(source, cluster)
+	}
+	if err != nil {
+		return err
+	}
+
+	contextName := userName
+	if o.ServiceAccount == "" && o.Identity == KubeConfigIdentityAdmin {
+		contextName = "root"
+	}
+	kubeConfig := clientcmdapi.Config{
+		Clusters:       map[string]*clientcmdapi.Cluster{"root": cluster},
+		AuthInfos:      map[string]*clientcmdapi.AuthInfo{userName: authInfo},
+		Contexts:       map[string]*clientcmdapi.Context{contextName: {Cluster: "root", AuthInfo: userName}},
+		CurrentContext: contextName,
+	}
+
+	if o.Output != "" {
+		return clientcmd.WriteToFile(kubeConfig, o.Output)
+	}
+	data, err := clientcmd.Write(kubeConfig)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// identityAuthInfo returns a client certificate of the admin or the user, or
+// their token of the given server kubeconfig if the server does not use the
+// client CA.
+func (o *KubeConfigOptions) identityAuthInfo(source *clientcmdapi.Config, cluster *clientcmdapi.Cluster) (string, *clientcmdapi.AuthInfo, error) {
+	userName, authInfo, err := o.clientCertAuthInfo(cluster)
+	if !errors.Is(err, errClientCAUnused) {
+		return userName, authInfo, err
+	}
+
+	userName = gcpUserUserName
+	if o.Identity == KubeConfigIdentityAdmin {
+		userName = gcpAdminUserName
+	}
+	if source == nil || source.AuthInfos[userName] == nil || source.AuthInfos[userName].Token == "" {
+		return "", nil, err
+	}
+	klog.Background().Info("The server does not use the client CA, using the token of the kubeconfig without expiration", "user", userName, "kubeconfig", o.KubeConfig)
+	return userName, &clientcmdapi.AuthInfo{Token: source.AuthInfos[userName].Token}, nil
+}
+
+// clientCertAuthInfo returns a client certificate of the admin or the user.
+// If the server of the given cluster is reachable, it must trust the client CA,
+// otherwise an error wrapping errClientCAUnused is returned.
+func (o *KubeConfigOptions) clientCertAuthInfo(cluster *clientcmdapi.Cluster) (string, *clientcmdapi.AuthInfo, error) {
+	userName, groups := gcpUserUserName, []string(nil)
+	if o.Identity == KubeConfigIdentityAdmin {
+		userName, groups = gcpAdminUserName, []string{user.SystemPrivilegedGroup}
+	}
+
+	cas, err := certutil.CertsFromFile(o.ClientCAFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, fmt.Errorf("client CA file %q does not exist: %w", o.ClientCAFile, errClientCAUnused)
+	} else if err != nil {
+		return "", nil, fmt.Errorf("error reading client CA file %q: %w", o.ClientCAFile, err)
+	}
+	if err := checkClientCATrusted(cluster, cas[0]); err != nil {
+		return "", nil, err
+	}
+	cert, key, err := signClientCert(cas[0], o.ClientCAKeyFile, userName, groups, o.Expiration)
+	if err != nil {
+		return "", nil, err
+	}
+	return userName, &clientcmdapi.AuthInfo{ClientCertificateData: cert, ClientKeyData: key}, nil
+}
+
+// errClientCAUnused explains when the server has a client CA for the admin and the user.
+var errClientCAUnused = errors.New("the server only trusts client certificates of the admin and the user when started with " +
+	"--authentication-admin-credentials=client-cert or --authentication-static-users-file, " +
+	"and --kubeconfig has no token of the identity. Use --serviceaccount instead")
+
+// checkClientCATrusted checks that the server of the given cluster requests
+// client certificates signed by the given CA. The CAs accepted by the server
+// are part of its TLS handshake. A server which is not reachable is not checked.
+func checkClientCATrusted(cluster *clientcmdapi.Cluster, ca *x509.Certificate) error {
+	u, err := url.Parse(cluster.Server)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	tlsConfig, err := rest.TLSConfigFor(&rest.Config{TLSClientConfig: rest.TLSClientConfig{
+		Insecure:   cluster.InsecureSkipTLSVerify,
+		ServerName: cluster.TLSServerName,
+		CAFile:     cluster.CertificateAuthority,
+		CAData:     cluster.CertificateAuthorityData,
+	}})
+	if err != nil || tlsConfig == nil {
+		return nil
+	}
+
+	trusted := false
+	tlsConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		for _, subject := range info.AcceptableCAs {
+			if bytes.Equal(subject, ca.RawSubject) {
+				trusted = true
+			}
+		}
+		return &tls.Certificate{}, nil
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", host, tlsConfig)
+	if err != nil {
+		klog.V(2).InfoS("Not checking the client CA of the server", "server", cluster.Server, "err", err)
+		return nil
+	}
+	conn.Close()
+
+	if !trusted {
+		return fmt.Errorf("the server at %s does not trust the client CA %q: %w", cluster.Server, ca.Subject.CommonName, errClientCAUnused)
+	}
+	return nil
+}
+
+// serviceAccountAuthInfo returns a ServiceAccount token requested from the running server.
+func (o *KubeConfigOptions) serviceAccountAuthInfo(ctx context.Context) (string, *clientcmdapi.AuthInfo, error) {
+	namespace, name, _ := strings.Cut(o.ServiceAccount, "/")
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: o.KubeConfig},
+		&clientcmd.ConfigOverrides{CurrentContext: o.Context},
+	).ClientConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	expirationSeconds := int64(o.Expiration / time.Second)
+	tokenRequest, err := client.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         o.Audiences,
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to request a token for ServiceAccount %s: %w", o.ServiceAccount, err)
+	}
+	return serviceaccount.MakeUsername(namespace, name), &clientcmdapi.AuthInfo{Token: tokenRequest.Status.Token}, nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	x509request "k8s.io/apiserver/pkg/authentication/request/x509"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func TestClientCertAuthInfoWithoutClientCA(t *testing.T) {
+	o := NewKubeConfigOptions(t.TempDir())
+	o.Identity = KubeConfigIdentityUser
+
+	_, _, err := o.clientCertAuthInfo(&clientcmdapi.Cluster{Server: "https://127.0.0.1:1"})
+	if err == nil || !strings.Contains(err.Error(), "--authentication-admin-credentials=client-cert") {
+		t.Errorf("expected an error explaining the missing client CA, got %v", err)
+	}
+}
+
+func TestIdentityAuthInfoWithTokens(t *testing.T) {
+	untrustingServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(untrustingServer.Close)
+	unreachable := &clientcmdapi.Cluster{Server: "https://127.0.0.1:1"}
+	untrusting := &clientcmdapi.Cluster{
+		Server:                   untrustingServer.URL,
+		CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: untrustingServer.Certificate().Raw}),
+	}
+
+	tests := []struct {
+		name string
+		// tokenUsers are the users with a token in the server kubeconfig
+		tokenUsers []string
+		clientCA   bool
+		cluster    *clientcmdapi.Cluster
+		identity   string
+		wantUser   string
+		wantToken  bool
+		wantErr    string
+	}{
+		{name: "default admin", tokenUsers: []string{gcpUserUserName, gcpAdminUserName}, cluster: unreachable, identity: KubeConfigIdentityAdmin, wantUser: gcpAdminUserName, wantToken: true},
+		{name: "default user", tokenUsers: []string{gcpUserUserName, gcpAdminUserName}, cluster: unreachable, identity: KubeConfigIdentityUser, wantUser: gcpUserUserName, wantToken: true},
+		{name: "untrusted client CA", tokenUsers: []string{gcpUserUserName}, clientCA: true, cluster: untrusting, identity: KubeConfigIdentityUser, wantUser: gcpUserUserName, wantToken: true},
+		{name: "client CA", tokenUsers: []string{gcpUserUserName}, clientCA: true, cluster: unreachable, identity: KubeConfigIdentityUser, wantUser: gcpUserUserName},
+		{name: "admin without token", tokenUsers: []string{gcpUserUserName}, cluster: unreachable, identity: KubeConfigIdentityAdmin, wantErr: "--kubeconfig has no token"},
+		{name: "no tokens", cluster: unreachable, identity: KubeConfigIdentityUser, wantErr: "--kubeconfig has no token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			o := NewKubeConfigOptions(rootDir)
+			o.Identity = tt.identity
+			source := &clientcmdapi.Config{AuthInfos: map[string]*clientcmdapi.AuthInfo{}}
+			for _, name := range tt.tokenUsers {
+				source.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: name + "-token"}
+			}
+			if tt.clientCA {
+				if err := ensureCA(o.ClientCAFile, o.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			userName, authInfo, err := o.identityAuthInfo(source, tt.cluster)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userName != tt.wantUser {
+				t.Errorf("user %q, want %q", userName, tt.wantUser)
+			}
+			if tt.wantToken && (authInfo.Token != tt.wantUser+"-token" || len(authInfo.ClientCertificateData) > 0) {
+				t.Errorf("expected the kubeconfig token of %q, got %+v", tt.wantUser, authInfo)
+			}
+			if !tt.wantToken && (authInfo.Token != "" || len(authInfo.ClientCertificateData) == 0) {
+				t.Errorf("expected a client certificate, got %+v", authInfo)
+			}
+		})
+	}
+}
+
+func TestKubeConfigClientCertsAuthenticate(t *testing.T) {
+	rootDir := t.TempDir()
+	s := NewAdminAuthentication(rootDir)
+	s.StaticUsersFile = filepath.Join(rootDir, "users.yaml")
+	if err := os.WriteFile(s.StaticUsersFile, []byte(staticUsersHeader+"users:\n- name: carol\n  clientCertificate: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureCA(s.ClientCAFile, s.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the x509 authenticator of the server trusting the client CA
+	cas, err := certutil.CertsFromFile(s.ClientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyOptions := x509request.DefaultVerifyOptions()
+	verifyOptions.Roots = x509.NewCertPool()
+	verifyOptions.Roots.AddCert(cas[0])
+	config := &genericapiserver.Config{PostStartHooks: map[string]genericapiserver.PostStartHookConfigEntry{}}
+	config.Authentication.Authenticator = x509request.New(verifyOptions, x509request.CommonNameUserConversion)
+	if _, _, err := s.ApplyTo(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		identity   string
+		wantUser   string
+		wantGroups []string
+	}{
+		{identity: KubeConfigIdentityAdmin, wantUser: gcpAdminUserName, wantGroups: []string{user.SystemPrivilegedGroup}},
+		{identity: KubeConfigIdentityUser, wantUser: gcpUserUserName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identity, func(t *testing.T) {
+			o := NewKubeConfigOptions(rootDir)
+			o.Identity = tt.identity
+			o.Server = "https://127.0.0.1:1"
+			o.Output = filepath.Join(t.TempDir(), "kubeconfig")
+			if err := o.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			kubeConfig, err := clientcmd.LoadFromFile(o.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs, err := certutil.ParseCertsPEM(kubeConfig.AuthInfos[kubeConfig.Contexts[kubeConfig.CurrentContext].AuthInfo].ClientCertificateData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+			resp, ok, err := config.Authentication.Authenticator.AuthenticateRequest(req)
+			if err != nil || !ok {
+				t.Fatalf("client certificate was not authenticated: %v, %v", ok, err)
+			}
+			if resp.User.GetName() != tt.wantUser || !slices.Equal(resp.User.GetGroups(), tt.wantGroups) {
+				t.Errorf("authenticated as %q in %v, want %q in %v", resp.User.GetName(), resp.User.GetGroups(), tt.wantUser, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestCheckClientCATrusted(t *testing.T) {
+	dir := t.TempDir()
+	newCA := func(name string) *x509.Certificate {
+		t.Helper()
+		certFile := filepath.Join(dir, name+".crt")
+		if err := ensureCA(certFile, filepath.Join(dir, name+".key"), name); err != nil {
+			t.Fatal(err)
+		}
+		cas, err := certutil.CertsFromFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cas[0]
+	}
+	clientCA, otherCA := newCA("client-ca"), newCA("other-ca")
+
+	newServer := func(clientCAs ...*x509.Certificate) *clientcmdapi.Cluster {
+		t.Helper()
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		srv.TLS = &tls.Config{}
+		if len(clientCAs) > 0 {
+			srv.TLS.ClientAuth = tls.RequestClientCert
+			srv.TLS.ClientCAs = x509.NewCertPool()
+			for _, ca := range clientCAs {
+				srv.TLS.ClientCAs.AddCert(ca)
+			}
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return &clientcmdapi.Cluster{
+			Server:                   srv.URL,
+			CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		cluster *clientcmdapi.Cluster
+		wantErr bool
+	}{
+		{name: "trusted", cluster: newServer(otherCA, clientCA)},
+		{name: "other client CA", cluster: newServer(otherCA), wantErr: true},
+		{name: "no client CA", cluster: newServer(), wantErr: true},
+		{name: "unreachable", cluster: &clientcmdapi.Cluster{Server: "https://127.0.0.1:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkClientCATrusted(tt.cluster, clientCA)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("wantErr = %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
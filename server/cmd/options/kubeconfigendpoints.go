@@ -0,0 +1,115 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	certutil "k8s.io/client-go/util/cert"
+)
+
+const (
+	// kubeConfigEndpointExternal is the endpoint of the external address.
+	kubeConfigEndpointExternal = "external"
+	// kubeConfigEndpointLoopback is the endpoint of 127.0.0.1 and the external port.
+	kubeConfigEndpointLoopback = "loopback"
+)
+
+// kubeConfigEndpoint is a cluster of the kubeconfig.
+type kubeConfigEndpoint struct {
+	Name          string
+	Server        string
+	TLSServerName string
+}
+
+// clusterName returns the name of the kubeconfig cluster of the endpoint. The
+// first endpoint is called "root".
+func (e kubeConfigEndpoint) clusterName(first bool) string {
+	if first {
+		return "root"
+	}
+	return e.Name
+}
+
+// parseKubeConfigEndpoint parses an entry of --kubeconfig-endpoints into
+// its name and, for custom endpoints, its host with an optional port.
+func parseKubeConfigEndpoint(entry string) (string, string, error) {
+	switch entry {
+	case kubeConfigEndpointExternal, kubeConfigEndpointLoopback:
+		return entry, "", nil
+	}
+	name, host, ok := strings.Cut(entry, "=")
+	switch {
+	case !ok:
+		return "", "", fmt.Errorf("invalid kubeconfig endpoint %q, expected %s, %s or <name>=<host>[:<port>]", entry, kubeConfigEndpointExternal, kubeConfigEndpointLoopback)
+	case name == "" || host == "":
+		return "", "", fmt.Errorf("invalid kubeconfig endpoint %q, name and host must not be empty", entry)
+	case name == "root" || name == kubeConfigEndpointExternal || name == kubeConfigEndpointLoopback:
+		return "", "", fmt.Errorf("invalid kubeconfig endpoint %q, name %q is reserved", entry, name)
+	case strings.ContainsAny(name, "@/"):
+		return "", "", fmt.Errorf("invalid kubeconfig endpoint %q, name must not contain '@' or '/'", entry)
+	case strings.Contains(host, "/"):
+		return "", "", fmt.Errorf("invalid kubeconfig endpoint %q, expected a host with an optional port", entry)
+	}
+	return name, host, nil
+}
+
+// kubeConfigEndpoints returns the configured kubeconfig endpoints for the given
+// external address and serving certificate. Endpoints whose host is not
+// covered by the serving certificate get a TLS server name which is.
+func (s *AdminAuthentication) kubeConfigEndpoints(externalAddress string, servingCert []byte) ([]kubeConfigEndpoint, error) {
+	externalHost, externalPort, err := net.SplitHostPort(externalAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external address %q: %w", externalAddress, err)
+	}
+	tlsServerName := s.KubeConfigTLSServerName
+	if tlsServerName == "" {
+		tlsServerName = externalHost
+	}
+	covered := func(string) bool { return false }
+	if certs, err := certutil.ParseCertsPEM(servingCert); err == nil && len(certs) > 0 {
+		covered = func(host string) bool { return certs[0].VerifyHostname(host) == nil }
+	}
+
+	var endpoints []kubeConfigEndpoint
+	for _, entry := range s.KubeConfigEndpoints {
+		name, host, err := parseKubeConfigEndpoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		port := externalPort
+		switch name {
+		case kubeConfigEndpointExternal:
+			endpoints = append(endpoints, kubeConfigEndpoint{Name: name, Server: "https://" + externalAddress})
+			continue
+		case kubeConfigEndpointLoopback:
+			host = "127.0.0.1"
+		default:
+			if h, p, err := net.SplitHostPort(host); err == nil {
+				host, port = h, p
+			}
+		}
+		endpoint := kubeConfigEndpoint{Name: name, Server: "https://" + net.JoinHostPort(host, port)}
+		if !covered(host) {
+			endpoint.TLSServerName = tlsServerName
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
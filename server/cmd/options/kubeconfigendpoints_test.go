@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func TestParseKubeConfigEndpoint(t *testing.T) {
+	tests := []struct {
+		entry    string
+		wantName string
+		wantHost string
+		wantErr  string
+	}{
+		{entry: "external", wantName: "external"},
+		{entry: "loopback", wantName: "loopback"},
+		{entry: "docker=host.docker.internal", wantName: "docker", wantHost: "host.docker.internal"},
+		{entry: "lb=10.0.0.1:443", wantName: "lb", wantHost: "10.0.0.1:443"},
+		{entry: "docker", wantErr: "expected external, loopback or"},
+		{entry: "=host", wantErr: "must not be empty"},
+		{entry: "root=host", wantErr: `name "root" is reserved`},
+		{entry: "loopback=host", wantErr: `name "loopback" is reserved`},
+		{entry: "a@b=host", wantErr: "must not contain"},
+		{entry: "docker=https://host", wantErr: "expected a host with an optional port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			name, host, err := parseKubeConfigEndpoint(tt.entry)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.wantName || host != tt.wantHost {
+				t.Errorf("got %q, %q, want %q, %q", name, host, tt.wantName, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestKubeConfigEndpoints(t *testing.T) {
+	servingCert, _, err := certutil.GenerateSelfSignedCertKey("gcp.example.com", []net.IP{net.ParseIP("127.0.0.1")}, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		endpoints     []string
+		tlsServerName string
+		want          []kubeConfigEndpoint
+	}{
+		{
+			name:      "external",
+			endpoints: []string{"external"},
+			want:      []kubeConfigEndpoint{{Name: "external", Server: "https://gcp.example.com:6443"}},
+		},
+		{
+			name:      "loopback is covered by the serving certificate",
+			endpoints: []string{"loopback", "external"},
+			want: []kubeConfigEndpoint{
+				{Name: "loopback", Server: "https://127.0.0.1:6443"},
+				{Name: "external", Server: "https://gcp.example.com:6443"},
+			},
+		},
+		{
+			name:      "custom hosts not covered by the serving certificate get the external host as server name",
+			endpoints: []string{"external", "docker=host.docker.internal", "local=localhost:7443"},
+			want: []kubeConfigEndpoint{
+				{Name: "external", Server: "https://gcp.example.com:6443"},
+				{Name: "docker", Server: "https://host.docker.internal:6443", TLSServerName: "gcp.example.com"},
+				{Name: "local", Server: "https://localhost:7443"},
+			},
+		},
+		{
+			name:          "custom TLS server name",
+			endpoints:     []string{"docker=host.docker.internal"},
+			tlsServerName: "localhost",
+			want:          []kubeConfigEndpoint{{Name: "docker", Server: "https://host.docker.internal:6443", TLSServerName: "localhost"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &AdminAuthentication{KubeConfigEndpoints: tt.endpoints, KubeConfigTLSServerName: tt.tlsServerName}
+			got, err := s.kubeConfigEndpoints("gcp.example.com:6443", servingCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected endpoints (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	s := &AdminAuthentication{KubeConfigEndpoints: []string{"external"}}
+	if _, err := s.kubeConfigEndpoints("gcp.example.com", servingCert); err == nil {
+		t.Errorf("expected an error for an external address without port")
+	}
+}
+
+func TestAddContextsForEndpoints(t *testing.T) {
+	endpoints := []kubeConfigEndpoint{
+		{Name: "external", Server: "https://gcp.example.com:6443"},
+		{Name: "docker", Server: "https://host.docker.internal:6443", TLSServerName: "gcp.example.com"},
+	}
+	kubeConfig := createKubeConfig(nil, "user-token", endpoints, nil)
+	addContexts(kubeConfig, endpoints)
+
+	contexts := map[string]string{}
+	for name, context := range kubeConfig.Contexts {
+		contexts[name] = context.Cluster + "/" + context.AuthInfo
+	}
+	want := map[string]string{
+		"root":        "root/" + gcpAdminUserName,
+		"root@docker": "docker/" + gcpAdminUserName,
+		"user":        "root/" + gcpUserUserName,
+		"user@docker": "docker/" + gcpUserUserName,
+	}
+	if diff := cmp.Diff(want, contexts); diff != "" {
+		t.Errorf("unexpected contexts (-want +got):\n%s", diff)
+	}
+	if kubeConfig.Clusters["docker"].TLSServerName != "gcp.example.com" {
+		t.Errorf("TLS server name of the docker cluster was not set")
+	}
+}
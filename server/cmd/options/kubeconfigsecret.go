@@ -0,0 +1,200 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// kubeConfigSecretKey is the key of the kubeconfig in the published Secret.
+const kubeConfigSecretKey = "kubeconfig"
+
+// KubeConfigSecretCheckName is the name of the readyz check of the kubeconfig
+// Secret. Waiting for readiness before publishing the Secret must exclude it.
+const KubeConfigSecretCheckName = "kubeconfig-secret"
+
+// kubeConfigSecretCheck is the readyz check of the kubeconfig Secret. It fails
+// until the Secret is published.
+type kubeConfigSecretCheck struct {
+	lock sync.RWMutex
+	err  error
+}
+
+var _ healthz.HealthChecker = &kubeConfigSecretCheck{}
+
+func newKubeConfigSecretCheck() *kubeConfigSecretCheck {
+	return &kubeConfigSecretCheck{err: errors.New("kubeconfig Secret not published yet")}
+}
+
+// Name implements healthz.HealthChecker.
+func (c *kubeConfigSecretCheck) Name() string {
+	return KubeConfigSecretCheckName
+}
+
+// Check implements healthz.HealthChecker.
+func (c *kubeConfigSecretCheck) Check(_ *http.Request) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.err
+}
+
+func (c *kubeConfigSecretCheck) setErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+}
+
+// kubeConfigSecretReadTimeout bounds reading the tokens from the kubeconfig
+// Secret in the host cluster at startup.
+const kubeConfigSecretReadTimeout = 30 * time.Second
+
+// loadKubeConfigSecretTokens reads the tokens of the kubeconfig Secret
+// published to the host cluster of KubeConfigSecretKubeConfig by a previous
+// start. A missing Secret results in no tokens.
+func (s *AdminAuthentication) loadKubeConfigSecretTokens(ctx context.Context) (map[string]string, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", s.KubeConfigSecretKubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load --kubeconfig-secret-kubeconfig: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(rest.AddUserAgent(config, "gcp-kubeconfig-publisher"))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kubeConfigSecretReadTimeout)
+	defer cancel()
+	secret, err := client.CoreV1().Secrets(s.KubeConfigSecretNamespace).Get(ctx, s.KubeConfigSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the tokens of kubeconfig Secret %s/%s: %w", s.KubeConfigSecretNamespace, s.KubeConfigSecretName, err)
+	}
+	kubeConfig, err := clientcmd.Load(secret.Data[kubeConfigSecretKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig Secret %s/%s: %w", s.KubeConfigSecretNamespace, s.KubeConfigSecretName, err)
+	}
+	return kubeConfigTokens(kubeConfig), nil
+}
+
+// PublishKubeConfig publishes the kubeconfig written by WriteKubeConfig as a
+// Secret, if configured, either to gcp itself through the given loopback
+// config or to the host cluster of KubeConfigSecretKubeConfig. It retries
+// until the Secret is published or the context is done, so it is meant to run
+// in a goroutine; failures are reported by the readyz check added in ApplyTo.
+// The Secret is updated when the static users change.
+func (s *AdminAuthentication) PublishKubeConfig(ctx context.Context, loopbackClientConfig *rest.Config) error {
+	if s.KubeConfigSecretNamespace == "" {
+		return nil
+	}
+	check := s.kubeConfigSecretCheck
+	if check == nil {
+		check = newKubeConfigSecretCheck()
+	}
+
+	config := rest.CopyConfig(loopbackClientConfig)
+	if s.KubeConfigSecretKubeConfig != "" {
+		var err error
+		config, err = clientcmd.BuildConfigFromFlags("", s.KubeConfigSecretKubeConfig)
+		if err != nil {
+			err = fmt.Errorf("failed to load --kubeconfig-secret-kubeconfig: %w", err)
+			check.setErr(err)
+			return err
+		}
+	}
+	client, err := kubernetes.NewForConfig(rest.AddUserAgent(config, "gcp-kubeconfig-publisher"))
+	if err != nil {
+		check.setErr(err)
+		return err
+	}
+
+	logger := klog.FromContext(ctx).WithValues("namespace", s.KubeConfigSecretNamespace, "name", s.KubeConfigSecretName)
+	if err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		err := s.publishKubeConfig(ctx, client)
+		if err != nil {
+			check.setErr(fmt.Errorf("failed to publish kubeconfig Secret: %w", err))
+			logger.Error(err, "Failed to publish kubeconfig Secret, retrying")
+			return false, nil
+		}
+		check.setErr(nil)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	logger.Info("Published kubeconfig Secret")
+
+	if s.staticUsers != nil {
+		s.staticUsers.setOnChange(func() error {
+			if err := s.writeKubeConfigFile(); err != nil {
+				return err
+			}
+			return s.publishKubeConfig(ctx, client)
+		})
+	}
+	return nil
+}
+
+func (s *AdminAuthentication) publishKubeConfig(ctx context.Context, client kubernetes.Interface) error {
+	kubeConfig, err := s.newKubeConfig()
+	if err != nil {
+		return err
+	}
+	data, err := clientcmd.Write(*kubeConfig)
+	if err != nil {
+		return err
+	}
+
+	// creating namespaces might be forbidden in a host cluster, the Secret operations tell then
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: s.KubeConfigSecretNamespace}}
+	if _, err := client.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) && !apierrors.IsForbidden(err) {
+		return err
+	}
+
+	secrets := client.CoreV1().Secrets(s.KubeConfigSecretNamespace)
+	existing, err := secrets.Get(ctx, s.KubeConfigSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: s.KubeConfigSecretName, Namespace: s.KubeConfigSecretNamespace},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{kubeConfigSecretKey: data},
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if existing.Data == nil {
+		existing.Data = map[string][]byte{}
+	}
+	existing.Data[kubeConfigSecretKey] = data
+	_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func newPublishingAdminAuthentication(server string) *AdminAuthentication {
+	s := &AdminAuthentication{
+		KubeConfigSecretNamespace: "gcp-system",
+		KubeConfigSecretName:      "admin-kubeconfig",
+		kubeConfigSecretCheck:     newKubeConfigSecretCheck(),
+	}
+	s.newKubeConfig = func() (*clientcmdapi.Config, error) {
+		kubeConfig := clientcmdapi.NewConfig()
+		kubeConfig.Clusters["root"] = &clientcmdapi.Cluster{Server: server}
+		return kubeConfig, nil
+	}
+	return s
+}
+
+func TestPublishKubeConfigSecret(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	// creating namespaces is forbidden, as in a host cluster
+	client.PrependReactor("create", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "gcp-system", nil)
+	})
+
+	s := newPublishingAdminAuthentication("https://first:6443")
+	if err := s.publishKubeConfig(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := client.CoreV1().Secrets("gcp-system").Get(ctx, "admin-kubeconfig", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != corev1.SecretTypeOpaque || len(secret.Data[kubeConfigSecretKey]) == 0 {
+		t.Fatalf("unexpected Secret %+v", secret)
+	}
+
+	// an existing Secret is updated, keeping other keys
+	secret.Data["other"] = []byte("kept")
+	if _, err := client.CoreV1().Secrets("gcp-system").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s = newPublishingAdminAuthentication("https://second:6443")
+	if err := s.publishKubeConfig(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	secret, err = client.CoreV1().Secrets("gcp-system").Get(ctx, "admin-kubeconfig", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["other"]) != "kept" {
+		t.Errorf("other keys of the Secret were not kept")
+	}
+	if got := string(secret.Data[kubeConfigSecretKey]); !strings.Contains(got, "https://second:6443") {
+		t.Errorf("Secret was not updated: %s", got)
+	}
+}
+
+func TestPublishKubeConfigUnreachable(t *testing.T) {
+	s := newPublishingAdminAuthentication("https://127.0.0.1:6443")
+	if err := s.kubeConfigSecretCheck.Check(nil); err == nil {
+		t.Errorf("check succeeded before the Secret was published")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// nothing listens on port 1
+	if err := s.PublishKubeConfig(ctx, &rest.Config{Host: "https://127.0.0.1:1", Timeout: time.Second}); err == nil {
+		t.Fatal("expected publishing to an unreachable host to fail when the context is done")
+	}
+	err := s.kubeConfigSecretCheck.Check(nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to publish kubeconfig Secret") {
+		t.Errorf("check does not report the publishing failure: %v", err)
+	}
+}
+
+func TestPublishKubeConfigDisabled(t *testing.T) {
+	s := &AdminAuthentication{}
+	if err := s.PublishKubeConfig(context.Background(), &rest.Config{Host: "https://127.0.0.1:1"}); err != nil {
+		t.Errorf("unexpected error without Secret namespace: %v", err)
+	}
+}
+
+func TestKubeConfigSecretTokensWithoutKubeConfigFile(t *testing.T) {
+	// the host cluster serves the kubeconfig Secret once it is published
+	var lock sync.Mutex
+	var published *corev1.Secret
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method != http.MethodGet || req.URL.Path != "/api/v1/namespaces/gcp-system/secrets/admin-kubeconfig" || published == nil {
+			status := apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "admin-kubeconfig").ErrStatus
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&status)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(published)
+	}))
+	defer host.Close()
+
+	rootDir := t.TempDir()
+	hostKubeConfig := clientcmdapi.NewConfig()
+	hostKubeConfig.Clusters["host"] = &clientcmdapi.Cluster{Server: host.URL}
+	hostKubeConfig.AuthInfos["host"] = &clientcmdapi.AuthInfo{}
+	hostKubeConfig.Contexts["host"] = &clientcmdapi.Context{Cluster: "host", AuthInfo: "host"}
+	hostKubeConfig.CurrentContext = "host"
+	hostKubeConfigFile := filepath.Join(rootDir, "host.kubeconfig")
+	if err := clientcmd.WriteToFile(*hostKubeConfig, hostKubeConfigFile); err != nil {
+		t.Fatal(err)
+	}
+
+	newAdminAuthentication := func() *AdminAuthentication {
+		s := NewAdminAuthentication(rootDir)
+		s.KubeConfigPath = ""
+		s.KubeConfigSecretNamespace = "gcp-system"
+		s.KubeConfigSecretKubeConfig = hostKubeConfigFile
+		if errs := s.Validate(); len(errs) > 0 {
+			t.Fatalf("unexpected validation errors: %v", errs)
+		}
+		return s
+	}
+
+	adminToken, userToken, err := newAdminAuthentication().ApplyTo(newAuthenticationConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeConfig := clientcmdapi.NewConfig()
+	kubeConfig.AuthInfos[gcpAdminUserName] = &clientcmdapi.AuthInfo{Token: adminToken}
+	kubeConfig.AuthInfos[gcpUserUserName] = &clientcmdapi.AuthInfo{Token: userToken}
+	data, err := clientcmd.Write(*kubeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	published = &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "admin-kubeconfig", Namespace: "gcp-system"},
+		Data:       map[string][]byte{kubeConfigSecretKey: data},
+	}
+	lock.Unlock()
+
+	// a restart reuses the tokens of the published Secret
+	config := newAuthenticationConfig()
+	restartedAdminToken, restartedUserToken, err := newAdminAuthentication().ApplyTo(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartedAdminToken != adminToken || restartedUserToken != userToken {
+		t.Errorf("tokens of the published Secret were not reused")
+	}
+	if name, ok := authenticate(t, config, adminToken); !ok || name != gcpAdminUserName {
+		t.Errorf("admin token authenticated as %q, %v", name, ok)
+	}
+}
+
+func TestKubeConfigSecretInGcpRequiresKubeConfigFile(t *testing.T) {
+	s := NewAdminAuthentication(t.TempDir())
+	s.KubeConfigPath = ""
+	s.KubeConfigSecretNamespace = "gcp-system"
+	if errs := s.Validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "requires --kubeconfig-secret-kubeconfig") {
+		t.Errorf("expected an error for a Secret in gcp itself without kubeconfig file, got %v", errs)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	etcdoptions "github.com/kcp-dev/embeddedetcd/options"
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	etcdtypes "go.etcd.io/etcd/client/pkg/v3/types"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+// MemberOptions holds the configuration of the member commands, which manage
+// the members of the embedded etcd cluster through the embedded etcd of the
+// running server.
+type MemberOptions struct {
+	EmbeddedEtcd etcdoptions.Options
+}
+
+// NewMemberOptions returns a new MemberOptions for the given root directory.
+func NewMemberOptions(rootDir string) *MemberOptions {
+	o := &MemberOptions{
+		EmbeddedEtcd: *etcdoptions.NewOptions(rootDir),
+	}
+	o.EmbeddedEtcd.Enabled = true
+	return o
+}
+
+// AddFlags adds the flags of the embedded etcd used by the member commands to the given FlagSet.
+func (o *MemberOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.EmbeddedEtcd.Directory, "embedded-etcd-directory", o.EmbeddedEtcd.Directory, "Directory for embedded etcd")
+	fs.StringVar(&o.EmbeddedEtcd.ClientPort, "embedded-etcd-client-port", o.EmbeddedEtcd.ClientPort, "Port for embedded etcd client")
+}
+
+// Validate validates the member command options.
+func (o *MemberOptions) Validate() []error {
+	var errs []error
+
+	if o.EmbeddedEtcd.Directory == "" {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-directory must be specified"))
+	}
+	if o.EmbeddedEtcd.ClientPort == "" {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-client-port must be specified"))
+	}
+
+	return errs
+}
+
+// List returns the members of the embedded etcd cluster.
+func (o *MemberOptions) List(ctx context.Context) ([]*etcdserverpb.Member, error) {
+	client, err := o.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	resp, err := client.MemberList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the members of the embedded etcd: %w", err)
+	}
+	return resp.Members, nil
+}
+
+// Add adds a member with the given name and peer URL to the embedded etcd
+// cluster, and returns its ID and the initial cluster to start it with.
+func (o *MemberOptions) Add(ctx context.Context, name, peerURL string) (uint64, string, error) {
+	urls, err := etcdtypes.NewURLs([]string{peerURL})
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid peer URL %q: %w", peerURL, err)
+	}
+	if urls[0].Scheme != "https" {
+		return 0, "", fmt.Errorf("peer URL %q must be https", peerURL)
+	}
+
+	client, err := o.client(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer client.Close()
+
+	resp, err := client.MemberAdd(ctx, urls.StringSlice())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to add member %q to the embedded etcd: %w", name, err)
+	}
+
+	var initialCluster []string
+	for _, member := range resp.Members {
+		memberName := member.Name
+		if member.ID == resp.Member.ID {
+			memberName = name
+		}
+		for _, u := range member.PeerURLs {
+			initialCluster = append(initialCluster, memberName+"="+u)
+		}
+	}
+	return resp.Member.ID, strings.Join(initialCluster, ","), nil
+}
+
+// Remove removes the member with the given name or hexadecimal ID from the
+// embedded etcd cluster, and returns its ID.
+func (o *MemberOptions) Remove(ctx context.Context, member string) (uint64, error) {
+	client, err := o.client(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	resp, err := client.MemberList(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list the members of the embedded etcd: %w", err)
+	}
+	var id uint64
+	for _, m := range resp.Members {
+		if m.Name == member || strconv.FormatUint(m.ID, 16) == strings.ToLower(member) {
+			id = m.ID
+			break
+		}
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("embedded etcd has no member %q", member)
+	}
+
+	if _, err := client.MemberRemove(ctx, id); err != nil {
+		return 0, fmt.Errorf("failed to remove member %q from the embedded etcd: %w", member, err)
+	}
+	return id, nil
+}
+
+// client returns a client of the embedded etcd of the running server.
+func (o *MemberOptions) client(ctx context.Context) (*clientv3.Client, error) {
+	etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("", nil))
+	o.EmbeddedEtcd.Complete(etcdOptions)
+	config, err := embeddedEtcdClientConfig(etcdOptions.StorageConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	config.Context = ctx
+	config.Logger = zap.NewNop()
+	return clientv3.New(config)
+}
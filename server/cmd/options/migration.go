@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/kcp-dev/generic-controlplane/server/migration"
+)
+
+const (
+	// migrationQPS and migrationBurst raise the client side rate limit, as
+	// exports and imports issue a request per resource or object.
+	migrationQPS   = 100
+	migrationBurst = 200
+)
+
+// MigrationOptions holds the configuration of the export and import commands,
+// which move the objects of a running server to another one.
+type MigrationOptions struct {
+	// KubeConfig is the kubeconfig of the running server.
+	KubeConfig string
+	Context    string
+
+	// Overwrite replaces existing objects on import instead of keeping them.
+	Overwrite bool
+}
+
+// NewMigrationOptions returns a new MigrationOptions for the given root directory.
+func NewMigrationOptions(rootDir string) *MigrationOptions {
+	return &MigrationOptions{
+		KubeConfig: filepath.Join(rootDir, "admin.kubeconfig"),
+		Context:    "root",
+	}
+}
+
+// AddFlags adds the flags for the export and import commands to the given FlagSet.
+func (o *MigrationOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.KubeConfig, "kubeconfig", o.KubeConfig, "The kubeconfig of the running server.")
+	fs.StringVar(&o.Context, "context", o.Context, "The context of --kubeconfig to use.")
+}
+
+// AddImportFlags adds the flags for the import command to the given FlagSet.
+func (o *MigrationOptions) AddImportFlags(fs *pflag.FlagSet) {
+	o.AddFlags(fs)
+	fs.BoolVar(&o.Overwrite, "overwrite", o.Overwrite, "Replace objects which exist already with those of the export instead of keeping them.")
+}
+
+// Validate validates the export and import command options.
+func (o *MigrationOptions) Validate() []error {
+	var errs []error
+
+	if o.KubeConfig == "" {
+		errs = append(errs, fmt.Errorf("--kubeconfig must be specified"))
+	}
+
+	return errs
+}
+
+// Export writes the objects of the server to the directory tree or archive at target.
+func (o *MigrationOptions) Export(ctx context.Context, target string) (migration.ExportStats, error) {
+	config, err := o.restConfig()
+	if err != nil {
+		return migration.ExportStats{}, err
+	}
+	return migration.Export(ctx, config, target)
+}
+
+// Import creates the objects of the directory tree or archive at source on the server.
+func (o *MigrationOptions) Import(ctx context.Context, source string) (migration.ImportStats, error) {
+	config, err := o.restConfig()
+	if err != nil {
+		return migration.ImportStats{}, err
+	}
+	return migration.Import(ctx, config, source, o.Overwrite)
+}
+
+func (o *MigrationOptions) restConfig() (*rest.Config, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: o.KubeConfig},
+		&clientcmd.ConfigOverrides{CurrentContext: o.Context},
+	).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.QPS = migrationQPS
+	config.Burst = migrationBurst
+	return config, nil
+}
@@ -28,8 +28,10 @@ import (
 
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/admission"
+	"k8s.io/apiserver/pkg/authentication/user"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/informers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/util/keyutil"
 	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
@@ -46,7 +48,14 @@ import (
 type Options struct {
 	GenericControlPlane controlplaneapiserveroptions.Options
 	EmbeddedEtcd        etcdoptions.Options
+	EtcdCluster         EtcdCluster
+	SQLStorage          SQLStorage
+	EtcdSnapshots       EtcdSnapshots
+	EtcdMaintenance     EtcdMaintenance
 	AdminAuthentication AdminAuthentication
+	AuthorizationPolicy AuthorizationPolicy
+	BootstrapManifests  BootstrapManifests
+	Certificates        Certificates
 	Batteries           batteries.Options
 
 	Extra ExtraOptions
@@ -55,12 +64,30 @@ type Options struct {
 // ExtraOptions holds the extra configuration for the generic controlplane server.
 type ExtraOptions struct {
 	RootDir string
+
+	// RootCAFile is the CA bundle published as kube-root-ca.crt and added to
+	// legacy token Secrets. It defaults to the CAs of the serving certificate.
+	RootCAFile string
+}
+
+// SetRootDirectory moves the paths without flags below the given root
+// directory. The paths with flags are moved when the flags are parsed.
+func (o *Options) SetRootDirectory(rootDir string) {
+	o.Extra.RootDir = rootDir
+	o.SQLStorage.Socket = NewSQLStorage(rootDir).Socket
 }
 
 type completedOptions struct {
 	GenericControlPlane controlplaneapiserveroptions.CompletedOptions
 	EmbeddedEtcd        etcdoptions.CompletedOptions
+	EtcdCluster         EtcdCluster
+	SQLStorage          SQLStorage
+	EtcdSnapshots       EtcdSnapshots
+	EtcdMaintenance     EtcdMaintenance
 	AdminAuthentication AdminAuthentication
+	AuthorizationPolicy AuthorizationPolicy
+	BootstrapManifests  BootstrapManifests
+	Certificates        Certificates
 	Batteries           batteries.CompletedOptions
 
 	Extra ExtraOptions
@@ -76,7 +103,14 @@ func NewOptions(rootDir string) *Options {
 	o := &Options{
 		GenericControlPlane: *controlplaneapiserveroptions.NewOptions(),
 		EmbeddedEtcd:        *etcdoptions.NewOptions(rootDir),
+		EtcdCluster:         *NewEtcdCluster(rootDir),
+		SQLStorage:          *NewSQLStorage(rootDir),
+		EtcdSnapshots:       *NewEtcdSnapshots(rootDir),
+		EtcdMaintenance:     *NewEtcdMaintenance(),
 		AdminAuthentication: *NewAdminAuthentication(rootDir),
+		AuthorizationPolicy: *NewAuthorizationPolicy(rootDir),
+		BootstrapManifests:  *NewBootstrapManifests(),
+		Certificates:        *NewCertificates(rootDir),
 		Batteries:           batteries.New(),
 		Extra: ExtraOptions{
 			RootDir: rootDir,
@@ -91,10 +125,6 @@ func NewOptions(rootDir string) *Options {
 		panic(err) // only fails on unknown feature gate, which is a programming error
 	}
 
-	factory := func(factory informers.SharedInformerFactory) serviceaccount.ServiceAccountTokenGetter {
-		return tokengetter.NewGetterFromClient(factory.Core().V1().Secrets().Lister(), factory.Core().V1().ServiceAccounts().Lister())
-	}
-
 	// override for standalone mode
 	o.GenericControlPlane.SecureServing.ServerCert.CertDirectory = rootDir
 	// We use KCP form of the authentication options as it does not contain nodes and pods
@@ -109,8 +139,6 @@ func NewOptions(rootDir string) *Options {
 		WithTokenFile().
 		WithWebHook()
 
-	o.GenericControlPlane.Authentication.ServiceAccounts.OptionalTokenGetter = factory
-
 	o.GenericControlPlane.Authentication.ServiceAccounts.Issuers = []string{"https://gcp.default.svc"}
 	o.GenericControlPlane.Etcd.StorageConfig.Transport.ServerList = []string{"embedded"}
 	o.GenericControlPlane.Features.EnablePriorityAndFairness = false
@@ -128,23 +156,61 @@ func NewOptions(rootDir string) *Options {
 func (o *Options) AddFlags(fss *cliflag.NamedFlagSets) {
 	o.GenericControlPlane.AddFlags(fss)
 
+	fss.FlagSet("secure serving").StringVar(&o.Extra.RootCAFile, "root-ca-file", o.Extra.RootCAFile,
+		"The CA bundle published as kube-root-ca.crt ConfigMap and added to legacy service account token Secrets. "+
+			"Defaults to the CA certificates of the serving certificate chain, which includes the CA of a self-signed serving certificate.")
+
 	etcdServers := fss.FlagSet("etcd").Lookup("etcd-servers")
-	etcdServers.Usage += " By default an embedded etcd server is started."
+	etcdServers.Usage += " By default an embedded etcd server is started. A single sqlite://<file>, postgres:// or postgresql:// URL " +
+		"serves the storage from that database instead."
 
+	o.SQLStorage.AddFlags(fss.FlagSet("etcd"))
 	o.EmbeddedEtcd.AddFlags(fss.FlagSet("Embedded etcd"))
+	o.EtcdCluster.AddFlags(fss.FlagSet("Embedded etcd"))
+	o.EtcdSnapshots.AddFlags(fss.FlagSet("Embedded etcd"))
+	o.EtcdMaintenance.AddFlags(fss.FlagSet("Embedded etcd"))
 	o.AdminAuthentication.AddFlags(fss.FlagSet("GCP Standalone Authentication"))
+	o.AuthorizationPolicy.AddFlags(fss.FlagSet("GCP Authorization Policy"))
+	o.BootstrapManifests.AddFlags(fss.FlagSet("GCP Bootstrap Manifests"))
+	o.Certificates.AddFlags(fss.FlagSet("Certificates"))
 	o.Batteries.AddFlags(fss.FlagSet("Options"))
 }
 
 // Complete fills in any fields not set that are required to have valid data.
 func (o *Options) Complete(ctx context.Context) (*CompletedOptions, error) {
+	if err := o.SQLStorage.Complete(o.GenericControlPlane.Etcd); err != nil {
+		return nil, err
+	}
+	if o.SQLStorage.Enabled {
+		klog.Background().Info("enabling SQL storage", "socket", o.SQLStorage.Socket, "storage", o.SQLStorage.Storage)
+	}
 	if servers := o.GenericControlPlane.Etcd.StorageConfig.Transport.ServerList; len(servers) == 1 && servers[0] == "embedded" {
 		klog.Background().Info("enabling embedded etcd server")
 		o.EmbeddedEtcd.Enabled = true
 	}
+	if err := o.EtcdCluster.Complete(o.EmbeddedEtcd.Enabled); err != nil {
+		return nil, err
+	}
 
 	completedBatteries := o.Batteries.Complete()
 
+	// only start informers for the core resources that are served
+	o.GenericControlPlane.Authentication.ServiceAccounts.OptionalTokenGetter = func(factory informers.SharedInformerFactory) serviceaccount.ServiceAccountTokenGetter {
+		var secretLister corev1listers.SecretLister
+		var serviceAccountLister corev1listers.ServiceAccountLister
+		if completedBatteries.IsEnabled(batteries.BatteryCoreSecrets) {
+			secretLister = factory.Core().V1().Secrets().Lister()
+		}
+		if completedBatteries.IsEnabled(batteries.BatteryCoreServiceAccounts) {
+			serviceAccountLister = factory.Core().V1().ServiceAccounts().Lister()
+		}
+		return tokengetter.NewGetterFromClient(secretLister, serviceAccountLister)
+	}
+	if !completedBatteries.IsEnabled(batteries.BatteryCoreNamespaces) {
+		// the system namespaces controller cannot create namespaces that are not served
+		o.GenericControlPlane.SystemNamespaces = nil
+	}
+
 	var serviceAccountFile string
 	if len(o.GenericControlPlane.Authentication.ServiceAccounts.KeyFiles) == 0 {
 		// use sa.key and auto-generate if not existing
@@ -178,7 +244,7 @@ func (o *Options) Complete(ctx context.Context) (*CompletedOptions, error) {
 	// override set of admission plugins
 	completedBatteries.RegisterAllAdmissionPlugins(o.GenericControlPlane.Admission.GenericAdmission.Plugins)
 	o.GenericControlPlane.Admission.GenericAdmission.DisablePlugins = sets.List[string](completedBatteries.DefaultOffAdmissionPlugins())
-	o.GenericControlPlane.Admission.GenericAdmission.RecommendedPluginOrder = batteries.AllOrderedPlugins
+	o.GenericControlPlane.Admission.GenericAdmission.RecommendedPluginOrder = completedBatteries.OrderedAdmissionPlugins()
 
 	var err error
 	if !filepath.IsAbs(o.EmbeddedEtcd.Directory) {
@@ -187,6 +253,12 @@ func (o *Options) Complete(ctx context.Context) (*CompletedOptions, error) {
 			return nil, err
 		}
 	}
+	if !filepath.IsAbs(o.EtcdSnapshots.Directory) {
+		o.EtcdSnapshots.Directory, err = filepath.Abs(o.EtcdSnapshots.Directory)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if !filepath.IsAbs(o.GenericControlPlane.SecureServing.ServerCert.CertDirectory) {
 		o.GenericControlPlane.SecureServing.ServerCert.CertDirectory, err = filepath.Abs(o.GenericControlPlane.SecureServing.ServerCert.CertDirectory)
 		if err != nil {
@@ -199,13 +271,86 @@ func (o *Options) Complete(ctx context.Context) (*CompletedOptions, error) {
 			return nil, err
 		}
 	}
-	if !filepath.IsAbs(o.AdminAuthentication.KubeConfigPath) {
+	if o.AdminAuthentication.KubeConfigPath != "" && !filepath.IsAbs(o.AdminAuthentication.KubeConfigPath) {
 		o.AdminAuthentication.KubeConfigPath, err = filepath.Abs(o.AdminAuthentication.KubeConfigPath)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if !filepath.IsAbs(o.Certificates.CAFile) {
+		o.Certificates.CAFile, err = filepath.Abs(o.Certificates.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !filepath.IsAbs(o.Certificates.CAKeyFile) {
+		o.Certificates.CAKeyFile, err = filepath.Abs(o.Certificates.CAKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range []*string{
+		&o.AdminAuthentication.ClientCAFile,
+		&o.AdminAuthentication.ClientCAKeyFile,
+		&o.AdminAuthentication.ClientCertFile,
+		&o.AdminAuthentication.ClientKeyFile,
+		&o.AdminAuthentication.StaticUsersFile,
+		&o.AdminAuthentication.StaticUsersCertDirectory,
+		&o.AdminAuthentication.KubeConfigSecretKubeConfig,
+		&o.AuthorizationPolicy.File,
+		&o.BootstrapManifests.Directory,
+	} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path, err = filepath.Abs(*path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the CAs of client certificates which are trusted unless --client-ca-file is set
+	var clientCAs []string
+
+	// the static users may have client certificates signed by the admin client CA
+	if o.AdminAuthentication.Credentials == AdminCredentialsClientCert || o.AdminAuthentication.StaticUsersFile != "" {
+		if err := ensureCA(o.AdminAuthentication.ClientCAFile, o.AdminAuthentication.ClientCAKeyFile, "gcp-client-ca"); err != nil {
+			return nil, err
+		}
+		if o.AdminAuthentication.Credentials == AdminCredentialsClientCert {
+			if err := ensureClientCert(o.AdminAuthentication.ClientCAFile, o.AdminAuthentication.ClientCAKeyFile,
+				o.AdminAuthentication.ClientCertFile, o.AdminAuthentication.ClientKeyFile, gcpAdminUserName, []string{user.SystemPrivilegedGroup}); err != nil {
+				return nil, err
+			}
+		}
+		clientCAs = append(clientCAs, o.AdminAuthentication.ClientCAFile)
+	}
+
+	// the embedded CSR signer has its own CA, such that certificates of
+	// approved requests cannot be confused with the admin client certificates
+	if completedBatteries.IsEnabled(batteries.BatteryCertificates) {
+		if err := ensureCA(o.Certificates.CAFile, o.Certificates.CAKeyFile, "gcp-csr-signer-ca"); err != nil {
+			return nil, err
+		}
+		clientCAs = append(clientCAs, o.Certificates.CAFile)
+	}
+
+	switch clientCA := o.GenericControlPlane.Authentication.ClientCert.ClientCA; {
+	case len(clientCAs) == 0:
+	case clientCA == "" && len(clientCAs) == 1:
+		o.GenericControlPlane.Authentication.ClientCert.ClientCA = clientCAs[0]
+	case clientCA == "":
+		bundle := filepath.Join(o.Extra.RootDir, "client-ca-bundle.crt")
+		if err := writeCABundle(bundle, clientCAs...); err != nil {
+			return nil, err
+		}
+		o.GenericControlPlane.Authentication.ClientCert.ClientCA = bundle
+	case len(clientCAs) > 1 || clientCA != clientCAs[0]:
+		klog.Background().Info("--client-ca-file is set, the generated client certificates are only trusted if the bundle includes their CAs",
+			"clientCAFile", clientCA, "generatedClientCAFiles", clientCAs)
+	}
+
 	completedGenericServerRunOptions, err := o.GenericControlPlane.Complete(ctx, nil, nil)
 	if err != nil {
 		return nil, err
@@ -217,7 +362,14 @@ func (o *Options) Complete(ctx context.Context) (*CompletedOptions, error) {
 		completedOptions: &completedOptions{
 			GenericControlPlane: completedGenericServerRunOptions,
 			EmbeddedEtcd:        completedEmbeddedEtcd,
+			EtcdCluster:         o.EtcdCluster,
+			SQLStorage:          o.SQLStorage,
+			EtcdSnapshots:       o.EtcdSnapshots,
+			EtcdMaintenance:     o.EtcdMaintenance,
 			AdminAuthentication: o.AdminAuthentication,
+			AuthorizationPolicy: o.AuthorizationPolicy,
+			BootstrapManifests:  o.BootstrapManifests,
+			Certificates:        o.Certificates,
 			Batteries:           completedBatteries,
 			Extra:               o.Extra,
 		},
@@ -230,8 +382,28 @@ func (o *CompletedOptions) Validate() []error {
 
 	errs = append(errs, o.GenericControlPlane.Validate()...)
 	errs = append(errs, o.EmbeddedEtcd.Validate()...)
+	errs = append(errs, o.EtcdCluster.Validate()...)
+	if o.EtcdCluster.InitialCluster != "" && !o.EmbeddedEtcd.Enabled {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-initial-cluster requires the embedded etcd"))
+	}
+	errs = append(errs, o.SQLStorage.Validate()...)
+	errs = append(errs, o.EtcdSnapshots.Validate()...)
+	errs = append(errs, o.EtcdMaintenance.Validate()...)
+	if o.EtcdSnapshots.Interval > 0 && !o.EmbeddedEtcd.Enabled {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-snapshot-interval requires the embedded etcd"))
+	}
 	errs = append(errs, o.AdminAuthentication.Validate()...)
+	errs = append(errs, o.BootstrapManifests.Validate()...)
+	errs = append(errs, o.Certificates.Validate()...)
 	errs = append(errs, o.Batteries.Validate()...)
 
+	if o.AdminAuthentication.KubeConfigSecretNamespace != "" && o.AdminAuthentication.KubeConfigSecretKubeConfig == "" {
+		for _, battery := range []batteries.Battery{batteries.BatteryCoreNamespaces, batteries.BatteryCoreSecrets} {
+			if !o.Batteries.IsEnabled(battery) {
+				errs = append(errs, fmt.Errorf("--kubeconfig-secret-namespace requires battery %q unless --kubeconfig-secret-kubeconfig is set", battery))
+			}
+		}
+	}
+
 	return errs
 }
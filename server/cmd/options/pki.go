@@ -0,0 +1,271 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"crypto"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"slices"
+	"time"
+
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/klog/v2"
+)
+
+// ensureCA generates a self-signed CA certificate and key at the given paths
+// if they do not exist yet.
+func ensureCA(certFile, keyFile, commonName string) error {
+	if ok, err := certutil.CanReadCertAndKey(certFile, keyFile); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	klog.Background().WithValues("cert", certFile, "key", keyFile).Info("generating CA")
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("error generating CA private key: %w", err)
+	}
+	cert, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: commonName}, key)
+	if err != nil {
+		return fmt.Errorf("error generating CA certificate: %w", err)
+	}
+
+	encodedKey, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return fmt.Errorf("error converting CA private key to PEM format: %w", err)
+	}
+	if err := keyutil.WriteKey(keyFile, encodedKey); err != nil {
+		return fmt.Errorf("error writing CA private key file %q: %w", keyFile, err)
+	}
+	encodedCert, err := certutil.EncodeCertificates(cert)
+	if err != nil {
+		return fmt.Errorf("error converting CA certificate to PEM format: %w", err)
+	}
+	if err := certutil.WriteCert(certFile, encodedCert); err != nil {
+		return fmt.Errorf("error writing CA certificate file %q: %w", certFile, err)
+	}
+	return nil
+}
+
+// writeCABundle writes the certificates of the given CA files to a bundle at
+// the given path.
+func writeCABundle(bundleFile string, caFiles ...string) error {
+	var certs []*x509.Certificate
+	for _, caFile := range caFiles {
+		cas, err := certutil.CertsFromFile(caFile)
+		if err != nil {
+			return fmt.Errorf("error reading CA certificate file %q: %w", caFile, err)
+		}
+		certs = append(certs, cas...)
+	}
+	encoded, err := certutil.EncodeCertificates(certs...)
+	if err != nil {
+		return fmt.Errorf("error converting CA certificates to PEM format: %w", err)
+	}
+	if err := certutil.WriteCert(bundleFile, encoded); err != nil {
+		return fmt.Errorf("error writing CA bundle file %q: %w", bundleFile, err)
+	}
+	return nil
+}
+
+const (
+	// clientCertValidity is the validity of generated client certificates.
+	clientCertValidity = 365 * 24 * time.Hour
+	// clientCertRenewBefore is the remaining validity below which client
+	// certificates are regenerated.
+	clientCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// ensureClientCert generates a client certificate and key for the given user
+// and groups at the given paths, signed by the given CA. Existing certificates
+// are kept unless they do not match the user and groups, are not signed by
+// the CA or are about to expire.
+func ensureClientCert(caCertFile, caKeyFile, certFile, keyFile, userName string, groups []string) error {
+	cas, err := certutil.CertsFromFile(caCertFile)
+	if err != nil {
+		return fmt.Errorf("error reading CA certificate file %q: %w", caCertFile, err)
+	}
+	ca := cas[0]
+
+	if ok, err := certutil.CanReadCertAndKey(certFile, keyFile); err != nil {
+		return err
+	} else if ok {
+		certs, err := certutil.CertsFromFile(certFile)
+		if err != nil {
+			return fmt.Errorf("error reading client certificate file %q: %w", certFile, err)
+		}
+		cert := certs[0]
+		if cert.Subject.CommonName == userName && slices.Equal(cert.Subject.Organization, groups) &&
+			cert.CheckSignatureFrom(ca) == nil && time.Now().Add(clientCertRenewBefore).Before(cert.NotAfter) {
+			return nil
+		}
+	}
+
+	klog.Background().WithValues("cert", certFile, "key", keyFile, "user", userName).Info("generating client certificate")
+	encodedCert, encodedKey, err := signClientCert(ca, caKeyFile, userName, groups, clientCertValidity)
+	if err != nil {
+		return err
+	}
+	if err := keyutil.WriteKey(keyFile, encodedKey); err != nil {
+		return fmt.Errorf("error writing client private key file %q: %w", keyFile, err)
+	}
+	if err := certutil.WriteCert(certFile, encodedCert); err != nil {
+		return fmt.Errorf("error writing client certificate file %q: %w", certFile, err)
+	}
+	return nil
+}
+
+// ensurePeerCert signs a peer certificate for the given name and hosts with the
+// given CA, unless the certificate file already holds a valid one.
+func ensurePeerCert(caCertFile, caKeyFile, certFile, keyFile, name string, hosts []string) error {
+	cas, err := certutil.CertsFromFile(caCertFile)
+	if err != nil {
+		return fmt.Errorf("error reading CA certificate file %q: %w", caCertFile, err)
+	}
+	ca := cas[0]
+
+	if ok, err := certutil.CanReadCertAndKey(certFile, keyFile); err != nil {
+		return err
+	} else if ok {
+		certs, err := certutil.CertsFromFile(certFile)
+		if err != nil {
+			return fmt.Errorf("error reading peer certificate file %q: %w", certFile, err)
+		}
+		cert := certs[0]
+		if cert.Subject.CommonName == name && slices.Equal(certHosts(cert), sortedHosts(hosts)) &&
+			cert.CheckSignatureFrom(ca) == nil && time.Now().Add(peerCertRenewBefore).Before(cert.NotAfter) {
+			return nil
+		}
+	}
+
+	klog.Background().WithValues("cert", certFile, "key", keyFile, "name", name).Info("generating peer certificate")
+	encodedCert, encodedKey, err := signPeerCert(ca, caKeyFile, name, hosts, peerCertValidity)
+	if err != nil {
+		return err
+	}
+	if err := keyutil.WriteKey(keyFile, encodedKey); err != nil {
+		return fmt.Errorf("error writing peer private key file %q: %w", keyFile, err)
+	}
+	if err := certutil.WriteCert(certFile, encodedCert); err != nil {
+		return fmt.Errorf("error writing peer certificate file %q: %w", certFile, err)
+	}
+	return nil
+}
+
+// certHosts returns the sorted IP addresses and DNS names of the given certificate.
+func certHosts(cert *x509.Certificate) []string {
+	hosts := slices.Clone(cert.DNSNames)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return sortedHosts(hosts)
+}
+
+// sortedHosts returns the given hosts sorted and without duplicates, with IP
+// addresses in their canonical form.
+func sortedHosts(hosts []string) []string {
+	sorted := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		sorted = append(sorted, host)
+	}
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
+
+// signClientCert returns a new PEM encoded client certificate and key for the
+// given user and groups, signed by the given CA and valid for the given duration.
+func signClientCert(ca *x509.Certificate, caKeyFile, userName string, groups []string, validity time.Duration) ([]byte, []byte, error) {
+	now := time.Now()
+	return signCert(ca, caKeyFile, &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   userName,
+			Organization: groups,
+		},
+		NotBefore:   now.Add(-time.Minute).UTC(),
+		NotAfter:    now.Add(validity).UTC(),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// signPeerCert returns a new PEM encoded certificate and key for both ends of
+// the given hosts, i.e. DNS names or IPs, signed by the given CA and valid
+// for the given duration.
+func signPeerCert(ca *x509.Certificate, caKeyFile, commonName string, hosts []string, validity time.Duration) ([]byte, []byte, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		NotBefore:   now.Add(-time.Minute).UTC(),
+		NotAfter:    now.Add(validity).UTC(),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return signCert(ca, caKeyFile, template)
+}
+
+// signCert returns a new PEM encoded certificate of the given template and
+// its key, signed by the given CA.
+func signCert(ca *x509.Certificate, caKeyFile string, template *x509.Certificate) ([]byte, []byte, error) {
+	caKey, err := keyutil.PrivateKeyFromFile(caKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading CA private key file %q: %w", caKeyFile, err)
+	}
+	caSigner, ok := caKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA private key file %q does not contain a signing key", caKeyFile)
+	}
+
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating private key: %w", err)
+	}
+	serial, err := cryptorand.Int(cryptorand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, ca, key.Public(), caSigner)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error signing certificate: %w", err)
+	}
+
+	encodedKey, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error converting private key to PEM format: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: certutil.CertificateBlockType, Bytes: der}), encodedKey, nil
+}
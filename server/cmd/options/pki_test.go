@@ -0,0 +1,211 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func TestEnsureClientCert(t *testing.T) {
+	dir := t.TempDir()
+	caFile, caKeyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := ensureCA(caFile, caKeyFile, "test-ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureClientCert(caFile, caKeyFile, certFile, keyFile, "alice", []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a matching certificate is kept
+	if err := ensureClientCert(caFile, caKeyFile, certFile, keyFile, "alice", []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _ := os.ReadFile(certFile); string(kept) != string(first) {
+		t.Errorf("matching client certificate was regenerated")
+	}
+
+	// different groups regenerate the certificate
+	if err := ensureClientCert(caFile, caKeyFile, certFile, keyFile, "alice", []string{"ops"}); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := certutil.CertsFromFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs[0].Subject.CommonName != "alice" || len(certs[0].Subject.Organization) != 1 || certs[0].Subject.Organization[0] != "ops" {
+		t.Errorf("unexpected subject %v", certs[0].Subject)
+	}
+
+	// a new CA regenerates the certificate
+	for _, path := range []string{caFile, caKeyFile} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ensureCA(caFile, caKeyFile, "test-ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureClientCert(caFile, caKeyFile, certFile, keyFile, "alice", []string{"ops"}); err != nil {
+		t.Fatal(err)
+	}
+	cas, err := certutil.CertsFromFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err = certutil.CertsFromFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certs[0].CheckSignatureFrom(cas[0]); err != nil {
+		t.Errorf("client certificate is not signed by the new CA: %v", err)
+	}
+}
+
+func TestEnsurePeerCert(t *testing.T) {
+	dir := t.TempDir()
+	caFile, caKeyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	certFile, keyFile := filepath.Join(dir, "peer", "cert.pem"), filepath.Join(dir, "peer", "key.pem")
+	if err := ensureCA(caFile, caKeyFile, "test-ca"); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		t.Helper()
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-0", []string{"127.0.0.1", "gcp-0.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	first := read()
+
+	// a matching certificate is kept, regardless of the order of the hosts
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-0", []string{"gcp-0.example.com", "127.0.0.1", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if read() != first {
+		t.Errorf("matching peer certificate was regenerated")
+	}
+
+	// different hosts regenerate the certificate
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-0", []string{"127.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := certutil.CertsFromFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.2"}, certHosts(certs[0])); diff != "" {
+		t.Errorf("unexpected hosts (-want +got):\n%s", diff)
+	}
+	second := read()
+
+	// a different name regenerates the certificate
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-1", []string{"127.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if read() == second {
+		t.Errorf("peer certificate of another name was kept")
+	}
+
+	// a certificate about to expire is renewed
+	cas, err := certutil.CertsFromFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := signPeerCert(cas[0], caKeyFile, "gcp-1", []string{"127.0.0.2"}, peerCertRenewBefore-time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-1", []string{"127.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if read() == string(cert) {
+		t.Errorf("expiring peer certificate was kept")
+	}
+
+	// a new CA regenerates the certificate
+	for _, path := range []string{caFile, caKeyFile} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ensureCA(caFile, caKeyFile, "test-ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensurePeerCert(caFile, caKeyFile, certFile, keyFile, "gcp-1", []string{"127.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if cas, err = certutil.CertsFromFile(caFile); err != nil {
+		t.Fatal(err)
+	}
+	if certs, err = certutil.CertsFromFile(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := certs[0].CheckSignatureFrom(cas[0]); err != nil {
+		t.Errorf("peer certificate is not signed by the new CA: %v", err)
+	}
+}
+
+func TestWriteCABundle(t *testing.T) {
+	dir := t.TempDir()
+	clientCA, signerCA := filepath.Join(dir, "client-ca.crt"), filepath.Join(dir, "csr-signer-ca.crt")
+	if err := ensureCA(clientCA, filepath.Join(dir, "client-ca.key"), "gcp-client-ca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureCA(signerCA, filepath.Join(dir, "csr-signer-ca.key"), "gcp-csr-signer-ca"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(dir, "client-ca-bundle.crt")
+	if err := writeCABundle(bundle, clientCA, signerCA); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := certutil.CertsFromFile(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].Subject.CommonName != "gcp-client-ca" || certs[1].Subject.CommonName != "gcp-csr-signer-ca" {
+		t.Errorf("unexpected bundle %v", certs)
+	}
+
+	if err := writeCABundle(bundle, filepath.Join(dir, "missing.crt")); err == nil {
+		t.Errorf("expected an error for a missing CA file")
+	}
+}
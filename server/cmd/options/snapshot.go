@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kcp-dev/embeddedetcd"
+	etcdoptions "github.com/kcp-dev/embeddedetcd/options"
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+
+	"github.com/kcp-dev/generic-controlplane/server/snapshot"
+)
+
+// snapshotDialTimeout is the timeout to connect to the running embedded etcd.
+const snapshotDialTimeout = 5 * time.Second
+
+// SnapshotOptions holds the configuration of the snapshot commands, which save
+// and restore snapshots of the embedded etcd.
+type SnapshotOptions struct {
+	EmbeddedEtcd etcdoptions.Options
+	// EtcdCluster is the membership of the restored member.
+	EtcdCluster EtcdCluster
+
+	// Offline saves the snapshot from the data directory of a stopped server
+	// instead of the running embedded etcd.
+	Offline bool
+}
+
+// NewSnapshotOptions returns a new SnapshotOptions for the given root directory.
+func NewSnapshotOptions(rootDir string) *SnapshotOptions {
+	o := &SnapshotOptions{
+		EmbeddedEtcd: *etcdoptions.NewOptions(rootDir),
+		EtcdCluster:  *NewEtcdCluster(rootDir),
+	}
+	o.EmbeddedEtcd.Enabled = true
+	return o
+}
+
+// AddFlags adds the flags of the embedded etcd used by the snapshot commands to the given FlagSet.
+func (o *SnapshotOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.EmbeddedEtcd.Directory, "embedded-etcd-directory", o.EmbeddedEtcd.Directory, "Directory for embedded etcd")
+	fs.StringVar(&o.EmbeddedEtcd.PeerPort, "embedded-etcd-peer-port", o.EmbeddedEtcd.PeerPort, "Port for embedded etcd peer")
+	fs.StringVar(&o.EmbeddedEtcd.ClientPort, "embedded-etcd-client-port", o.EmbeddedEtcd.ClientPort, "Port for embedded etcd client")
+}
+
+// AddSaveFlags adds the flags of the snapshot save command to the given FlagSet.
+func (o *SnapshotOptions) AddSaveFlags(fs *pflag.FlagSet) {
+	o.AddFlags(fs)
+	fs.BoolVar(&o.Offline, "offline", o.Offline,
+		"Save the snapshot from the embedded etcd directory of a stopped server instead of the running embedded etcd.")
+}
+
+// AddRestoreFlags adds the flags of the snapshot restore command to the given FlagSet.
+func (o *SnapshotOptions) AddRestoreFlags(fs *pflag.FlagSet) {
+	o.AddFlags(fs)
+	fs.StringVar(&o.EtcdCluster.Name, "embedded-etcd-name", o.EtcdCluster.Name, "Name of the restored member of the embedded etcd cluster.")
+	fs.StringVar(&o.EtcdCluster.InitialCluster, "embedded-etcd-initial-cluster", o.EtcdCluster.InitialCluster, ""+
+		"Comma separated name=https://host:port peer URLs of the members of the restored embedded etcd cluster, including this one. "+
+		"Empty restores a single member. Every member must be restored from the same snapshot with the same initial cluster.")
+	fs.StringVar(&o.EtcdCluster.InitialClusterToken, "embedded-etcd-initial-cluster-token", o.EtcdCluster.InitialClusterToken,
+		"Token of the restored embedded etcd cluster.")
+}
+
+// Validate validates the snapshot command options.
+func (o *SnapshotOptions) Validate() []error {
+	var errs []error
+
+	if o.EmbeddedEtcd.Directory == "" {
+		errs = append(errs, fmt.Errorf("--embedded-etcd-directory must be specified"))
+	}
+	errs = append(errs, o.EmbeddedEtcd.Validate()...)
+	errs = append(errs, o.EtcdCluster.Validate()...)
+
+	return errs
+}
+
+// Save saves a verified snapshot of the embedded etcd to path.
+func (o *SnapshotOptions) Save(ctx context.Context, path string) (*snapshot.Status, error) {
+	if o.Offline {
+		return snapshot.SaveOffline(o.EmbeddedEtcd.Directory, path)
+	}
+
+	etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("", nil))
+	o.EmbeddedEtcd.Complete(etcdOptions)
+	config, err := embeddedEtcdClientConfig(etcdOptions.StorageConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Save(ctx, config, path)
+}
+
+// Restore restores the verified snapshot at path into the embedded etcd
+// directory, and returns the path of the previous member directory, if any.
+func (o *SnapshotOptions) Restore(path string) (string, error) {
+	etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("", nil))
+	config, err := embeddedetcd.NewConfig(o.EmbeddedEtcd.Complete(etcdOptions), false)
+	if err != nil {
+		return "", err
+	}
+	o.EtcdCluster.Enabled = o.EtcdCluster.InitialCluster != ""
+	if err := o.EtcdCluster.applyMembership(config.Config); err != nil {
+		return "", err
+	}
+	return snapshot.Restore(path, config.Config)
+}
+
+// embeddedEtcdClientConfig returns the etcd client config for the transport
+// config of the embedded etcd.
+func embeddedEtcdClientConfig(transportConfig storagebackend.TransportConfig) (clientv3.Config, error) {
+	tlsConfig, err := transport.TLSInfo{
+		CertFile:      transportConfig.CertFile,
+		KeyFile:       transportConfig.KeyFile,
+		TrustedCAFile: transportConfig.TrustedCAFile,
+	}.ClientConfig()
+	if err != nil {
+		return clientv3.Config{}, fmt.Errorf("failed to load the client certificate of the embedded etcd: %w", err)
+	}
+	return clientv3.Config{
+		Endpoints:   transportConfig.ServerList,
+		TLS:         tlsConfig,
+		DialTimeout: snapshotDialTimeout,
+	}, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+
+	"github.com/kcp-dev/generic-controlplane/server/sqlstorage"
+)
+
+// maxSocketPathLength is the length limit of unix socket paths on Linux and macOS.
+const maxSocketPathLength = 103
+
+const (
+	// StorageEtcd stores the data in the embedded etcd or --etcd-servers.
+	StorageEtcd = "etcd"
+	// StorageMemory keeps the data in process memory only.
+	StorageMemory = "memory"
+)
+
+// SQLStorage holds the configuration of the SQL storage, which serves the
+// etcd API from a SQLite or Postgres database when --etcd-servers is a
+// sqlite:// or postgres:// URL, or from memory with --storage=memory.
+type SQLStorage struct {
+	Enabled bool
+
+	// Storage is StorageEtcd or StorageMemory.
+	Storage string
+
+	// DataSource is the URL of the database.
+	DataSource string
+	// Socket is the unix socket the API server connects to.
+	Socket string
+}
+
+// NewSQLStorage returns a new SQLStorage for the given root directory.
+func NewSQLStorage(rootDir string) *SQLStorage {
+	return &SQLStorage{
+		Storage: StorageEtcd,
+		Socket:  filepath.Join(rootDir, "sql-storage.sock"),
+	}
+}
+
+// AddFlags adds the SQL storage flags to the flag set.
+func (s *SQLStorage) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&s.Storage, "storage", s.Storage,
+		"The storage of the server, etcd or memory. With memory, all data is kept in process memory and lost when the server stops.")
+}
+
+// Complete enables the SQL storage if the etcd servers are a SQL data source,
+// and points the etcd options to its socket.
+func (s *SQLStorage) Complete(etcdOptions *genericoptions.EtcdOptions) error {
+	servers := etcdOptions.StorageConfig.Transport.ServerList
+	if s.Storage == StorageMemory {
+		if len(servers) != 1 || servers[0] != "embedded" {
+			return fmt.Errorf("--storage=%s must not be combined with --etcd-servers", StorageMemory)
+		}
+		servers = []string{sqlstorage.MemoryDataSource}
+	}
+	for _, server := range servers {
+		if sqlstorage.IsDataSource(server) && len(servers) > 1 {
+			return fmt.Errorf("--etcd-servers must not list other servers with the SQL data source %q", redactDataSource(server))
+		}
+	}
+	if len(servers) != 1 || !sqlstorage.IsDataSource(servers[0]) {
+		return nil
+	}
+
+	s.Enabled = true
+	s.DataSource = servers[0]
+	if path := sqlstorage.SQLitePath(s.DataSource); path != "" && s.DataSource != sqlstorage.MemoryDataSource && !filepath.IsAbs(path) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		s.DataSource = strings.Replace(s.DataSource, path, abs, 1)
+	}
+	var err error
+	if s.Socket, err = filepath.Abs(s.Socket); err != nil {
+		return err
+	}
+
+	etcdOptions.StorageConfig.Transport.ServerList = []string{"unix://" + s.Socket}
+	return nil
+}
+
+// Validate validates the SQL storage options.
+func (s *SQLStorage) Validate() []error {
+	var errs []error
+
+	if s.Storage != StorageEtcd && s.Storage != StorageMemory {
+		errs = append(errs, fmt.Errorf("--storage must be %s or %s, got %q", StorageEtcd, StorageMemory, s.Storage))
+	}
+	if s.Enabled {
+		if strings.HasPrefix(s.DataSource, "sqlite://") && sqlstorage.SQLitePath(s.DataSource) == "" {
+			errs = append(errs, fmt.Errorf("--etcd-servers=sqlite://<file> must specify the database file"))
+		}
+		if len(s.Socket) > maxSocketPathLength {
+			errs = append(errs, fmt.Errorf("the SQL storage socket %q is longer than %d characters, use a shorter --root-directory", s.Socket, maxSocketPathLength))
+		}
+	}
+
+	return errs
+}
+
+// redactDataSource returns the data source without the password.
+func redactDataSource(dataSource string) string {
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	genericoptions "k8s.io/apiserver/pkg/server/options"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+
+	"github.com/kcp-dev/generic-controlplane/server/sqlstorage"
+)
+
+func TestSQLStorageComplete(t *testing.T) {
+	rootDir := t.TempDir()
+	socket := filepath.Join(rootDir, "sql-storage.sock")
+	dbFile, err := filepath.Abs("gcp.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		storage        string
+		servers        []string
+		wantEnabled    bool
+		wantDataSource string
+		wantServers    []string
+		wantErr        string
+	}{
+		{
+			name:        "embedded etcd",
+			storage:     StorageEtcd,
+			servers:     []string{"embedded"},
+			wantServers: []string{"embedded"},
+		},
+		{
+			name:        "etcd servers",
+			storage:     StorageEtcd,
+			servers:     []string{"https://etcd-1:2379", "https://etcd-2:2379"},
+			wantServers: []string{"https://etcd-1:2379", "https://etcd-2:2379"},
+		},
+		{
+			name:           "memory",
+			storage:        StorageMemory,
+			servers:        []string{"embedded"},
+			wantEnabled:    true,
+			wantDataSource: sqlstorage.MemoryDataSource,
+			wantServers:    []string{"unix://" + socket},
+		},
+		{
+			name:    "memory with etcd servers",
+			storage: StorageMemory,
+			servers: []string{"https://etcd-1:2379"},
+			wantErr: "must not be combined with --etcd-servers",
+		},
+		{
+			name:    "memory with sqlite",
+			storage: StorageMemory,
+			servers: []string{"sqlite://gcp.db"},
+			wantErr: "must not be combined with --etcd-servers",
+		},
+		{
+			name:           "relative sqlite file",
+			storage:        StorageEtcd,
+			servers:        []string{"sqlite://gcp.db?_pragma=foreign_keys(1)"},
+			wantEnabled:    true,
+			wantDataSource: "sqlite://" + dbFile + "?_pragma=foreign_keys(1)",
+			wantServers:    []string{"unix://" + socket},
+		},
+		{
+			name:           "postgres",
+			storage:        StorageEtcd,
+			servers:        []string{"postgres://gcp:secret@db:5432/gcp"},
+			wantEnabled:    true,
+			wantDataSource: "postgres://gcp:secret@db:5432/gcp",
+			wantServers:    []string{"unix://" + socket},
+		},
+		{
+			name:    "data source with other servers",
+			storage: StorageEtcd,
+			servers: []string{"postgres://gcp:secret@db:5432/gcp", "https://etcd-1:2379"},
+			wantErr: `"postgres://gcp:xxxxx@db:5432/gcp"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSQLStorage(rootDir)
+			s.Storage = tt.storage
+			etcdOptions := genericoptions.NewEtcdOptions(storagebackend.NewDefaultConfig("/registry", nil))
+			etcdOptions.StorageConfig.Transport.ServerList = tt.servers
+
+			err := s.Complete(etcdOptions)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Enabled != tt.wantEnabled {
+				t.Errorf("Enabled = %v, want %v", s.Enabled, tt.wantEnabled)
+			}
+			if s.DataSource != tt.wantDataSource {
+				t.Errorf("DataSource = %q, want %q", s.DataSource, tt.wantDataSource)
+			}
+			if diff := cmp.Diff(tt.wantServers, etcdOptions.StorageConfig.Transport.ServerList); diff != "" {
+				t.Errorf("unexpected etcd servers (-want +got):\n%s", diff)
+			}
+			if errs := s.Validate(); len(errs) > 0 {
+				t.Errorf("unexpected validation errors: %v", errs)
+			}
+		})
+	}
+}
+
+func TestSQLStorageValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage *SQLStorage
+		wantErr string
+	}{
+		{name: "etcd", storage: &SQLStorage{Storage: StorageEtcd}},
+		{name: "memory", storage: &SQLStorage{Storage: StorageMemory, Enabled: true, DataSource: sqlstorage.MemoryDataSource, Socket: "/tmp/sql-storage.sock"}},
+		{name: "unknown storage", storage: &SQLStorage{Storage: "disk"}, wantErr: `--storage must be etcd or memory, got "disk"`},
+		{name: "sqlite without file", storage: &SQLStorage{Storage: StorageEtcd, Enabled: true, DataSource: "sqlite://"}, wantErr: "must specify the database file"},
+		{
+			name:    "long socket path",
+			storage: &SQLStorage{Storage: StorageMemory, Enabled: true, DataSource: sqlstorage.MemoryDataSource, Socket: "/" + strings.Repeat("a", maxSocketPathLength)},
+			wantErr: "use a shorter --root-directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.storage.Validate()
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("unexpected errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr) {
+				t.Errorf("expected one error containing %q, got %v", tt.wantErr, errs)
+			}
+		})
+	}
+}
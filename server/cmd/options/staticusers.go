@@ -0,0 +1,295 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// StaticUsersAPIVersion is the apiVersion of the static users file.
+	StaticUsersAPIVersion = "gcp.kcp.io/v1alpha1"
+	// StaticUsersKind is the kind of the static users file.
+	StaticUsersKind = "StaticUsers"
+
+	// staticUsersReloadInterval is the interval to check the static users file for changes.
+	staticUsersReloadInterval = 10 * time.Second
+)
+
+// StaticUsers is the content of the static users file, e.g.
+//
+//	apiVersion: gcp.kcp.io/v1alpha1
+//	kind: StaticUsers
+//	users:
+//	- name: alice
+//	  groups: ["dev"]
+//	  token: 0c1f3a6e-...
+//	- name: bob
+//	  tokenSHA256: 9f86d081884c7d65...
+//	- name: carol
+//	  groups: ["ops"]
+//	  clientCertificate: true
+type StaticUsers struct {
+	APIVersion string       `json:"apiVersion"`
+	Kind       string       `json:"kind"`
+	Users      []StaticUser `json:"users"`
+}
+
+// StaticUser is a user of the static users file with token or client
+// certificate credentials.
+type StaticUser struct {
+	// Name is the user name. It is also the name of the user's kubeconfig context.
+	Name string `json:"name"`
+	// UID is the optional user UID.
+	UID string `json:"uid,omitempty"`
+	// Groups are the groups of the user.
+	Groups []string `json:"groups,omitempty"`
+
+	// Token is a bearer token of the user.
+	Token string `json:"token,omitempty"`
+	// TokenSHA256 is the hex encoded SHA-256 hash of a bearer token of the
+	// user. Users with only a token hash get no kubeconfig context.
+	TokenSHA256 string `json:"tokenSHA256,omitempty"`
+	// ClientCertificate requests a client certificate signed by the admin
+	// client CA for the user.
+	ClientCertificate bool `json:"clientCertificate,omitempty"`
+}
+
+// reservedUserNames are the names of the built-in identities and the cluster
+// context of the kubeconfig.
+var reservedUserNames = sets.New[string](gcpAdminUserName, gcpUserUserName, "root")
+
+// loadStaticUsers reads and validates the static users file.
+func loadStaticUsers(data []byte) (*StaticUsers, error) {
+	var users StaticUsers
+	if err := yaml.UnmarshalStrict(data, &users); err != nil {
+		return nil, err
+	}
+	if users.APIVersion != StaticUsersAPIVersion || users.Kind != StaticUsersKind {
+		return nil, fmt.Errorf("unsupported apiVersion %q and kind %q, expected %s %s", users.APIVersion, users.Kind, StaticUsersAPIVersion, StaticUsersKind)
+	}
+
+	names := sets.New[string]()
+	for i, u := range users.Users {
+		switch {
+		case u.Name == "":
+			return nil, fmt.Errorf("users[%d]: name is required", i)
+		case reservedUserNames.Has(u.Name):
+			return nil, fmt.Errorf("users[%d]: name %q is reserved", i, u.Name)
+		case strings.ContainsAny(u.Name, "/@"):
+			return nil, fmt.Errorf("users[%d]: name %q must not contain '/' or '@'", i, u.Name)
+		case names.Has(u.Name):
+			return nil, fmt.Errorf("users[%d]: duplicate name %q", i, u.Name)
+		case u.Token != "" && u.TokenSHA256 != "":
+			return nil, fmt.Errorf("users[%d]: token and tokenSHA256 are mutually exclusive", i)
+		case u.Token == "" && u.TokenSHA256 == "" && !u.ClientCertificate:
+			return nil, fmt.Errorf("users[%d]: one of token, tokenSHA256 or clientCertificate is required", i)
+		case u.TokenSHA256 != "" && !isSHA256Hex(u.TokenSHA256):
+			return nil, fmt.Errorf("users[%d]: tokenSHA256 must be a hex encoded SHA-256 hash of 64 characters", i)
+		}
+		names.Insert(u.Name)
+	}
+	return &users, nil
+}
+
+// isSHA256Hex returns true if the value is a hex encoded SHA-256 hash.
+func isSHA256Hex(value string) bool {
+	decoded, err := hex.DecodeString(value)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// staticUsers authenticates the tokens of the static users file and keeps
+// the client certificates of its users up-to-date. It is reloaded when the
+// file changes.
+type staticUsers struct {
+	path                          string
+	certDir                       string
+	clientCAFile, clientCAKeyFile string
+
+	lock    sync.RWMutex
+	data    []byte
+	users   *StaticUsers
+	byToken map[string]*user.DefaultInfo
+
+	// onChange is called after the file has been reloaded successfully.
+	onChangeLock sync.Mutex
+	onChange     func() error
+}
+
+var _ authenticator.Token = &staticUsers{}
+
+func newStaticUsers(path, certDir, clientCAFile, clientCAKeyFile string) (*staticUsers, error) {
+	s := &staticUsers{
+		path:            path,
+		certDir:         certDir,
+		clientCAFile:    clientCAFile,
+		clientCAKeyFile: clientCAKeyFile,
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load static users file %q: %w", path, err)
+	}
+	return s, nil
+}
+
+// reload reads the static users file and returns true if it has changed.
+func (s *staticUsers) reload() (bool, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	unchanged := s.users != nil && bytes.Equal(data, s.data)
+	s.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	users, err := loadStaticUsers(data)
+	if err != nil {
+		return false, err
+	}
+
+	byToken := map[string]*user.DefaultInfo{}
+	for _, u := range users.Users {
+		info := &user.DefaultInfo{Name: u.Name, UID: u.UID, Groups: u.Groups}
+		switch {
+		case u.Token != "":
+			byToken[hashToken(u.Token)] = info
+		case u.TokenSHA256 != "":
+			byToken[strings.ToLower(u.TokenSHA256)] = info
+		}
+		if u.ClientCertificate {
+			if err := ensureCA(s.clientCAFile, s.clientCAKeyFile, "gcp-client-ca"); err != nil {
+				return false, err
+			}
+			certFile, keyFile := s.clientCertFiles(u.Name)
+			if err := ensureClientCert(s.clientCAFile, s.clientCAKeyFile, certFile, keyFile, u.Name, u.Groups); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data = data
+	s.users = users
+	s.byToken = byToken
+	return true, nil
+}
+
+// run reloads the static users file periodically until the context is done.
+func (s *staticUsers) run(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithValues("path", s.path)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		changed, err := s.reload()
+		if err != nil {
+			logger.Error(err, "Failed to reload static users file, keeping the previous users")
+			return
+		}
+		if !changed {
+			return
+		}
+		logger.Info("Reloaded static users file")
+		s.onChangeLock.Lock()
+		defer s.onChangeLock.Unlock()
+		if s.onChange != nil {
+			if err := s.onChange(); err != nil {
+				logger.Error(err, "Failed to apply reloaded static users")
+			}
+		}
+	}, staticUsersReloadInterval)
+}
+
+// setOnChange sets the function called after the file has been reloaded.
+func (s *staticUsers) setOnChange(onChange func() error) {
+	s.onChangeLock.Lock()
+	defer s.onChangeLock.Unlock()
+	s.onChange = onChange
+}
+
+func (s *staticUsers) clientCertFiles(name string) (string, string) {
+	return filepath.Join(s.certDir, name+".crt"), filepath.Join(s.certDir, name+".key")
+}
+
+// hasClientCert returns true if the given user with the given groups requests
+// a client certificate.
+func (s *staticUsers) hasClientCert(userName string, groups []string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, u := range s.users.Users {
+		if u.Name == userName {
+			return u.ClientCertificate && slices.Equal(u.Groups, groups)
+		}
+	}
+	return false
+}
+
+// AuthenticateToken implements authenticator.Token.
+func (s *staticUsers) AuthenticateToken(_ context.Context, token string) (*authenticator.Response, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if info, ok := s.byToken[hashToken(token)]; ok {
+		return &authenticator.Response{User: info}, true, nil
+	}
+	return nil, false, nil
+}
+
+// addAuthInfos adds a user for every static user with a token or client
+// certificate to the kubeconfig.
+func (s *staticUsers) addAuthInfos(kubeConfig *clientcmdapi.Config) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, u := range s.users.Users {
+		authInfo := &clientcmdapi.AuthInfo{}
+		switch {
+		case u.Token != "":
+			authInfo.Token = u.Token
+		case u.ClientCertificate:
+			certFile, keyFile := s.clientCertFiles(u.Name)
+			var err error
+			if authInfo.ClientCertificateData, err = os.ReadFile(certFile); err != nil {
+				return err
+			}
+			if authInfo.ClientKeyData, err = os.ReadFile(keyFile); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		kubeConfig.AuthInfos[u.Name] = authInfo
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const staticUsersHeader = "apiVersion: gcp.kcp.io/v1alpha1\nkind: StaticUsers\n"
+
+func TestLoadStaticUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			data: staticUsersHeader + "users:\n- name: alice\n  token: a\n- name: bob\n  tokenSHA256: " + strings.ToUpper(hashToken("b")) + "\n- name: carol\n  clientCertificate: true\n",
+		},
+		{name: "wrong kind", data: "apiVersion: gcp.kcp.io/v1alpha1\nkind: Users\n", wantErr: "unsupported apiVersion"},
+		{name: "unknown field", data: staticUsersHeader + "users:\n- name: alice\n  password: a\n", wantErr: "unknown field"},
+		{name: "missing name", data: staticUsersHeader + "users:\n- token: a\n", wantErr: "name is required"},
+		{name: "reserved name", data: staticUsersHeader + "users:\n- name: root\n  token: a\n", wantErr: `name "root" is reserved`},
+		{name: "invalid name", data: staticUsersHeader + "users:\n- name: a@b\n  token: a\n", wantErr: "must not contain"},
+		{name: "duplicate name", data: staticUsersHeader + "users:\n- name: alice\n  token: a\n- name: alice\n  token: b\n", wantErr: `duplicate name "alice"`},
+		{name: "token and hash", data: staticUsersHeader + "users:\n- name: alice\n  token: a\n  tokenSHA256: ab\n", wantErr: "mutually exclusive"},
+		{name: "no credentials", data: staticUsersHeader + "users:\n- name: alice\n", wantErr: "is required"},
+		{name: "short hash", data: staticUsersHeader + "users:\n- name: alice\n  tokenSHA256: ab\n", wantErr: "tokenSHA256 must be a hex encoded SHA-256 hash"},
+		{name: "base64 hash", data: staticUsersHeader + "users:\n- name: alice\n  tokenSHA256: n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=\n", wantErr: "tokenSHA256 must be a hex encoded SHA-256 hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadStaticUsers([]byte(tt.data))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStaticUsersReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	authenticated := func(s *staticUsers, token string) string {
+		t.Helper()
+		resp, ok, err := s.AuthenticateToken(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return ""
+		}
+		return resp.User.GetName()
+	}
+
+	write(staticUsersHeader + "users:\n- name: alice\n  groups: [dev]\n  token: alice-token\n")
+	s, err := newStaticUsers(path, filepath.Join(dir, "users"), filepath.Join(dir, "client-ca.crt"), filepath.Join(dir, "client-ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := authenticated(s, "alice-token"); name != "alice" {
+		t.Errorf("alice-token authenticated as %q", name)
+	}
+
+	if changed, err := s.reload(); err != nil || changed {
+		t.Errorf("reload of an unchanged file returned %v, %v", changed, err)
+	}
+
+	write(staticUsersHeader + "users:\n" +
+		"- name: bob\n  tokenSHA256: " + hashToken("bob-token") + "\n" +
+		"- name: carol\n  groups: [ops]\n  clientCertificate: true\n")
+	if changed, err := s.reload(); err != nil || !changed {
+		t.Fatalf("reload of a changed file returned %v, %v", changed, err)
+	}
+	if name := authenticated(s, "alice-token"); name != "" {
+		t.Errorf("token of the removed user authenticated as %q", name)
+	}
+	if name := authenticated(s, "bob-token"); name != "bob" {
+		t.Errorf("bob-token authenticated as %q", name)
+	}
+
+	kubeConfig := clientcmdapi.NewConfig()
+	if err := s.addAuthInfos(kubeConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kubeConfig.AuthInfos["bob"]; ok {
+		t.Errorf("user with only a token hash got a kubeconfig user")
+	}
+	if carol, ok := kubeConfig.AuthInfos["carol"]; !ok || len(carol.ClientCertificateData) == 0 || len(carol.ClientKeyData) == 0 {
+		t.Errorf("user with client certificate got no kubeconfig user with certificate")
+	}
+
+	// an invalid file keeps the previous users
+	for _, data := range []string{
+		"users:\n- name: root\n  token: root-token\n",
+		"users:\n- name: bob\n  tokenSHA256: bob-token\n",
+	} {
+		write(staticUsersHeader + data)
+		if _, err := s.reload(); err == nil {
+			t.Errorf("expected an error reloading the invalid file %q", data)
+		}
+		if name := authenticated(s, "bob-token"); name != "bob" {
+			t.Errorf("previous users were not kept, bob-token authenticated as %q", name)
+		}
+	}
+}
+
+func TestStaticUsersRunCallsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.yaml")
+	if err := os.WriteFile(path, []byte(staticUsersHeader+"users:\n- name: alice\n  token: a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newStaticUsers(path, dir, filepath.Join(dir, "client-ca.crt"), filepath.Join(dir, "client-ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 1)
+	s.setOnChange(func() error {
+		changed <- struct{}{}
+		return nil
+	})
+	if err := os.WriteFile(path, []byte(staticUsersHeader+"users:\n- name: bob\n  token: b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	select {
+	case <-changed:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("onChange was not called")
+	}
+	if _, ok, _ := s.AuthenticateToken(ctx, "b"); !ok {
+		t.Errorf("reloaded token is not authenticated")
+	}
+}
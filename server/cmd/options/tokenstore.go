@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/uuid"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+// tokenStore is the content of the admin token hash file. Only the SHA-256
+// hashes of the tokens are persisted. The tokens themselves are only written
+// to the kubeconfig or its Secret, and reused from there across restarts.
+type tokenStore struct {
+	Users map[string]storedToken `json:"users"`
+}
+
+type storedToken struct {
+	UID  string `json:"uid"`
+	Hash string `json:"sha256"`
+}
+
+// newStoredToken returns a new random token and its stored hash.
+func newStoredToken() (string, storedToken) {
+	token := uuid.New().String()
+	return token, storedToken{UID: uuid.New().String(), Hash: hashToken(token)}
+}
+
+// matches returns true if the token matches the stored hash.
+func (t storedToken) matches(token string) bool {
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.Hash)) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTokenStore reads the token hash file. A missing file results in an
+// empty store.
+func loadTokenStore(path string) (*tokenStore, error) {
+	store := &tokenStore{Users: map[string]storedToken{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("failed to parse token hash file %q: %w", path, err)
+	}
+	if store.Users == nil {
+		store.Users = map[string]storedToken{}
+	}
+	return store, nil
+}
+
+// write writes the token hash file atomically, readable only by the owner.
+func (s *tokenStore) write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// loadKubeConfigTokens reads the tokens of the kubeconfig, mapping user names
+// to tokens. A missing kubeconfig results in no tokens.
+func loadKubeConfigTokens(path string) (map[string]string, error) {
+	tokens := map[string]string{}
+	if path == "" {
+		return tokens, nil
+	}
+	kubeConfig, err := clientcmd.LoadFromFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig %q: %w", path, err)
+	}
+	return kubeConfigTokens(kubeConfig), nil
+}
+
+// kubeConfigTokens returns the tokens of the kubeconfig, mapping user names to
+// tokens.
+func kubeConfigTokens(kubeConfig *clientcmdapi.Config) map[string]string {
+	tokens := map[string]string{}
+	for name, authInfo := range kubeConfig.AuthInfos {
+		if authInfo.Token != "" {
+			tokens[name] = authInfo.Token
+		}
+	}
+	return tokens
+}
+
+// ensureTokens returns the tokens of the given users and the store with their
+// hashes. The existing tokens, as handed out by a previous start, are reused if
+// they match the persisted hashes. Otherwise, or if rotate is set, new tokens
+// are generated and the token hash file is written. Tokens of other users are
+// removed. No files are used if hashFilePath is empty.
+func ensureTokens(hashFilePath string, existing map[string]string, names []string, rotate bool) (*tokenStore, map[string]string, error) {
+	logger := klog.Background()
+
+	store := &tokenStore{Users: map[string]storedToken{}}
+	if hashFilePath != "" {
+		var err error
+		if store, err = loadTokenStore(hashFilePath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tokens := map[string]string{}
+	changed := false
+	for _, name := range names {
+		stored, ok := store.Users[name]
+		if ok && !rotate && stored.matches(existing[name]) {
+			tokens[name] = existing[name]
+			continue
+		}
+		if ok && !rotate {
+			logger.Info("No token matching the persisted hash in the kubeconfig, generating a new token", "user", name)
+		}
+		tokens[name], store.Users[name] = newStoredToken()
+		changed = true
+	}
+	// invalidate the tokens of users which no longer get one
+	for name := range store.Users {
+		if !slices.Contains(names, name) {
+			delete(store.Users, name)
+			changed = true
+		}
+	}
+	if changed && hashFilePath != "" {
+		if err := store.write(hashFilePath); err != nil {
+			return nil, nil, fmt.Errorf("failed to write token hash file: %w", err)
+		}
+		logger.Info("Generated new tokens", "path", hashFilePath)
+	}
+	return store, tokens, nil
+}
+
+// writeFileAtomic writes the file atomically, readable only by the owner.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
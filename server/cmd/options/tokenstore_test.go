@@ -0,0 +1,217 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestStoredTokenMatches(t *testing.T) {
+	token, stored := newStoredToken()
+	if !stored.matches(token) {
+		t.Errorf("token does not match its own hash")
+	}
+	if stored.matches(token + "x") {
+		t.Errorf("different token matches")
+	}
+	if stored.matches("") {
+		t.Errorf("empty token matches")
+	}
+	if (storedToken{}).matches("") {
+		t.Errorf("empty token matches an empty hash")
+	}
+}
+
+// writeKubeConfigTokens writes a kubeconfig with the given tokens, as the
+// server does with the tokens returned by ensureTokens.
+func writeKubeConfigTokens(t *testing.T, path string, tokens map[string]string) {
+	t.Helper()
+	kubeConfig := clientcmdapi.NewConfig()
+	for name, token := range tokens {
+		kubeConfig.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: token}
+	}
+	if err := clientcmd.WriteToFile(*kubeConfig, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readKubeConfigTokens reads the tokens of the kubeconfig, as the server does
+// on start.
+func readKubeConfigTokens(t *testing.T, path string) map[string]string {
+	t.Helper()
+	tokens, err := loadKubeConfigTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestEnsureTokens(t *testing.T) {
+	names := []string{gcpAdminUserName, gcpUserUserName}
+	dir := t.TempDir()
+	hashFile, kubeConfigFile := filepath.Join(dir, ".admin-token-store"), filepath.Join(dir, "admin.kubeconfig")
+
+	// first start generates tokens
+	store, tokens, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if tokens[name] == "" || !store.Users[name].matches(tokens[name]) {
+			t.Fatalf("no valid token generated for %q", name)
+		}
+	}
+	info, err := os.Stat(hashFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("%s has mode %v, want 0600", hashFile, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(hashFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if strings.Contains(string(data), tokens[name]) {
+			t.Errorf("token of %q is persisted in the token hash file", name)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the token hash file, got %v", entries)
+	}
+
+	// restart reuses the tokens of the kubeconfig
+	writeKubeConfigTokens(t, kubeConfigFile, tokens)
+	store, reused, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if reused[name] != tokens[name] {
+			t.Errorf("token of %q was not reused", name)
+		}
+		if !store.Users[name].matches(reused[name]) {
+			t.Errorf("reused token of %q does not match", name)
+		}
+	}
+
+	// a token not matching its hash is regenerated, the others are kept
+	writeKubeConfigTokens(t, kubeConfigFile, map[string]string{gcpAdminUserName: "tampered", gcpUserUserName: tokens[gcpUserUserName]})
+	_, regenerated, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regenerated[gcpAdminUserName] == tokens[gcpAdminUserName] || regenerated[gcpAdminUserName] == "tampered" {
+		t.Errorf("token not matching its hash was not regenerated")
+	}
+	if regenerated[gcpUserUserName] != tokens[gcpUserUserName] {
+		t.Errorf("matching token was not reused")
+	}
+
+	// a lost kubeconfig regenerates all tokens
+	if err := os.Remove(kubeConfigFile); err != nil {
+		t.Fatal(err)
+	}
+	_, lost, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if lost[name] == regenerated[name] {
+			t.Errorf("token of %q was reused without kubeconfig", name)
+		}
+	}
+
+	// rotation generates new tokens and invalidates the old ones
+	writeKubeConfigTokens(t, kubeConfigFile, lost)
+	store, rotated, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), names, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if rotated[name] == lost[name] {
+			t.Errorf("token of %q was not rotated", name)
+		}
+		if store.Users[name].matches(lost[name]) {
+			t.Errorf("old token of %q still matches", name)
+		}
+	}
+}
+
+func TestEnsureTokensWithoutFiles(t *testing.T) {
+	names := []string{gcpAdminUserName}
+	store, tokens, err := ensureTokens("", nil, names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Users[gcpAdminUserName].matches(tokens[gcpAdminUserName]) {
+		t.Errorf("no valid token generated")
+	}
+}
+
+func TestLoadTokenStoreInvalid(t *testing.T) {
+	hashFile := filepath.Join(t.TempDir(), ".admin-token-store")
+	if err := os.WriteFile(hashFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ensureTokens(hashFile, nil, []string{gcpAdminUserName}, false); err == nil {
+		t.Errorf("expected an error for an invalid token hash file")
+	}
+}
+
+func TestEnsureTokensRemovesUsers(t *testing.T) {
+	dir := t.TempDir()
+	hashFile, kubeConfigFile := filepath.Join(dir, ".admin-token-store"), filepath.Join(dir, "admin.kubeconfig")
+	_, tokens, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), []string{gcpAdminUserName, gcpUserUserName}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKubeConfigTokens(t, kubeConfigFile, tokens)
+
+	store, reused, err := ensureTokens(hashFile, readKubeConfigTokens(t, kubeConfigFile), []string{gcpUserUserName}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Users[gcpAdminUserName]; ok {
+		t.Errorf("hash of the admin token was kept")
+	}
+	if _, ok := reused[gcpAdminUserName]; ok {
+		t.Errorf("admin token was returned")
+	}
+	if reused[gcpUserUserName] != tokens[gcpUserUserName] {
+		t.Errorf("user token was not reused")
+	}
+
+	persisted, err := loadTokenStore(hashFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := persisted.Users[gcpAdminUserName]; ok {
+		t.Errorf("admin token hash was kept in the token hash file")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// defaultRootDirectory is the root directory the defaults of all commands are
+// built from.
+const defaultRootDirectory = ".gcp"
+
+// rootDirectory is the value of the persistent --root-directory flag.
+var rootDirectory = defaultRootDirectory
+
+// AddRootDirectoryFlag adds the persistent --root-directory flag to the given
+// root command. Before any subcommand runs, the defaults of its path flags
+// which are below the default root directory are moved below the given one.
+func AddRootDirectoryFlag(cmd *cobra.Command) {
+	// the subcommands have their own persistent pre-run hooks
+	cobra.EnableTraverseRunHooks = true
+
+	cmd.PersistentFlags().StringVar(&rootDirectory, "root-directory", rootDirectory,
+		"The root directory of the server, which holds the CAs, keys, kubeconfigs and the embedded etcd by default.")
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, _ []string) error {
+		return rebaseRootDirectory(cmd.Flags(), defaultRootDirectory, rootDirectory)
+	}
+}
+
+// rebaseRootDirectory moves the values of all string flags not set on the
+// command line from below the from directory to below the to directory.
+func rebaseRootDirectory(fs *pflag.FlagSet, from, to string) error {
+	if filepath.Clean(from) == filepath.Clean(to) {
+		return nil
+	}
+
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Value.Type() != "string" || f.Name == "root-directory" {
+			return
+		}
+		rel, relErr := filepath.Rel(from, f.Value.String())
+		if relErr != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+		err = f.Value.Set(filepath.Join(to, rel))
+	})
+	return err
+}
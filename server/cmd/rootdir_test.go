@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/spf13/pflag"
+
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+func TestRebaseRootDirectory(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	values := map[string]*string{
+		"kubeconfig":  fs.String("kubeconfig", ".gcp/admin.kubeconfig", ""),
+		"etcd":        fs.String("etcd", ".gcp/etcd-server", ""),
+		"root":        fs.String("root", ".gcp", ""),
+		"sibling":     fs.String("sibling", ".gcp-other/file", ""),
+		"outside":     fs.String("outside", "/etc/gcp/file", ""),
+		"explicit":    fs.String("explicit", ".gcp/explicit", ""),
+		"context":     fs.String("context", "root", ""),
+		"unset-empty": fs.String("unset-empty", "", ""),
+	}
+	fs.StringSlice("slice", []string{".gcp/a"}, "")
+	if err := fs.Parse([]string{"--explicit=.gcp/set"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rebaseRootDirectory(fs, ".gcp", "/data/gcp"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for name, value := range values {
+		got[name] = *value
+	}
+	want := map[string]string{
+		"kubeconfig":  "/data/gcp/admin.kubeconfig",
+		"etcd":        "/data/gcp/etcd-server",
+		"root":        "/data/gcp",
+		"sibling":     ".gcp-other/file",
+		"outside":     "/etc/gcp/file",
+		"explicit":    ".gcp/set",
+		"context":     "root",
+		"unset-empty": "",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected flag values (-want +got):\n%s", diff)
+	}
+	if slice, _ := fs.GetStringSlice("slice"); !cmp.Equal(slice, []string{".gcp/a"}) {
+		t.Errorf("non-string flag was changed to %v", slice)
+	}
+}
+
+func TestSetRootDirectory(t *testing.T) {
+	var o options.Options
+	o.SetRootDirectory("/data/gcp")
+	if o.Extra.RootDir != "/data/gcp" {
+		t.Errorf("RootDir = %q", o.Extra.RootDir)
+	}
+	if o.SQLStorage.Socket != "/data/gcp/sql-storage.sock" {
+		t.Errorf("SQL storage socket %q is not in the root directory", o.SQLStorage.Socket)
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/kcp-dev/embeddedetcd"
 	"github.com/spf13/cobra"
@@ -49,6 +48,8 @@ import (
 	_ "k8s.io/kubernetes/pkg/features"
 
 	"github.com/kcp-dev/generic-controlplane/server/batteries"
+	"github.com/kcp-dev/generic-controlplane/server/bootstrapmanifests"
+	"github.com/kcp-dev/generic-controlplane/server/bootstrappolicy"
 	"github.com/kcp-dev/generic-controlplane/server/cmd/help"
 	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
 	"github.com/kcp-dev/generic-controlplane/server/readiness"
@@ -63,19 +64,7 @@ func init() {
 
 // NewCommand creates a *cobra.Command object with default parameters
 func NewCommand() *cobra.Command {
-	// manually extract root directory from flags first as it influence all other flags
-	rootDir := ".gcp"
-	for i, f := range os.Args {
-		if f == "--root-directory" {
-			if i < len(os.Args)-1 {
-				rootDir = os.Args[i+1]
-			} // else let normal flag processing fail
-		} else if strings.HasPrefix(f, "--root-directory=") {
-			rootDir = strings.TrimPrefix(f, "--root-directory=")
-		}
-	}
-
-	s := options.NewOptions(rootDir)
+	s := options.NewOptions(defaultRootDirectory)
 
 	cmdStart := &cobra.Command{
 		Use: "start",
@@ -94,6 +83,7 @@ APIs.`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			verflag.PrintAndExitIfRequested()
 			fs := cmd.Flags()
+			s.SetRootDirectory(rootDirectory)
 
 			// Activate logging as soon as possible, after that
 			// show flags with the final logging configuration.
@@ -194,6 +184,21 @@ func Run(ctx context.Context, opts options.CompletedOptions) error {
 		if err := embeddedetcd.NewServer(completed.EmbeddedEtcd).Run(ctx); err != nil {
 			return err
 		}
+		if completed.EtcdSnapshotScheduler != nil {
+			go completed.EtcdSnapshotScheduler.Run(ctx)
+		}
+		if completed.EtcdMaintainer != nil {
+			go completed.EtcdMaintainer.Run(ctx)
+		}
+		if completed.EtcdQuorumChecker != nil {
+			go completed.EtcdQuorumChecker.Run(ctx)
+		}
+	}
+	if completed.SQLStorage != nil {
+		klog.Info("Starting SQL storage")
+		if err := completed.SQLStorage.Run(ctx); err != nil {
+			return err
+		}
 	}
 
 	server, err := createServerChain(completed)
@@ -222,11 +227,28 @@ func Run(ctx context.Context, opts options.CompletedOptions) error {
 
 	// wait for the server to be ready
 	klog.Info("Waiting for control plane to be ready")
-	err = readiness.WaitForReady(ctx, completed.Options.AdminAuthentication.KubeConfigPath)
+	// the kubeconfig Secret is only published and the manifests are only
+	// applied once the server is ready
+	excludedChecks := []string{options.KubeConfigSecretCheckName, bootstrapmanifests.CheckName}
+	if completed.Options.AdminAuthentication.KubeConfigPath != "" {
+		err = readiness.WaitForReady(ctx, completed.Options.AdminAuthentication.KubeConfigPath, excludedChecks...)
+	} else {
+		err = readiness.WaitForReadyWithConfig(ctx, completed.ControlPlane.Generic.LoopbackClientConfig, excludedChecks...)
+	}
 	if err != nil {
 		return err
 	}
 
+	go func() {
+		if err := completed.Options.AdminAuthentication.PublishKubeConfig(ctx, completed.ControlPlane.Generic.LoopbackClientConfig); err != nil && ctx.Err() == nil {
+			klog.ErrorS(err, "Failed to publish kubeconfig Secret")
+		}
+	}()
+
+	if completed.BootstrapManifests != nil {
+		go completed.BootstrapManifests.Run(ctx, completed.ControlPlane.Generic.LoopbackClientConfig)
+	}
+
 	<-ctx.Done()
 
 	return nil
@@ -270,6 +292,14 @@ func createServerChain(config options.CompletedConfig) (*aggregatorapiserver.API
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage providers: %w", err)
 	}
+	// reconcile the gcp bootstrap policy instead of the upstream one
+	storageProviders = bootstrappolicy.ReplaceRBACPolicy(storageProviders)
+
+	batteryStorageProviders, err := config.Batteries.StorageProviders(config.ControlPlane, client.Discovery())
+	if err != nil {
+		return nil, err
+	}
+	storageProviders = append(storageProviders, batteryStorageProviders...)
 
 	// Filter out the disabled batteries
 	storageProviders = config.Batteries.FilterStorageProviders(storageProviders)
@@ -281,6 +311,18 @@ func createServerChain(config options.CompletedConfig) (*aggregatorapiserver.API
 		klog.Infof("Serving %s", storageProvider.GroupName())
 	}
 
+	// Hooks must be added before the aggregator is created as it copies them from its delegate.
+	if err := config.Batteries.AddPostStartHooks(nativeAPIs.GenericAPIServer); err != nil {
+		return nil, err
+	}
+	controllers, err := newControllersConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := addControllers(controllers, nativeAPIs.GenericAPIServer); err != nil {
+		return nil, err
+	}
+
 	// 3. Aggregator for APIServices, discovery and OpenAPI
 	// If CRDs are enabled, we wire in, else - its a no-op.
 	if config.Batteries.IsEnabled(batteries.BatteryCRDs) {
@@ -0,0 +1,124 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/kcp-dev/generic-controlplane/server/cmd/help"
+	options "github.com/kcp-dev/generic-controlplane/server/cmd/options"
+)
+
+// NewSnapshotCommand creates the snapshot command, saving and restoring
+// snapshots of the embedded etcd.
+func NewSnapshotCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Save and restore snapshots of the embedded etcd",
+		Long: help.Doc(`
+			Save and restore snapshots of the embedded etcd
+
+			Snapshots are etcd snapshots with an integrity hash, compatible with etcdctl and etcdutl.
+			They are verified after saving and before restoring.
+		`),
+	}
+	cmd.AddCommand(newSnapshotSaveCommand())
+	cmd.AddCommand(newSnapshotRestoreCommand())
+	return cmd
+}
+
+func newSnapshotSaveCommand() *cobra.Command {
+	o := options.NewSnapshotOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "save <file>",
+		Short: "Save a snapshot of the embedded etcd",
+		Long: help.Doc(`
+			Save a snapshot of the embedded etcd
+
+			By default the snapshot is requested from the embedded etcd of the running server.
+			With --offline, it is read from the embedded etcd directory of a stopped server.
+		`),
+		Example: help.Doc(`
+			gcp snapshot save backup.db
+			gcp snapshot save --offline --root-directory=.gcp backup.db
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			status, err := o.Save(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Saved snapshot %s: revision %d, %d keys, %d bytes, sha256 %s\n",
+				args[0], status.Revision, status.Keys, status.Size, status.Hash)
+			return nil
+		},
+	}
+	o.AddSaveFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newSnapshotRestoreCommand() *cobra.Command {
+	o := options.NewSnapshotOptions(defaultRootDirectory)
+
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Restore the embedded etcd from a snapshot",
+		Long: help.Doc(`
+			Restore the embedded etcd from a snapshot
+
+			The server must be stopped. The snapshot is verified and the embedded etcd directory is
+			rebuilt from it. The previous data of the embedded etcd is kept in a backup directory
+			next to it, which can be removed once the restored server works.
+
+			To restore an embedded etcd cluster, stop all members and restore each of them from the
+			same snapshot with its own --embedded-etcd-name and the same --embedded-etcd-initial-cluster.
+		`),
+		Example: help.Doc(`
+			gcp snapshot restore --root-directory=.gcp backup.db
+			gcp snapshot restore --root-directory=.gcp-0 --embedded-etcd-name=gcp-0 --embedded-etcd-initial-cluster=$CLUSTER backup.db
+		`),
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if errs := o.Validate(); len(errs) != 0 {
+				return kerrors.NewAggregate(errs)
+			}
+			backup, err := o.Restore(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Restored snapshot %s into %s\n", args[0], o.EmbeddedEtcd.Directory)
+			if backup != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "The previous data is kept in %s\n", backup)
+			}
+			return nil
+		},
+	}
+	o.AddRestoreFlags(cmd.Flags())
+
+	return cmd
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificates
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	capi "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	certificatesinformers "k8s.io/client-go/informers/certificates/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/controller/certificates"
+)
+
+// ApprovePolicy decides which CertificateSigningRequests are approved automatically.
+type ApprovePolicy string
+
+const (
+	// ApprovePolicyNone approves nothing automatically.
+	ApprovePolicyNone ApprovePolicy = "none"
+	// ApprovePolicySelf approves short-lived client certificates for the
+	// requesting user's own name and a subset of its groups. ServiceAccounts and
+	// system users are not approved.
+	ApprovePolicySelf ApprovePolicy = "self"
+	// ApprovePolicyAll approves all client certificates. Only use for development.
+	ApprovePolicyAll ApprovePolicy = "all"
+)
+
+// ApprovePolicies is the set of all known approve policies.
+var ApprovePolicies = sets.New[string](string(ApprovePolicyNone), string(ApprovePolicySelf), string(ApprovePolicyAll))
+
+// MaxSelfExpiration is the longest expirationSeconds approved by the 'self'
+// policy. Requests without expirationSeconds are not approved by it.
+const MaxSelfExpiration = 24 * time.Hour
+
+// clientUsages are the usages allowed for approved client certificates.
+var clientUsages = sets.New(capi.UsageClientAuth, capi.UsageDigitalSignature, capi.UsageKeyEncipherment)
+
+type approver struct {
+	client clientset.Interface
+	policy ApprovePolicy
+}
+
+// NewCSRApprovingController returns a controller approving kube-apiserver-client
+// CertificateSigningRequests according to the given policy.
+func NewCSRApprovingController(ctx context.Context, client clientset.Interface, csrInformer certificatesinformers.CertificateSigningRequestInformer, policy ApprovePolicy) *certificates.CertificateController {
+	a := &approver{
+		client: client,
+		policy: policy,
+	}
+	return certificates.NewCertificateController(
+		ctx,
+		"csrapproving-gcp",
+		client,
+		csrInformer,
+		a.handle,
+	)
+}
+
+func (a *approver) handle(ctx context.Context, csr *capi.CertificateSigningRequest) error {
+	if len(csr.Status.Certificate) != 0 {
+		return nil
+	}
+	if approved, denied := certificates.GetCertApprovalCondition(&csr.Status); approved || denied {
+		return nil
+	}
+	if csr.Spec.SignerName != capi.KubeAPIServerClientSignerName {
+		return nil
+	}
+
+	x509cr, err := parseCSR(csr.Spec.Request)
+	if err != nil {
+		return fmt.Errorf("unable to parse csr %q: %w", csr.Name, err)
+	}
+
+	message, ok := a.approvable(csr, x509cr)
+	if !ok {
+		return nil
+	}
+
+	klog.FromContext(ctx).V(2).Info("Approving CertificateSigningRequest", "csr", csr.Name, "policy", a.policy)
+	csr.Status.Conditions = append(csr.Status.Conditions, capi.CertificateSigningRequestCondition{
+		Type:    capi.CertificateApproved,
+		Status:  corev1.ConditionTrue,
+		Reason:  "AutoApproved",
+		Message: message,
+	})
+	_, err = a.client.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, csr.Name, csr, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating approval for csr: %w", err)
+	}
+	return nil
+}
+
+// approvable returns an approval message and true if the request is approved by the policy.
+func (a *approver) approvable(csr *capi.CertificateSigningRequest, x509cr *x509.CertificateRequest) (string, bool) {
+	for _, usage := range csr.Spec.Usages {
+		if !clientUsages.Has(usage) {
+			return "", false
+		}
+	}
+
+	switch a.policy {
+	case ApprovePolicyAll:
+		return "Auto approving client certificate by the 'all' policy", true
+	case ApprovePolicySelf:
+		// ServiceAccounts and system users must not turn their credentials
+		// into long-lived certificates
+		if strings.HasPrefix(csr.Spec.Username, "system:") {
+			return "", false
+		}
+		if csr.Spec.ExpirationSeconds == nil || time.Duration(*csr.Spec.ExpirationSeconds)*time.Second > MaxSelfExpiration {
+			return "", false
+		}
+		if x509cr.Subject.CommonName != csr.Spec.Username {
+			return "", false
+		}
+		if !sets.New(csr.Spec.Groups...).HasAll(x509cr.Subject.Organization...) {
+			return "", false
+		}
+		return "Auto approving self client certificate by the 'self' policy", true
+	default:
+		return "", false
+	}
+}
+
+func parseCSR(pemBytes []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("PEM block type must be CERTIFICATE REQUEST")
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
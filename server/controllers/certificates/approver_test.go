@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificates
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+
+	capi "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/controller/certificates"
+	"k8s.io/utils/ptr"
+)
+
+func newCSR(t *testing.T, username string, groups []string, commonName string, organization []string, expirationSeconds *int32) *capi.CertificateSigningRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName, Organization: organization},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &capi.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "csr"},
+		Spec: capi.CertificateSigningRequestSpec{
+			Request:           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+			SignerName:        capi.KubeAPIServerClientSignerName,
+			ExpirationSeconds: expirationSeconds,
+			Usages:            []capi.KeyUsage{capi.UsageClientAuth, capi.UsageDigitalSignature},
+			Username:          username,
+			Groups:            groups,
+		},
+	}
+}
+
+func TestApprove(t *testing.T) {
+	hour := ptr.To[int32](3600)
+
+	tests := []struct {
+		name         string
+		policy       ApprovePolicy
+		csr          func(t *testing.T) *capi.CertificateSigningRequest
+		wantApproved bool
+	}{
+		{
+			name:   "none",
+			policy: ApprovePolicyNone,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", []string{"dev"}, "alice", []string{"dev"}, hour)
+			},
+		},
+		{
+			name:   "all approves any user",
+			policy: ApprovePolicyAll,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", nil, "bob", []string{"system:masters"}, nil)
+			},
+			wantApproved: true,
+		},
+		{
+			name:   "all denies server usages",
+			policy: ApprovePolicyAll,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				csr := newCSR(t, "alice", nil, "alice", nil, hour)
+				csr.Spec.Usages = append(csr.Spec.Usages, capi.UsageServerAuth)
+				return csr
+			},
+		},
+		{
+			name:   "all ignores other signers",
+			policy: ApprovePolicyAll,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				csr := newCSR(t, "alice", nil, "alice", nil, hour)
+				csr.Spec.SignerName = capi.KubeletServingSignerName
+				return csr
+			},
+		},
+		{
+			name:   "self approves own name and groups",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", []string{"dev", "ops"}, "alice", []string{"dev"}, hour)
+			},
+			wantApproved: true,
+		},
+		{
+			name:   "self denies another name",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", nil, "bob", nil, hour)
+			},
+		},
+		{
+			name:   "self denies other groups",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", []string{"dev"}, "alice", []string{"system:masters"}, hour)
+			},
+		},
+		{
+			name:   "self denies ServiceAccounts",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				username := "system:serviceaccount:default:deployer"
+				return newCSR(t, username, []string{"system:serviceaccounts"}, username, nil, hour)
+			},
+		},
+		{
+			name:   "self denies system users",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "system:admin", nil, "system:admin", nil, hour)
+			},
+		},
+		{
+			name:   "self denies requests without expiration",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", nil, "alice", nil, nil)
+			},
+		},
+		{
+			name:   "self denies long expiration",
+			policy: ApprovePolicySelf,
+			csr: func(t *testing.T) *capi.CertificateSigningRequest {
+				return newCSR(t, "alice", nil, "alice", nil, ptr.To[int32](int32(MaxSelfExpiration.Seconds())+1))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr := tt.csr(t)
+			client := fake.NewSimpleClientset(csr)
+			a := &approver{client: client, policy: tt.policy}
+			if err := a.handle(context.Background(), csr); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := client.CertificatesV1().CertificateSigningRequests().Get(context.Background(), csr.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			approved, denied := certificates.GetCertApprovalCondition(&got.Status)
+			if approved != tt.wantApproved {
+				t.Errorf("approved = %v, want %v", approved, tt.wantApproved)
+			}
+			if denied {
+				t.Errorf("request was denied, expected it to be left for manual approval")
+			}
+		})
+	}
+}
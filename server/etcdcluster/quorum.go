@@ -0,0 +1,112 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package etcdcluster reports on the quorum of an embedded etcd with
+// multiple members.
+package etcdcluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/klog/v2"
+)
+
+// checkTimeout is the timeout of the requests of a quorum check. It is
+// longer than an election with the default election timeout.
+const checkTimeout = 2 * time.Second
+
+// QuorumChecker checks whether the member of the etcd cluster at a single
+// endpoint has a leader and the cluster has quorum.
+type QuorumChecker struct {
+	config clientv3.Config
+
+	lock   sync.RWMutex
+	client *clientv3.Client
+}
+
+var _ healthz.HealthChecker = &QuorumChecker{}
+
+// NewQuorumChecker returns a quorum checker of the etcd member at the single
+// endpoint of config.
+func NewQuorumChecker(config clientv3.Config) *QuorumChecker {
+	return &QuorumChecker{config: config}
+}
+
+// Run connects to the etcd member until the context is done.
+func (q *QuorumChecker) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	config := q.config
+	config.Context = ctx
+	config.Logger = zap.NewNop()
+	client, err := clientv3.New(config)
+	if err != nil {
+		logger.Error(err, "Failed to create embedded etcd quorum client")
+		return
+	}
+
+	q.lock.Lock()
+	q.client = client
+	q.lock.Unlock()
+
+	<-ctx.Done()
+
+	q.lock.Lock()
+	q.client = nil
+	q.lock.Unlock()
+	client.Close()
+}
+
+// Name implements healthz.HealthChecker.
+func (q *QuorumChecker) Name() string {
+	return "etcd-quorum"
+}
+
+// Check implements healthz.HealthChecker. It fails if the member has no
+// leader, or a linearizable request to the cluster does not succeed, i.e.
+// the majority of the members is not reachable.
+func (q *QuorumChecker) Check(req *http.Request) error {
+	q.lock.RLock()
+	client := q.client
+	q.lock.RUnlock()
+	if client == nil {
+		return errors.New("embedded etcd quorum client is not started")
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	status, err := client.Status(ctx, q.config.Endpoints[0])
+	if err != nil {
+		return fmt.Errorf("failed to get the status of the embedded etcd member: %w", err)
+	}
+	if status.Leader == 0 {
+		return fmt.Errorf("embedded etcd member %x has no leader", status.Header.MemberId)
+	}
+	if _, err := client.MemberList(ctx); err != nil {
+		return fmt.Errorf("embedded etcd cluster has no quorum: %w", err)
+	}
+	return nil
+}
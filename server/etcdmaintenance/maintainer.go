@@ -0,0 +1,249 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package etcdmaintenance keeps the backend of the embedded etcd bounded by
+// compacting old revisions, defragmenting the database and clearing NOSPACE
+// alarms once there is space again.
+package etcdmaintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// disarmBelowQuota is the fraction of the quota the database must be below
+	// to clear a NOSPACE alarm, such that it is not raised again right away.
+	disarmBelowQuota = 0.9
+
+	// alarmPollInterval is the interval to check for NOSPACE alarms, which
+	// trigger a maintenance run right away.
+	alarmPollInterval = 10 * time.Second
+)
+
+// Policy configures the maintenance of the embedded etcd.
+type Policy struct {
+	// Interval is the interval between maintenance runs.
+	Interval time.Duration
+	// RetainedRevisions is the number of revisions kept by compactions. Zero
+	// disables compactions.
+	RetainedRevisions int64
+	// DefragThreshold is the fraction of unused space of the database above
+	// which it is defragmented.
+	DefragThreshold float64
+	// DefragMinSizeBytes is the database size below which it is not
+	// defragmented, unless the NOSPACE alarm is active.
+	DefragMinSizeBytes int64
+	// QuotaBackendBytes is the backend quota of the etcd server.
+	QuotaBackendBytes int64
+}
+
+// Maintainer runs the maintenance of the etcd server at a single endpoint.
+type Maintainer struct {
+	config clientv3.Config
+	policy Policy
+
+	lock    sync.RWMutex
+	noSpace bool
+}
+
+var _ healthz.HealthChecker = &Maintainer{}
+
+// NewMaintainer returns a maintainer of the etcd server at the single
+// endpoint of config.
+func NewMaintainer(config clientv3.Config, policy Policy) *Maintainer {
+	RegisterMetrics()
+	return &Maintainer{
+		config: config,
+		policy: policy,
+	}
+}
+
+// Run runs the maintenance right away, then periodically and whenever the
+// NOSPACE alarm is raised until the context is done.
+func (m *Maintainer) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting embedded etcd maintenance", "interval", m.policy.Interval)
+
+	config := m.config
+	config.Context = ctx
+	config.Logger = zap.NewNop()
+	client, err := clientv3.New(config)
+	if err != nil {
+		logger.Error(err, "Failed to create embedded etcd maintenance client")
+		return
+	}
+	defer client.Close()
+
+	var lastRun time.Time
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		wasNoSpace := m.isNoSpace()
+		noSpace, err := m.noSpaceAlarms(ctx, client)
+		if err == nil && time.Since(lastRun) < m.policy.Interval && (len(noSpace) == 0 || wasNoSpace) {
+			return
+		}
+		lastRun = time.Now()
+		if err == nil {
+			err = m.maintain(klog.NewContext(ctx, logger), client, noSpace)
+		}
+		if err != nil && ctx.Err() == nil {
+			failures.Inc()
+			logger.Error(err, "Failed to maintain embedded etcd")
+		}
+	}, alarmPollInterval)
+}
+
+// noSpaceAlarms returns the active NOSPACE alarms and records whether there are any.
+func (m *Maintainer) noSpaceAlarms(ctx context.Context, client *clientv3.Client) ([]*etcdserverpb.AlarmMember, error) {
+	alarms, err := client.AlarmList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list alarms: %w", err)
+	}
+	var noSpace []*etcdserverpb.AlarmMember
+	for _, alarm := range alarms.Alarms {
+		if alarm.Alarm == etcdserverpb.AlarmType_NOSPACE {
+			noSpace = append(noSpace, alarm)
+		}
+	}
+	m.setNoSpace(len(noSpace) > 0)
+	return noSpace, nil
+}
+
+// maintain compacts, defragments if necessary and clears the NOSPACE alarms
+// of this member among the given ones if there is space again.
+func (m *Maintainer) maintain(ctx context.Context, client *clientv3.Client, noSpace []*etcdserverpb.AlarmMember) error {
+	logger := klog.FromContext(ctx)
+	endpoint := m.config.Endpoints[0]
+
+	status, err := client.Status(ctx, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to get status: %w", err)
+	}
+
+	// the sizes are of this member only, the alarms of other members are left
+	// to their own maintainers, as defragmentation blocks the member
+	var own, others []*etcdserverpb.AlarmMember
+	for _, alarm := range noSpace {
+		if alarm.MemberID == status.Header.MemberId {
+			own = append(own, alarm)
+		} else {
+			others = append(others, alarm)
+		}
+	}
+	if len(own) > 0 {
+		logger.Info("Embedded etcd is out of space, compacting and defragmenting")
+	}
+
+	if m.policy.RetainedRevisions > 0 {
+		if rev := status.Header.Revision - m.policy.RetainedRevisions; rev > 0 {
+			_, err := client.Compact(ctx, rev, clientv3.WithCompactPhysical())
+			switch {
+			case errors.Is(err, rpctypes.ErrCompacted):
+				// already compacted further, e.g. by the API server
+			case err != nil:
+				return fmt.Errorf("failed to compact to revision %d: %w", rev, err)
+			default:
+				compactions.Inc()
+				logger.V(2).Info("Compacted embedded etcd", "revision", rev)
+			}
+			if status, err = client.Status(ctx, endpoint); err != nil {
+				return fmt.Errorf("failed to get status: %w", err)
+			}
+		}
+	}
+
+	unused := float64(status.DbSize-status.DbSizeInUse) / float64(max(status.DbSize, 1))
+	if len(own) > 0 || (status.DbSize >= m.policy.DefragMinSizeBytes && unused >= m.policy.DefragThreshold) {
+		logger.Info("Defragmenting embedded etcd", "size", status.DbSize, "sizeInUse", status.DbSizeInUse)
+		if _, err := client.Defragment(ctx, endpoint); err != nil {
+			return fmt.Errorf("failed to defragment: %w", err)
+		}
+		defragmentations.Inc()
+		if status, err = client.Status(ctx, endpoint); err != nil {
+			return fmt.Errorf("failed to get status: %w", err)
+		}
+		logger.Info("Defragmented embedded etcd", "size", status.DbSize)
+	}
+	dbSizeBytes.Set(float64(status.DbSize))
+	dbSizeInUseBytes.Set(float64(status.DbSizeInUse))
+
+	if len(noSpace) > 0 {
+		if len(own) > 0 {
+			if float64(status.DbSize) >= disarmBelowQuota*float64(m.policy.QuotaBackendBytes) {
+				return fmt.Errorf("embedded etcd is still out of space with %d of %d bytes after compaction and defragmentation", status.DbSize, m.policy.QuotaBackendBytes)
+			}
+			for _, alarm := range own {
+				if _, err := client.AlarmDisarm(ctx, (*clientv3.AlarmMember)(alarm)); err != nil {
+					return fmt.Errorf("failed to clear NOSPACE alarm: %w", err)
+				}
+				alarmDisarms.Inc()
+			}
+			logger.Info("Cleared NOSPACE alarm of embedded etcd", "size", status.DbSize)
+		}
+		if len(others) > 0 {
+			logger.Info("Other embedded etcd members are out of space", "alarms", len(others))
+		}
+		m.setNoSpace(len(others) > 0)
+	}
+
+	return nil
+}
+
+func (m *Maintainer) setNoSpace(noSpace bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.noSpace = noSpace
+	if noSpace {
+		noSpaceAlarm.Set(1)
+	} else {
+		noSpaceAlarm.Set(0)
+	}
+}
+
+func (m *Maintainer) isNoSpace() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.noSpace
+}
+
+// Name implements healthz.HealthChecker.
+func (m *Maintainer) Name() string {
+	return "etcd-nospace"
+}
+
+// Check implements healthz.HealthChecker. It fails while the NOSPACE alarm
+// of the embedded etcd is active, i.e. while it only serves reads and deletes.
+func (m *Maintainer) Check(_ *http.Request) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.noSpace {
+		return fmt.Errorf("embedded etcd is out of space, see the gcp_etcd_maintenance metrics")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package etcdmaintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+var testPolicy = Policy{
+	Interval:           time.Minute,
+	DefragThreshold:    0.5,
+	DefragMinSizeBytes: 64 * 1024 * 1024,
+	QuotaBackendBytes:  2 * 1024 * 1024 * 1024,
+}
+
+// startEtcd starts a single member etcd listening on a random local port and
+// returns a client config for it.
+func startEtcd(t *testing.T) clientv3.Config {
+	t.Helper()
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.LogLevel = "error"
+	local := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+	config.ListenClientUrls = []url.URL{local}
+	config.AdvertiseClientUrls = []url.URL{local}
+	config.ListenPeerUrls = []url.URL{local}
+	config.AdvertisePeerUrls = []url.URL{{Scheme: "http", Host: "127.0.0.1:2380"}}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+
+	e, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("etcd did not become ready")
+	}
+	return clientv3.Config{
+		Endpoints:   []string{"http://" + e.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+func TestMaintainCompaction(t *testing.T) {
+	tests := []struct {
+		name              string
+		retainedRevisions int64
+		wantCompacted     bool
+	}{
+		{name: "zero disables compactions", retainedRevisions: 0},
+		{name: "more revisions retained than written", retainedRevisions: 100},
+		{name: "old revisions compacted", retainedRevisions: 3, wantCompacted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			config := startEtcd(t)
+			client, err := clientv3.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			first, err := client.Put(ctx, "/registry/key", "0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < 10; i++ {
+				if _, err := client.Put(ctx, "/registry/key", fmt.Sprint(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			policy := testPolicy
+			policy.RetainedRevisions = tt.retainedRevisions
+			m := NewMaintainer(config, policy)
+			if err := m.maintain(ctx, client, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Get(ctx, "/registry/key", clientv3.WithRev(first.Header.Revision))
+			if compacted := errors.Is(err, rpctypes.ErrCompacted); compacted != tt.wantCompacted {
+				t.Errorf("compacted = %v, want %v (err %v)", compacted, tt.wantCompacted, err)
+			}
+		})
+	}
+}
+
+func TestMaintainDisarmsOwnAlarms(t *testing.T) {
+	RegisterMetrics()
+
+	tests := []struct {
+		name             string
+		ownAlarm         bool
+		wantDefragmented bool
+	}{
+		{name: "own and other alarms", ownAlarm: true, wantDefragmented: true},
+		{name: "only other alarm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			config := startEtcd(t)
+			client, err := clientv3.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			status, err := client.Status(ctx, config.Endpoints[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			own, other := status.Header.MemberId, status.Header.MemberId+1
+			memberIDs := []uint64{other}
+			if tt.ownAlarm {
+				memberIDs = append(memberIDs, own)
+			}
+			maintenance := etcdserverpb.NewMaintenanceClient(client.ActiveConnection())
+			for _, memberID := range memberIDs {
+				if _, err := maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{
+					Action:   etcdserverpb.AlarmRequest_ACTIVATE,
+					MemberID: memberID,
+					Alarm:    etcdserverpb.AlarmType_NOSPACE,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := NewMaintainer(config, testPolicy)
+			noSpace, err := m.noSpaceAlarms(ctx, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(noSpace) != len(memberIDs) {
+				t.Fatalf("expected %d NOSPACE alarms, got %v", len(memberIDs), noSpace)
+			}
+			before, err := testutil.GetCounterMetricValue(defragmentations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.maintain(ctx, client, noSpace); err != nil {
+				t.Fatal(err)
+			}
+			after, err := testutil.GetCounterMetricValue(defragmentations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if defragmented := after > before; defragmented != tt.wantDefragmented {
+				t.Errorf("defragmented = %v, want %v", defragmented, tt.wantDefragmented)
+			}
+
+			alarms, err := client.AlarmList(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(alarms.Alarms) != 1 || alarms.Alarms[0].MemberID != other {
+				t.Errorf("expected only the alarm of the other member to remain, got %v", alarms.Alarms)
+			}
+			if !m.isNoSpace() {
+				t.Errorf("the remaining alarm of the other member is not reported")
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m := NewMaintainer(clientv3.Config{}, testPolicy)
+	if err := m.Check(nil); err != nil {
+		t.Errorf("check failed without NOSPACE alarm: %v", err)
+	}
+	m.setNoSpace(true)
+	if err := m.Check(nil); err == nil {
+		t.Errorf("check succeeded with NOSPACE alarm")
+	}
+	m.setNoSpace(false)
+	if err := m.Check(nil); err != nil {
+		t.Errorf("check failed after the NOSPACE alarm was cleared: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package etcdmaintenance
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const subsystem = "gcp_etcd_maintenance"
+
+var (
+	dbSizeBytes = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      subsystem,
+			Name:           "db_size_bytes",
+			Help:           "Size in bytes of the backend database of the embedded etcd after the last maintenance",
+			StabilityLevel: metrics.ALPHA,
+		})
+	dbSizeInUseBytes = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      subsystem,
+			Name:           "db_size_in_use_bytes",
+			Help:           "Size in bytes of the backend database of the embedded etcd in use after the last maintenance",
+			StabilityLevel: metrics.ALPHA,
+		})
+	noSpaceAlarm = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      subsystem,
+			Name:           "nospace_alarm",
+			Help:           "1 if the NOSPACE alarm of the embedded etcd is active after the last maintenance, 0 otherwise",
+			StabilityLevel: metrics.ALPHA,
+		})
+	compactions = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      subsystem,
+			Name:           "compactions_total",
+			Help:           "Number of compactions of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+	defragmentations = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      subsystem,
+			Name:           "defragmentations_total",
+			Help:           "Number of defragmentations of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+	alarmDisarms = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      subsystem,
+			Name:           "alarm_disarms_total",
+			Help:           "Number of NOSPACE alarms of the embedded etcd cleared after recovering",
+			StabilityLevel: metrics.ALPHA,
+		})
+	failures = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      subsystem,
+			Name:           "failures_total",
+			Help:           "Number of failed maintenance runs of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+)
+
+var registerMetrics sync.Once
+
+// RegisterMetrics registers the embedded etcd maintenance metrics.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(dbSizeBytes, dbSizeInUseBytes, noSpaceAlarm, compactions, defragmentations, alarmDisarms, failures)
+	})
+}
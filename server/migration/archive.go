@@ -0,0 +1,194 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IsArchive returns whether the export at the given path is a gzipped tar
+// archive instead of a directory tree.
+func IsArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// file is a file of an export, with its slash separated path relative to
+// the root of the export.
+type file struct {
+	name string
+	data []byte
+}
+
+// writer writes the files of an export.
+type writer interface {
+	write(name string, data []byte) error
+	Close() error
+}
+
+// newWriter returns a writer of an archive or a directory tree at the given
+// path. It does not write into existing archives or non-empty directories,
+// so that exports are not mixed.
+func newWriter(target string) (writer, error) {
+	if IsArchive(target) {
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create export archive: %w", err)
+		}
+		gz := gzip.NewWriter(f)
+		return &archiveWriter{file: f, gzip: gz, tar: tar.NewWriter(gz), modTime: time.Now()}, nil
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read export directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("export directory %q is not empty", target)
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create export directory: %w", err)
+	}
+	return &directoryWriter{directory: target}, nil
+}
+
+type directoryWriter struct {
+	directory string
+}
+
+func (w *directoryWriter) write(name string, data []byte) error {
+	target := filepath.Join(w.directory, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0600)
+}
+
+func (w *directoryWriter) Close() error {
+	return nil
+}
+
+type archiveWriter struct {
+	file    *os.File
+	gzip    *gzip.Writer
+	tar     *tar.Writer
+	modTime time.Time
+}
+
+func (w *archiveWriter) write(name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: w.modTime,
+	}
+	if err := w.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := w.tar.Write(data)
+	return err
+}
+
+func (w *archiveWriter) Close() error {
+	return errors.Join(w.tar.Close(), w.gzip.Close(), w.file.Close())
+}
+
+// readFiles returns the .yaml files of the archive or directory tree at the
+// given path in lexical order.
+func readFiles(source string) ([]file, error) {
+	var files []file
+	var err error
+	if IsArchive(source) {
+		files, err = readArchive(source)
+	} else {
+		files, err = readDirectory(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+func readDirectory(directory string) ([]file, error) {
+	var files []file
+	err := filepath.WalkDir(directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(p) != ".yaml" {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(directory, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{name: filepath.ToSlash(name), data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export directory %q: %w", directory, err)
+	}
+	return files, nil
+}
+
+func readArchive(archive string) ([]file, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export archive: %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export archive %q: %w", archive, err)
+	}
+	defer gz.Close()
+
+	var files []file
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export archive %q: %w", archive, err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Ext(header.Name) != ".yaml" {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s of export archive %q: %w", header.Name, archive, err)
+		}
+		files = append(files, file{name: header.Name, data: data})
+	}
+}
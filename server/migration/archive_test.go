@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	files := []file{
+		{name: "namespaces/b.yaml", data: []byte("kind: Namespace\n")},
+		{name: "configmaps/a/c.yaml", data: []byte("kind: ConfigMap\n")},
+		{name: "widgets.example.com/a/w.yaml", data: []byte("kind: Widget\n")},
+	}
+	want := []file{files[1], files[0], files[2]}
+
+	for _, target := range []string{"export", "export.tar.gz", "export.tgz"} {
+		t.Run(target, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), target)
+			w, err := newWriter(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if err := w.write(f.name, f.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readFiles(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(file{})); diff != "" {
+				t.Errorf("unexpected files (-want +got):\n%s", diff)
+			}
+
+			// exports are not written into existing ones
+			if _, err := newWriter(target); err == nil {
+				t.Errorf("expected an error writing into an existing export")
+			}
+		})
+	}
+}
+
+func TestReadFilesSkipsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"namespaces/a.yaml":     "kind: Namespace\n",
+		"namespaces/README.md":  "not an object",
+		"namespaces/a.yaml.bak": "kind: Namespace\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := readFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].name != "namespaces/a.yaml" {
+		t.Errorf("unexpected files %v", got)
+	}
+}
+
+func TestReadFilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.tar.gz")
+	if err := os.WriteFile(invalid, []byte("not gzip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{name: "missing directory", source: filepath.Join(dir, "missing"), wantErr: "failed to read export directory"},
+		{name: "missing archive", source: filepath.Join(dir, "missing.tgz"), wantErr: "failed to open export archive"},
+		{name: "invalid archive", source: invalid, wantErr: "failed to read export archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readFiles(tt.source); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package migration exports the objects of a running server and imports them
+// into another one, to move data between storages, versions or root
+// directories.
+package migration
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/pager"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// automanagedLabel marks the APIServices of the built-in groups, which
+	// every server creates itself.
+	automanagedLabel = "kube-aggregator.kubernetes.io/automanaged"
+	// identityLabel marks the Leases of the API server identities, which
+	// belong to a single server instance.
+	identityLabel = "apiserver.kubernetes.io/identity"
+	// rootCAConfigMapName is the ConfigMap with the CA bundle of the server,
+	// which every server publishes into every namespace.
+	rootCAConfigMapName = "kube-root-ca.crt"
+
+	listPageSize = 500
+)
+
+// serverPopulatedFields are the metadata fields set by the server, which are
+// not exported.
+var serverPopulatedFields = []string{
+	"uid",
+	"resourceVersion",
+	"generation",
+	"creationTimestamp",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+	"managedFields",
+	"selfLink",
+}
+
+// skippedResources are not exported. Events expire soon, and are served by
+// both groups.
+var skippedResources = sets.New(
+	schema.GroupResource{Resource: "events"},
+	schema.GroupResource{Group: "events.k8s.io", Resource: "events"},
+)
+
+var crdGroupKind = apiextensionsv1.Kind("CustomResourceDefinition")
+
+// ExportStats are the numbers of exported resources and objects.
+type ExportStats struct {
+	Resources int
+	Objects   int
+}
+
+// Export writes every object of the server of config to the directory tree or
+// archive at target, one file <resource>.<group>/[<namespace>/]<name>.yaml
+// per object. The resources are the preferred versions of all groups,
+// including those of CRDs and aggregated APIs.
+func Export(ctx context.Context, config *rest.Config, target string) (ExportStats, error) {
+	logger := klog.FromContext(ctx)
+	var stats ExportStats
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return stats, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return stats, err
+	}
+
+	// a partial discovery misses resources, so the export would be incomplete
+	resourceLists, err := discoveryClient.ServerPreferredResources()
+	if err != nil {
+		return stats, fmt.Errorf("failed to discover the resources: %w", err)
+	}
+
+	w, err := newWriter(target)
+	if err != nil {
+		return stats, err
+	}
+	defer w.Close()
+
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return stats, err
+		}
+		for _, resource := range resourceList.APIResources {
+			verbs := sets.New[string](resource.Verbs...)
+			gvr := gv.WithResource(resource.Name)
+			if !verbs.HasAll("list", "create") || skippedResources.Has(gvr.GroupResource()) {
+				continue
+			}
+			n, err := exportResource(ctx, client, w, gvr, resource.Kind)
+			if err != nil {
+				return stats, err
+			}
+			logger.V(2).Info("exported resource", "resource", gvr.String(), "objects", n)
+			stats.Resources++
+			stats.Objects += n
+		}
+	}
+
+	return stats, w.Close()
+}
+
+// exportResource writes the objects of the given resource, and returns their number.
+func exportResource(ctx context.Context, client dynamic.Interface, w writer, gvr schema.GroupVersionResource, kind string) (int, error) {
+	p := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return client.Resource(gvr).List(ctx, opts)
+	})
+	p.PageSize = listPageSize
+
+	n := 0
+	err := p.EachListItem(ctx, metav1.ListOptions{}, func(item runtime.Object) error {
+		obj, ok := item.(*unstructured.Unstructured)
+		if !ok {
+			return fmt.Errorf("unexpected list item %T", item)
+		}
+		if !exported(gvr.GroupResource(), obj) {
+			return nil
+		}
+		obj.SetAPIVersion(gvr.GroupVersion().String())
+		obj.SetKind(kind)
+		strip(obj)
+
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if err := w.write(fileName(gvr.GroupResource(), obj), data); err != nil {
+			return fmt.Errorf("failed to write %s %s: %w", gvr.Resource, obj.GetName(), err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to export %s: %w", gvr.GroupResource(), err)
+	}
+	return n, nil
+}
+
+// exported returns whether the object belongs to the data of the server, i.e.
+// is not being deleted and not recreated by every server itself. Service
+// account token Secrets are signed by the keys of the exporting server, so
+// the importing server issues its own.
+func exported(gr schema.GroupResource, obj *unstructured.Unstructured) bool {
+	if obj.GetDeletionTimestamp() != nil {
+		return false
+	}
+	switch gr {
+	case schema.GroupResource{Resource: "secrets"}:
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType != string(corev1.SecretTypeServiceAccountToken)
+	case schema.GroupResource{Resource: "configmaps"}:
+		return obj.GetName() != rootCAConfigMapName
+	case schema.GroupResource{Group: "apiregistration.k8s.io", Resource: "apiservices"}:
+		return obj.GetLabels()[automanagedLabel] == ""
+	case schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}:
+		_, ok := obj.GetLabels()[identityLabel]
+		return !ok
+	}
+	return true
+}
+
+// strip removes the fields populated by the server. The status is kept, except
+// for CRDs, which are established again by the importing server.
+func strip(obj *unstructured.Unstructured) {
+	for _, field := range serverPopulatedFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	if obj.GroupVersionKind().GroupKind() == crdGroupKind {
+		unstructured.RemoveNestedField(obj.Object, "status")
+	}
+}
+
+// fileName returns the path of the object in an export.
+func fileName(gr schema.GroupResource, obj *unstructured.Unstructured) string {
+	directory := gr.String()
+	if ns := obj.GetNamespace(); ns != "" {
+		directory = path.Join(directory, ns)
+	}
+	return path.Join(directory, obj.GetName()+".yaml")
+}
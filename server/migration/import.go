@@ -0,0 +1,282 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kcp-dev/generic-controlplane/server/bootstrapmanifests"
+)
+
+var namespaceGroupKind = schema.GroupKind{Kind: "Namespace"}
+
+// admissionGroup is the group of the webhook configurations and admission
+// policies, which may reject the creation of other objects, e.g. if the
+// webhook backend is not running yet.
+const admissionGroup = "admissionregistration.k8s.io"
+
+// ImportStats are the numbers of created objects, of objects which exist
+// already and are kept or overwritten, and of objects which failed.
+type ImportStats struct {
+	Created     int
+	Existing    int
+	Overwritten int
+	Failed      int
+}
+
+// importer creates the objects of an export on the server.
+type importer struct {
+	client dynamic.Interface
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+	// overwrite replaces existing objects instead of keeping them.
+	overwrite bool
+
+	stats ImportStats
+	errs  []error
+}
+
+// Import creates the objects of the directory tree or archive at source on
+// the server of config: the CRDs first and, once they are established, the
+// namespaces, then the other objects and last the admission configuration,
+// such that it does not reject the other objects. Objects which exist already
+// are kept, or replaced with overwrite. Owner references are resolved to the
+// UIDs of the owners on the server, and dropped if the owner does not exist.
+func Import(ctx context.Context, config *rest.Config, source string, overwrite bool) (ImportStats, error) {
+	files, err := readFiles(source)
+	if err != nil {
+		return ImportStats{}, err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	i := &importer{
+		client:    client,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		overwrite: overwrite,
+	}
+	return i.importFiles(ctx, files)
+}
+
+// importFiles creates the objects of the given files.
+func (i *importer) importFiles(ctx context.Context, files []file) (ImportStats, error) {
+	var crds, namespaces, others, admission []*unstructured.Unstructured
+	for _, f := range files {
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(f.data, &obj.Object); err != nil {
+			i.fail(fmt.Errorf("failed to decode %s: %w", f.name, err))
+			continue
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		switch gk := obj.GroupVersionKind().GroupKind(); {
+		case gk == crdGroupKind:
+			crds = append(crds, obj)
+		case gk == namespaceGroupKind:
+			namespaces = append(namespaces, obj)
+		case gk.Group == admissionGroup:
+			admission = append(admission, obj)
+		default:
+			others = append(others, obj)
+		}
+	}
+
+	for _, crd := range crds {
+		if i.create(ctx, crd) {
+			if err := bootstrapmanifests.WaitForEstablished(ctx, i.client, crd.GetName()); err != nil {
+				i.fail(err)
+			}
+		}
+	}
+	if len(crds) > 0 {
+		i.mapper.Reset()
+	}
+
+	for _, ns := range namespaces {
+		i.create(ctx, ns)
+	}
+
+	i.createOwnersFirst(ctx, others)
+	// webhooks whose backends are not running yet would reject the objects
+	i.createOwnersFirst(ctx, admission)
+
+	return i.stats, kerrors.NewAggregate(i.errs)
+}
+
+// createOwnersFirst creates the given objects, owners before their
+// dependents, so that the owner references get their new UIDs.
+func (i *importer) createOwnersFirst(ctx context.Context, objs []*unstructured.Unstructured) {
+	for len(objs) > 0 {
+		var pending []*unstructured.Unstructured
+		for _, obj := range objs {
+			if i.resolveOwnerReferences(ctx, obj, false) {
+				i.create(ctx, obj)
+			} else {
+				pending = append(pending, obj)
+			}
+		}
+		if len(pending) == len(objs) {
+			for _, obj := range pending {
+				i.resolveOwnerReferences(ctx, obj, true)
+				i.create(ctx, obj)
+			}
+			return
+		}
+		objs = pending
+	}
+}
+
+// create creates the object with its status, or replaces an existing one
+// with overwrite, and returns whether it exists on the server afterwards.
+func (i *importer) create(ctx context.Context, obj *unstructured.Unstructured) bool {
+	logger := klog.FromContext(ctx)
+
+	resource, err := i.resource(obj)
+	if err != nil {
+		i.fail(fmt.Errorf("failed to import %s: %w", describe(obj), err))
+		return false
+	}
+
+	created, err := resource.Create(ctx, obj, metav1.CreateOptions{})
+	switch {
+	case apierrors.IsAlreadyExists(err) && !i.overwrite:
+		// existing objects may differ from the export, so they are reported
+		logger.Info("kept existing object", "object", describe(obj))
+		i.stats.Existing++
+		return true
+	case apierrors.IsAlreadyExists(err):
+		if created, err = i.replace(ctx, resource, obj); err != nil {
+			i.fail(fmt.Errorf("failed to overwrite %s: %w", describe(obj), err))
+			return false
+		}
+		logger.Info("overwrote existing object", "object", describe(obj))
+		i.stats.Overwritten++
+	case err != nil:
+		i.fail(fmt.Errorf("failed to create %s: %w", describe(obj), err))
+		return false
+	default:
+		logger.V(2).Info("created object", "object", describe(obj))
+		i.stats.Created++
+	}
+
+	// the status is ignored on create by resources with a status subresource
+	status, ok := obj.Object["status"]
+	if !ok || obj.GroupVersionKind().GroupKind() == crdGroupKind {
+		return true
+	}
+	created.Object["status"] = status
+	if _, err := resource.UpdateStatus(ctx, created, metav1.UpdateOptions{}); err != nil && !apierrors.IsNotFound(err) && !apierrors.IsMethodNotSupported(err) {
+		i.fail(fmt.Errorf("failed to update the status of %s: %w", describe(obj), err))
+	}
+	return true
+}
+
+// replace updates the existing object to the given one.
+func (i *importer) replace(ctx context.Context, resource dynamic.ResourceInterface, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	existing, err := resource.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	obj = obj.DeepCopy()
+	obj.SetUID(existing.GetUID())
+	obj.SetResourceVersion(existing.GetResourceVersion())
+	return resource.Update(ctx, obj, metav1.UpdateOptions{})
+}
+
+// resolveOwnerReferences sets the UIDs of the owners on the server in the
+// owner references of the object, and returns whether all owners exist. With
+// drop, the references to missing owners are removed instead.
+func (i *importer) resolveOwnerReferences(ctx context.Context, obj *unstructured.Unstructured, drop bool) bool {
+	refs := obj.GetOwnerReferences()
+	if len(refs) == 0 {
+		return true
+	}
+
+	resolved := make([]metav1.OwnerReference, 0, len(refs))
+	for _, ref := range refs {
+		owner := &unstructured.Unstructured{}
+		owner.SetAPIVersion(ref.APIVersion)
+		owner.SetKind(ref.Kind)
+		owner.SetName(ref.Name)
+		owner.SetNamespace(obj.GetNamespace())
+
+		resource, err := i.resource(owner)
+		var existing *unstructured.Unstructured
+		if err == nil {
+			existing, err = resource.Get(ctx, ref.Name, metav1.GetOptions{})
+		}
+		if err != nil {
+			if !drop {
+				return false
+			}
+			klog.FromContext(ctx).Info("dropping owner reference to missing owner", "object", describe(obj), "owner", describe(owner))
+			continue
+		}
+		ref.UID = existing.GetUID()
+		resolved = append(resolved, ref)
+	}
+	obj.SetOwnerReferences(resolved)
+	return true
+}
+
+// resource returns the client of the resource of the object, in its namespace
+// for namespaced resources.
+func (i *importer) resource(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := i.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return i.client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+	}
+	return i.client.Resource(mapping.Resource), nil
+}
+
+func (i *importer) fail(err error) {
+	i.stats.Failed++
+	i.errs = append(i.errs, err)
+}
+
+// describe returns the kind and the name of the object for messages.
+func describe(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() != "" {
+		return fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	namespacesResource = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	configMapsResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	secretsResource    = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	leasesResource     = schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1", Resource: "leases"}
+	webhooksResource   = schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "validatingwebhookconfigurations"}
+
+	kinds = map[schema.GroupVersionResource]string{
+		namespacesResource: "Namespace",
+		configMapsResource: "ConfigMap",
+		secretsResource:    "Secret",
+		leasesResource:     "Lease",
+		webhooksResource:   "ValidatingWebhookConfiguration",
+	}
+)
+
+func newObject(gvr schema.GroupVersionResource, namespace, name string, fields map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	for k, v := range fields {
+		obj.Object[k] = v
+	}
+	obj.SetAPIVersion(gvr.GroupVersion().String())
+	obj.SetKind(kinds[gvr])
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func newDynamicClient(objs ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{}
+	for gvr, kind := range kinds {
+		listKinds[gvr] = kind + "List"
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objs...)
+}
+
+// newImporter returns an importer of the core resources into the given client.
+func newImporter(client *dynamicfake.FakeDynamicClient, overwrite bool) *importer {
+	discoveryClient := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", Kind: "Namespace", Verbs: []string{"create", "get", "list", "update"}},
+			{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: []string{"create", "get", "list", "update"}},
+			{Name: "secrets", Kind: "Secret", Namespaced: true, Verbs: []string{"create", "get", "list", "update"}},
+		},
+	}, {
+		GroupVersion: "admissionregistration.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration", Verbs: []string{"create", "get", "list", "update"}},
+		},
+	}}}}
+	return &importer{
+		client:    client,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		overwrite: overwrite,
+	}
+}
+
+func TestExported(t *testing.T) {
+	deleted := newObject(configMapsResource, "a", "deleted", nil)
+	now := metav1.Now()
+	deleted.SetDeletionTimestamp(&now)
+	identity := newObject(leasesResource, "kube-system", "apiserver-1", nil)
+	identity.SetLabels(map[string]string{identityLabel: "kube-apiserver"})
+
+	tests := []struct {
+		name string
+		gvr  schema.GroupVersionResource
+		obj  *unstructured.Unstructured
+		want bool
+	}{
+		{name: "configmap", gvr: configMapsResource, obj: newObject(configMapsResource, "a", "settings", nil), want: true},
+		{name: "root CA configmap", gvr: configMapsResource, obj: newObject(configMapsResource, "a", rootCAConfigMapName, nil)},
+		{name: "deleted object", gvr: configMapsResource, obj: deleted},
+		{name: "opaque secret", gvr: secretsResource, obj: newObject(secretsResource, "a", "creds", map[string]interface{}{"type": "Opaque"}), want: true},
+		{name: "secret without type", gvr: secretsResource, obj: newObject(secretsResource, "a", "creds", nil), want: true},
+		{name: "service account token secret", gvr: secretsResource, obj: newObject(secretsResource, "a", "token", map[string]interface{}{"type": "kubernetes.io/service-account-token"})},
+		{name: "lease", gvr: leasesResource, obj: newObject(leasesResource, "a", "leader", nil), want: true},
+		{name: "identity lease", gvr: leasesResource, obj: identity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exported(tt.gvr.GroupResource(), tt.obj); got != tt.want {
+				t.Errorf("exported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportImportArchive(t *testing.T) {
+	ctx := context.Background()
+
+	settings := newObject(configMapsResource, "a", "settings", map[string]interface{}{"data": map[string]interface{}{"key": "exported"}})
+	settings.SetUID("old-settings")
+	settings.SetResourceVersion("42")
+	creds := newObject(secretsResource, "a", "creds", map[string]interface{}{"type": "Opaque", "data": map[string]interface{}{"password": "c2VjcmV0"}})
+	creds.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "settings", UID: "old-settings"}})
+	source := newDynamicClient(
+		newObject(namespacesResource, "", "a", nil),
+		settings,
+		creds,
+		newObject(configMapsResource, "a", rootCAConfigMapName, map[string]interface{}{"data": map[string]interface{}{"ca.crt": "old CA"}}),
+		newObject(secretsResource, "a", "token", map[string]interface{}{"type": "kubernetes.io/service-account-token"}),
+	)
+
+	archive := filepath.Join(t.TempDir(), "export.tar.gz")
+	w, err := newWriter(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gvr := range []schema.GroupVersionResource{namespacesResource, configMapsResource, secretsResource} {
+		if _, err := exportResource(ctx, source, w, gvr, kinds[gvr]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readFiles(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	if diff := cmp.Diff([]string{"configmaps/a/settings.yaml", "namespaces/a.yaml", "secrets/a/creds.yaml"}, names); diff != "" {
+		t.Errorf("unexpected exported files (-want +got):\n%s", diff)
+	}
+
+	// the target server has its own root CA and the namespace already
+	rootCA := newObject(configMapsResource, "a", rootCAConfigMapName, map[string]interface{}{"data": map[string]interface{}{"ca.crt": "new CA"}})
+	target := newDynamicClient(newObject(namespacesResource, "", "a", nil), rootCA)
+	stats, err := newImporter(target, false).importFiles(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ImportStats{Created: 2, Existing: 1}, stats); diff != "" {
+		t.Errorf("unexpected stats (-want +got):\n%s", diff)
+	}
+
+	imported, err := target.Resource(configMapsResource).Namespace("a").Get(ctx, "settings", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.GetUID() != "" || imported.GetResourceVersion() == "42" {
+		t.Errorf("server populated fields were imported: uid %q, resourceVersion %q", imported.GetUID(), imported.GetResourceVersion())
+	}
+	if diff := cmp.Diff(settings.Object["data"], imported.Object["data"]); diff != "" {
+		t.Errorf("unexpected data (-want +got):\n%s", diff)
+	}
+	ca, err := target.Resource(configMapsResource).Namespace("a").Get(ctx, rootCAConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(rootCA.Object["data"], ca.Object["data"]); diff != "" {
+		t.Errorf("root CA of the target server was changed (-want +got):\n%s", diff)
+	}
+	secrets, err := target.Resource(secretsResource).Namespace("a").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 1 || secrets.Items[0].GetName() != "creds" {
+		t.Errorf("unexpected secrets %v", secrets.Items)
+	}
+}
+
+func TestImportExisting(t *testing.T) {
+	ctx := context.Background()
+
+	exported := newObject(configMapsResource, "a", "settings", map[string]interface{}{"data": map[string]interface{}{"key": "exported"}})
+	dependent := newObject(configMapsResource, "a", "dependent", nil)
+	dependent.SetOwnerReferences([]metav1.OwnerReference{
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "settings", UID: "old-settings"},
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "missing", UID: "old-missing"},
+	})
+	var files []file
+	for _, obj := range []*unstructured.Unstructured{dependent, exported} {
+		files = append(files, file{name: fileName(configMapsResource.GroupResource(), obj), data: mustMarshal(t, obj)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	newTarget := func() *dynamicfake.FakeDynamicClient {
+		existing := newObject(configMapsResource, "a", "settings", map[string]interface{}{"data": map[string]interface{}{"key": "existing"}})
+		existing.SetUID(types.UID("new-settings"))
+		existing.SetResourceVersion("7")
+		return newDynamicClient(existing)
+	}
+	data := func(client *dynamicfake.FakeDynamicClient) interface{} {
+		t.Helper()
+		obj, err := client.Resource(configMapsResource).Namespace("a").Get(ctx, "settings", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj.Object["data"]
+	}
+
+	tests := []struct {
+		name      string
+		overwrite bool
+		wantStats ImportStats
+		wantData  interface{}
+	}{
+		{
+			name:      "kept",
+			wantStats: ImportStats{Created: 1, Existing: 1},
+			wantData:  map[string]interface{}{"key": "existing"},
+		},
+		{
+			name:      "overwritten",
+			overwrite: true,
+			wantStats: ImportStats{Created: 1, Overwritten: 1},
+			wantData:  map[string]interface{}{"key": "exported"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTarget()
+			stats, err := newImporter(target, tt.overwrite).importFiles(ctx, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.wantStats, stats); diff != "" {
+				t.Errorf("unexpected stats (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantData, data(target)); diff != "" {
+				t.Errorf("unexpected data (-want +got):\n%s", diff)
+			}
+
+			// the dependent refers to the owner on the target server only
+			obj, err := target.Resource(configMapsResource).Namespace("a").Get(ctx, "dependent", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "settings", UID: "new-settings"}}
+			if diff := cmp.Diff(want, obj.GetOwnerReferences()); diff != "" {
+				t.Errorf("unexpected owner references (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestImportWebhooksLast(t *testing.T) {
+	ctx := context.Background()
+
+	// the webhook configuration is read before the objects it would reject
+	webhook := newObject(webhooksResource, "", "webhook", nil)
+	files := []file{{name: fileName(webhooksResource.GroupResource(), webhook), data: mustMarshal(t, webhook)}}
+	for gvr, obj := range map[schema.GroupVersionResource]*unstructured.Unstructured{
+		namespacesResource: newObject(namespacesResource, "", "b", nil),
+		configMapsResource: newObject(configMapsResource, "b", "settings", nil),
+		secretsResource:    newObject(secretsResource, "b", "creds", nil),
+	} {
+		files = append(files, file{name: fileName(gvr.GroupResource(), obj), data: mustMarshal(t, obj)})
+	}
+
+	// the webhook rejects every object once it exists, as its backend is not
+	// running yet
+	target := newDynamicClient()
+	webhookCreated := false
+	target.PrependReactor("create", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetResource() == webhooksResource {
+			webhookCreated = true
+			return false, nil, nil
+		}
+		if webhookCreated {
+			return true, nil, apierrors.NewInternalError(errors.New("webhook backend is not running"))
+		}
+		return false, nil, nil
+	})
+
+	stats, err := newImporter(target, false).importFiles(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ImportStats{Created: 4}, stats); diff != "" {
+		t.Errorf("unexpected stats (-want +got):\n%s", diff)
+	}
+	var created []string
+	for _, action := range target.Actions() {
+		if create, ok := action.(clienttesting.CreateAction); ok {
+			created = append(created, create.GetResource().Resource)
+		}
+	}
+	if len(created) == 0 || created[len(created)-1] != webhooksResource.Resource {
+		t.Errorf("webhook configuration was not created last: %v", created)
+	}
+}
+
+func mustMarshal(t *testing.T, obj *unstructured.Unstructured) []byte {
+	t.Helper()
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/klog/v2"
+)
+
+// reloadInterval is the interval to check the policy file for changes.
+const reloadInterval = 10 * time.Second
+
+// Authorizer authorizes requests by the rules of a policy file. Requests not
+// allowed by a rule are denied, except for members of system:masters, which
+// are left to the other authorizers. The policy file is reloaded on change.
+type Authorizer struct {
+	path string
+
+	lock   sync.RWMutex
+	data   []byte
+	policy *compiledPolicy
+}
+
+var _ authorizer.Authorizer = &Authorizer{}
+
+// NewAuthorizer returns an authorizer for the given policy file.
+func NewAuthorizer(path string) (*Authorizer, error) {
+	a := &Authorizer{path: path}
+	if _, err := a.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load authorization policy file %q: %w", path, err)
+	}
+	return a, nil
+}
+
+// reload reads the policy file and returns true if it has changed.
+func (a *Authorizer) reload() (bool, error) {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+	a.lock.RLock()
+	unchanged := a.policy != nil && bytes.Equal(data, a.data)
+	a.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	policy, err := parse(data)
+	if err != nil {
+		return false, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.data = data
+	a.policy = policy
+	return true, nil
+}
+
+// Run reloads the policy file periodically until the context is done. Invalid
+// or missing policy files are logged and the previous policy is kept.
+func (a *Authorizer) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithValues("path", a.path)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		changed, err := a.reload()
+		if err != nil {
+			logger.Error(err, "Failed to reload authorization policy file, keeping the previous policy")
+			return
+		}
+		if changed {
+			logger.Info("Reloaded authorization policy file")
+		}
+	}, reloadInterval)
+}
+
+// Authorize implements authorizer.Authorizer.
+func (a *Authorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	if u := attrs.GetUser(); u != nil && slices.Contains(u.GetGroups(), user.SystemPrivilegedGroup) {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+
+	a.lock.RLock()
+	policy := a.policy
+	a.lock.RUnlock()
+
+	if allowed, reason := policy.allows(ctx, attrs); allowed {
+		return authorizer.DecisionAllow, reason, nil
+	}
+	return authorizer.DecisionDeny, "no authorization policy rule matches", nil
+}
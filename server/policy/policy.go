@@ -0,0 +1,292 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker"
+	"sigs.k8s.io/yaml"
+
+	celconfig "k8s.io/apiserver/pkg/apis/cel"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// APIVersion is the apiVersion of the policy file.
+	APIVersion = "gcp.kcp.io/v1alpha1"
+	// Kind is the kind of the policy file.
+	Kind = "AuthorizationPolicy"
+)
+
+// Policy is the content of the policy file, e.g.
+//
+//	apiVersion: gcp.kcp.io/v1alpha1
+//	kind: AuthorizationPolicy
+//	rules:
+//	- users: ["user"]
+//	  verbs: ["get", "list", "watch"]
+//	  apiGroups: [""]
+//	  resources: ["configmaps"]
+//	  namespaces: ["default"]
+//	- groups: ["dev"]
+//	  verbs: ["*"]
+//	  apiGroups: ["*"]
+//	  resources: ["*"]
+//	  expression: request.namespace.startsWith("dev-")
+type Policy struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Rules      []Rule `json:"rules"`
+}
+
+// Rule allows the requests of the matching users and groups. All non-empty
+// fields of a rule must match. "*" matches everything.
+type Rule struct {
+	// Users and Groups are the subjects of the rule. One of them must match.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Verbs are the allowed verbs, e.g. get, list, create.
+	Verbs []string `json:"verbs"`
+
+	// APIGroups, Resources and Namespaces match resource requests. Resources
+	// can include a subresource, e.g. "configmaps" or "serviceaccounts/token".
+	// Empty namespaces match all namespaces and cluster-scoped resources.
+	APIGroups  []string `json:"apiGroups,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NonResourceURLs match non-resource requests. A trailing "*" matches
+	// all paths with the given prefix.
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+
+	// Expression is an optional CEL expression which must evaluate to true.
+	// The variable "request" has the fields user, groups, verb, apiGroup,
+	// resource, subresource, namespace, name, path and resourceRequest.
+	Expression string `json:"expression,omitempty"`
+}
+
+// defaultRules allow discovery, health, metrics, service account issuer
+// discovery and self-review requests like the default RBAC roles of
+// kube-apiserver do.
+var defaultRules = []Rule{
+	{
+		Groups:          []string{user.AllAuthenticated, user.AllUnauthenticated},
+		Verbs:           []string{"get"},
+		NonResourceURLs: []string{"/healthz", "/healthz/*", "/livez", "/livez/*", "/readyz", "/readyz/*", "/version", "/version/"},
+	},
+	{
+		Groups:          []string{user.AllAuthenticated},
+		Verbs:           []string{"get"},
+		NonResourceURLs: []string{"/api", "/api/*", "/apis", "/apis/*", "/openapi", "/openapi/*"},
+	},
+	{
+		Groups: []string{user.AllAuthenticated},
+		Verbs:  []string{"get"},
+		NonResourceURLs: []string{
+			"/.well-known/openid-configuration", "/.well-known/openid-configuration/",
+			"/openid/v1/jwks", "/openid/v1/jwks/",
+		},
+	},
+	{
+		Groups:          []string{user.MonitoringGroup},
+		Verbs:           []string{"get"},
+		NonResourceURLs: []string{"/metrics", "/metrics/*"},
+	},
+	{
+		Groups:    []string{user.AllAuthenticated},
+		Verbs:     []string{"create"},
+		APIGroups: []string{"authentication.k8s.io", "authorization.k8s.io"},
+		Resources: []string{"selfsubjectreviews", "selfsubjectaccessreviews", "selfsubjectrulesreviews"},
+	},
+}
+
+// compiledRule is a rule with its compiled expression.
+type compiledRule struct {
+	Rule
+	program cel.Program
+}
+
+// compiledPolicy is a parsed, validated and compiled policy.
+type compiledPolicy struct {
+	rules []compiledRule
+}
+
+var env = func() *cel.Env {
+	env, err := cel.NewEnv(cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		panic(err) // only fails on invalid declarations, which is a programming error
+	}
+	return env
+}()
+
+// maxRequestValueSize is the size of the request values, i.e. of the strings
+// and the groups, assumed when estimating the cost of an expression, as their
+// dynamic type has no declared size. It is far more than real requests have.
+const maxRequestValueSize = 64 * 1024
+
+// requestSizeEstimator estimates the size of every request value as
+// maxRequestValueSize.
+type requestSizeEstimator struct{}
+
+func (requestSizeEstimator) EstimateSize(checker.AstNode) *checker.SizeEstimate {
+	return &checker.SizeEstimate{Min: 0, Max: maxRequestValueSize}
+}
+
+func (requestSizeEstimator) EstimateCallCost(string, string, *checker.AstNode, []checker.AstNode) *checker.CallEstimate {
+	return nil
+}
+
+// parse parses, validates and compiles the given policy file content.
+func parse(data []byte) (*compiledPolicy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, err
+	}
+	if policy.APIVersion != APIVersion || policy.Kind != Kind {
+		return nil, fmt.Errorf("unsupported apiVersion %q and kind %q, expected %s %s", policy.APIVersion, policy.Kind, APIVersion, Kind)
+	}
+
+	compiled := &compiledPolicy{}
+	for i, rule := range append(slices.Clone(defaultRules), policy.Rules...) {
+		switch {
+		case len(rule.Users) == 0 && len(rule.Groups) == 0:
+			return nil, fmt.Errorf("rules[%d]: users or groups are required", i-len(defaultRules))
+		case len(rule.Verbs) == 0:
+			return nil, fmt.Errorf("rules[%d]: verbs are required", i-len(defaultRules))
+		case len(rule.Resources) == 0 && len(rule.NonResourceURLs) == 0:
+			return nil, fmt.Errorf("rules[%d]: resources or nonResourceURLs are required", i-len(defaultRules))
+		case len(rule.Resources) > 0 && len(rule.NonResourceURLs) > 0:
+			return nil, fmt.Errorf("rules[%d]: resources and nonResourceURLs are mutually exclusive", i-len(defaultRules))
+		case len(rule.Resources) > 0 && len(rule.APIGroups) == 0:
+			return nil, fmt.Errorf("rules[%d]: apiGroups are required with resources", i-len(defaultRules))
+		}
+
+		cr := compiledRule{Rule: rule}
+		if rule.Expression != "" {
+			ast, issues := env.Compile(rule.Expression)
+			if issues != nil && issues.Err() != nil {
+				return nil, fmt.Errorf("rules[%d]: invalid expression: %w", i-len(defaultRules), issues.Err())
+			}
+			if ast.OutputType() != cel.BoolType {
+				return nil, fmt.Errorf("rules[%d]: expression must evaluate to a bool, got %s", i-len(defaultRules), ast.OutputType())
+			}
+			// expressions are evaluated on every request, so their cost is bounded
+			// like that of the CEL expressions of the API server
+			cost, err := env.EstimateCost(ast, requestSizeEstimator{})
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: failed to estimate the cost of the expression: %w", i-len(defaultRules), err)
+			}
+			if cost.Max > celconfig.PerCallLimit {
+				return nil, fmt.Errorf("rules[%d]: estimated cost %d of the expression exceeds the limit %d", i-len(defaultRules), cost.Max, celconfig.PerCallLimit)
+			}
+			program, err := env.Program(ast, cel.CostLimit(celconfig.PerCallLimit))
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: invalid expression: %w", i-len(defaultRules), err)
+			}
+			cr.program = program
+		}
+		compiled.rules = append(compiled.rules, cr)
+	}
+	return compiled, nil
+}
+
+// allows returns true if a rule of the policy allows the request, and the reason.
+// A rule whose expression fails to evaluate is logged and does not match.
+func (p *compiledPolicy) allows(ctx context.Context, attrs authorizer.Attributes) (bool, string) {
+	for i, rule := range p.rules {
+		ok, err := rule.matches(attrs)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to evaluate authorization policy rule, skipping it", "rule", i-len(defaultRules))
+			continue
+		}
+		if ok {
+			if i < len(defaultRules) {
+				return true, "allowed by a default policy rule"
+			}
+			return true, fmt.Sprintf("allowed by policy rule %d", i-len(defaultRules))
+		}
+	}
+	return false, ""
+}
+
+func (r compiledRule) matches(attrs authorizer.Attributes) (bool, error) {
+	u := attrs.GetUser()
+	if u == nil {
+		return false, nil
+	}
+	if !matchesAny(r.Users, u.GetName()) && !slices.ContainsFunc(u.GetGroups(), func(group string) bool { return matchesAny(r.Groups, group) }) {
+		return false, nil
+	}
+	if !matchesAny(r.Verbs, attrs.GetVerb()) {
+		return false, nil
+	}
+
+	if attrs.IsResourceRequest() {
+		resource := attrs.GetResource()
+		if attrs.GetSubresource() != "" {
+			resource += "/" + attrs.GetSubresource()
+		}
+		if len(r.Resources) == 0 || !matchesAny(r.APIGroups, attrs.GetAPIGroup()) || !matchesAny(r.Resources, resource) {
+			return false, nil
+		}
+		if len(r.Namespaces) > 0 && !matchesAny(r.Namespaces, attrs.GetNamespace()) {
+			return false, nil
+		}
+	} else if !slices.ContainsFunc(r.NonResourceURLs, func(url string) bool {
+		prefix, wildcard := strings.CutSuffix(url, "*")
+		return url == attrs.GetPath() || (wildcard && strings.HasPrefix(attrs.GetPath(), prefix))
+	}) {
+		return false, nil
+	}
+
+	if r.program == nil {
+		return true, nil
+	}
+	out, _, err := r.program.Eval(map[string]any{
+		"request": map[string]any{
+			"user":            u.GetName(),
+			"groups":          u.GetGroups(),
+			"verb":            attrs.GetVerb(),
+			"apiGroup":        attrs.GetAPIGroup(),
+			"resource":        attrs.GetResource(),
+			"subresource":     attrs.GetSubresource(),
+			"namespace":       attrs.GetNamespace(),
+			"name":            attrs.GetName(),
+			"path":            attrs.GetPath(),
+			"resourceRequest": attrs.IsResourceRequest(),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate expression %q: %w", r.Expression, err)
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched, nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return pattern == "*" || pattern == value
+	})
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const policyHeader = "apiVersion: gcp.kcp.io/v1alpha1\nkind: AuthorizationPolicy\n"
+
+func resourceRequest(u user.Info, verb, apiGroup, resource, namespace string) authorizer.AttributesRecord {
+	return authorizer.AttributesRecord{
+		User:            u,
+		Verb:            verb,
+		APIGroup:        apiGroup,
+		Resource:        resource,
+		Namespace:       namespace,
+		ResourceRequest: true,
+	}
+}
+
+func pathRequest(u user.Info, path string) authorizer.AttributesRecord {
+	return authorizer.AttributesRecord{User: u, Verb: "get", Path: path}
+}
+
+func TestAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policyHeader+`rules:
+- users: ["alice"]
+  verbs: ["get", "list"]
+  apiGroups: [""]
+  resources: ["configmaps"]
+  namespaces: ["default"]
+- groups: ["dev"]
+  verbs: ["*"]
+  apiGroups: ["*"]
+  resources: ["*"]
+  expression: request.namespace.startsWith("dev-")
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &user.DefaultInfo{Name: "alice", Groups: []string{user.AllAuthenticated}}
+	bob := &user.DefaultInfo{Name: "bob", Groups: []string{"dev", user.AllAuthenticated}}
+	anonymous := &user.DefaultInfo{Name: user.Anonymous, Groups: []string{user.AllUnauthenticated}}
+	monitoring := &user.DefaultInfo{Name: "prometheus", Groups: []string{user.MonitoringGroup, user.AllAuthenticated}}
+	admin := &user.DefaultInfo{Name: "admin", Groups: []string{user.SystemPrivilegedGroup}}
+
+	tests := []struct {
+		name  string
+		attrs authorizer.AttributesRecord
+		want  authorizer.Decision
+	}{
+		{name: "rule allows", attrs: resourceRequest(alice, "list", "", "configmaps", "default"), want: authorizer.DecisionAllow},
+		{name: "other verb", attrs: resourceRequest(alice, "delete", "", "configmaps", "default"), want: authorizer.DecisionDeny},
+		{name: "other namespace", attrs: resourceRequest(alice, "get", "", "configmaps", "kube-system"), want: authorizer.DecisionDeny},
+		{name: "other resource", attrs: resourceRequest(alice, "get", "", "secrets", "default"), want: authorizer.DecisionDeny},
+		{name: "expression allows", attrs: resourceRequest(bob, "delete", "apps", "deployments", "dev-a"), want: authorizer.DecisionAllow},
+		{name: "expression denies", attrs: resourceRequest(bob, "delete", "apps", "deployments", "prod"), want: authorizer.DecisionDeny},
+		{name: "system:masters", attrs: resourceRequest(admin, "delete", "", "secrets", "kube-system"), want: authorizer.DecisionNoOpinion},
+		{name: "anonymous healthz", attrs: pathRequest(anonymous, "/healthz"), want: authorizer.DecisionAllow},
+		{name: "anonymous readyz check", attrs: pathRequest(anonymous, "/readyz/etcd"), want: authorizer.DecisionAllow},
+		{name: "anonymous livez check", attrs: pathRequest(anonymous, "/livez/ping"), want: authorizer.DecisionAllow},
+		{name: "anonymous discovery", attrs: pathRequest(anonymous, "/apis"), want: authorizer.DecisionDeny},
+		{name: "discovery", attrs: pathRequest(alice, "/apis/apps/v1"), want: authorizer.DecisionAllow},
+		{name: "openid configuration", attrs: pathRequest(alice, "/.well-known/openid-configuration"), want: authorizer.DecisionAllow},
+		{name: "openid keys", attrs: pathRequest(alice, "/openid/v1/jwks"), want: authorizer.DecisionAllow},
+		{name: "metrics", attrs: pathRequest(monitoring, "/metrics"), want: authorizer.DecisionAllow},
+		{name: "metrics without monitoring group", attrs: pathRequest(alice, "/metrics"), want: authorizer.DecisionDeny},
+		{name: "self review", attrs: resourceRequest(alice, "create", "authorization.k8s.io", "selfsubjectaccessreviews", ""), want: authorizer.DecisionAllow},
+		{name: "no user", attrs: authorizer.AttributesRecord{Verb: "get", Path: "/healthz"}, want: authorizer.DecisionDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, reason, err := a.Authorize(context.Background(), tt.attrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision != tt.want {
+				t.Errorf("decision = %v (%q), want %v", decision, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeSkipsFailingExpressions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policyHeader+`rules:
+- users: ["carol"]
+  verbs: ["*"]
+  apiGroups: [""]
+  resources: ["configmaps"]
+  expression: request.groups[0] == "ops"
+- users: ["carol"]
+  verbs: ["get"]
+  apiGroups: [""]
+  resources: ["configmaps"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// carol has no groups, so the expression fails with an index out of range
+	carol := &user.DefaultInfo{Name: "carol"}
+	tests := []struct {
+		name  string
+		attrs authorizer.AttributesRecord
+		want  authorizer.Decision
+	}{
+		{name: "next rule allows", attrs: resourceRequest(carol, "get", "", "configmaps", "default"), want: authorizer.DecisionAllow},
+		{name: "no other rule", attrs: resourceRequest(carol, "delete", "", "configmaps", "default"), want: authorizer.DecisionDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, reason, err := a.Authorize(context.Background(), tt.attrs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decision != tt.want {
+				t.Errorf("decision = %v (%q), want %v", decision, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decision := func(a *Authorizer, u user.Info) authorizer.Decision {
+		t.Helper()
+		d, _, err := a.Authorize(context.Background(), resourceRequest(u, "get", "", "configmaps", "default"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+
+	write(policyHeader + "rules:\n- users: [alice]\n  verbs: [get]\n  apiGroups: ['']\n  resources: [configmaps]\n")
+	a, err := NewAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := a.reload(); err != nil || changed {
+		t.Errorf("reload of an unchanged file returned %v, %v", changed, err)
+	}
+
+	write(policyHeader + "rules:\n- users: [bob]\n  verbs: [get]\n  apiGroups: ['']\n  resources: [configmaps]\n")
+	if changed, err := a.reload(); err != nil || !changed {
+		t.Fatalf("reload of a changed file returned %v, %v", changed, err)
+	}
+	if decision(a, alice) != authorizer.DecisionDeny || decision(a, bob) != authorizer.DecisionAllow {
+		t.Errorf("reloaded policy is not used")
+	}
+
+	// an invalid file keeps the previous policy
+	write(policyHeader + "rules:\n- users: [alice]\n  verbs: [get]\n  apiGroups: ['']\n  resources: [configmaps]\n  expression: request.user ==\n")
+	if _, err := a.reload(); err == nil {
+		t.Errorf("expected an error reloading an invalid file")
+	}
+	if decision(a, bob) != authorizer.DecisionAllow {
+		t.Errorf("previous policy was not kept")
+	}
+}
+
+func TestAuthorizeCostLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policyHeader+`rules:
+- users: ["alice"]
+  verbs: ["get"]
+  nonResourceURLs: ["/x/*"]
+  expression: request.path.matches("^/x/.*y$")
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the long path is more than the cost estimate assumes, so the evaluation
+	// is aborted at the limit and the rule does not match
+	alice := &user.DefaultInfo{Name: "alice"}
+	tests := []struct {
+		name string
+		path string
+		want authorizer.Decision
+	}{
+		{name: "short path", path: "/x/ay", want: authorizer.DecisionAllow},
+		{name: "long path", path: "/x/" + strings.Repeat("a", 8*1024*1024) + "y", want: authorizer.DecisionDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, reason, err := a.Authorize(context.Background(), pathRequest(alice, tt.path))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if decision != tt.want {
+				t.Errorf("decision = %v (%q), want %v", decision, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "empty rules", data: policyHeader},
+		{name: "wrong kind", data: "apiVersion: gcp.kcp.io/v1alpha1\nkind: Policy\n", wantErr: "unsupported apiVersion"},
+		{name: "unknown field", data: policyHeader + "rules:\n- user: [a]\n", wantErr: "unknown field"},
+		{name: "no subjects", data: policyHeader + "rules:\n- verbs: [get]\n  nonResourceURLs: [/x]\n", wantErr: "rules[0]: users or groups are required"},
+		{name: "no verbs", data: policyHeader + "rules:\n- users: [a]\n  nonResourceURLs: [/x]\n", wantErr: "rules[0]: verbs are required"},
+		{name: "no target", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n", wantErr: "resources or nonResourceURLs are required"},
+		{name: "both targets", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  apiGroups: ['']\n  resources: [pods]\n  nonResourceURLs: [/x]\n", wantErr: "mutually exclusive"},
+		{name: "no api groups", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  resources: [pods]\n", wantErr: "apiGroups are required"},
+		{name: "bad expression", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  nonResourceURLs: [/x]\n  expression: request.user ==\n", wantErr: "rules[0]: invalid expression"},
+		{name: "cheap expression", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  nonResourceURLs: [/x]\n  expression: request.groups.exists(g, g.startsWith('ops-'))\n"},
+		{name: "expensive expression", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  nonResourceURLs: [/x]\n  expression: request.groups.all(a, request.groups.all(b, a == b))\n", wantErr: "rules[0]: estimated cost"},
+		{name: "non-bool expression", data: policyHeader + "rules:\n- users: [a]\n  verbs: [get]\n  nonResourceURLs: [/x]\n  expression: request.user\n", wantErr: "must evaluate to a bool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse([]byte(tt.data))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
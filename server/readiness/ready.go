@@ -25,17 +25,14 @@ import (
 
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
-// WaitForReady waits for the control plane to be ready.
-func WaitForReady(ctx context.Context, kubeConfigPath string) error {
-	// wait for readiness
-	logger := klog.FromContext(ctx)
-	logger.Info("Waiting for /readyz to succeed")
-	lastSeenUnready := sets.New[string]()
-
+// WaitForReady waits for the control plane to be ready, ignoring the given
+// readyz checks.
+func WaitForReady(ctx context.Context, kubeConfigPath string, excludedChecks ...string) error {
 	configLoader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeConfigPath},
 		&clientcmd.ConfigOverrides{CurrentContext: "root"},
 	)
@@ -43,6 +40,17 @@ func WaitForReady(ctx context.Context, kubeConfigPath string) error {
 	if err != nil {
 		return err
 	}
+	return WaitForReadyWithConfig(ctx, config, excludedChecks...)
+}
+
+// WaitForReadyWithConfig waits for the control plane of the given client config
+// to be ready, ignoring the given readyz checks.
+func WaitForReadyWithConfig(ctx context.Context, config *rest.Config, excludedChecks ...string) error {
+	// wait for readiness
+	logger := klog.FromContext(ctx)
+	logger.Info("Waiting for /readyz to succeed")
+	lastSeenUnready := sets.New[string]()
+
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return err
@@ -57,7 +65,11 @@ func WaitForReady(ctx context.Context, kubeConfigPath string) error {
 		default:
 		}
 
-		res := client.RESTClient().Get().AbsPath("/readyz").Do(ctx)
+		req := client.RESTClient().Get().AbsPath("/readyz")
+		for _, name := range excludedChecks {
+			req = req.Param("exclude", name)
+		}
+		res := req.Do(ctx)
 		if _, err := res.Raw(); err != nil {
 			unreadyComponents := unreadyComponentsFromError(err)
 			//logger.Error(err, "control plane not ready", "unreadyComponents", sets.List[string](unreadyComponents), "error", err)
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const subsystem = "gcp_etcd_snapshot"
+
+var (
+	lastSuccessTimestamp = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      subsystem,
+			Name:           "last_success_timestamp_seconds",
+			Help:           "Unix time of the last successful scheduled snapshot of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+	lastSizeBytes = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      subsystem,
+			Name:           "last_size_bytes",
+			Help:           "Compressed size in bytes of the last successful scheduled snapshot of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+	failures = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Subsystem:      subsystem,
+			Name:           "failures_total",
+			Help:           "Number of failed scheduled snapshots of the embedded etcd",
+			StabilityLevel: metrics.ALPHA,
+		})
+)
+
+var registerMetrics sync.Once
+
+// RegisterMetrics registers the scheduled snapshot metrics.
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(lastSuccessTimestamp, lastSizeBytes, failures)
+	})
+}
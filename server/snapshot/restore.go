@@ -0,0 +1,115 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	etcdutlsnapshot "go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+// Restore verifies the snapshot at path and rebuilds the member directory of
+// the etcd data directory of the given config from it with etcdutl, as a new
+// cluster with the name, initial cluster and peer URLs of the config. An
+// existing member directory is kept as member.<timestamp>.bak, and its path is
+// returned. The server must be stopped.
+func Restore(path string, config *embed.Config) (string, error) {
+	if _, err := Verify(path); err != nil {
+		return "", err
+	}
+	memberDir := filepath.Join(config.Dir, "member")
+	if _, err := os.Stat(DatabasePath(config.Dir)); err == nil {
+		// fails if the server is running
+		db, err := openDatabase(DatabasePath(config.Dir))
+		if err != nil {
+			return "", err
+		}
+		db.Close()
+	}
+
+	if err := fileutil.TouchDirAll(zap.NewNop(), config.Dir); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(config.Dir, ".restore-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath, err := uncompressed(path, tmpDir)
+	if err != nil {
+		return "", err
+	}
+	peerURLs := make([]string, 0, len(config.AdvertisePeerUrls))
+	for _, u := range config.AdvertisePeerUrls {
+		peerURLs = append(peerURLs, u.String())
+	}
+	dataDir := filepath.Join(tmpDir, "data")
+	if err := etcdutlsnapshot.NewV3(zap.NewNop()).Restore(etcdutlsnapshot.RestoreConfig{
+		SnapshotPath:        snapshotPath,
+		Name:                config.Name,
+		OutputDataDir:       dataDir,
+		PeerURLs:            peerURLs,
+		InitialCluster:      config.InitialCluster,
+		InitialClusterToken: config.InitialClusterToken,
+	}); err != nil {
+		return "", fmt.Errorf("failed to restore snapshot %q: %w", path, err)
+	}
+
+	var backup string
+	if _, err := os.Stat(memberDir); err == nil {
+		backup = fmt.Sprintf("%s.%s.bak", memberDir, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(memberDir, backup); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(dataDir, "member"), memberDir); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
+
+// uncompressed returns the path of the snapshot at path if it is not
+// compressed, or decompresses it into dir and returns the decompressed path.
+func uncompressed(path, dir string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, gzipMagic) {
+		return path, nil
+	}
+	decompressed := filepath.Join(dir, "snapshot.db")
+	if err := decompress(path, decompressed); err != nil {
+		return "", fmt.Errorf("failed to decompress snapshot %q: %w", path, err)
+	}
+	return decompressed, nil
+}
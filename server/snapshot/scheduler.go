@@ -0,0 +1,221 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// scheduledPrefix and scheduledSuffix enclose the UTC timestamp in the
+	// file names of scheduled snapshots.
+	scheduledPrefix = "etcd-"
+	scheduledSuffix = ".db.gz"
+	timestampFormat = "20060102T150405Z"
+)
+
+// Scheduler saves compressed, timestamped snapshots of the running etcd
+// periodically and deletes all but the newest ones.
+type Scheduler struct {
+	config    clientv3.Config
+	dir       string
+	interval  time.Duration
+	retention int
+
+	lock        sync.RWMutex
+	started     time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+var _ healthz.HealthChecker = &Scheduler{}
+
+// NewScheduler returns a scheduler saving a snapshot of the etcd at the
+// endpoint of config into dir every interval, keeping retention snapshots.
+func NewScheduler(config clientv3.Config, dir string, interval time.Duration, retention int) *Scheduler {
+	RegisterMetrics()
+	return &Scheduler{
+		config:    config,
+		dir:       dir,
+		interval:  interval,
+		retention: retention,
+		started:   time.Now(),
+	}
+}
+
+// Run saves snapshots until the context is done. The first snapshot is
+// saved after one interval.
+func (s *Scheduler) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithValues("directory", s.dir)
+	logger.Info("Starting scheduled etcd snapshots", "interval", s.interval, "retention", s.retention)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// an attempt must not block the next one
+		saveCtx, cancel := context.WithTimeout(ctx, s.interval)
+		path, size, err := s.save(saveCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.lastErr = err
+		if err == nil {
+			s.lastSuccess = time.Now()
+		}
+		s.lock.Unlock()
+
+		if err != nil {
+			failures.Inc()
+			logger.Error(err, "Failed to save scheduled etcd snapshot")
+			continue
+		}
+		lastSuccessTimestamp.SetToCurrentTime()
+		lastSizeBytes.Set(float64(size))
+		logger.V(2).Info("Saved scheduled etcd snapshot", "path", path, "size", size)
+
+		if err := s.prune(); err != nil {
+			logger.Error(err, "Failed to delete old etcd snapshots")
+		}
+	}
+}
+
+// save saves a verified snapshot and compresses it. It returns the path and
+// the size of the compressed snapshot.
+func (s *Scheduler) save(ctx context.Context) (string, int64, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", 0, err
+	}
+	path := filepath.Join(s.dir, scheduledPrefix+time.Now().UTC().Format(timestampFormat)+scheduledSuffix)
+
+	tmpDir, err := os.MkdirTemp(s.dir, ".snapshot-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "db")
+	if _, err := Save(ctx, s.config, dbPath); err != nil {
+		return "", 0, err
+	}
+	gzPath := filepath.Join(tmpDir, "db.gz")
+	if err := compress(dbPath, gzPath); err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(gzPath)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), os.Rename(gzPath, path)
+}
+
+// prune deletes the oldest scheduled snapshots beyond the retention.
+func (s *Scheduler) prune() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), scheduledPrefix) && strings.HasSuffix(e.Name(), scheduledSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	// timestamps sort chronologically
+	slices.Sort(names)
+	for len(names) > s.retention {
+		if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Name implements healthz.HealthChecker.
+func (s *Scheduler) Name() string {
+	return "etcd-snapshots"
+}
+
+// Check implements healthz.HealthChecker. It fails when no snapshot has
+// succeeded for two intervals.
+func (s *Scheduler) Check(_ *http.Request) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	since := s.lastSuccess
+	if since.IsZero() {
+		since = s.started
+	}
+	if time.Since(since) <= 2*s.interval {
+		return nil
+	}
+	err := fmt.Errorf("no etcd snapshot succeeded since %s", since.Format(time.RFC3339))
+	if s.lastErr != nil {
+		err = fmt.Errorf("%w: %w", err, s.lastErr)
+	}
+	return err
+}
+
+// compress writes the gzip compressed file src to dst.
+func compress(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestSchedulerRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	clientConfig := startEtcd(t, newEtcdConfig(filepath.Join(dir, "etcd")))
+	if _, err := newClient(t, clientConfig).Put(ctx, "/registry/key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotDir := filepath.Join(dir, "snapshots")
+	s := NewScheduler(clientConfig, snapshotDir, 100*time.Millisecond, 2)
+	go s.Run(ctx)
+
+	var snapshots []string
+	if err := wait.PollUntilContextTimeout(ctx, 50*time.Millisecond, wait.ForeverTestTimeout, true, func(context.Context) (bool, error) {
+		var err error
+		snapshots, err = filepath.Glob(filepath.Join(snapshotDir, scheduledPrefix+"*"+scheduledSuffix))
+		return len(snapshots) > 0, err
+	}); err != nil {
+		t.Fatalf("no scheduled snapshot was saved: %v", err)
+	}
+	if err := s.Check(nil); err != nil {
+		t.Errorf("check failed after a successful snapshot: %v", err)
+	}
+
+	status, err := Verify(snapshots[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Keys < 1 {
+		t.Errorf("scheduled snapshot has no keys: %+v", status)
+	}
+}
+
+func TestSchedulerPrune(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"etcd-20240101T120000Z.db.gz",
+		"etcd-20240102T120000Z.db.gz",
+		"etcd-20240103T120000Z.db.gz",
+		"etcd-20240104T120000Z.db.gz",
+		"backup.db",
+		"etcd-manual.db",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "etcd-20230101T120000Z.db.gz"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewScheduler(clientv3.Config{}, dir, time.Hour, 2)
+	if err := s.prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{
+		"backup.db",
+		"etcd-20230101T120000Z.db.gz",
+		"etcd-20240103T120000Z.db.gz",
+		"etcd-20240104T120000Z.db.gz",
+		"etcd-manual.db",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected files after pruning (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchedulerCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := clientv3.Config{Endpoints: []string{"http://127.0.0.1:1"}, DialTimeout: 50 * time.Millisecond}
+	interval := 100 * time.Millisecond
+	s := NewScheduler(config, t.TempDir(), interval, 1)
+	if err := s.Check(nil); err != nil {
+		t.Errorf("check failed before the first interval: %v", err)
+	}
+
+	go s.Run(ctx)
+	var err error
+	if pollErr := wait.PollUntilContextTimeout(ctx, interval, wait.ForeverTestTimeout, false, func(context.Context) (bool, error) {
+		err = s.Check(nil)
+		return err != nil, nil
+	}); pollErr != nil {
+		t.Fatal("check did not fail without successful snapshots")
+	}
+	if !strings.Contains(err.Error(), "no etcd snapshot succeeded since") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package snapshot saves, verifies and restores snapshots of the embedded
+// etcd. Snapshots are etcd backend databases with an appended SHA-256 hash,
+// compatible with etcdctl and etcdutl, optionally gzip compressed.
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	clientsnapshot "go.etcd.io/etcd/client/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+const (
+	// lockTimeout is how long to wait for the lock of an etcd database held
+	// by a running server.
+	lockTimeout = time.Second
+
+	// hashSize is the size of the SHA-256 hash appended to snapshots.
+	hashSize = sha256.Size
+)
+
+var (
+	keyBucket  = []byte("key")
+	metaBucket = []byte("meta")
+
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// Status describes a verified snapshot.
+type Status struct {
+	// Hash is the hex encoded SHA-256 hash of the snapshot database.
+	Hash string
+	// Revision is the latest revision in the snapshot.
+	Revision int64
+	// Keys is the number of key revisions in the snapshot.
+	Keys int
+	// Size is the size of the snapshot database in bytes.
+	Size int64
+}
+
+// DatabasePath returns the path of the backend database of the etcd data directory.
+func DatabasePath(dataDir string) string {
+	return filepath.Join(dataDir, "member", "snap", "db")
+}
+
+// Save saves a snapshot of the running etcd server at the single endpoint of
+// the given client config to path, and verifies it.
+func Save(ctx context.Context, config clientv3.Config, path string) (*Status, error) {
+	if _, err := clientsnapshot.SaveWithVersion(ctx, zap.NewNop(), config, path); err != nil {
+		return nil, fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return Verify(path)
+}
+
+// SaveOffline saves a snapshot of the etcd data directory of a stopped server
+// to path, and verifies it.
+func SaveOffline(dataDir, path string) (*Status, error) {
+	db, err := openDatabase(DatabasePath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	partPath := path + ".part"
+	f, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(partPath)
+
+	h := sha256.New()
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(io.MultiWriter(f, h))
+		return err
+	})
+	if err == nil {
+		_, err = f.Write(h.Sum(nil))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return nil, err
+	}
+	return Verify(path)
+}
+
+// Verify checks the hash and the consistency of the snapshot database at path.
+func Verify(path string) (*Status, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "db")
+	hash, err := copyVerified(path, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	status, err := verifyDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	status.Hash = hex.EncodeToString(hash)
+	return status, nil
+}
+
+// copyVerified copies the snapshot at path without its hash to dbPath and
+// returns the hash after checking it. Gzip compressed snapshots are
+// decompressed first.
+func copyVerified(path, dbPath string) ([]byte, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(src, magic); err == nil && bytes.Equal(magic, gzipMagic) {
+		decompressed := dbPath + ".snapshot"
+		if err := decompress(path, decompressed); err != nil {
+			return nil, fmt.Errorf("failed to decompress snapshot %q: %w", path, err)
+		}
+		defer os.Remove(decompressed)
+		if src, err = os.Open(decompressed); err != nil {
+			return nil, err
+		}
+		defer src.Close()
+	} else if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// etcd databases are a multiple of the page size. A hash makes the size
+	// exceed a multiple of 512, the minimum disk sector size, by the hash size.
+	size := info.Size() - hashSize
+	if info.Size()%512 != hashSize {
+		return nil, fmt.Errorf("snapshot %q has no integrity hash, it is truncated or not an etcd snapshot", path)
+	}
+
+	dst, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), io.LimitReader(src, size))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make([]byte, hashSize)
+	if _, err := io.ReadFull(src, expected); err != nil {
+		return nil, err
+	}
+	if actual := h.Sum(nil); !bytes.Equal(actual, expected) {
+		return nil, fmt.Errorf("snapshot %q is corrupted: hash %x does not match the expected hash %x", path, actual, expected)
+	}
+	return expected, nil
+}
+
+// verifyDatabase checks the consistency of the etcd database at dbPath.
+func verifyDatabase(dbPath string) (*Status, error) {
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	status := &Status{}
+	err = db.View(func(tx *bolt.Tx) error {
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("inconsistent database: %w", errors.Join(errs...))
+		}
+		if tx.Bucket(metaBucket) == nil {
+			return fmt.Errorf("not an etcd database: missing %q bucket", metaBucket)
+		}
+		status.Size = tx.Size()
+
+		keys := tx.Bucket(keyBucket)
+		if keys == nil {
+			return nil
+		}
+		status.Keys = keys.Stats().KeyN
+		if k, _ := keys.Cursor().Last(); len(k) >= 8 {
+			// keys are revisions, starting with the big endian main revision
+			status.Revision = int64(binary.BigEndian.Uint64(k[:8]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify %q: %w", dbPath, err)
+	}
+	return status, nil
+}
+
+// decompress writes the gzip decompressed file src to dst.
+func decompress(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, zr)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openDatabase opens the etcd database at path read-only. It fails if a
+// running server holds the database.
+func openDatabase(path string) (*bolt.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		return nil, fmt.Errorf("database %q is in use, stop the server first", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %q: %w", path, err)
+	}
+	return db, nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// newEtcdConfig returns the config of a single member etcd in dir, listening
+// on random local ports.
+func newEtcdConfig(dir string) *embed.Config {
+	config := embed.NewConfig()
+	config.Dir = dir
+	config.LogLevel = "error"
+	local := url.URL{Scheme: "http", Host: "127.0.0.1:0"}
+	config.ListenClientUrls = []url.URL{local}
+	config.AdvertiseClientUrls = []url.URL{local}
+	config.ListenPeerUrls = []url.URL{local}
+	config.AdvertisePeerUrls = []url.URL{{Scheme: "http", Host: "127.0.0.1:2380"}}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+	return config
+}
+
+// startEtcd starts the etcd of config and returns a client config for it.
+func startEtcd(t *testing.T, config *embed.Config) clientv3.Config {
+	t.Helper()
+	e, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("etcd did not become ready")
+	}
+	return clientv3.Config{
+		Endpoints:   []string{"http://" + e.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+func newClient(t *testing.T, config clientv3.Config) *clientv3.Client {
+	t.Helper()
+	client, err := clientv3.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSaveRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	config := newEtcdConfig(filepath.Join(dir, "etcd"))
+	e, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-e.Server.ReadyNotify()
+	clientConfig := clientv3.Config{Endpoints: []string{"http://" + e.Clients[0].Addr().String()}, DialTimeout: 5 * time.Second}
+	client := newClient(t, clientConfig)
+	for i := range 10 {
+		if _, err := client.Put(ctx, fmt.Sprintf("/registry/key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "backup.db")
+	status, err := Save(ctx, clientConfig, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Revision < 11 || status.Keys < 10 || len(status.Hash) != 64 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	compressed := filepath.Join(dir, "backup.db.gz")
+	if err := compress(path, compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes after the snapshot are lost by the restore
+	if _, err := client.Put(ctx, "/registry/after", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(path, config); err == nil || !strings.Contains(err.Error(), "stop the server first") {
+		t.Errorf("expected restoring into a running server to fail, got %v", err)
+	}
+	e.Close()
+
+	for _, snapshot := range []string{path, compressed} {
+		t.Run(filepath.Base(snapshot), func(t *testing.T) {
+			backup, err := Restore(snapshot, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(backup, "snap", "db")); err != nil {
+				t.Errorf("previous member directory was not kept: %v", err)
+			}
+			defer os.RemoveAll(backup)
+
+			client := newClient(t, startEtcd(t, config))
+			resp, err := client.Get(ctx, "/registry/", clientv3.WithPrefix())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Kvs) != 10 {
+				t.Errorf("restored %d keys, want 10", len(resp.Kvs))
+			}
+			for _, kv := range resp.Kvs {
+				if string(kv.Key) == "/registry/after" {
+					t.Errorf("key written after the snapshot was restored")
+				}
+			}
+			if resp.Header.Revision < status.Revision {
+				t.Errorf("restored revision %d is older than the snapshot revision %d", resp.Header.Revision, status.Revision)
+			}
+			members, err := client.MemberList(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(members.Members) != 1 || members.Members[0].Name != config.Name {
+				t.Errorf("unexpected members %v", members.Members)
+			}
+		})
+	}
+}
+
+func TestRestoreInitialCluster(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	clientConfig := startEtcd(t, newEtcdConfig(filepath.Join(dir, "etcd")))
+	if _, err := newClient(t, clientConfig).Put(ctx, "/registry/key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "backup.db")
+	if _, err := Save(ctx, clientConfig, path); err != nil {
+		t.Fatal(err)
+	}
+
+	initialCluster := "gcp-0=https://127.0.0.1:32380,gcp-1=https://127.0.0.1:32381,gcp-2=https://127.0.0.1:32382"
+	for i := range 3 {
+		config := embed.NewConfig()
+		config.Dir = filepath.Join(dir, fmt.Sprintf("gcp-%d", i))
+		config.Name = fmt.Sprintf("gcp-%d", i)
+		config.InitialCluster = initialCluster
+		config.AdvertisePeerUrls = []url.URL{{Scheme: "https", Host: fmt.Sprintf("127.0.0.1:%d", 32380+i)}}
+		if _, err := Restore(path, config); err != nil {
+			t.Fatalf("failed to restore member %s: %v", config.Name, err)
+		}
+		if _, err := os.Stat(DatabasePath(config.Dir)); err != nil {
+			t.Errorf("member %s has no database: %v", config.Name, err)
+		}
+	}
+
+	config := embed.NewConfig()
+	config.Dir = filepath.Join(dir, "gcp-3")
+	config.Name = "gcp-3"
+	config.InitialCluster = initialCluster
+	config.AdvertisePeerUrls = []url.URL{{Scheme: "https", Host: "127.0.0.1:32383"}}
+	if _, err := Restore(path, config); err == nil {
+		t.Errorf("expected restoring a member not in the initial cluster to fail")
+	}
+}
+
+func TestRestoreCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "backup.db")
+	if err := os.WriteFile(path, make([]byte, 4096+hashSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := newEtcdConfig(filepath.Join(dir, "etcd"))
+	if _, err := Restore(path, config); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("expected a corrupted snapshot error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.Dir, "member")); !os.IsNotExist(err) {
+		t.Errorf("member directory was written from a corrupted snapshot: %v", err)
+	}
+}
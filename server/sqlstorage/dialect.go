@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the pgx driver
+	_ "modernc.org/sqlite"             // registers the pure Go sqlite driver, builds without cgo
+)
+
+const (
+	sqliteScheme     = "sqlite://"
+	postgresScheme   = "postgres://"
+	postgresqlScheme = "postgresql://"
+
+	// sqliteParameters are the default connection parameters of SQLite
+	// databases. Writes are serialized by the store, the busy timeout only
+	// covers other processes accessing the file, e.g. backups.
+	sqliteParameters = "_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(30000)&_txlock=immediate"
+
+	// sqliteMemory is the SQLite path of a database in process memory.
+	sqliteMemory = ":memory:"
+	// MemoryDataSource is the data source of a database in process memory,
+	// which is lost when the server stops.
+	MemoryDataSource = sqliteScheme + sqliteMemory
+)
+
+// IsDataSource returns whether server is a SQL data source, i.e. a
+// sqlite://, postgres:// or postgresql:// URL, instead of an etcd server.
+func IsDataSource(server string) bool {
+	for _, scheme := range []string{sqliteScheme, postgresScheme, postgresqlScheme} {
+		if strings.HasPrefix(server, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// SQLitePath returns the database file of a sqlite:// data source, or an
+// empty string for other data sources. It is ":memory:" for MemoryDataSource.
+func SQLitePath(dataSource string) string {
+	if !strings.HasPrefix(dataSource, sqliteScheme) {
+		return ""
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(dataSource, sqliteScheme), "?")
+	return path
+}
+
+// dialect holds the differences of the supported databases.
+type dialect struct {
+	name string
+	// numbered is whether placeholders are numbered, i.e. $1, instead of ?.
+	numbered bool
+	// bytes and integer are the column types of byte strings and 64 bit integers.
+	bytes, integer string
+	// sizeQuery returns the size of the database and the size in use.
+	sizeQuery string
+}
+
+var (
+	sqlite = &dialect{
+		name:      "sqlite",
+		bytes:     "BLOB",
+		integer:   "INTEGER",
+		sizeQuery: "SELECT c.page_count * s.page_size, (c.page_count - f.freelist_count) * s.page_size FROM pragma_page_count() c, pragma_freelist_count() f, pragma_page_size() s",
+	}
+	postgres = &dialect{
+		name:      "postgres",
+		numbered:  true,
+		bytes:     "BYTEA",
+		integer:   "BIGINT",
+		sizeQuery: "SELECT pg_database_size(current_database()), pg_database_size(current_database())",
+	}
+)
+
+// openDatabase opens the database of the given data source.
+func openDatabase(dataSource string) (*sql.DB, *dialect, error) {
+	if path := SQLitePath(dataSource); path == sqliteMemory {
+		db, err := sql.Open("sqlite", "file::memory:?_txlock=immediate")
+		if err != nil {
+			return nil, nil, err
+		}
+		// every connection opens a separate database in memory
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		return db, sqlite, nil
+	} else if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, nil, err
+		}
+		parameters := sqliteParameters
+		if _, extra, ok := strings.Cut(dataSource, "?"); ok && extra != "" {
+			parameters += "&" + extra
+		}
+		db, err := sql.Open("sqlite", "file:"+path+"?"+parameters)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, sqlite, nil
+	}
+
+	if strings.HasPrefix(dataSource, postgresScheme) || strings.HasPrefix(dataSource, postgresqlScheme) {
+		db, err := sql.Open("pgx", dataSource)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, postgres, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported data source, expected sqlite://<file>, postgres:// or postgresql://")
+}
+
+// schema returns the statements creating the tables of the store.
+func (d *dialect) schema() []string {
+	return []string{
+		// every revision is a row, deletions are rows with deleted = 1
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS gcp_kv (
+	revision %[2]s PRIMARY KEY,
+	name %[1]s NOT NULL,
+	create_revision %[2]s NOT NULL,
+	prev_revision %[2]s NOT NULL,
+	version %[2]s NOT NULL,
+	lease %[2]s NOT NULL,
+	deleted %[2]s NOT NULL,
+	value %[1]s
+)`, d.bytes, d.integer),
+		"CREATE INDEX IF NOT EXISTS gcp_kv_name_revision ON gcp_kv (name, revision)",
+		"CREATE INDEX IF NOT EXISTS gcp_kv_lease ON gcp_kv (lease)",
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS gcp_leases (id %[1]s PRIMARY KEY, ttl %[1]s NOT NULL, expires %[1]s NOT NULL)", d.integer),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS gcp_meta (name VARCHAR(64) PRIMARY KEY, value %s NOT NULL)", d.integer),
+	}
+}
+
+// rebind replaces the ? placeholders of query with numbered ones if the
+// database requires them. The queries of the store have no ? in literals.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
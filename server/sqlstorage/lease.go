@@ -0,0 +1,252 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// minLeaseTTL and maxLeaseTTL are the bounds of the TTL of leases in
+	// seconds, as of etcd with the default heartbeat and election timeout.
+	minLeaseTTL = 2
+	maxLeaseTTL = 9000000000
+	// leaseExpiryInterval is the interval to revoke expired leases.
+	leaseExpiryInterval = time.Second
+)
+
+// expiry returns the expiry of a lease with the given TTL renewed now in
+// milliseconds since the epoch.
+func expiry(ttl int64) int64 {
+	return time.Now().UnixMilli() + ttl*1000
+}
+
+func (s *store) leaseExists(ctx context.Context, q querier, id int64) (bool, error) {
+	var one int
+	err := q.QueryRowContext(ctx, s.query("SELECT 1 FROM gcp_leases WHERE id = ?"), id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// LeaseGrant creates a lease.
+func (s *store) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	if r.TTL > maxLeaseTTL {
+		return nil, rpctypes.ErrGRPCLeaseTTLTooLarge
+	}
+	ttl := max(r.TTL, minLeaseTTL)
+
+	id := r.ID
+	for id == 0 {
+		candidate := rand.Int64N(1<<63 - 1)
+		exists, err := s.leaseExists(ctx, s.db, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			id = candidate
+		}
+	}
+	if exists, err := s.leaseExists(ctx, s.db, id); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, rpctypes.ErrGRPCLeaseExist
+	}
+
+	if _, err := s.db.ExecContext(ctx, s.query("INSERT INTO gcp_leases (id, ttl, expires) VALUES (?, ?, ?)"), id, ttl, expiry(ttl)); err != nil {
+		return nil, err
+	}
+	return &pb.LeaseGrantResponse{Header: header(s.rev.Load()), ID: id, TTL: ttl}, nil
+}
+
+// LeaseRevoke deletes a lease and the keys attached to it.
+func (s *store) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	rev, err := s.revoke(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LeaseRevokeResponse{Header: header(rev)}, nil
+}
+
+// revoke deletes the lease id and the keys attached to it.
+func (s *store) revoke(ctx context.Context, id int64) (int64, error) {
+	return s.write(ctx, func(w *writeTxn) error {
+		res, err := w.tx.ExecContext(ctx, s.query("DELETE FROM gcp_leases WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return rpctypes.ErrGRPCLeaseNotFound
+		}
+
+		keys, err := s.leaseKeys(ctx, w.tx, id)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := w.deleteRange(ctx, &pb.DeleteRangeRequest{Key: key}); err != nil {
+				return err
+			}
+		}
+		// commit the lease deletion without deleted keys, too
+		w.dirty = true
+		return nil
+	})
+}
+
+// leaseKeys returns the keys currently attached to lease id.
+func (s *store) leaseKeys(ctx context.Context, q querier, id int64) ([][]byte, error) {
+	rows, err := q.QueryContext(ctx, s.query("SELECT DISTINCT name FROM gcp_kv WHERE lease = ?"), id)
+	if err != nil {
+		return nil, err
+	}
+	var names [][]byte
+	for rows.Next() {
+		var name []byte
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, name := range names {
+		r, err := s.live(ctx, q, name)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && r.lease == id {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+// LeaseKeepAlive renews leases until the stream is closed.
+func (s *store) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	ctx := stream.Context()
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		resp := &pb.LeaseKeepAliveResponse{Header: header(s.rev.Load()), ID: req.ID}
+		var ttl int64
+		err = s.db.QueryRowContext(ctx, s.query("SELECT ttl FROM gcp_leases WHERE id = ?"), req.ID).Scan(&ttl)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// a TTL of zero signals the lease is gone
+		case err != nil:
+			return err
+		default:
+			if _, err := s.db.ExecContext(ctx, s.query("UPDATE gcp_leases SET expires = ? WHERE id = ?"), expiry(ttl), req.ID); err != nil {
+				return err
+			}
+			resp.TTL = ttl
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// LeaseTimeToLive returns the remaining TTL of a lease.
+func (s *store) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	resp := &pb.LeaseTimeToLiveResponse{Header: header(s.rev.Load()), ID: r.ID, TTL: -1}
+	var ttl, expires int64
+	err := s.db.QueryRowContext(ctx, s.query("SELECT ttl, expires FROM gcp_leases WHERE id = ?"), r.ID).Scan(&ttl, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return resp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	resp.GrantedTTL = ttl
+	resp.TTL = max((expires-time.Now().UnixMilli())/1000, 0)
+
+	if r.Keys {
+		if resp.Keys, err = s.leaseKeys(ctx, s.db, r.ID); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// LeaseLeases lists the leases.
+func (s *store) LeaseLeases(ctx context.Context, _ *pb.LeaseLeasesRequest) (*pb.LeaseLeasesResponse, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM gcp_leases ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	resp := &pb.LeaseLeasesResponse{Header: header(s.rev.Load())}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: id})
+	}
+	return resp, rows.Err()
+}
+
+// expireLeases revokes the expired leases periodically until the context is done.
+func (s *store) expireLeases(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		rows, err := s.db.QueryContext(ctx, s.query("SELECT id FROM gcp_leases WHERE expires <= ?"), time.Now().UnixMilli())
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error(err, "Failed to list expired leases")
+			}
+			return
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if _, err := s.revoke(ctx, id); err != nil && !errors.Is(err, rpctypes.ErrGRPCLeaseNotFound) && ctx.Err() == nil {
+				logger.Error(err, "Failed to revoke expired lease", "lease", id)
+			}
+		}
+	}, leaseExpiryInterval)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sqlstorage serves the subset of the etcd v3 API used by the API
+// server from a SQLite or Postgres database, such that small installations
+// do not need to run etcd.
+package sqlstorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// clusterID, memberID and raftTerm describe the store as a cluster with
+	// a single member.
+	clusterID = 1
+	memberID  = 1
+	raftTerm  = 1
+
+	// grpcOverheadBytes is the allowance of the gRPC framing of requests, as of etcd.
+	grpcOverheadBytes = 512 * 1024
+)
+
+// Config holds the configuration of the SQL storage.
+type Config struct {
+	// DataSource is the sqlite://<file>, postgres:// or postgresql:// URL of the database.
+	DataSource string
+	// Socket is the unix socket serving the etcd API.
+	Socket string
+}
+
+// Server serves the etcd API from a SQL database.
+type Server struct {
+	config Config
+}
+
+// NewServer returns a server of the etcd API from the database of config.
+func NewServer(config Config) *Server {
+	return &Server{config: config}
+}
+
+// Run opens the database and serves the etcd API on the socket until the
+// context is done. It returns once the socket accepts connections.
+func (s *Server) Run(ctx context.Context) error {
+	logger := klog.FromContext(ctx).WithValues("socket", s.config.Socket)
+
+	db, d, err := openDatabase(s.config.DataSource)
+	if err != nil {
+		return err
+	}
+	st, err := newStore(ctx, db, d)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to open %s database: %w", d.name, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.config.Socket), 0700); err != nil {
+		db.Close()
+		return err
+	}
+	if err := os.Remove(s.config.Socket); err != nil && !os.IsNotExist(err) {
+		db.Close()
+		return err
+	}
+	listener, err := net.Listen("unix", s.config.Socket)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	server := grpc.NewServer(
+		grpc.MaxRecvMsgSize(maxRequestBytes+grpcOverheadBytes),
+		grpc.MaxSendMsgSize(math.MaxInt32),
+		// the API server pings every 30s
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 5 * time.Second, PermitWithoutStream: true}),
+	)
+	pb.RegisterKVServer(server, st)
+	pb.RegisterWatchServer(server, st)
+	pb.RegisterLeaseServer(server, st)
+	pb.RegisterMaintenanceServer(server, st)
+
+	logger.Info("Serving etcd API from SQL storage", "database", d.name, "revision", st.rev.Load())
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error(err, "Failed to serve etcd API from SQL storage")
+		}
+	}()
+	go st.expireLeases(ctx)
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+		db.Close()
+	}()
+
+	return nil
+}
+
+// Status reports the store as the leader of a single member cluster. The
+// API server checks the version for the features it uses.
+func (s *store) Status(ctx context.Context, _ *pb.StatusRequest) (*pb.StatusResponse, error) {
+	size, inUse, err := s.size(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rev := s.rev.Load()
+	return &pb.StatusResponse{
+		Header:           header(rev),
+		Version:          version.Version,
+		DbSize:           size,
+		DbSizeInUse:      inUse,
+		Leader:           memberID,
+		RaftIndex:        uint64(rev),
+		RaftTerm:         raftTerm,
+		RaftAppliedIndex: uint64(rev),
+	}, nil
+}
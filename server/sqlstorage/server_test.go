@@ -0,0 +1,492 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	sqlitedriver "modernc.org/sqlite"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// postgresDataSourceEnv is the environment variable with the data source of
+// a Postgres database to run the tests against. The tests are run against
+// SQLite only if it is not set. They use their own keys, but compact the
+// database.
+const postgresDataSourceEnv = "GCP_TEST_POSTGRES_DSN"
+
+// forEachDatabase runs fn with a client of a fresh server for every database
+// and a key prefix unique to the test.
+func forEachDatabase(t *testing.T, fn func(t *testing.T, client *clientv3.Client, prefix string)) {
+	dataSources := map[string]func(t *testing.T) string{
+		"sqlite": func(t *testing.T) string { return "sqlite://" + filepath.Join(t.TempDir(), "gcp.db") },
+		"memory": func(*testing.T) string { return MemoryDataSource },
+	}
+	if dsn := os.Getenv(postgresDataSourceEnv); dsn != "" {
+		dataSources["postgres"] = func(*testing.T) string { return dsn }
+	}
+	for name, dataSource := range dataSources {
+		t.Run(name, func(t *testing.T) {
+			fn(t, newClient(t, dataSource(t)), fmt.Sprintf("/%s/%d/", t.Name(), time.Now().UnixNano()))
+		})
+	}
+}
+
+// newClient serves the etcd API from the given data source until the test
+// ends and returns a client of it.
+func newClient(t *testing.T, dataSource string) *clientv3.Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// socket paths are limited in length
+	dir, err := os.MkdirTemp("", "gcp-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "etcd.sock")
+	if err := NewServer(Config{DataSource: dataSource, Socket: socket}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"unix://" + socket},
+		DialTimeout: 5 * time.Second,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func put(t *testing.T, client *clientv3.Client, key, value string, opts ...clientv3.OpOption) int64 {
+	t.Helper()
+	resp, err := client.Put(context.Background(), key, value, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header.Revision
+}
+
+// nextEvents returns the events of the watch channel until there are n of them.
+func nextEvents(t *testing.T, ch clientv3.WatchChan, n int) []*clientv3.Event {
+	t.Helper()
+	var events []*clientv3.Event
+	timeout := time.After(wait.ForeverTestTimeout)
+	for len(events) < n {
+		select {
+		case resp, ok := <-ch:
+			if !ok {
+				t.Fatalf("watch closed after %d of %d events", len(events), n)
+			}
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, resp.Events...)
+		case <-timeout:
+			t.Fatalf("timed out after %d of %d events", len(events), n)
+		}
+	}
+	return events
+}
+
+func TestTxn(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx := context.Background()
+		key := prefix + "key"
+
+		// create only if the key does not exist, as the API server does
+		create := func(value string) *clientv3.TxnResponse {
+			t.Helper()
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+				Then(clientv3.OpPut(key, value)).
+				Else(clientv3.OpGet(key)).
+				Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+		created := create("v1")
+		if !created.Succeeded {
+			t.Fatalf("creating a new key failed")
+		}
+		if again := create("v2"); again.Succeeded {
+			t.Errorf("creating an existing key succeeded")
+		} else if kvs := again.Responses[0].GetResponseRange().Kvs; len(kvs) != 1 || string(kvs[0].Value) != "v1" {
+			t.Errorf("unexpected else response %v", kvs)
+		}
+
+		// update only if unchanged since the given revision
+		update := func(rev int64, value string) bool {
+			t.Helper()
+			resp, err := client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+				Then(clientv3.OpPut(key, value, clientv3.WithPrevKV())).
+				Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Succeeded {
+				if prev := resp.Responses[0].GetResponsePut().PrevKv; prev == nil || prev.ModRevision != rev {
+					t.Errorf("unexpected previous key %v", prev)
+				}
+			}
+			return resp.Succeeded
+		}
+		if !update(created.Header.Revision, "v2") {
+			t.Errorf("update at the current revision failed")
+		}
+		if update(created.Header.Revision, "v3") {
+			t.Errorf("update at an outdated revision succeeded")
+		}
+
+		resp, err := client.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "v2" || resp.Kvs[0].Version != 2 || resp.Kvs[0].CreateRevision != created.Header.Revision {
+			t.Errorf("unexpected key %v", resp.Kvs)
+		}
+	})
+}
+
+func TestRangeWithRevision(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx := context.Background()
+		key := prefix + "key"
+
+		rev1 := put(t, client, key, "v1")
+		rev2 := put(t, client, key, "v2")
+		deleted, err := client.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rev3 := deleted.Header.Revision
+
+		for rev, want := range map[int64]string{rev1: "v1", rev2: "v2", rev3: "", 0: ""} {
+			resp, err := client.Get(ctx, key, clientv3.WithRev(rev))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if len(resp.Kvs) > 0 {
+				got = string(resp.Kvs[0].Value)
+			}
+			if got != want {
+				t.Errorf("value at revision %d is %q, want %q", rev, got, want)
+			}
+		}
+		if _, err := client.Get(ctx, key, clientv3.WithRev(rev3+1000)); !errors.Is(err, rpctypes.ErrFutureRev) {
+			t.Errorf("expected a future revision error, got %v", err)
+		}
+
+		for i := range 3 {
+			put(t, client, fmt.Sprintf("%slist/%d", prefix, i), "v")
+		}
+		resp, err := client.Get(ctx, prefix+"list/", clientv3.WithPrefix(), clientv3.WithLimit(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 2 || !resp.More || resp.Count != 3 {
+			t.Errorf("unexpected limited range: %d keys, more %v, count %d", len(resp.Kvs), resp.More, resp.Count)
+		}
+	})
+}
+
+func TestWatchResume(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		rev1 := put(t, client, prefix+"a", "1")
+		put(t, client, prefix+"b", "1")
+		put(t, client, prefix+"a", "2")
+
+		// replay from the database, then live events
+		ch := client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev1), clientv3.WithPrevKV())
+		events := nextEvents(t, ch, 3)
+		if string(events[2].Kv.Value) != "2" || events[2].PrevKv == nil || string(events[2].PrevKv.Value) != "1" {
+			t.Errorf("unexpected replayed event %v", events[2])
+		}
+		deleted, err := client.Delete(ctx, prefix+"b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		live := nextEvents(t, ch, 1)
+		if live[0].Type != mvccpb.DELETE || live[0].Kv.ModRevision != deleted.Header.Revision {
+			t.Errorf("unexpected live event %v", live[0])
+		}
+
+		// progress notifications report the revision all events are sent for
+		if err := client.RequestProgress(ctx); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case resp := <-ch:
+			if !resp.IsProgressNotify() || resp.Header.Revision < deleted.Header.Revision {
+				t.Errorf("unexpected progress response %+v", resp)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatal("no progress notification")
+		}
+		cancel()
+
+		// a watch resumed after the last seen revision only gets new events
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		ch = client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(deleted.Header.Revision+1))
+		rev := put(t, client, prefix+"c", "1")
+		resumed := nextEvents(t, ch, 1)
+		if len(resumed) != 1 || resumed[0].Kv.ModRevision != rev {
+			t.Errorf("unexpected events after resuming %v", resumed)
+		}
+	})
+}
+
+func TestWatchProgressDuringWrites(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch := client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+		if resp := <-ch; !resp.Created {
+			t.Fatalf("unexpected first response %+v", resp)
+		}
+
+		// progress is requested while concurrent writes are published
+		const writers, writes = 4, 100
+		progressCtx, stopProgress := context.WithCancel(ctx)
+		errCh := make(chan error, writers+1)
+		for w := range writers {
+			go func() {
+				for i := range writes {
+					if _, err := client.Put(ctx, fmt.Sprintf("%s%d", prefix, w), fmt.Sprint(i)); err != nil {
+						errCh <- err
+						return
+					}
+				}
+				errCh <- nil
+			}()
+		}
+		go func() {
+			for progressCtx.Err() == nil {
+				if err := client.RequestProgress(progressCtx); err != nil && progressCtx.Err() == nil {
+					errCh <- err
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+			errCh <- nil
+		}()
+
+		var events int
+		var lastRev int64
+		// receive checks that no progress notification reports a revision
+		// lower than an event sent before it, and returns whether resp is one.
+		receive := func(resp clientv3.WatchResponse) bool {
+			t.Helper()
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range resp.Events {
+				events++
+				lastRev = e.Kv.ModRevision
+			}
+			if resp.IsProgressNotify() && resp.Header.Revision < lastRev {
+				t.Fatalf("progress notification of revision %d after an event of revision %d", resp.Header.Revision, lastRev)
+			}
+			return resp.IsProgressNotify()
+		}
+		timeout := time.After(wait.ForeverTestTimeout)
+		for events < writers*writes {
+			select {
+			case resp := <-ch:
+				receive(resp)
+			case <-timeout:
+				t.Fatalf("timed out after %d of %d events", events, writers*writes)
+			}
+		}
+		stopProgress()
+		for range writers + 1 {
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// once the writes are done, progress reaches the last revision
+		if err := client.RequestProgress(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			select {
+			case resp := <-ch:
+				if receive(resp) && resp.Header.Revision >= lastRev {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no progress notification of revision %d", lastRev)
+			}
+		}
+	})
+}
+
+func TestWatchFutureStartRevision(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		rev := put(t, client, prefix+"a", "1")
+		ch := client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+3), clientv3.WithCreatedNotify())
+		if resp := <-ch; !resp.Created {
+			t.Fatalf("unexpected first response %+v", resp)
+		}
+
+		put(t, client, prefix+"b", "1")
+		put(t, client, prefix+"c", "1")
+		start := put(t, client, prefix+"d", "1")
+		events := nextEvents(t, ch, 1)
+		if len(events) != 1 || events[0].Kv.ModRevision != start {
+			t.Errorf("expected only the event of revision %d, got %v", start, events)
+		}
+	})
+}
+
+func TestCompaction(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx := context.Background()
+		key := prefix + "key"
+
+		rev1 := put(t, client, key, "v1")
+		rev2 := put(t, client, key, "v2")
+		put(t, client, key, "v3")
+
+		if _, err := client.Compact(ctx, rev2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Compact(ctx, rev2); !errors.Is(err, rpctypes.ErrCompacted) {
+			t.Errorf("expected compacting twice to fail, got %v", err)
+		}
+		if _, err := client.Get(ctx, key, clientv3.WithRev(rev1)); !errors.Is(err, rpctypes.ErrCompacted) {
+			t.Errorf("expected a compacted error, got %v", err)
+		}
+		resp, err := client.Get(ctx, key, clientv3.WithRev(rev2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "v2" {
+			t.Errorf("compaction removed the value at the compacted revision: %v", resp.Kvs)
+		}
+
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		select {
+		case resp := <-client.Watch(watchCtx, key, clientv3.WithRev(rev1)):
+			if !resp.Canceled || resp.CompactRevision != rev2 {
+				t.Errorf("expected the watch to be canceled at compact revision %d, got %+v", rev2, resp)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatal("watch from a compacted revision was not canceled")
+		}
+	})
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, client *clientv3.Client, prefix string) {
+		ctx := context.Background()
+
+		lease, err := client.Grant(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		put(t, client, prefix+"expiring", "v", clientv3.WithLease(lease.ID))
+		ttl, err := client.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl.TTL <= 0 || len(ttl.Keys) != 1 {
+			t.Errorf("unexpected time to live %+v", ttl)
+		}
+
+		if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, wait.ForeverTestTimeout, false, func(ctx context.Context) (bool, error) {
+			resp, err := client.Get(ctx, prefix+"expiring")
+			return err == nil && len(resp.Kvs) == 0, err
+		}); err != nil {
+			t.Fatalf("key of the expired lease was not deleted: %v", err)
+		}
+		if _, err := client.KeepAliveOnce(ctx, lease.ID); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			t.Errorf("expected the expired lease to be gone, got %v", err)
+		}
+
+		// revoking deletes the keys right away
+		lease, err = client.Grant(ctx, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		put(t, client, prefix+"revoked", "v", clientv3.WithLease(lease.ID))
+		if _, err := client.KeepAliveOnce(ctx, lease.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Revoke(ctx, lease.ID); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(ctx, prefix+"revoked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 0 {
+			t.Errorf("key of the revoked lease was not deleted")
+		}
+	})
+}
+
+func TestMemoryDataSource(t *testing.T) {
+	db, _, err := openDatabase(MemoryDataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.Driver().(*sqlitedriver.Driver); !ok {
+		t.Errorf("memory database uses %T, want the pure Go driver", db.Driver())
+	}
+
+	// every server starts with an empty database
+	ctx := context.Background()
+	put(t, newClient(t, MemoryDataSource), "/memory/key", "v1")
+	resp, err := newClient(t, MemoryDataSource).Get(ctx, "/memory/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Errorf("key of another in-memory server was found")
+	}
+}
@@ -0,0 +1,581 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlstorage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// kvColumns are the columns of gcp_kv in the order scanned by scanRow.
+	kvColumns = "revision, name, create_revision, prev_revision, version, lease, deleted, value"
+
+	// maxRequestBytes is the limit of keys and values, as of etcd.
+	maxRequestBytes = 1536 * 1024
+
+	compactRevisionName = "compact_revision"
+)
+
+// row is a revision of a key.
+type row struct {
+	revision       int64
+	name           []byte
+	createRevision int64
+	prevRevision   int64
+	version        int64
+	lease          int64
+	deleted        bool
+	value          []byte
+}
+
+func (r *row) keyValue() *mvccpb.KeyValue {
+	if r.deleted {
+		return &mvccpb.KeyValue{Key: r.name, ModRevision: r.revision}
+	}
+	return &mvccpb.KeyValue{
+		Key:            r.name,
+		CreateRevision: r.createRevision,
+		ModRevision:    r.revision,
+		Version:        r.version,
+		Value:          r.value,
+		Lease:          r.lease,
+	}
+}
+
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRow(s scanner) (*row, error) {
+	var r row
+	var deleted int64
+	if err := s.Scan(&r.revision, &r.name, &r.createRevision, &r.prevRevision, &r.version, &r.lease, &deleted, &r.value); err != nil {
+		return nil, err
+	}
+	r.deleted = deleted != 0
+	return &r, nil
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// store is a multi-version key-value store in a SQL database implementing the
+// etcd gRPC services. Every write of a key is a new revision, i.e. unlike etcd
+// a transaction writing several keys increments the revision for each of them.
+type store struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedWatchServer
+	pb.UnimplementedLeaseServer
+	pb.UnimplementedMaintenanceServer
+
+	db      *sql.DB
+	dialect *dialect
+
+	// lock serializes the writes, such that revisions are committed and
+	// published to the watchers in order.
+	lock     sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// rev is the revision of the last committed write.
+	rev atomic.Int64
+	// compactRev is the revision of the last compaction.
+	compactRev atomic.Int64
+}
+
+// newStore returns a store in db, creating its tables if necessary.
+func newStore(ctx context.Context, db *sql.DB, d *dialect) (*store, error) {
+	s := &store{
+		db:       db,
+		dialect:  d,
+		watchers: map[*watcher]struct{}{},
+	}
+
+	for _, stmt := range d.schema() {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	var compactRev sql.NullInt64
+	err := db.QueryRowContext(ctx, s.query("SELECT value FROM gcp_meta WHERE name = ?"), compactRevisionName).Scan(&compactRev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	var rev sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(revision) FROM gcp_kv").Scan(&rev); err != nil {
+		return nil, err
+	}
+	s.compactRev.Store(compactRev.Int64)
+	// the last revisions may be compacted deletions, and an empty store
+	// starts at revision 1 like etcd
+	s.rev.Store(max(rev.Int64, compactRev.Int64, 1))
+
+	return s, nil
+}
+
+func (s *store) query(query string) string {
+	return s.dialect.rebind(query)
+}
+
+// rangeCondition returns the condition on column matching the keys from key
+// to end, following the etcd semantics of range_end.
+func rangeCondition(column string, key, end []byte) (string, []any) {
+	switch {
+	case len(end) == 0:
+		return column + " = ?", []any{key}
+	case len(end) == 1 && end[0] == 0:
+		return column + " >= ?", []any{key}
+	default:
+		return column + " >= ? AND " + column + " < ?", []any{key, end}
+	}
+}
+
+// inRange returns whether name is in the range from key to end.
+func inRange(name, key, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(name, key)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(name, key) >= 0
+	default:
+		return bytes.Compare(name, key) >= 0 && bytes.Compare(name, end) < 0
+	}
+}
+
+// rangeKeys returns the keys of the range request at revision rev.
+func (s *store) rangeKeys(ctx context.Context, q querier, r *pb.RangeRequest, rev int64) (*pb.RangeResponse, error) {
+	if (r.SortOrder != pb.RangeRequest_NONE && r.SortOrder != pb.RangeRequest_ASCEND) || r.SortTarget != pb.RangeRequest_KEY {
+		return nil, status.Error(codes.Unimplemented, "sorting is not supported")
+	}
+	if r.MinModRevision != 0 || r.MaxModRevision != 0 || r.MinCreateRevision != 0 || r.MaxCreateRevision != 0 {
+		return nil, status.Error(codes.Unimplemented, "revision filters are not supported")
+	}
+
+	if r.Revision > 0 {
+		if r.Revision > rev {
+			return nil, rpctypes.ErrGRPCFutureRev
+		}
+		rev = r.Revision
+	}
+	if rev < s.compactRev.Load() {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+
+	condition, args := rangeCondition("name", r.Key, r.RangeEnd)
+	latest := "revision IN (SELECT MAX(revision) FROM gcp_kv WHERE " + condition + " AND revision <= ? GROUP BY name) AND deleted = 0"
+	args = append(args, rev)
+
+	resp := &pb.RangeResponse{}
+	if !r.CountOnly {
+		columns := kvColumns
+		if r.KeysOnly {
+			columns = strings.Replace(columns, "value", "NULL", 1)
+		}
+		query := "SELECT " + columns + " FROM gcp_kv WHERE " + latest + " ORDER BY name"
+		if r.Limit > 0 {
+			query += fmt.Sprintf(" LIMIT %d", r.Limit+1)
+		}
+		rows, err := q.QueryContext(ctx, s.query(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			kv, err := scanRow(rows)
+			if err != nil {
+				return nil, err
+			}
+			resp.Kvs = append(resp.Kvs, kv.keyValue())
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		resp.Count = int64(len(resp.Kvs))
+		if r.Limit > 0 && int64(len(resp.Kvs)) > r.Limit {
+			resp.Kvs = resp.Kvs[:r.Limit]
+			resp.More = true
+		}
+	}
+	if r.CountOnly || resp.More {
+		if err := q.QueryRowContext(ctx, s.query("SELECT COUNT(*) FROM gcp_kv WHERE "+latest), args...).Scan(&resp.Count); err != nil {
+			return nil, err
+		}
+	}
+
+	// a concurrent compaction may have removed revisions
+	if rev < s.compactRev.Load() {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+	return resp, nil
+}
+
+// Range returns the keys of the range request.
+func (s *store) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	rev := s.rev.Load()
+	resp, err := s.rangeKeys(ctx, s.db, r, rev)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header(rev)
+	return resp, nil
+}
+
+// writeTxn is a database transaction writing new revisions.
+type writeTxn struct {
+	store *store
+	tx    *sql.Tx
+	// rev is the revision of the last write of the transaction.
+	rev    int64
+	events []*mvccpb.Event
+	// dirty is whether the transaction wrote anything but revisions.
+	dirty bool
+}
+
+// write runs fn in a write transaction and publishes its events to the
+// watchers after committing it. It returns the resulting revision.
+func (s *store) write(ctx context.Context, fn func(w *writeTxn) error) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op after the commit
+
+	w := &writeTxn{store: s, tx: tx, rev: s.rev.Load()}
+	if err := fn(w); err != nil {
+		return 0, err
+	}
+	if len(w.events) == 0 && !w.dirty {
+		return w.rev, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.rev.Store(w.rev)
+	s.publish(w.events)
+	return w.rev, nil
+}
+
+// live returns the last revision of key if it is not deleted, or nil.
+func (s *store) live(ctx context.Context, q querier, key []byte) (*row, error) {
+	r, err := scanRow(q.QueryRowContext(ctx, s.query("SELECT "+kvColumns+" FROM gcp_kv WHERE name = ? ORDER BY revision DESC LIMIT 1"), key))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && r.deleted) {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (w *writeTxn) insert(ctx context.Context, r *row) error {
+	deleted := 0
+	if r.deleted {
+		deleted = 1
+	}
+	_, err := w.tx.ExecContext(ctx, w.store.query("INSERT INTO gcp_kv ("+kvColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		r.revision, r.name, r.createRevision, r.prevRevision, r.version, r.lease, deleted, r.value)
+	return err
+}
+
+// put writes a new revision of the key of r.
+func (w *writeTxn) put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	if r.IgnoreValue || r.IgnoreLease {
+		return nil, status.Error(codes.Unimplemented, "ignore_value and ignore_lease are not supported")
+	}
+	if len(r.Key) == 0 {
+		return nil, rpctypes.ErrGRPCEmptyKey
+	}
+	if len(r.Key)+len(r.Value) > maxRequestBytes {
+		return nil, rpctypes.ErrGRPCRequestTooLarge
+	}
+	if r.Lease != 0 {
+		if ok, err := w.store.leaseExists(ctx, w.tx, r.Lease); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, rpctypes.ErrGRPCLeaseNotFound
+		}
+	}
+
+	prev, err := w.store.live(ctx, w.tx, r.Key)
+	if err != nil {
+		return nil, err
+	}
+	w.rev++
+	next := &row{
+		revision:       w.rev,
+		name:           r.Key,
+		createRevision: w.rev,
+		version:        1,
+		lease:          r.Lease,
+		value:          r.Value,
+	}
+	if next.value == nil {
+		next.value = []byte{}
+	}
+	event := &mvccpb.Event{Type: mvccpb.PUT}
+	resp := &pb.PutResponse{}
+	if prev != nil {
+		next.createRevision = prev.createRevision
+		next.version = prev.version + 1
+		next.prevRevision = prev.revision
+		event.PrevKv = prev.keyValue()
+		if r.PrevKv {
+			resp.PrevKv = event.PrevKv
+		}
+	}
+	if err := w.insert(ctx, next); err != nil {
+		return nil, err
+	}
+	event.Kv = next.keyValue()
+	w.events = append(w.events, event)
+	return resp, nil
+}
+
+// deleteRange deletes the keys of r.
+func (w *writeTxn) deleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	existing, err := w.store.rangeKeys(ctx, w.tx, &pb.RangeRequest{Key: r.Key, RangeEnd: r.RangeEnd}, w.rev)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.DeleteRangeResponse{Deleted: int64(len(existing.Kvs))}
+	for _, kv := range existing.Kvs {
+		w.rev++
+		tombstone := &row{revision: w.rev, name: kv.Key, prevRevision: kv.ModRevision, deleted: true}
+		if err := w.insert(ctx, tombstone); err != nil {
+			return nil, err
+		}
+		w.events = append(w.events, &mvccpb.Event{Type: mvccpb.DELETE, Kv: tombstone.keyValue(), PrevKv: kv})
+		if r.PrevKv {
+			resp.PrevKvs = append(resp.PrevKvs, kv)
+		}
+	}
+	return resp, nil
+}
+
+// compare evaluates c against the current revision of its key.
+func (w *writeTxn) compare(ctx context.Context, c *pb.Compare) (bool, error) {
+	if len(c.RangeEnd) > 0 {
+		return false, status.Error(codes.Unimplemented, "comparisons of ranges are not supported")
+	}
+	r, err := w.store.live(ctx, w.tx, c.Key)
+	if err != nil {
+		return false, err
+	}
+	kv := &mvccpb.KeyValue{}
+	if r != nil {
+		kv = r.keyValue()
+	} else if c.Target == pb.Compare_VALUE {
+		// values of missing keys never match
+		return false, nil
+	}
+
+	var result int
+	switch c.Target {
+	case pb.Compare_VERSION:
+		result = compareInt(kv.Version, c.GetVersion())
+	case pb.Compare_CREATE:
+		result = compareInt(kv.CreateRevision, c.GetCreateRevision())
+	case pb.Compare_MOD:
+		result = compareInt(kv.ModRevision, c.GetModRevision())
+	case pb.Compare_VALUE:
+		result = bytes.Compare(kv.Value, c.GetValue())
+	case pb.Compare_LEASE:
+		result = compareInt(kv.Lease, c.GetLease())
+	default:
+		return false, status.Errorf(codes.InvalidArgument, "unknown compare target %v", c.Target)
+	}
+
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return result == 0, nil
+	case pb.Compare_NOT_EQUAL:
+		return result != 0, nil
+	case pb.Compare_GREATER:
+		return result > 0, nil
+	case pb.Compare_LESS:
+		return result < 0, nil
+	default:
+		return false, status.Errorf(codes.InvalidArgument, "unknown compare result %v", c.Result)
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Txn evaluates the comparisons of r and runs its success or failure operations.
+func (s *store) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	resp := &pb.TxnResponse{}
+	rev, err := s.write(ctx, func(w *writeTxn) error {
+		resp.Succeeded = true
+		for _, c := range r.Compare {
+			ok, err := w.compare(ctx, c)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				resp.Succeeded = false
+				break
+			}
+		}
+		ops := r.Success
+		if !resp.Succeeded {
+			ops = r.Failure
+		}
+
+		for _, op := range ops {
+			var result *pb.ResponseOp
+			switch op := op.Request.(type) {
+			case *pb.RequestOp_RequestRange:
+				rr, err := s.rangeKeys(ctx, w.tx, op.RequestRange, w.rev)
+				if err != nil {
+					return err
+				}
+				result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr}}
+			case *pb.RequestOp_RequestPut:
+				pr, err := w.put(ctx, op.RequestPut)
+				if err != nil {
+					return err
+				}
+				result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: pr}}
+			case *pb.RequestOp_RequestDeleteRange:
+				dr, err := w.deleteRange(ctx, op.RequestDeleteRange)
+				if err != nil {
+					return err
+				}
+				result = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: dr}}
+			default:
+				return status.Error(codes.Unimplemented, "nested transactions are not supported")
+			}
+			resp.Responses = append(resp.Responses, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header(rev)
+	return resp, nil
+}
+
+// Put writes a new revision of the key of r.
+func (s *store) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	var resp *pb.PutResponse
+	rev, err := s.write(ctx, func(w *writeTxn) (err error) {
+		resp, err = w.put(ctx, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header(rev)
+	return resp, nil
+}
+
+// DeleteRange deletes the keys of r.
+func (s *store) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	var resp *pb.DeleteRangeResponse
+	rev, err := s.write(ctx, func(w *writeTxn) (err error) {
+		resp, err = w.deleteRange(ctx, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Header = header(rev)
+	return resp, nil
+}
+
+// Compact deletes the revisions before rev that are superseded by a later
+// revision up to rev, and all deletions up to rev.
+func (s *store) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rev := s.rev.Load()
+	if r.Revision <= s.compactRev.Load() {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+	if r.Revision > rev {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op after the commit
+
+	if _, err := tx.ExecContext(ctx, s.query(`DELETE FROM gcp_kv WHERE revision <= ? AND (deleted = 1 OR revision <
+	(SELECT MAX(k.revision) FROM gcp_kv k WHERE k.name = gcp_kv.name AND k.revision <= ?))`), r.Revision, r.Revision); err != nil {
+		return nil, fmt.Errorf("failed to compact: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, s.query("INSERT INTO gcp_meta (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value"),
+		compactRevisionName, r.Revision); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.compactRev.Store(r.Revision)
+
+	return &pb.CompactionResponse{Header: header(rev)}, nil
+}
+
+// size returns the size of the database and the size in use.
+func (s *store) size(ctx context.Context) (int64, int64, error) {
+	var size, inUse int64
+	err := s.db.QueryRowContext(ctx, s.dialect.sizeQuery).Scan(&size, &inUse)
+	return size, inUse, err
+}
+
+// header returns the response header at revision rev. The store acts as a
+// cluster with a single member that is always the leader.
+func header(rev int64) *pb.ResponseHeader {
+	return &pb.ResponseHeader{
+		ClusterId: clusterID,
+		MemberId:  memberID,
+		Revision:  rev,
+		RaftTerm:  raftTerm,
+	}
+}
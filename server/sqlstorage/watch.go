@@ -0,0 +1,475 @@
+/*
+Copyright 2024 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlstorage
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// watcherBuffer is the number of published events a watcher buffers
+	// before it falls back to reading them from the database.
+	watcherBuffer = 1024
+	// replayBatch is the number of events read from the database at once.
+	replayBatch = 1000
+	// progressNotifyInterval is the interval of progress notifications of
+	// watchers requesting them, as of etcd.
+	progressNotifyInterval = 10 * time.Minute
+	// progressRetryInterval is the interval to retry a progress request
+	// while watchers of the stream are catching up.
+	progressRetryInterval = 50 * time.Millisecond
+)
+
+// watcher is a watch of a range of keys.
+type watcher struct {
+	id             int64
+	key, end       []byte
+	prevKV         bool
+	noPut          bool
+	noDelete       bool
+	progressNotify bool
+	// startRevision is the first revision sent, which may be in the future.
+	startRevision int64
+
+	// events are the events published by the store while it is subscribed.
+	events chan *mvccpb.Event
+	// lagged is closed when the store unsubscribes the watcher because its
+	// buffer is full.
+	lagged chan struct{}
+	// pending is the number of published events not sent yet.
+	pending atomic.Int64
+
+	cancel context.CancelFunc
+}
+
+// subscribe subscribes w to the published events if there are no revisions
+// from next on. It returns the current revision, and the channel closed when
+// w is unsubscribed again if it is subscribed.
+func (s *store) subscribe(w *watcher, next int64) (int64, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rev := s.rev.Load()
+	if next <= rev {
+		return rev, nil
+	}
+	w.lagged = make(chan struct{})
+	s.watchers[w] = struct{}{}
+	return rev, w.lagged
+}
+
+func (s *store) unsubscribe(w *watcher) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.watchers, w)
+}
+
+// publish sends the events of a committed write to the subscribed watchers.
+// It must be called with the lock held.
+func (s *store) publish(events []*mvccpb.Event) {
+	for w := range s.watchers {
+		for _, e := range events {
+			if !inRange(e.Kv.Key, w.key, w.end) {
+				continue
+			}
+			select {
+			case w.events <- e:
+				w.pending.Add(1)
+			default:
+				// the watcher catches up from the database
+				delete(s.watchers, w)
+				close(w.lagged)
+			}
+			if _, ok := s.watchers[w]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// synced returns whether all events of the watchers up to the current
+// revision are sent. It must be called with the lock held.
+func (s *store) synced(watchers []*watcher) bool {
+	for _, w := range watchers {
+		if _, ok := s.watchers[w]; !ok || w.pending.Load() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// history returns up to replayBatch events in the range of w from revision
+// next to rev.
+func (s *store) history(ctx context.Context, w *watcher, next, rev int64) ([]*mvccpb.Event, error) {
+	condition, args := rangeCondition("k.name", w.key, w.end)
+	query := `SELECT k.revision, k.name, k.create_revision, k.prev_revision, k.version, k.lease, k.deleted, k.value,
+	p.revision, p.create_revision, p.version, p.lease, p.value
+FROM gcp_kv k LEFT JOIN gcp_kv p ON p.revision = k.prev_revision
+WHERE k.revision >= ? AND k.revision <= ? AND ` + condition + ` ORDER BY k.revision LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, s.query(query), append(append([]any{next, rev}, args...), replayBatch)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*mvccpb.Event
+	for rows.Next() {
+		var r row
+		var deleted int64
+		var prevRevision, prevCreateRevision, prevVersion, prevLease sql.NullInt64
+		var prevValue []byte
+		if err := rows.Scan(&r.revision, &r.name, &r.createRevision, &r.prevRevision, &r.version, &r.lease, &deleted, &r.value,
+			&prevRevision, &prevCreateRevision, &prevVersion, &prevLease, &prevValue); err != nil {
+			return nil, err
+		}
+		r.deleted = deleted != 0
+
+		e := &mvccpb.Event{Type: mvccpb.PUT, Kv: r.keyValue()}
+		if r.deleted {
+			e.Type = mvccpb.DELETE
+		}
+		if prevRevision.Valid {
+			prev := &row{
+				revision:       prevRevision.Int64,
+				name:           r.name,
+				createRevision: prevCreateRevision.Int64,
+				version:        prevVersion.Int64,
+				lease:          prevLease.Int64,
+				value:          prevValue,
+			}
+			e.PrevKv = prev.keyValue()
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// watchStream serves the watchers of a Watch stream.
+type watchStream struct {
+	ctx    context.Context
+	store  *store
+	stream pb.Watch_WatchServer
+
+	// sendLock serializes the responses. It is never acquired with the lock
+	// of the store held, such that slow streams do not block writes, but
+	// sendProgress acquires the lock of the store with it held.
+	sendLock sync.Mutex
+
+	lock          sync.Mutex
+	watchers      map[int64]*watcher
+	nextID        int64
+	progressQueue atomic.Bool
+
+	wg sync.WaitGroup
+}
+
+func (ws *watchStream) send(resp *pb.WatchResponse) error {
+	ws.sendLock.Lock()
+	defer ws.sendLock.Unlock()
+	return ws.stream.Send(resp)
+}
+
+// Watch serves a Watch stream until it is closed.
+func (s *store) Watch(stream pb.Watch_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	ws := &watchStream{
+		ctx:      ctx,
+		store:    s,
+		stream:   stream,
+		watchers: map[int64]*watcher{},
+	}
+	defer ws.wg.Wait()
+
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		ws.notifyProgress(ctx)
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			cancel()
+			return nil
+		}
+
+		switch r := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			if err := ws.create(ctx, r.CreateRequest); err != nil {
+				return err
+			}
+		case *pb.WatchRequest_CancelRequest:
+			ws.lock.Lock()
+			if w, ok := ws.watchers[r.CancelRequest.WatchId]; ok {
+				w.cancel()
+				delete(ws.watchers, w.id)
+			}
+			ws.lock.Unlock()
+		case *pb.WatchRequest_ProgressRequest:
+			if ws.progressQueue.CompareAndSwap(false, true) {
+				ws.wg.Add(1)
+				go func() {
+					defer ws.wg.Done()
+					ws.requestProgress(ctx)
+				}()
+			}
+		}
+	}
+}
+
+// create starts a watcher of r.
+func (ws *watchStream) create(ctx context.Context, r *pb.WatchCreateRequest) error {
+	w := &watcher{
+		key:            r.Key,
+		end:            r.RangeEnd,
+		prevKV:         r.PrevKv,
+		progressNotify: r.ProgressNotify,
+		events:         make(chan *mvccpb.Event, watcherBuffer),
+	}
+	for _, f := range r.Filters {
+		switch f {
+		case pb.WatchCreateRequest_NOPUT:
+			w.noPut = true
+		case pb.WatchCreateRequest_NODELETE:
+			w.noDelete = true
+		}
+	}
+
+	ws.lock.Lock()
+	w.id = r.WatchId
+	if w.id == int64(clientv3.AutoWatchID) {
+		for _, ok := ws.watchers[ws.nextID]; ok; _, ok = ws.watchers[ws.nextID] {
+			ws.nextID++
+		}
+		w.id = ws.nextID
+		ws.nextID++
+	}
+	if _, ok := ws.watchers[w.id]; ok {
+		ws.lock.Unlock()
+		return ws.send(&pb.WatchResponse{Header: header(ws.store.rev.Load()), WatchId: w.id, Created: true, Canceled: true, CancelReason: "duplicate watch ID"})
+	}
+	var watchCtx context.Context
+	watchCtx, w.cancel = context.WithCancel(ctx)
+	ws.watchers[w.id] = w
+	ws.lock.Unlock()
+
+	// the created response precedes all events of the watcher
+	rev := ws.store.rev.Load()
+	if err := ws.send(&pb.WatchResponse{Header: header(rev), WatchId: w.id, Created: true}); err != nil {
+		return err
+	}
+	next := r.StartRevision
+	if next <= 0 {
+		next = rev + 1
+	}
+	w.startRevision = next
+
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		ws.run(watchCtx, w, next)
+	}()
+	return nil
+}
+
+// run sends the events of w from revision next on until the context is done.
+func (ws *watchStream) run(ctx context.Context, w *watcher, next int64) {
+	logger := klog.FromContext(ctx)
+	s := ws.store
+	defer ws.remove(w)
+	defer s.unsubscribe(w)
+
+	for {
+		rev, lagged := s.subscribe(w, next)
+		if lagged == nil {
+			// catch up from the database
+			if compactRev := s.compactRev.Load(); next <= compactRev {
+				_ = ws.send(&pb.WatchResponse{Header: header(rev), WatchId: w.id, CompactRevision: compactRev, Canceled: true})
+				return
+			}
+			events, err := s.history(ctx, w, next, rev)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error(err, "Failed to read watch events", "watchID", w.id)
+					_ = ws.send(&pb.WatchResponse{Header: header(rev), WatchId: w.id, Canceled: true, CancelReason: err.Error()})
+				} else {
+					ws.cancelled(w)
+				}
+				return
+			}
+			if len(events) < replayBatch {
+				next = rev + 1
+			} else {
+				next = events[len(events)-1].Kv.ModRevision + 1
+			}
+			if err := ws.sendEvents(w, rev, events); err != nil {
+				return
+			}
+			continue
+		}
+
+		// forward the published events until the watcher lags
+		for lagged != nil || len(w.events) > 0 {
+			var events []*mvccpb.Event
+			select {
+			case <-ctx.Done():
+				ws.cancelled(w)
+				return
+			case e := <-w.events:
+				events = append(events, e)
+			case <-lagged:
+				// send the buffered events before catching up
+				lagged = nil
+			}
+			for len(events) < replayBatch && len(w.events) > 0 {
+				events = append(events, <-w.events)
+			}
+			if len(events) == 0 {
+				continue
+			}
+			next = events[len(events)-1].Kv.ModRevision + 1
+			err := ws.sendEvents(w, next-1, events)
+			w.pending.Add(-int64(len(events)))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// remove removes w from the watchers of the stream.
+func (ws *watchStream) remove(w *watcher) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.watchers[w.id] == w {
+		delete(ws.watchers, w.id)
+	}
+}
+
+// cancelled confirms the cancellation of w unless the stream is closed.
+func (ws *watchStream) cancelled(w *watcher) {
+	if ws.ctx.Err() != nil {
+		return
+	}
+	_ = ws.send(&pb.WatchResponse{Header: header(ws.store.rev.Load()), WatchId: w.id, Canceled: true})
+}
+
+// sendEvents sends the events of w up to revision rev that pass its filters.
+// Events before the start revision of w are published while it waits for a
+// future start revision, and are dropped.
+func (ws *watchStream) sendEvents(w *watcher, rev int64, events []*mvccpb.Event) error {
+	filtered := make([]*mvccpb.Event, 0, len(events))
+	for _, e := range events {
+		if e.Kv.ModRevision < w.startRevision {
+			continue
+		}
+		if (e.Type == mvccpb.PUT && w.noPut) || (e.Type == mvccpb.DELETE && w.noDelete) {
+			continue
+		}
+		if !w.prevKV && e.PrevKv != nil {
+			e = &mvccpb.Event{Type: e.Type, Kv: e.Kv}
+		}
+		filtered = append(filtered, e)
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return ws.send(&pb.WatchResponse{Header: header(rev), WatchId: w.id, Events: filtered})
+}
+
+// list returns the watchers of the stream.
+func (ws *watchStream) list() []*watcher {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	watchers := make([]*watcher, 0, len(ws.watchers))
+	for _, w := range ws.watchers {
+		watchers = append(watchers, w)
+	}
+	return watchers
+}
+
+// requestProgress sends the current revision once all watchers of the stream
+// have sent their events up to it, as of a WatchProgressRequest.
+func (ws *watchStream) requestProgress(ctx context.Context) {
+	defer ws.progressQueue.Store(false)
+	ticker := time.NewTicker(progressRetryInterval)
+	defer ticker.Stop()
+	for {
+		if ws.sendProgress(int64(clientv3.InvalidWatchID), ws.list()) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyProgress sends the current revision periodically to the synced
+// watchers requesting progress notifications.
+func (ws *watchStream) notifyProgress(ctx context.Context) {
+	ticker := time.NewTicker(progressNotifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, w := range ws.list() {
+			if w.progressNotify {
+				ws.sendProgress(w.id, []*watcher{w})
+			}
+		}
+	}
+}
+
+// sendProgress sends the current revision with the given watch ID if the
+// given watchers are synced. It returns whether it sent it.
+func (ws *watchStream) sendProgress(id int64, watchers []*watcher) bool {
+	s := ws.store
+	// The send lock is held from reading the revision until the progress is
+	// sent, such that no event of a higher revision is sent before it. The
+	// lock of the store is only held to read the revision all events of the
+	// watchers are sent for, as a slow stream must not block the writes.
+	ws.sendLock.Lock()
+	defer ws.sendLock.Unlock()
+
+	s.lock.Lock()
+	synced := s.synced(watchers)
+	rev := s.rev.Load()
+	s.lock.Unlock()
+
+	if !synced {
+		return false
+	}
+	_ = ws.stream.Send(&pb.WatchResponse{Header: header(rev), WatchId: id})
+	return true
+}
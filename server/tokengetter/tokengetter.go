@@ -31,12 +31,16 @@ type clientGetter struct {
 
 // NewGetterFromClient returns a ServiceAccountTokenGetter that
 // uses the specified client to retrieve service accounts, secrets and
-// return errors for nodes and pods.
+// return errors for nodes and pods. A nil lister means that the resource
+// is not served, and NotFound errors are returned for it.
 func NewGetterFromClient(secretLister v1listers.SecretLister, serviceAccountLister v1listers.ServiceAccountLister) serviceaccount.ServiceAccountTokenGetter {
 	return clientGetter{secretLister, serviceAccountLister}
 }
 
 func (c clientGetter) GetServiceAccount(namespace, name string) (*v1.ServiceAccount, error) {
+	if c.serviceAccountLister == nil {
+		return nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), name)
+	}
 	return c.serviceAccountLister.ServiceAccounts(namespace).Get(name)
 }
 
@@ -45,6 +49,9 @@ func (c clientGetter) GetPod(_, name string) (*v1.Pod, error) {
 }
 
 func (c clientGetter) GetSecret(namespace, name string) (*v1.Secret, error) {
+	if c.secretLister == nil {
+		return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
+	}
 	return c.secretLister.Secrets(namespace).Get(name)
 }
 